@@ -0,0 +1,300 @@
+package krakend
+
+import (
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/opentelemetry"
+	"github.com/devopsfaith/krakend-ce/requestid"
+	"github.com/devopsfaith/krakend-ce/zaplog"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AccessLogNamespace is the key to use to store and access the access log config
+const AccessLogNamespace = "github_com/devopsfaith/krakend-ce/access-log"
+
+// accessLogConfig is the config of the access log. The UTC, TimeFormat and Output settings are ignored when
+// the structured logger is enabled, since it writes the access log with its own encoder and sinks.
+type accessLogConfig struct {
+	// SkipPaths contains exact paths, prefixes (ending with '*') and glob patterns to exclude from the log
+	SkipPaths []string `json:"skip_paths"`
+	// Sampling defines the ratio of requests to log per status class ("2xx", "3xx", "4xx", "5xx"). The
+	// entries kept are still rate limited by the zap sampler, like the rest of the access log.
+	Sampling map[string]float64 `json:"sampling"`
+	// UTC forces the timestamps to be encoded in UTC
+	UTC bool `json:"utc"`
+	// TimeFormat is one of epoch (default), iso8601 or rfc3339
+	TimeFormat string `json:"time_format"`
+	// Output is the zap sink: stderr (default), stdout or a file path
+	Output          string   `json:"output"`
+	RequestHeaders  []string `json:"request_headers"`
+	ResponseHeaders []string `json:"response_headers"`
+}
+
+func newAccessLogConfig(e config.ExtraConfig, l logging.Logger) accessLogConfig {
+	cfg := accessLogConfig{}
+	if _, err := parseExtraConfig(e, AccessLogNamespace, &cfg); err != nil {
+		l.Warning("access log: unable to parse the config:", err.Error())
+		return accessLogConfig{}
+	}
+	return cfg
+}
+
+// pathSkipper decides if a request path should be excluded from the access log
+type pathSkipper struct {
+	exact    map[string]struct{}
+	prefixes []string
+	globs    []string
+}
+
+func newPathSkipper(patterns []string) pathSkipper {
+	s := pathSkipper{exact: map[string]struct{}{}}
+	for _, p := range patterns {
+		switch {
+		case strings.HasSuffix(p, "*") && !strings.ContainsAny(p[:len(p)-1], "*?["):
+			s.prefixes = append(s.prefixes, p[:len(p)-1])
+		case strings.ContainsAny(p, "*?["):
+			s.globs = append(s.globs, p)
+		default:
+			s.exact[p] = struct{}{}
+		}
+	}
+	return s
+}
+
+func (s pathSkipper) skip(p string) bool {
+	if _, ok := s.exact[p]; ok {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	for _, glob := range s.globs {
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// statusSampler keeps a ratio of the requests per status class
+type statusSampler map[int]float64
+
+func newStatusSampler(rates map[string]float64) statusSampler {
+	s := statusSampler{}
+	for k, v := range rates {
+		if len(k) != 3 || !strings.HasSuffix(strings.ToLower(k), "xx") || k[0] < '1' || k[0] > '5' {
+			continue
+		}
+		s[int(k[0]-'0')] = v
+	}
+	return s
+}
+
+func (s statusSampler) keep(status int) bool {
+	rate, ok := s[status/100]
+	if !ok || rate >= 1 {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+// accessLoggers keeps the loggers of the access log built during the life of the process, so the engines
+// created by every reload share them instead of opening their sinks again
+var accessLoggers = &accessLoggerCache{loggers: map[accessLoggerKey]*zap.Logger{}}
+
+// accessLoggerKey contains the settings of the access log config used to build the logger
+type accessLoggerKey struct {
+	utc        bool
+	timeFormat string
+	output     string
+}
+
+type accessLoggerCache struct {
+	mu      sync.Mutex
+	loggers map[accessLoggerKey]*zap.Logger
+	closers []func()
+}
+
+// get returns the logger for the config, building it the first time the settings are used
+func (c *accessLoggerCache) get(cfg accessLogConfig) (*zap.Logger, error) {
+	key := accessLoggerKey{
+		utc:        cfg.UTC,
+		timeFormat: cfg.TimeFormat,
+		output:     cfg.Output,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if logger, ok := c.loggers[key]; ok {
+		return logger, nil
+	}
+	logger, closer, err := newAccessLogger(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.loggers[key] = logger
+	c.closers = append(c.closers, closer)
+	return logger, nil
+}
+
+// close syncs the loggers and closes their sinks. The loggers requested after closing the cache are
+// built again.
+func (c *accessLoggerCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, logger := range c.loggers {
+		logger.Sync()
+	}
+	for _, closer := range c.closers {
+		closer()
+	}
+	c.loggers = map[accessLoggerKey]*zap.Logger{}
+	c.closers = nil
+}
+
+// newAccessLogger builds a logger like the zap production one, returning also the function closing its sinks
+func newAccessLogger(cfg accessLogConfig) (*zap.Logger, func(), error) {
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.EncodeLevel = zapcore.CapitalLevelEncoder
+	encCfg.EncodeDuration = zapcore.MillisDurationEncoder
+
+	var timeEncoder zapcore.TimeEncoder
+	switch cfg.TimeFormat {
+	case "iso8601":
+		timeEncoder = zapcore.ISO8601TimeEncoder
+	case "rfc3339":
+		timeEncoder = zapcore.RFC3339TimeEncoder
+	default:
+		timeEncoder = zapcore.EpochTimeEncoder
+	}
+	if cfg.UTC {
+		encCfg.EncodeTime = func(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+			timeEncoder(t.UTC(), enc)
+		}
+	} else {
+		encCfg.EncodeTime = timeEncoder
+	}
+
+	output := cfg.Output
+	if output == "" {
+		output = "stderr"
+	}
+	sink, closeSink, err := zap.Open(output)
+	if err != nil {
+		return nil, nil, err
+	}
+	errSink, closeErrSink, err := zap.Open("stderr")
+	if err != nil {
+		closeSink()
+		return nil, nil, err
+	}
+
+	// the sampling per status class is done by the middleware, before the rate limit of the zap sampler
+	core := zapcore.NewSampler(zapcore.NewCore(zapcore.NewJSONEncoder(encCfg), sink, zapcore.InfoLevel), time.Second, 100, 100)
+	logger := zap.New(core, zap.ErrorOutput(errSink), zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel))
+	return logger, func() {
+		closeSink()
+		closeErrSink()
+	}, nil
+}
+
+// zapLogger returns a zap logger middleware. If the received logger is the structured one, the access log
+// is written by it, with the hash of the config of the engine.
+func zapLogger(serviceCfg config.ServiceConfig, l logging.Logger) gin.HandlerFunc {
+	cfg := newAccessLogConfig(serviceCfg.ExtraConfig, l)
+
+	var logger *zap.Logger
+	if zl, ok := l.(*zaplog.Logger); ok {
+		hash, _ := serviceCfg.Hash()
+		logger = zl.Zap().With(zap.String("config_hash", hash))
+	} else {
+		var err error
+		logger, err = accessLoggers.get(cfg)
+		if err != nil {
+			l.Warning("access log: unable to build the logger with the custom config:", err.Error())
+			logger, _ = accessLoggers.get(accessLogConfig{})
+		}
+	}
+
+	skipper := newPathSkipper(cfg.SkipPaths)
+	sampler := newStatusSampler(cfg.Sampling)
+
+	return func(c *gin.Context) {
+		// Start timer
+		start := time.Now()
+		path := c.Request.URL.Path
+
+		// Process request
+		c.Next()
+
+		// Log only when path is not being skipped
+		if skipper.skip(path) {
+			return
+		}
+
+		status := c.Writer.Status()
+		if !sampler.keep(status) {
+			return
+		}
+
+		fields := []zapcore.Field{
+			zap.Duration("duration", time.Since(start)),
+			zap.String("host", c.Request.URL.Host),
+			zap.String("ip", c.ClientIP()),
+			zap.String("method", c.Request.Method),
+			zap.String("path", path),
+			zap.String("request_id", requestid.FromContext(c)),
+			zap.Int("status", status),
+			zap.String("trace_id", traceID(c)),
+			zap.String("user_agent", c.Request.UserAgent()),
+		}
+		if len(cfg.RequestHeaders) > 0 {
+			fields = append(fields, zap.Any("request_headers", pickHeaders(c.Request.Header, cfg.RequestHeaders)))
+		}
+		if len(cfg.ResponseHeaders) > 0 {
+			fields = append(fields, zap.Any("response_headers", pickHeaders(c.Writer.Header(), cfg.ResponseHeaders)))
+		}
+		if len(c.Errors) > 0 {
+			fields = append(fields, zap.Strings("errors", c.Errors.Errors()))
+		}
+
+		if status >= 200 && status < 400 {
+			logger.Info("request", fields...)
+		} else if status >= 400 && status < 500 {
+			logger.Warn("bad request", fields...)
+		} else {
+			logger.Error("request error", fields...)
+		}
+	}
+}
+
+// traceID returns the ID of the trace recorded by the opentelemetry router layer or, if there is none, the
+// one of the traceparent header received
+func traceID(c *gin.Context) string {
+	if id := opentelemetry.TraceID(c); id != "" {
+		return id
+	}
+	// version-traceid-parentid-flags
+	if parts := strings.Split(c.Request.Header.Get("traceparent"), "-"); len(parts) == 4 {
+		return parts[1]
+	}
+	return ""
+}
+
+func pickHeaders(h http.Header, names []string) map[string]string {
+	res := make(map[string]string, len(names))
+	for _, name := range names {
+		res[name] = h.Get(name)
+	}
+	return res
+}
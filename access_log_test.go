@@ -0,0 +1,129 @@
+package krakend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+func TestPathSkipper(t *testing.T) {
+	s := newPathSkipper([]string{"/__health", "/static/*", "/users/*/avatar", "/v?/ping"})
+	for p, expected := range map[string]bool{
+		"/__health":          true,
+		"/__health/ready":    false,
+		"/static/":           true,
+		"/static/css/a.css":  true,
+		"/statics":           false,
+		"/users/42/avatar":   true,
+		"/users/42/profile":  false,
+		"/users/a/b/avatar":  false,
+		"/v1/ping":           true,
+		"/v10/ping":          false,
+		"/anything/__health": false,
+	} {
+		if s.skip(p) != expected {
+			t.Errorf("unexpected result for %s: %v", p, !expected)
+		}
+	}
+}
+
+func TestStatusSampler(t *testing.T) {
+	s := newStatusSampler(map[string]float64{"2xx": 0, "4XX": 1, "5xx": .5, "6xx": 0, "200": 0, "xx": 0})
+	if len(s) != 3 {
+		t.Errorf("unexpected classes: %v", s)
+	}
+	for status, expected := range map[int]bool{200: false, 204: false, 301: true, 404: true} {
+		if s.keep(status) != expected {
+			t.Errorf("unexpected result for the status %d", status)
+		}
+	}
+
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		if s.keep(503) {
+			kept++
+		}
+	}
+	if kept < 400 || kept > 600 {
+		t.Errorf("unexpected number of 5xx entries kept: %d", kept)
+	}
+}
+
+func TestZapLogger(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir, err := ioutil.TempDir("", "access_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "access.log")
+
+	cfg := config.ServiceConfig{ExtraConfig: config.ExtraConfig{AccessLogNamespace: map[string]interface{}{
+		"skip_paths":       []string{"/skipped"},
+		"sampling":         map[string]float64{"2xx": 1, "4xx": 0},
+		"output":           output,
+		"request_headers":  []string{"X-Tenant", "X-Missing"},
+		"response_headers": []string{"X-Cache"},
+	}}}
+
+	engine := gin.New()
+	engine.Use(zapLogger(cfg, logging.NoOp))
+	engine.GET("/:status", func(c *gin.Context) {
+		c.Header("X-Cache", "HIT")
+		if c.Param("status") == "missing" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+	// the engines built by the reloads share the logger
+	reloaded := gin.New()
+	reloaded.Use(zapLogger(cfg, logging.NoOp))
+	reloaded.GET("/reloaded", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, h := range []struct {
+		engine *gin.Engine
+		path   string
+	}{{engine, "/logged"}, {engine, "/skipped"}, {engine, "/missing"}, {reloaded, "/reloaded"}} {
+		req := httptest.NewRequest("GET", h.path, nil)
+		req.Header.Set("X-Tenant", "acme")
+		h.engine.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	accessLoggers.close()
+
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected entries: %s", b)
+	}
+	for i, p := range []string{"/logged", "/reloaded"} {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["path"] != p || entry["status"] != float64(200) || entry["level"] != "INFO" {
+			t.Errorf("unexpected entry: %v", entry)
+		}
+		if i > 0 {
+			continue
+		}
+		if h, _ := entry["request_headers"].(map[string]interface{}); h["X-Tenant"] != "acme" || h["X-Missing"] != "" {
+			t.Errorf("unexpected request headers: %v", entry["request_headers"])
+		}
+		if h, _ := entry["response_headers"].(map[string]interface{}); h["X-Cache"] != "HIT" {
+			t.Errorf("unexpected response headers: %v", entry["response_headers"])
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package krakend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/revocation"
+	"github.com/devopsfaith/krakend-ce/slo"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+// AdminNamespace is the key to use to store and access the admin API config
+const AdminNamespace = "github_com/devopsfaith/krakend-ce/admin"
+
+const (
+	adminRedacted         = "<redacted>"
+	adminShutdownTimeout  = time.Second
+	adminConfigPath       = "/__admin/config"
+	adminEndpointsPath    = "/__admin/endpoints"
+	adminPluginsPath      = "/__admin/plugins"
+	adminBreakersPath     = "/__admin/circuit_breakers"
+	adminRateLimitersPath = "/__admin/rate_limits"
+	adminRevocationsPath  = "/__admin/revocations"
+	adminSLOPath          = "/__admin/slo"
+)
+
+// defaultRedactedKeys contains the fragments of the config keys holding secrets. The keys are compared
+// in lower case and without separators.
+var defaultRedactedKeys = []string{
+	"password",
+	"secret",
+	"token",
+	"privatekey",
+	"apikey",
+	"credential",
+	"authorization",
+}
+
+type adminConfig struct {
+	ListenAddress string `json:"listen_address"`
+	// Users enables the basic auth with the given user and password pairs. The config and the revocations
+	// APIs are only served when it is set.
+	Users map[string]string `json:"users"`
+	// RedactKeys contains extra fragments of the config keys to redact
+	RedactKeys []string `json:"redact_keys"`
+}
+
+// adminServer exposes the state of the running gateway on a dedicated listener. The listener settings are
+// read once, so they are not affected by the hot reload, but the exposed state is replaced every time
+// the router stacks are rebuilt. A nil adminServer is a valid disabled one.
+type adminServer struct {
+	cfg        adminConfig
+	redactKeys []string
+	logger     logging.Logger
+	current    atomic.Value
+	// revocations is exposed only when the basic auth is enabled
+	revocations *revocation.Registry
+	slos        *slo.Registry
+}
+
+// adminState is the gateway version exposed by the admin server
+type adminState struct {
+	cfg       config.ServiceConfig
+	inspector *stackInspector
+}
+
+func newAdminServer(cfg config.ServiceConfig, l logging.Logger) *adminServer {
+	aCfg := adminConfig{}
+	ok, err := parseExtraConfig(cfg.ExtraConfig, AdminNamespace, &aCfg)
+	if !ok {
+		return nil
+	}
+	if err != nil {
+		l.Warning("admin: unable to parse the config:", err.Error())
+		return nil
+	}
+	if aCfg.ListenAddress == "" {
+		l.Warning("admin: the listen_address is required")
+		return nil
+	}
+
+	redactKeys := append([]string{}, defaultRedactedKeys...)
+	for _, k := range aCfg.RedactKeys {
+		redactKeys = append(redactKeys, normalizeConfigKey(k))
+	}
+	return &adminServer{cfg: aCfg, redactKeys: redactKeys, logger: l}
+}
+
+// publish replaces the exposed state with the given version of the gateway
+func (a *adminServer) publish(cfg config.ServiceConfig, inspector *stackInspector) {
+	if a == nil {
+		return
+	}
+	a.current.Store(adminState{cfg: cfg, inspector: inspector})
+}
+
+// exposeRevocations adds the revocations API to the admin server
+func (a *adminServer) exposeRevocations(r *revocation.Registry) {
+	if a == nil {
+		return
+	}
+	a.revocations = r
+}
+
+// exposeSLOs adds the error budgets of the endpoints with objectives to the admin server
+func (a *adminServer) exposeSLOs(r *slo.Registry) {
+	if a == nil {
+		return
+	}
+	a.slos = r
+}
+
+func (a *adminServer) state() adminState {
+	s, _ := a.current.Load().(adminState)
+	return s
+}
+
+// Run starts the admin listener and stops it once the context is cancelled
+func (a *adminServer) Run(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	server := &http.Server{
+		Addr:    a.cfg.ListenAddress,
+		Handler: a.engine(),
+	}
+	go func() {
+		a.logger.Info("admin: listening on", a.cfg.ListenAddress)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			a.logger.Error("admin:", err.Error())
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		a.logger.Info("admin: shutting down the listener")
+		ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		server.Shutdown(ctx)
+		cancel()
+	}()
+}
+
+func (a *adminServer) engine() *gin.Engine {
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	if len(a.cfg.Users) > 0 {
+		engine.Use(gin.BasicAuth(gin.Accounts(a.cfg.Users)))
+	}
+
+	if len(a.cfg.Users) > 0 {
+		engine.GET(adminConfigPath, a.configHandler)
+	} else {
+		a.logger.Warning("admin: the config API requires the basic auth users")
+	}
+	engine.GET(adminEndpointsPath, a.endpointsHandler)
+	engine.GET(adminPluginsPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, LoadedPlugins())
+	})
+	engine.GET(adminBreakersPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, a.state().inspector.breakerStates())
+	})
+	engine.GET(adminRateLimitersPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, a.state().inspector.rateLimits())
+	})
+	engine.GET(adminSLOPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, a.slos.Reports())
+	})
+
+	if a.revocations != nil {
+		if len(a.cfg.Users) == 0 {
+			a.logger.Warning("admin: the revocations API requires the basic auth users")
+			return engine
+		}
+		engine.GET(adminRevocationsPath, func(c *gin.Context) {
+			c.JSON(http.StatusOK, a.revocations.Entries())
+		})
+		engine.POST(adminRevocationsPath, a.revokeHandler)
+	}
+	return engine
+}
+
+type adminRevocation struct {
+	// Claim is the name of the claim to check. The "subject" alias means "sub".
+	Claim string `json:"claim"`
+	Value string `json:"value"`
+	// TTL is the time the token is rejected. Empty means the default ttl of the registry.
+	TTL string `json:"ttl"`
+}
+
+func (a *adminServer) revokeHandler(c *gin.Context) {
+	req := adminRevocation{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Claim == "subject" {
+		req.Claim = "sub"
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ttl = d
+	}
+
+	entry, err := a.revocations.Revoke(req.Claim, req.Value, ttl)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error(), "claims": a.revocations.Claims()})
+		return
+	}
+	a.logger.Info("admin: token revoked by", c.GetString(gin.AuthUserKey), entry.Claim, entry.Value)
+	c.JSON(http.StatusCreated, entry)
+}
+
+func (a *adminServer) configHandler(c *gin.Context) {
+	b, err := json.Marshal(a.state().cfg)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	redactAdminUsers(v)
+	c.JSON(http.StatusOK, a.redact(v))
+}
+
+// redact replaces the values of the keys holding secrets in the decoded JSON document. The objects and
+// lists below a secret key are redacted entirely, keeping their keys. The namespaces of the extra configs
+// (keys with a '/') are always inspected, so namespaces like the oauth2 client credentials one are not hidden.
+func (a *adminServer) redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, v := range t {
+			if a.isSecret(k) && !strings.Contains(k, "/") {
+				t[k] = redactAll(v)
+				continue
+			}
+			t[k] = a.redact(v)
+		}
+	case []interface{}:
+		for i, v := range t {
+			t[i] = a.redact(v)
+		}
+	}
+	return v
+}
+
+// redactAll replaces all the scalar values below v
+func redactAll(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = redactAll(v)
+		}
+		return t
+	case []interface{}:
+		for i, v := range t {
+			t[i] = redactAll(v)
+		}
+		return t
+	case nil:
+		return nil
+	}
+	return adminRedacted
+}
+
+// redactAdminUsers hides the passwords of the basic auth users of the admin API, since they are keyed by
+// the user names
+func redactAdminUsers(doc interface{}) {
+	root, _ := doc.(map[string]interface{})
+	extra, _ := root["ExtraConfig"].(map[string]interface{})
+	admin, _ := extra[AdminNamespace].(map[string]interface{})
+	if users, ok := admin["users"]; ok {
+		admin["users"] = redactAll(users)
+	}
+}
+
+func (a *adminServer) isSecret(key string) bool {
+	key = normalizeConfigKey(key)
+	for _, k := range a.redactKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeConfigKey(k string) string {
+	return strings.NewReplacer("_", "", "-", "", ".", "").Replace(strings.ToLower(k))
+}
+
+type adminEndpoint struct {
+	Endpoint string         `json:"endpoint"`
+	Method   string         `json:"method"`
+	Handler  []string       `json:"handler"`
+	Proxy    []string       `json:"proxy"`
+	Backends []adminBackend `json:"backends"`
+	// Source is "factories" when the layers were recorded by the factories building the endpoint or
+	// "config" when they are derived from the namespaces of the config
+	Source string `json:"source"`
+}
+
+type adminBackend struct {
+	Method     string   `json:"method"`
+	Host       []string `json:"host"`
+	URLPattern string   `json:"url_pattern"`
+	Layers     []string `json:"layers"`
+}
+
+const (
+	adminLayersFromFactories = "factories"
+	adminLayersFromConfig    = "config"
+)
+
+// endpointsHandler lists the endpoints with the layers wrapping their handlers, proxies and backends, from
+// the outermost to the innermost one. The layers are the ones recorded by the factories while building
+// the endpoint. The endpoints without records, like the ones built by injected factories ignoring the
+// stack inspector, get the layers the default factories would add for their config.
+func (a *adminServer) endpointsHandler(c *gin.Context) {
+	state := a.state()
+	cfg := state.cfg
+	order, _ := backendMiddlewareOrder(cfg.ExtraConfig)
+	bLayers := backendLayers(order)
+	res := make([]adminEndpoint, 0, len(cfg.Endpoints))
+	for _, e := range cfg.Endpoints {
+		hLayers, hOK := state.inspector.chain(handlerChainKey(e))
+		pLayers, pOK := state.inspector.chain(proxyChainKey(e))
+		ep := adminEndpoint{
+			Endpoint: e.Endpoint,
+			Method:   e.Method,
+			Handler:  hLayers,
+			Proxy:    pLayers,
+			Backends: make([]adminBackend, 0, len(e.Backend)),
+			Source:   adminLayersFromFactories,
+		}
+		recorded := hOK && pOK
+		for i, b := range e.Backend {
+			layers, ok := state.inspector.chain(backendChainKey(e, i))
+			recorded = recorded && ok
+			ep.Backends = append(ep.Backends, adminBackend{
+				Method:     b.Method,
+				Host:       b.Host,
+				URLPattern: b.URLPattern,
+				Layers:     layers,
+			})
+		}
+		if !recorded {
+			ep.Source = adminLayersFromConfig
+			ep.Handler = enabledLayers(handlerLayers, cfg.ExtraConfig, e.ExtraConfig)
+			ep.Proxy = enabledLayers(proxyLayers, cfg.ExtraConfig, e.ExtraConfig)
+			for i, b := range e.Backend {
+				ep.Backends[i].Layers = enabledLayers(bLayers, cfg.ExtraConfig, b.ExtraConfig)
+			}
+		}
+		res = append(res, ep)
+	}
+	c.JSON(http.StatusOK, res)
+}
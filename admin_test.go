@@ -0,0 +1,190 @@
+package krakend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/devopsfaith/krakend-ce/graphql"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+func TestAdminServer_configRedacted(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{
+			AdminNamespace: map[string]interface{}{
+				"listen_address": ":0",
+				"users":          map[string]interface{}{"admin": "admin-pass", "ops": "ops-pass"},
+			},
+			"github.com/devopsfaith/krakend-oauth2-clientcredentials": map[string]interface{}{
+				"client_id":     "visible-client",
+				"client_secret": "oauth-pass",
+			},
+		},
+		Endpoints: []*config.EndpointConfig{{
+			Endpoint: "/a",
+			ExtraConfig: config.ExtraConfig{
+				"github_com/acme/plugin": map[string]interface{}{
+					"credentials": map[string]interface{}{"alice": "nested-pass"},
+					"tokens":      []interface{}{"list-pass", map[string]interface{}{"value": "list-map-pass"}},
+					"password":    "scalar-pass",
+					"host":        "visible-host",
+				},
+			},
+		}},
+	}
+	a := newAdminServer(cfg, logging.NoOp)
+	if a == nil {
+		t.Fatal("the admin server was not created")
+	}
+	a.publish(cfg, nil)
+
+	req := httptest.NewRequest("GET", adminConfigPath, nil)
+	req.SetBasicAuth("admin", "admin-pass")
+	w := httptest.NewRecorder()
+	a.engine().ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+
+	body := w.Body.String()
+	for _, secret := range []string{"admin-pass", "ops-pass", "oauth-pass", "nested-pass", "list-pass", "list-map-pass", "scalar-pass"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("the secret %q was not redacted: %s", secret, body)
+		}
+	}
+	for _, visible := range []string{"visible-client", "visible-host", `"alice"`, `"ops"`} {
+		if !strings.Contains(body, visible) {
+			t.Errorf("the value %s should be visible: %s", visible, body)
+		}
+	}
+}
+
+func TestAdminServer_configRequiresUsers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{AdminNamespace: map[string]interface{}{"listen_address": ":0"}},
+	}
+	a := newAdminServer(cfg, logging.NoOp)
+	a.publish(cfg, nil)
+
+	w := httptest.NewRecorder()
+	a.engine().ServeHTTP(w, httptest.NewRequest("GET", adminConfigPath, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("the config was served without users: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminServer_endpointChains(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	backend := &config.Backend{URLPattern: "/b"}
+	endpoint := &config.EndpointConfig{Endpoint: "/a", Method: "GET", Backend: []*config.Backend{backend}}
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{AdminNamespace: map[string]interface{}{"listen_address": ":0"}},
+		Endpoints:   []*config.EndpointConfig{endpoint},
+	}
+
+	s := newStackInspector()
+	passthrough := func(next router.HandlerFactory) router.HandlerFactory { return next }
+	wrapper := func(next router.HandlerFactory) router.HandlerFactory {
+		return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+			h := next(remote, p)
+			return func(c *gin.Context) { h(c) }
+		}
+	}
+	hf := recordHandlerLayer(s, "endpoint", router.EndpointHandler)
+	hf = recordHandlerLayer(s, "disabled", passthrough(hf))
+	hf = recordHandlerLayer(s, "custom", wrapper(hf))
+	hf(endpoint, proxy.NoopProxy)
+
+	pf := recordProxyLayer(s, "merger", proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return proxy.NoopProxy, nil
+	}))
+	pf.New(endpoint)
+
+	inner := recordBackendLayer(s, "http_proxy", func(_ *config.Backend) proxy.Proxy { return proxy.NoopProxy })
+	bf := recordBackendLayer(s, "custom_backend", func(remote *config.Backend) proxy.Proxy {
+		next := inner(remote)
+		return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) { return next(ctx, r) }
+	})
+	bf(backend)
+
+	a := newAdminServer(cfg, logging.NoOp)
+	for _, tc := range []struct {
+		inspector *stackInspector
+		expected  string
+	}{
+		{
+			inspector: s,
+			expected:  `[{"endpoint":"/a","method":"GET","handler":["custom","endpoint"],"proxy":["merger"],"backends":[{"method":"","host":null,"url_pattern":"/b","layers":["custom_backend","http_proxy"]}],"source":"factories"}]`,
+		},
+		{
+			inspector: nil,
+			expected:  `"source":"config"`,
+		},
+	} {
+		a.publish(cfg, tc.inspector)
+		w := httptest.NewRecorder()
+		a.engine().ServeHTTP(w, httptest.NewRequest("GET", adminEndpointsPath, nil))
+		if body := w.Body.String(); !strings.Contains(body, tc.expected) {
+			t.Errorf("unexpected body: %s", body)
+		}
+	}
+}
+
+func TestAdminServer_graphqlChains(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	endpoint := &config.EndpointConfig{Endpoint: "/a", Method: "GET", Backend: []*config.Backend{
+		{
+			URLPattern: "/graphql",
+			ExtraConfig: config.ExtraConfig{
+				graphql.Namespace: map[string]interface{}{"query": "{ user { id } }"},
+			},
+		},
+		{URLPattern: "/b"},
+	}}
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{AdminNamespace: map[string]interface{}{"listen_address": ":0"}},
+		Endpoints:   []*config.EndpointConfig{endpoint},
+	}
+
+	s := newStackInspector()
+	bf := recordBackendLayer(s, "http_proxy", func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) { return nil, nil }
+	})
+	bf = recordBackendLayer(s, "graphql", graphql.BackendFactory(logging.NoOp, bf))
+	pf := recordProxyLayer(s, "merger", proxy.FactoryFunc(func(remote *config.EndpointConfig) (proxy.Proxy, error) {
+		for _, b := range remote.Backend {
+			bf(b)
+		}
+		return proxy.NoopProxy, nil
+	}))
+	pf.New(endpoint)
+	recordHandlerLayer(s, "endpoint", router.EndpointHandler)(endpoint, proxy.NoopProxy)
+
+	a := newAdminServer(cfg, logging.NoOp)
+	a.publish(cfg, s)
+	w := httptest.NewRecorder()
+	a.engine().ServeHTTP(w, httptest.NewRequest("GET", adminEndpointsPath, nil))
+	body := w.Body.String()
+	for _, expected := range []string{
+		`"url_pattern":"/graphql","layers":["graphql","http_proxy"]`,
+		`"url_pattern":"/b","layers":["http_proxy"]`,
+		`"source":"factories"`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("%s not found in the body: %s", expected, body)
+		}
+	}
+}
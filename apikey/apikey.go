@@ -0,0 +1,251 @@
+// Package apikey provides a handler middleware authenticating the requests with the API keys of a key store
+// and checking the roles of the key against the ones required by the endpoint.
+//
+// Sample service extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/apikey": {
+//			"header": "X-API-Key",
+//			"query_param": "api_key",
+//			"store": {
+//				"type": "kv",
+//				"path": "/etc/krakend/apikeys.txt",
+//				"reload_interval": "30s"
+//			}
+//		},
+//		...
+//	},
+//	...
+//
+// Sample endpoint extra config
+//
+//	...
+//	"headers_to_pass": ["X-Api-Key-Id"],
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/apikey": {
+//			"roles": ["partner", "admin"],
+//			"identity_header": "X-Api-Key-Id"
+//		},
+//		...
+//	},
+//	...
+//
+// The key is read from the header and, if it is not present, from the query param. The key must have any
+// of the roles of the endpoint, if defined. The identity of the key is set as the identity header of the
+// request, so it reaches the backends listing it in the headers_to_pass.
+//
+// The store types are:
+//   - file: a JSON file with a list of {"key": "...", "id": "...", "roles": [...]} objects, loaded once
+//   - env: the environment variables with the env_prefix (KRAKEND_APIKEY_ by default). The rest of the
+//     variable name is the identity and the value is the key, optionally followed by a colon and a comma
+//     separated list of roles
+//   - kv: a text file with a key, an identity and an optional comma separated list of roles per line,
+//     loaded again when it is modified
+//
+// The identity of the key is checked by the token rejecter as the "sub" claim, so the revoked identities
+// are rejected like the revoked tokens. The requests without a valid key get a 401 and the keys without the
+// required roles a 403, as the JWT validator does.
+package apikey
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	krakendjose "github.com/devopsfaith/krakend-jose"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+// Namespace is the key to use to store and access the custom config data, both at the service and the
+// endpoint level
+const Namespace = "github_com/devopsfaith/krakend-ce/apikey"
+
+const (
+	defaultHeader         = "X-API-Key"
+	defaultIdentityHeader = "X-Api-Key-Id"
+)
+
+var (
+	errNoConfig      = errors.New("apikey: no config")
+	errBadConfig     = errors.New("apikey: unable to parse the config")
+	errNoStore       = errors.New("apikey: no key store defined at the service config")
+	errMissingKey    = errors.New("apikey: missing key")
+	errUnknownKey    = errors.New("apikey: unknown key")
+	errRejectedKey   = errors.New("apikey: rejected key")
+	errForbiddenRole = errors.New("apikey: the key has none of the required roles")
+)
+
+// Identity is the owner of an API key
+type Identity struct {
+	ID    string
+	Roles []string
+}
+
+// Store returns the identity owning a key
+type Store interface {
+	Identity(key string) (Identity, bool)
+}
+
+// Config is the service config struct containing the params for the key lookup
+type Config struct {
+	Header     string      `json:"header"`
+	QueryParam string      `json:"query_param"`
+	Store      StoreConfig `json:"store"`
+}
+
+// EndpointConfig is the endpoint config struct containing the params for the key validation
+type EndpointConfig struct {
+	Roles          []string `json:"roles"`
+	IdentityHeader string   `json:"identity_header"`
+}
+
+func parse(e config.ExtraConfig, v interface{}) error {
+	tmp, ok := e[Namespace]
+	if !ok {
+		return errNoConfig
+	}
+	b, err := json.Marshal(tmp)
+	if err != nil {
+		return errBadConfig
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errBadConfig
+	}
+	return nil
+}
+
+// Authenticator finds the keys of the requests in the store
+type Authenticator struct {
+	cfg   Config
+	store Store
+}
+
+// New returns an Authenticator for the service config. It returns nil and no error if the service config
+// does not define the key store. The stores reloading their keys stop when the context is cancelled.
+func New(ctx context.Context, e config.ExtraConfig, logger logging.Logger) (*Authenticator, error) {
+	cfg := Config{}
+	if err := parse(e, &cfg); err != nil {
+		if err == errNoConfig {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if cfg.Header == "" {
+		cfg.Header = defaultHeader
+	}
+	store, err := NewStore(ctx, cfg.Store, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{cfg: cfg, store: store}, nil
+}
+
+// NewAuthenticator returns an Authenticator looking for the keys in the received store
+func NewAuthenticator(cfg Config, store Store) *Authenticator {
+	if cfg.Header == "" {
+		cfg.Header = defaultHeader
+	}
+	return &Authenticator{cfg: cfg, store: store}
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (Identity, error) {
+	key := r.Header.Get(a.cfg.Header)
+	if key == "" && a.cfg.QueryParam != "" {
+		key = r.URL.Query().Get(a.cfg.QueryParam)
+	}
+	if key == "" {
+		return Identity{}, errMissingKey
+	}
+	id, ok := a.store.Identity(key)
+	if !ok {
+		return Identity{}, errUnknownKey
+	}
+	return id, nil
+}
+
+// HandlerFactory adds the API key validation to the endpoints with the apikey config. The rejecter created
+// by the received factory can reject the identities of the keys. If the authenticator is nil, all the
+// requests to the protected endpoints are rejected.
+func HandlerFactory(next router.HandlerFactory, a *Authenticator, rejecterF krakendjose.RejecterFactory, logger logging.Logger) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := next(remote, p)
+
+		cfg := EndpointConfig{}
+		if err := parse(remote.ExtraConfig, &cfg); err != nil {
+			if err != errNoConfig {
+				logger.Error(err.Error(), remote.Endpoint)
+				return reject(http.StatusInternalServerError, err)
+			}
+			return handler
+		}
+		if a == nil {
+			logger.Error(errNoStore.Error(), remote.Endpoint)
+			return reject(http.StatusUnauthorized, errNoStore)
+		}
+		if cfg.IdentityHeader == "" {
+			cfg.IdentityHeader = defaultIdentityHeader
+		}
+
+		if rejecterF == nil {
+			rejecterF = krakendjose.NopRejecterFactory{}
+		}
+		rejecter := rejecterF.New(logger, remote)
+
+		logger.Info("apikey: validator enabled for the endpoint", remote.Endpoint)
+
+		return func(c *gin.Context) {
+			id, err := a.authenticate(c.Request)
+			if err != nil {
+				c.AbortWithError(http.StatusUnauthorized, err)
+				return
+			}
+
+			roles := make([]interface{}, len(id.Roles))
+			for i, r := range id.Roles {
+				roles[i] = r
+			}
+			if rejecter.Reject(map[string]interface{}{"sub": id.ID, "roles": roles}) {
+				c.AbortWithError(http.StatusUnauthorized, errRejectedKey)
+				return
+			}
+
+			if !hasAnyRole(id.Roles, cfg.Roles) {
+				c.AbortWithError(http.StatusForbidden, errForbiddenRole)
+				return
+			}
+
+			// the identity header replaces the one sent by the client
+			c.Request.Header.Set(cfg.IdentityHeader, id.ID)
+
+			handler(c)
+		}
+	}
+}
+
+func hasAnyRole(have, required []string) bool {
+	if len(required) == 0 {
+		return true
+	}
+	for _, r := range required {
+		for _, h := range have {
+			if r == h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func reject(status int, err error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.AbortWithError(status, err)
+	}
+}
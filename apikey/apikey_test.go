@@ -0,0 +1,189 @@
+package apikey
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	krakendjose "github.com/devopsfaith/krakend-jose"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := staticStore{
+		hashKey("partner-key"): Identity{ID: "partner-1", Roles: []string{"partner"}},
+		hashKey("guest-key"):   Identity{ID: "guest-1", Roles: []string{"guest"}},
+		hashKey("revoked-key"): Identity{ID: "revoked-1", Roles: []string{"partner"}},
+	}
+	a := NewAuthenticator(Config{QueryParam: "api_key"}, store)
+	rejecter := krakendjose.RejecterFactoryFunc(func(_ logging.Logger, _ *config.EndpointConfig) krakendjose.Rejecter {
+		return krakendjose.RejecterFunc(func(claims map[string]interface{}) bool {
+			return claims["sub"] == "revoked-1"
+		})
+	})
+	engine := newEngine(HandlerFactory(identityHandler, a, rejecter, logging.NoOp), map[string]interface{}{
+		"roles":           []interface{}{"partner", "admin"},
+		"identity_header": "X-Partner",
+	})
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		header map[string]string
+		status int
+		body   string
+	}{
+		{name: "header", url: "/", header: map[string]string{"X-API-Key": "partner-key"}, status: 200, body: "partner-1"},
+		{name: "query", url: "/?api_key=partner-key", status: 200, body: "partner-1"},
+		{name: "spoofed identity", url: "/", header: map[string]string{"X-API-Key": "partner-key", "X-Partner": "admin"}, status: 200, body: "partner-1"},
+		{name: "missing", url: "/", status: http.StatusUnauthorized},
+		{name: "unknown", url: "/", header: map[string]string{"X-API-Key": "unknown"}, status: http.StatusUnauthorized},
+		{name: "revoked", url: "/", header: map[string]string{"X-API-Key": "revoked-key"}, status: http.StatusUnauthorized},
+		{name: "forbidden", url: "/", header: map[string]string{"X-API-Key": "guest-key"}, status: http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest("GET", tc.url, nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%s: unexpected status code: %d", tc.name, w.Code)
+			continue
+		}
+		if tc.status == 200 && w.Body.String() != tc.body {
+			t.Errorf("%s: unexpected identity: %s", tc.name, w.Body.String())
+		}
+	}
+}
+
+func TestHandlerFactory_noAuthenticator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	engine := newEngine(HandlerFactory(identityHandler, nil, nil, logging.NoOp), map[string]interface{}{})
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-API-Key", "some-key")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status code: %d", w.Code)
+	}
+}
+
+func TestNewStore_env(t *testing.T) {
+	s := parseEnvKeys([]string{
+		"KRAKEND_APIKEY_PARTNER=secret:partner, admin",
+		"KRAKEND_APIKEY_GUEST=other",
+		"OTHER_VAR=ignored",
+	}, defaultEnvPrefix)
+
+	id, ok := s.Identity("secret")
+	if !ok || id.ID != "partner" || len(id.Roles) != 2 || id.Roles[1] != "admin" {
+		t.Errorf("unexpected identity: %v", id)
+	}
+	if id, ok := s.Identity("other"); !ok || id.ID != "guest" || len(id.Roles) != 0 {
+		t.Errorf("unexpected identity: %v", id)
+	}
+	if _, ok := s.Identity("ignored"); ok {
+		t.Error("the variables without the prefix should be ignored")
+	}
+}
+
+func TestNewStore_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(path, []byte(`[{"key":"secret","id":"partner-1","roles":["partner"]}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStore(context.Background(), StoreConfig{Type: "file", Path: path}, logging.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := s.Identity("secret"); !ok || id.ID != "partner-1" {
+		t.Errorf("unexpected identity: %v", id)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`[{"id":"partner-1"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStore(context.Background(), StoreConfig{Type: "file", Path: path}, logging.NoOp); err == nil {
+		t.Error("the entries without key should be rejected")
+	}
+}
+
+func TestNewStore_kv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apikey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.txt")
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# partners\nsecret partner-1 partner,admin\n\nother guest-1\n", time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s, err := NewStore(ctx, StoreConfig{Type: "kv", Path: path, ReloadInterval: "1ms"}, logging.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := s.Identity("secret"); !ok || id.ID != "partner-1" || len(id.Roles) != 2 {
+		t.Errorf("unexpected identity: %v", id)
+	}
+	if id, ok := s.Identity("other"); !ok || id.ID != "guest-1" {
+		t.Errorf("unexpected identity: %v", id)
+	}
+
+	write("rotated partner-1 partner\n", time.Now().Add(time.Minute))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := s.Identity("secret"); ok {
+		t.Error("the removed key should be rejected after the reload")
+	}
+	if id, ok := s.Identity("rotated"); !ok || id.ID != "partner-1" {
+		t.Errorf("unexpected identity: %v", id)
+	}
+
+	write("malformed\n", time.Now().Add(2*time.Minute))
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := s.Identity("rotated"); !ok {
+		t.Error("the keys should be kept when the file can not be parsed")
+	}
+}
+
+func identityHandler(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.String(200, c.Request.Header.Get("X-Partner"))
+	}
+}
+
+func newEngine(hf func(*config.EndpointConfig, proxy.Proxy) gin.HandlerFunc, cfg map[string]interface{}) *gin.Engine {
+	engine := gin.New()
+	engine.GET("/", hf(&config.EndpointConfig{
+		Endpoint:    "/",
+		ExtraConfig: config.ExtraConfig{Namespace: cfg},
+	}, proxy.NoopProxy))
+	return engine
+}
@@ -0,0 +1,206 @@
+package apikey
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+)
+
+const (
+	defaultEnvPrefix      = "KRAKEND_APIKEY_"
+	defaultReloadInterval = 30 * time.Second
+)
+
+// StoreConfig is the config struct of the key store
+type StoreConfig struct {
+	Type           string `json:"type"`
+	Path           string `json:"path"`
+	EnvPrefix      string `json:"env_prefix"`
+	ReloadInterval string `json:"reload_interval"`
+}
+
+// NewStore returns the key store defined by the config. The kv stores look for changes of the file every
+// reload_interval until the context is cancelled.
+func NewStore(ctx context.Context, cfg StoreConfig, logger logging.Logger) (Store, error) {
+	switch cfg.Type {
+	case "file":
+		b, err := ioutil.ReadFile(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		return parseJSONKeys(b)
+	case "env":
+		prefix := cfg.EnvPrefix
+		if prefix == "" {
+			prefix = defaultEnvPrefix
+		}
+		return parseEnvKeys(os.Environ(), prefix), nil
+	case "kv":
+		interval := defaultReloadInterval
+		if d, err := time.ParseDuration(cfg.ReloadInterval); err == nil && d > 0 {
+			interval = d
+		}
+		s := &kvStore{path: cfg.Path, logger: logger}
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		go s.watch(ctx, interval)
+		return s, nil
+	default:
+		return nil, fmt.Errorf("apikey: unknown store type %q", cfg.Type)
+	}
+}
+
+// keyHash is the index of the stores, so the keys are not kept in memory and the lookup does not depend
+// on how many characters of the key are right
+type keyHash [sha256.Size]byte
+
+func hashKey(key string) keyHash {
+	return sha256.Sum256([]byte(key))
+}
+
+type staticStore map[keyHash]Identity
+
+func (s staticStore) Identity(key string) (Identity, bool) {
+	id, ok := s[hashKey(key)]
+	return id, ok
+}
+
+func parseJSONKeys(b []byte) (staticStore, error) {
+	var entries []struct {
+		Key   string   `json:"key"`
+		ID    string   `json:"id"`
+		Roles []string `json:"roles"`
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, err
+	}
+	s := staticStore{}
+	for i, e := range entries {
+		if e.Key == "" || e.ID == "" {
+			return nil, fmt.Errorf("apikey: the key and the id of the entry #%d are required", i)
+		}
+		s[hashKey(e.Key)] = Identity{ID: e.ID, Roles: e.Roles}
+	}
+	return s, nil
+}
+
+func parseEnvKeys(env []string, prefix string) staticStore {
+	s := staticStore{}
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(kv, prefix), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		key, roles := parts[1], ""
+		if i := strings.Index(key, ":"); i >= 0 {
+			key, roles = key[:i], key[i+1:]
+		}
+		s[hashKey(key)] = Identity{ID: strings.ToLower(parts[0]), Roles: splitRoles(roles)}
+	}
+	return s
+}
+
+// parseKVKeys parses the lines <key> <id> [role,role...], skipping the empty ones and the comments
+func parseKVKeys(b []byte) (staticStore, error) {
+	s := staticStore{}
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("apikey: malformed line %d", n)
+		}
+		id := Identity{ID: fields[1]}
+		if len(fields) == 3 {
+			id.Roles = splitRoles(fields[2])
+		}
+		s[hashKey(fields[0])] = id
+	}
+	return s, sc.Err()
+}
+
+func splitRoles(s string) []string {
+	roles := []string{}
+	for _, r := range strings.Split(s, ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			roles = append(roles, r)
+		}
+	}
+	return roles
+}
+
+// kvStore keeps the keys of a text file, loading it again when it is modified. If the new version of the
+// file can not be parsed, the previous keys are kept.
+type kvStore struct {
+	path    string
+	logger  logging.Logger
+	mu      sync.RWMutex
+	keys    staticStore
+	modTime time.Time
+}
+
+func (s *kvStore) Identity(key string) (Identity, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys.Identity(key)
+}
+
+func (s *kvStore) load() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	unchanged := info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseKVKeys(b)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *kvStore) watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.load(); err != nil {
+				s.logger.Error("apikey: unable to reload the keys:", err.Error())
+			}
+		}
+	}
+}
@@ -3,17 +3,11 @@ package krakend
 import (
 	"context"
 
-	amqp "github.com/devopsfaith/krakend-amqp"
-	cel "github.com/devopsfaith/krakend-cel"
-	cb "github.com/devopsfaith/krakend-circuitbreaker/gobreaker/proxy"
-	httpcache "github.com/devopsfaith/krakend-httpcache"
-	lambda "github.com/devopsfaith/krakend-lambda"
-	lua "github.com/devopsfaith/krakend-lua/proxy"
+	"github.com/devopsfaith/krakend-ce/opentelemetry"
+	"github.com/devopsfaith/krakend-ce/requestid"
+	"github.com/devopsfaith/krakend-ce/retry"
 	martian "github.com/devopsfaith/krakend-martian"
 	metrics "github.com/devopsfaith/krakend-metrics/gin"
-	oauth2client "github.com/devopsfaith/krakend-oauth2-clientcredentials"
-	pubsub "github.com/devopsfaith/krakend-pubsub"
-	juju "github.com/devopsfaith/krakend-ratelimit/juju/proxy"
 	"github.com/luraproject/lura/config"
 	"github.com/luraproject/lura/logging"
 	"github.com/luraproject/lura/proxy"
@@ -23,47 +17,100 @@ import (
 )
 
 // NewBackendFactory creates a BackendFactory by stacking all the available middlewares:
-// - oauth2 client credentials
-// - http cache
+// - http client layers (transport tuning, proxy, compression, mutual TLS, pool stats, oauth2, http cache)
+// - extra transport decorators
 // - martian
 // - pubsub
 // - amqp
+// - lambda
+// - grpc
+// - graphql
 // - cel
 // - lua
 // - rate-limit
+// - hedging
+// - retry
 // - circuit breaker
 // - metrics collector
 // - opencensus collector
+// - opentelemetry collector
 func NewBackendFactory(logger logging.Logger, metricCollector *metrics.Metrics) proxy.BackendFactory {
 	return NewBackendFactoryWithContext(context.Background(), logger, metricCollector)
 }
 
-// NewBackendFactory creates a BackendFactory by stacking all the available middlewares and injecting the received context
+// NewBackendFactory creates a BackendFactory by stacking all the available middlewares and injecting the received context.
+// The middlewares are stacked in the order defined by the BackendMiddlewaresNamespace config, if it is
+// present in the context, or in the default order.
 func NewBackendFactoryWithContext(ctx context.Context, logger logging.Logger, metricCollector *metrics.Metrics) proxy.BackendFactory {
+	s := stackInspectorFromContext(ctx)
+	transportDecorators := transportDecoratorsFromContext(ctx)
 	requestExecutorFactory := func(cfg *config.Backend) client.HTTPRequestExecutor {
-		var clientFactory client.HTTPClientFactory
-		if _, ok := cfg.ExtraConfig[oauth2client.Namespace]; ok {
-			clientFactory = oauth2client.NewHTTPClient(cfg)
-		} else {
-			clientFactory = httpcache.NewHTTPClient(cfg)
+		key := s.backendKey(cfg)
+		clientFactory := newHTTPClientFactory(ctx, cfg, logger, metricCollector, transportDecorators)
+		for _, name := range appliedTransportLayers(cfg, transportDecorators) {
+			s.recordAppliedLayer(key, name)
 		}
-		return opencensus.HTTPRequestExecutorFromConfig(clientFactory, cfg)
+		executor := client.DefaultHTTPRequestExecutor(clientFactory)
+		s.recordLayer(key, "http_client", executor)
+		executor = opencensus.HTTPRequestExecutorFromConfig(clientFactory, cfg)
+		s.recordLayer(key, "opencensus_http_client", executor)
+		executor = requestid.HTTPRequestExecutor(executor)
+		s.recordLayer(key, "request_id", executor)
+		executor = opentelemetry.HTTPRequestExecutor(executor, cfg)
+		s.recordLayer(key, "opentelemetry_http_client", executor)
+		if _, ok := cfg.ExtraConfig[retry.Namespace]; ok {
+			executor = retry.HTTPRequestExecutor(executor)
+			s.recordLayer(key, "retry_status", executor)
+		}
+		return executor
+	}
+	pluginExecutorFactory := httprequestexecutor.HTTPRequestExecutor(logger, requestExecutorFactory)
+	requestExecutorFactory = func(cfg *config.Backend) client.HTTPRequestExecutor {
+		executor := pluginExecutorFactory(cfg)
+		s.recordLayer(s.backendKey(cfg), "http_client_plugin", executor)
+		return executor
+	}
+
+	order := backendMiddlewaresFromContext(ctx)
+
+	var backendFactory proxy.BackendFactory
+	if len(order) > 0 && order[0] == backendMiddlewareMartian {
+		martianFactory := martian.NewConfiguredBackendFactory(logger, requestExecutorFactory)
+		backendFactory = func(remote *config.Backend) proxy.Proxy {
+			p := martianFactory(remote)
+			// martian builds the plain http proxy for the backends without modifiers
+			name := "http_proxy"
+			if _, ok := remote.ExtraConfig[martian.Namespace]; ok {
+				name = backendMiddlewareMartian
+			}
+			s.recordLayer(s.backendKey(remote), name, p)
+			return p
+		}
+		order = order[1:]
+	} else {
+		backendFactory = recordBackendLayer(s, "http_proxy", func(remote *config.Backend) proxy.Proxy {
+			return proxy.NewHTTPProxyWithHTTPExecutor(remote, requestExecutorFactory(remote), remote.Decoder)
+		})
+	}
+
+	for _, name := range order {
+		backendFactory = recordBackendLayer(s, name, backendMiddlewares.get(name).middleware(ctx, logger, metricCollector, backendFactory))
 	}
-	requestExecutorFactory = httprequestexecutor.HTTPRequestExecutor(logger, requestExecutorFactory)
-	backendFactory := martian.NewConfiguredBackendFactory(logger, requestExecutorFactory)
-	bf := pubsub.NewBackendFactory(ctx, logger, backendFactory)
-	backendFactory = bf.New
-	backendFactory = amqp.NewBackendFactory(ctx, logger, backendFactory)
-	backendFactory = lambda.BackendFactory(backendFactory)
-	backendFactory = cel.BackendFactory(logger, backendFactory)
-	backendFactory = lua.BackendFactory(logger, backendFactory)
-	backendFactory = juju.BackendFactory(backendFactory)
-	backendFactory = cb.BackendFactory(backendFactory, logger)
-	backendFactory = metricCollector.BackendFactory("backend", backendFactory)
-	backendFactory = opencensus.BackendFactory(backendFactory)
 	return backendFactory
 }
 
+// backendClientLayers describes the layers of the http client used by NewBackendFactoryWithContext, from
+// the outermost to the innermost one. The admin API uses it only for the stacks without the layers
+// recorded by the factories.
+var backendClientLayers = append([]layer{
+	{Name: "http_client_plugin", Namespaces: []string{httprequestexecutor.Namespace}},
+	{Name: "retry_status", Namespaces: []string{retry.Namespace}},
+	{Name: "opentelemetry_http_client", Namespaces: []string{opentelemetry.Namespace}, Service: true},
+	{Name: "request_id", Always: true},
+	{Name: "opencensus_http_client", Namespaces: []string{opencensus.Namespace}, Service: true},
+	{Name: "http_client", Always: true},
+}, httpClientLayers()...)
+
 type backendFactory struct{}
 
 func (b backendFactory) NewBackendFactory(ctx context.Context, l logging.Logger, m *metrics.Metrics) proxy.BackendFactory {
@@ -0,0 +1,285 @@
+package krakend
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	amqp "github.com/devopsfaith/krakend-amqp"
+	"github.com/devopsfaith/krakend-ce/graphql"
+	"github.com/devopsfaith/krakend-ce/grpc"
+	"github.com/devopsfaith/krakend-ce/hedging"
+	"github.com/devopsfaith/krakend-ce/opentelemetry"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
+	"github.com/devopsfaith/krakend-ce/retry"
+	cel "github.com/devopsfaith/krakend-cel"
+	gcb "github.com/devopsfaith/krakend-circuitbreaker/gobreaker"
+	lambda "github.com/devopsfaith/krakend-lambda"
+	lua "github.com/devopsfaith/krakend-lua/proxy"
+	martian "github.com/devopsfaith/krakend-martian"
+	krakendmetrics "github.com/devopsfaith/krakend-metrics"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	pubsub "github.com/devopsfaith/krakend-pubsub"
+	juju "github.com/devopsfaith/krakend-ratelimit/juju/proxy"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	opencensus "github.com/scriptdash/krakend-opencensus"
+)
+
+// BackendMiddlewaresNamespace is the key to use to store and access the backend middlewares config
+const BackendMiddlewaresNamespace = "github_com/devopsfaith/krakend-ce/backend-middlewares"
+
+// celNamespace is the key used by the cel component. The package exposing it is internal.
+const celNamespace = "github.com/devopsfaith/krakend-cel"
+
+// backendMiddlewareMartian is the only middleware replacing the innermost backend instead of wrapping it,
+// so it can only be the first one of the list
+const backendMiddlewareMartian = "martian"
+
+// defaultBackendMiddlewares is the order used to stack the backend middlewares when it is not declared at
+// the configuration, from the innermost to the outermost one
+var defaultBackendMiddlewares = []string{
+	backendMiddlewareMartian,
+	"pubsub",
+	"amqp",
+	"lambda",
+	"grpc",
+	"graphql",
+	"cel",
+	"lua",
+	"rate_limit",
+	"hedging",
+	"retry",
+	"circuit_breaker",
+	"metrics",
+	"opencensus",
+	"opentelemetry",
+}
+
+// DefaultBackendMiddlewares returns a copy of the order used to stack the backend middlewares when it is
+// not declared at the configuration, from the innermost to the outermost one
+func DefaultBackendMiddlewares() []string {
+	return append([]string{}, defaultBackendMiddlewares...)
+}
+
+type backendMiddlewaresConfig struct {
+	// Order lists the enabled middlewares, from the innermost to the outermost one
+	Order []string `json:"order"`
+}
+
+// BackendMiddleware wraps the received backend factory with a middleware
+type BackendMiddleware func(context.Context, logging.Logger, *metrics.Metrics, proxy.BackendFactory) proxy.BackendFactory
+
+// RegisterBackendMiddleware adds a middleware to the registry, so it can be referenced by name in the
+// backend middlewares config. The namespaces are the keys of the backend extra config enabling it.
+func RegisterBackendMiddleware(name string, mw BackendMiddleware, namespaces ...string) error {
+	return backendMiddlewares.register(name, layer{Name: name, Namespaces: namespaces}, mw)
+}
+
+type registeredBackendMiddleware struct {
+	layer      layer
+	middleware BackendMiddleware
+}
+
+type backendMiddlewareRegistry struct {
+	mu    sync.RWMutex
+	items map[string]registeredBackendMiddleware
+}
+
+func (r *backendMiddlewareRegistry) register(name string, l layer, mw BackendMiddleware) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.items[name]; ok {
+		return fmt.Errorf("backend middleware %q already registered", name)
+	}
+	r.items[name] = registeredBackendMiddleware{layer: l, middleware: mw}
+	return nil
+}
+
+func (r *backendMiddlewareRegistry) get(name string) registeredBackendMiddleware {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.items[name]
+}
+
+func (r *backendMiddlewareRegistry) has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.items[name]
+	return ok
+}
+
+var backendMiddlewares = &backendMiddlewareRegistry{
+	items: map[string]registeredBackendMiddleware{
+		backendMiddlewareMartian: {
+			layer: layer{Name: backendMiddlewareMartian, Namespaces: []string{martian.Namespace}},
+			// martian is the innermost backend and it is built by NewBackendFactoryWithContext
+			middleware: func(_ context.Context, _ logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return next
+			},
+		},
+		"pubsub": {
+			layer: layer{Name: "pubsub", Namespaces: []string{pubsubPublisherNamespace, pubsubSubscriberNamespace}},
+			middleware: func(ctx context.Context, l logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				next = reportFailedInit(ctx, "pubsub", next, pubsubPublisherNamespace, pubsubSubscriberNamespace)
+				return pubsub.NewBackendFactory(ctx, l, next).New
+			},
+		},
+		"amqp": {
+			layer: layer{Name: "amqp", Namespaces: []string{amqpConsumerNamespace, amqpProducerNamespace}},
+			middleware: func(ctx context.Context, l logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				next = reportFailedInit(ctx, "amqp", next, amqpConsumerNamespace, amqpProducerNamespace)
+				return amqp.NewBackendFactory(ctx, l, next)
+			},
+		},
+		"lambda": {
+			layer: layer{Name: "lambda", Namespaces: []string{lambda.Namespace}},
+			middleware: func(_ context.Context, _ logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return lambda.BackendFactory(next)
+			},
+		},
+		"grpc": {
+			layer: layer{Name: "grpc", Namespaces: []string{grpc.Namespace}},
+			middleware: func(ctx context.Context, l logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return grpc.BackendFactory(ctx, l, next)
+			},
+		},
+		"graphql": {
+			layer: layer{Name: "graphql", Namespaces: []string{graphql.Namespace}},
+			middleware: func(_ context.Context, l logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return graphql.BackendFactory(l, next)
+			},
+		},
+		"cel": {
+			layer: layer{Name: "cel", Namespaces: []string{celNamespace}},
+			middleware: func(_ context.Context, l logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return cel.BackendFactory(l, next)
+			},
+		},
+		"lua": {
+			layer: layer{Name: "lua", Namespaces: []string{lua.BackendNamespace}},
+			middleware: func(_ context.Context, l logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return lua.BackendFactory(l, next)
+			},
+		},
+		"rate_limit": {
+			layer: layer{Name: "rate_limit", Namespaces: []string{juju.Namespace}},
+			middleware: func(ctx context.Context, l logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return countBackendRateLimits(ctx, ratelimit.BackendFactory(next, rateLimitStoreFromContext(ctx), l))
+			},
+		},
+		"hedging": {
+			layer: layer{Name: "hedging", Namespaces: []string{hedging.Namespace}},
+			middleware: func(_ context.Context, l logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return hedging.BackendFactory(next, l)
+			},
+		},
+		"retry": {
+			layer: layer{Name: "retry", Namespaces: []string{retry.Namespace}},
+			middleware: func(ctx context.Context, l logging.Logger, m *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				o := retry.Observers{retry.NewMetricsObserver(m), retry.NewOpenCensusObserver()}
+				return retry.BackendFactory(next, retryBudgetFromContext(ctx), o, l)
+			},
+		},
+		"circuit_breaker": {
+			layer: layer{Name: "circuit_breaker", Namespaces: []string{gcb.Namespace}},
+			middleware: func(ctx context.Context, l logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return circuitBreakerFactory(ctx, next, l)
+			},
+		},
+		"metrics": {
+			layer: layer{Name: "metrics", Namespaces: []string{krakendmetrics.Namespace}, Service: true},
+			middleware: func(_ context.Context, _ logging.Logger, m *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return m.BackendFactory("backend", next)
+			},
+		},
+		"opencensus": {
+			layer: layer{Name: "opencensus", Namespaces: []string{opencensus.Namespace}, Service: true},
+			middleware: func(_ context.Context, _ logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return opencensus.BackendFactory(next)
+			},
+		},
+		"opentelemetry": {
+			layer: layer{Name: "opentelemetry", Namespaces: []string{opentelemetry.Namespace}, Service: true},
+			middleware: func(_ context.Context, _ logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+				return opentelemetry.BackendFactory(next)
+			},
+		},
+	},
+}
+
+// backendMiddlewareOrder returns the backend middlewares declared at the service extra config or the
+// default ones. It fails if the list contains unknown or repeated names.
+func backendMiddlewareOrder(e config.ExtraConfig) ([]string, error) {
+	cfg := backendMiddlewaresConfig{}
+	ok, err := parseExtraConfig(e, BackendMiddlewaresNamespace, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("backend middlewares: %s", err.Error())
+	}
+	if !ok || cfg.Order == nil {
+		return DefaultBackendMiddlewares(), nil
+	}
+
+	seen := map[string]struct{}{}
+	for i, name := range cfg.Order {
+		if !backendMiddlewares.has(name) {
+			return nil, fmt.Errorf("backend middlewares: unknown middleware %q", name)
+		}
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("backend middlewares: middleware %q declared more than once", name)
+		}
+		if name == backendMiddlewareMartian && i != 0 {
+			return nil, fmt.Errorf("backend middlewares: %q must be the first middleware", name)
+		}
+		seen[name] = struct{}{}
+	}
+	return cfg.Order, nil
+}
+
+// backendLayers describes the middlewares stacked by NewBackendFactoryWithContext with the given order,
+// from the outermost to the innermost one
+func backendLayers(order []string) []layer {
+	res := make([]layer, 0, len(order)+len(backendClientLayers))
+	for i := len(order) - 1; i >= 0; i-- {
+		res = append(res, backendMiddlewares.get(order[i]).layer)
+	}
+	return append(res, backendClientLayers...)
+}
+
+type backendMiddlewaresContextKey struct{}
+
+// withBackendMiddlewares returns a copy of the context carrying the order of the backend middlewares
+func withBackendMiddlewares(ctx context.Context, order []string) context.Context {
+	return context.WithValue(ctx, backendMiddlewaresContextKey{}, order)
+}
+
+func backendMiddlewaresFromContext(ctx context.Context) []string {
+	if order, ok := ctx.Value(backendMiddlewaresContextKey{}).([]string); ok {
+		return order
+	}
+	return DefaultBackendMiddlewares()
+}
+
+type retryBudgetContextKey struct{}
+
+// withRetryBudget returns a copy of the context carrying the retry budget shared by all the backends
+func withRetryBudget(ctx context.Context, b *retry.Budget) context.Context {
+	return context.WithValue(ctx, retryBudgetContextKey{}, b)
+}
+
+func retryBudgetFromContext(ctx context.Context) *retry.Budget {
+	b, _ := ctx.Value(retryBudgetContextKey{}).(*retry.Budget)
+	return b
+}
+
+type rateLimitStoreContextKey struct{}
+
+func withRateLimitStore(ctx context.Context, s *ratelimit.SharedStore) context.Context {
+	return context.WithValue(ctx, rateLimitStoreContextKey{}, s)
+}
+
+func rateLimitStoreFromContext(ctx context.Context) *ratelimit.SharedStore {
+	s, _ := ctx.Value(rateLimitStoreContextKey{}).(*ratelimit.SharedStore)
+	return s
+}
@@ -0,0 +1,132 @@
+package krakend
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestBackendMiddlewareOrder(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		extra    config.ExtraConfig
+		expected []string
+		err      string
+	}{
+		{name: "default", extra: config.ExtraConfig{}, expected: defaultBackendMiddlewares},
+		{name: "no order", extra: orderConfig(nil), expected: defaultBackendMiddlewares},
+		{name: "empty", extra: orderConfig([]string{}), expected: []string{}},
+		{name: "custom", extra: orderConfig([]string{"martian", "retry", "circuit_breaker"}), expected: []string{"martian", "retry", "circuit_breaker"}},
+		{name: "without martian", extra: orderConfig([]string{"circuit_breaker", "retry"}), expected: []string{"circuit_breaker", "retry"}},
+		{name: "unknown", extra: orderConfig([]string{"retry", "unknown"}), err: `backend middlewares: unknown middleware "unknown"`},
+		{name: "duplicated", extra: orderConfig([]string{"retry", "lua", "retry"}), err: `backend middlewares: middleware "retry" declared more than once`},
+		{name: "martian not first", extra: orderConfig([]string{"retry", "martian"}), err: `backend middlewares: "martian" must be the first middleware`},
+		{name: "bad config", extra: config.ExtraConfig{BackendMiddlewaresNamespace: map[string]interface{}{"order": "retry"}}, err: "backend middlewares: "},
+	} {
+		order, err := backendMiddlewareOrder(tc.extra)
+		if tc.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(order, tc.expected) {
+			t.Errorf("%s: unexpected order: %v", tc.name, order)
+		}
+	}
+}
+
+func TestDefaultBackendMiddlewares(t *testing.T) {
+	order := DefaultBackendMiddlewares()
+	if !reflect.DeepEqual(order, defaultBackendMiddlewares) {
+		t.Errorf("unexpected order: %v", order)
+	}
+	order[0] = "changed"
+	if DefaultBackendMiddlewares()[0] != backendMiddlewareMartian {
+		t.Error("the default order was modified through the returned slice")
+	}
+	for _, name := range defaultBackendMiddlewares {
+		if !backendMiddlewares.has(name) {
+			t.Errorf("the default middleware %s is not registered", name)
+		}
+	}
+}
+
+func TestRegisterBackendMiddleware(t *testing.T) {
+	// the test registers its middlewares in a copy of the registry
+	registry := backendMiddlewares
+	defer func() { backendMiddlewares = registry }()
+	backendMiddlewares = &backendMiddlewareRegistry{items: map[string]registeredBackendMiddleware{}}
+	for name, item := range registry.items {
+		backendMiddlewares.items[name] = item
+	}
+
+	var calls []string
+	record := func(name string, shortcut bool) BackendMiddleware {
+		return func(_ context.Context, _ logging.Logger, _ *metrics.Metrics, next proxy.BackendFactory) proxy.BackendFactory {
+			return func(remote *config.Backend) proxy.Proxy {
+				p := next(remote)
+				return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+					calls = append(calls, name)
+					if shortcut {
+						return &proxy.Response{IsComplete: true}, nil
+					}
+					return p(ctx, r)
+				}
+			}
+		}
+	}
+	if err := RegisterBackendMiddleware("test_inner", record("test_inner", true), "test/inner"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterBackendMiddleware("test_outer", record("test_outer", false), "test/outer"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"test_inner", "retry"} {
+		if err := RegisterBackendMiddleware(name, record(name, false)); err == nil {
+			t.Errorf("the middleware %s was registered twice", name)
+		}
+	}
+
+	order, err := backendMiddlewareOrder(orderConfig([]string{"test_inner", "retry", "test_outer"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := []string{}
+	for _, l := range backendLayers(order)[:3] {
+		layers = append(layers, l.Name)
+	}
+	if !reflect.DeepEqual(layers, []string{"test_outer", "retry", "test_inner"}) {
+		t.Errorf("unexpected layers: %v", layers)
+	}
+	if l := backendMiddlewares.get("test_outer").layer; !l.enabled(nil, config.ExtraConfig{"test/outer": true}) {
+		t.Errorf("the namespaces of the custom middleware were not registered: %+v", l)
+	}
+
+	ctx := withBackendMiddlewares(context.Background(), order)
+	remote := &config.Backend{Method: "GET", Host: []string{"http://backend.example.com"}, URLPattern: "/"}
+	if _, err := NewBackendFactoryWithContext(ctx, logging.NoOp, nil)(remote)(context.Background(), &proxy.Request{}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(calls, []string{"test_outer", "test_inner"}) {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+}
+
+func orderConfig(order []string) config.ExtraConfig {
+	cfg := map[string]interface{}{}
+	if order != nil {
+		cfg["order"] = order
+	}
+	return config.ExtraConfig{BackendMiddlewaresNamespace: cfg}
+}
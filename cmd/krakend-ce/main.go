@@ -36,7 +36,12 @@ func main() {
 			log.Println("Signal intercepted:", sig)
 			cancel()
 		case <-ctx.Done():
+			return
 		}
+		// a second signal skips the graceful shutdown
+		sig := <-sigs
+		log.Println("Signal intercepted:", sig, "- forcing the exit")
+		os.Exit(1)
 	}()
 
 	krakend.RegisterEncoders()
@@ -53,5 +58,6 @@ func main() {
 		})
 	}
 
-	cmd.Execute(cfg, krakend.NewExecutor(ctx))
+	eb := &krakend.ExecutorBuilder{ConfigParser: cfg}
+	cmd.Execute(cfg, eb.NewCmdExecutor(ctx))
 }
@@ -9,6 +9,16 @@ import (
 	"time"
 
 	krakendbf "github.com/devopsfaith/bloomfilter/krakend"
+	"github.com/devopsfaith/bloomfilter/rotate"
+	"github.com/devopsfaith/krakend-ce/apikey"
+	"github.com/devopsfaith/krakend-ce/opentelemetry"
+	"github.com/devopsfaith/krakend-ce/prometheus"
+	"github.com/devopsfaith/krakend-ce/quota"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
+	"github.com/devopsfaith/krakend-ce/retry"
+	"github.com/devopsfaith/krakend-ce/revocation"
+	"github.com/devopsfaith/krakend-ce/slo"
+	"github.com/devopsfaith/krakend-ce/zaplog"
 	cel "github.com/devopsfaith/krakend-cel"
 	cmd "github.com/devopsfaith/krakend-cobra"
 	cors "github.com/devopsfaith/krakend-cors/gin"
@@ -26,7 +36,6 @@ import (
 	"github.com/luraproject/lura/core"
 	"github.com/luraproject/lura/logging"
 	"github.com/luraproject/lura/proxy"
-	krakendrouter "github.com/luraproject/lura/router"
 	router "github.com/luraproject/lura/router/gin"
 	server "github.com/luraproject/lura/transport/http/server/plugin"
 	opencensus "github.com/scriptdash/krakend-opencensus"
@@ -38,6 +47,7 @@ import (
 	_ "github.com/scriptdash/krakend-opencensus/exporter/stackdriver"
 	_ "github.com/scriptdash/krakend-opencensus/exporter/xray"
 	_ "github.com/scriptdash/krakend-opencensus/exporter/zipkin"
+	"go.opencensus.io/stats/view"
 )
 
 // NewExecutor returns an executor for the cmd package. The executor initalizes the entire gateway by
@@ -66,6 +76,12 @@ type TokenRejecterFactory interface {
 	NewTokenRejecter(context.Context, config.ServiceConfig, logging.Logger, func(string, int)) (jose.ChainedRejecterFactory, error)
 }
 
+// TokenRevoker is an optional interface for the TokenRejecterFactory. The admin API exposes the revocation
+// registry returned by a factory implementing it, once the token rejecter has been created.
+type TokenRevoker interface {
+	RevocationRegistry() *revocation.Registry
+}
+
 // MetricsAndTracesRegister registers the defined observability components and returns a metrics collector,
 // if required.
 type MetricsAndTracesRegister interface {
@@ -82,6 +98,12 @@ type ProxyFactory interface {
 	NewProxyFactory(logging.Logger, proxy.BackendFactory, *metrics.Metrics) proxy.Factory
 }
 
+// ContextProxyFactory is an optional interface for the ProxyFactory collaborators. The context carries
+// the stack inspector recording the layers of the proxies.
+type ContextProxyFactory interface {
+	NewProxyFactoryWithContext(context.Context, logging.Logger, proxy.BackendFactory, *metrics.Metrics) proxy.Factory
+}
+
 // BackendFactory returns a KrakenD backend factory, ready to be passed to the KrakenD proxy factory
 type BackendFactory interface {
 	NewBackendFactory(context.Context, logging.Logger, *metrics.Metrics) proxy.BackendFactory
@@ -92,6 +114,12 @@ type HandlerFactory interface {
 	NewHandlerFactory(logging.Logger, *metrics.Metrics, jose.RejecterFactory) router.HandlerFactory
 }
 
+// ContextHandlerFactory is an optional interface for the HandlerFactory collaborators. The context carries
+// the components created for the router stack, like the API key authenticator.
+type ContextHandlerFactory interface {
+	NewHandlerFactoryWithContext(context.Context, logging.Logger, *metrics.Metrics, jose.RejecterFactory) router.HandlerFactory
+}
+
 // LoggerFactory returns a KrakenD Logger factory, ready to be passed to the KrakenD RouterFactory
 type LoggerFactory interface {
 	NewLogger(config.ServiceConfig) (logging.Logger, io.Writer, error)
@@ -118,6 +146,16 @@ type ExecutorBuilder struct {
 	HandlerFactory              HandlerFactory
 	RunServerFactory            RunServerFactory
 
+	// ConfigParser is used to parse the configuration file again when the hot reload is enabled
+	ConfigParser config.Parser
+	// HealthRegistry collects the state of the components exposed by the readiness endpoint
+	HealthRegistry *HealthRegistry
+	// TransportDecorators are added on top of the default layers of the backend http clients, from the
+	// innermost to the outermost one
+	TransportDecorators []TransportDecorator
+	// QuotaStore keeps the counters of the quotas. If it is nil, the counters are kept in memory.
+	QuotaStore quota.Store
+
 	Middlewares []gin.HandlerFunc
 }
 
@@ -138,14 +176,21 @@ func (e *ExecutorBuilder) NewCmdExecutor(ctx context.Context) cmd.Executor {
 
 		startReporter(ctx, logger, cfg)
 
+		// the components are bound to their own context, so they keep working while the server drains
+		// the in-flight requests after the received context is cancelled
+		stacksCtx, cancelStacks := context.WithCancel(context.Background())
+		defer flushObservability(logger, newShutdownSettings(cfg, logger), cancelStacks, e.MetricsAndTracesRegister, gelfWriter)
+
 		if cfg.Plugin != nil {
 			e.PluginLoader.Load(cfg.Plugin.Folder, cfg.Plugin.Pattern, logger)
+			e.HealthRegistry.ReportCollaborator(healthComponentPlugins, e.PluginLoader)
 		}
 
-		metricCollector := e.MetricsAndTracesRegister.Register(ctx, cfg, logger)
+		metricCollector := e.MetricsAndTracesRegister.Register(stacksCtx, cfg, logger)
+		e.HealthRegistry.ReportCollaborator(healthComponentMetrics, e.MetricsAndTracesRegister)
 
 		tokenRejecterFactory, err := e.TokenRejecterFactory.NewTokenRejecter(
-			ctx,
+			stacksCtx,
 			cfg,
 			logger,
 			e.SubscriberFactoriesRegister.Register(ctx, cfg, logger),
@@ -153,26 +198,131 @@ func (e *ExecutorBuilder) NewCmdExecutor(ctx context.Context) cmd.Executor {
 		if err != nil {
 			logger.Warning("bloomFilter:", err.Error())
 		}
+		e.HealthRegistry.Report(healthComponentTokens, tokenRejecterHealth(cfg, err))
+		e.HealthRegistry.ReportCollaborator(healthComponentSD, e.SubscriberFactoriesRegister)
+
+		slos := slo.NewRegistry(metricCollector)
+		admin := newAdminServer(cfg, logger)
+		if r, ok := e.TokenRejecterFactory.(TokenRevoker); ok {
+			admin.exposeRevocations(r.RevocationRegistry())
+		}
+		admin.exposeSLOs(slos)
+		admin.Run(stacksCtx)
+
+		deps := routerDeps{
+			logger:          logger,
+			gelfWriter:      gelfWriter,
+			metricCollector: metricCollector,
+			rejecter:        tokenRejecterFactory,
+			health:          e.HealthRegistry,
+			admin:           admin,
+			quotas:          e.QuotaStore,
+			slos:            slos,
+			shutdown:        ctx,
+		}
+		if deps.quotas == nil {
+			deps.quotas = quota.NewMemoryStore()
+		}
+		runServer := router.RunServerFunc(e.RunServerFactory.NewRunServer(logger, runHTTPServer))
+
+		if r, ok := newReloader(stacksCtx, e, deps, cfg); ok {
+			r.Run(ctx, cfg, runServer)
+			return
+		}
 
 		// setup the krakend router
-		routerFactory := router.NewFactory(router.Config{
-			Engine: e.EngineFactory.NewEngine(cfg, logger, gelfWriter),
-			ProxyFactory: e.ProxyFactory.NewProxyFactory(
-				logger,
-				e.BackendFactory.NewBackendFactory(ctx, logger, metricCollector),
-				metricCollector,
-			),
-			Middlewares:    e.Middlewares,
-			Logger:         logger,
-			HandlerFactory: e.HandlerFactory.NewHandlerFactory(logger, metricCollector, tokenRejecterFactory),
-			RunServer:      router.RunServerFunc(e.RunServerFactory.NewRunServer(logger, krakendrouter.RunServer)),
-		})
+		routerCfg, inspector, err := e.newRouterConfig(stacksCtx, cfg, deps)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		routerCfg.RunServer = runServer
+		admin.publish(cfg, inspector)
+		routerFactory := router.NewFactory(routerCfg)
 
 		// start the engines
 		routerFactory.NewWithContext(ctx).Run(cfg)
 	}
 }
 
+// routerDeps groups the components created once per execution and shared by all the router stacks
+type routerDeps struct {
+	logger          logging.Logger
+	gelfWriter      io.Writer
+	metricCollector *metrics.Metrics
+	rejecter        jose.RejecterFactory
+	health          *HealthRegistry
+	admin           *adminServer
+	quotas          quota.Store
+	slos            *slo.Registry
+	// shutdown is cancelled when the shutdown starts, while the stacks keep working during the drain
+	shutdown context.Context
+}
+
+// newRouterConfig composes the engine and the handler, proxy and backend factories for the given configuration.
+// The RunServer is left for the caller to define. The returned inspector collects the stateful components
+// created by the factories.
+func (e *ExecutorBuilder) newRouterConfig(ctx context.Context, cfg config.ServiceConfig, d routerDeps) (router.Config, *stackInspector, error) {
+	order, err := backendMiddlewareOrder(cfg.ExtraConfig)
+	if err != nil {
+		return router.Config{}, nil, err
+	}
+	ctx = withBackendMiddlewares(ctx, order)
+	ctx = withRetryBudget(ctx, retry.NewBudget(retry.BudgetConfigGetter(cfg.ExtraConfig)))
+	rateLimitStore, err := ratelimit.New(ctx, cfg.ExtraConfig, d.logger)
+	if err != nil {
+		return router.Config{}, nil, err
+	}
+	ctx = withRateLimitStore(ctx, rateLimitStore)
+	ctx = withTransportDecorators(ctx, e.TransportDecorators)
+
+	authenticator, err := apikey.New(ctx, cfg.ExtraConfig, d.logger)
+	if err != nil {
+		return router.Config{}, nil, err
+	}
+	ctx = withAPIKeyAuthenticator(ctx, authenticator)
+	ctx = withQuotaStore(ctx, d.quotas)
+	ctx = withSLORegistry(ctx, d.slos)
+	ctx = withShutdown(ctx, d.shutdown)
+
+	stack := newStackHealth(cfg)
+	ctx = withStackHealth(ctx, stack)
+	inspector := newStackInspector()
+	ctx = withStackInspector(ctx, inspector)
+
+	engine := e.EngineFactory.NewEngine(cfg, d.logger, d.gelfWriter)
+	registerHealthEndpoints(engine, d.health, stack)
+
+	// the injected collaborators are recorded as layers too, so the ones wrapping the default factories
+	// or replacing them show up in the chains
+	var handlerFactory router.HandlerFactory
+	if hf, ok := e.HandlerFactory.(ContextHandlerFactory); ok {
+		handlerFactory = hf.NewHandlerFactoryWithContext(ctx, d.logger, d.metricCollector, d.rejecter)
+	} else {
+		handlerFactory = e.HandlerFactory.NewHandlerFactory(d.logger, d.metricCollector, d.rejecter)
+	}
+	handlerFactory = recordHandlerLayer(inspector, fmt.Sprintf("%T", e.HandlerFactory), handlerFactory)
+
+	backendFactory := e.BackendFactory.NewBackendFactory(ctx, d.logger, d.metricCollector)
+	backendFactory = recordBackendLayer(inspector, fmt.Sprintf("%T", e.BackendFactory), backendFactory)
+
+	var proxyFactory proxy.Factory
+	if pf, ok := e.ProxyFactory.(ContextProxyFactory); ok {
+		proxyFactory = pf.NewProxyFactoryWithContext(ctx, d.logger, backendFactory, d.metricCollector)
+	} else {
+		proxyFactory = e.ProxyFactory.NewProxyFactory(d.logger, backendFactory, d.metricCollector)
+	}
+	proxyFactory = recordProxyLayer(inspector, fmt.Sprintf("%T", e.ProxyFactory), proxyFactory)
+
+	return router.Config{
+		Engine:         engine,
+		ProxyFactory:   proxyFactory,
+		Middlewares:    e.Middlewares,
+		Logger:         d.logger,
+		HandlerFactory: countEndpointRateLimits(inspector, handlerFactory),
+	}, inspector, nil
+}
+
 func (e *ExecutorBuilder) checkCollaborators() {
 	if e.PluginLoader == nil {
 		e.PluginLoader = new(pluginLoader)
@@ -181,7 +331,7 @@ func (e *ExecutorBuilder) checkCollaborators() {
 		e.SubscriberFactoriesRegister = new(registerSubscriberFactories)
 	}
 	if e.TokenRejecterFactory == nil {
-		e.TokenRejecterFactory = new(BloomFilterJWT)
+		e.TokenRejecterFactory = new(RevocableBloomFilterJWT)
 	}
 	if e.MetricsAndTracesRegister == nil {
 		e.MetricsAndTracesRegister = new(MetricsAndTraces)
@@ -201,29 +351,50 @@ func (e *ExecutorBuilder) checkCollaborators() {
 	if e.LoggerFactory == nil {
 		e.LoggerFactory = new(LoggerBuilder)
 	}
+	if e.HealthRegistry == nil {
+		e.HealthRegistry = NewHealthRegistry()
+	}
 	if e.RunServerFactory == nil {
-		e.RunServerFactory = new(DefaultRunServerFactory)
+		e.RunServerFactory = &DefaultRunServerFactory{Health: e.HealthRegistry}
 	}
 }
 
 // DefaultRunServerFactory creates the default RunServer by wrapping the injected RunServer
-// with the plugin loader and the CORS module
-type DefaultRunServerFactory struct{}
+// with the plugin loader, the CORS module and the graceful shutdown
+type DefaultRunServerFactory struct {
+	// Health is flagged as draining when the shutdown starts. It is optional.
+	Health *HealthRegistry
+}
 
 func (d *DefaultRunServerFactory) NewRunServer(l logging.Logger, next router.RunServerFunc) RunServer {
-	return RunServer(server.New(
+	return NewGracefulRunServer(l, d.Health, RunServer(server.New(
 		l,
 		server.RunServer(cors.NewRunServer(cors.NewRunServerWithLogger(cors.RunServer(next), l))),
-	))
+	)))
 }
 
 // LoggerBuilder is the default BuilderFactory implementation.
 type LoggerBuilder struct{}
 
-// NewLogger sets up the logging components as defined at the configuration.
+// NewLogger sets up the logging components as defined at the configuration. The structured logger is
+// preferred over the logstash and the gologging ones, and it writes to the GELF writer only if its config
+// requires it.
 func (LoggerBuilder) NewLogger(cfg config.ServiceConfig) (logging.Logger, io.Writer, error) {
 	var writers []io.Writer
 	gelfWriter, gelfErr := gelf.NewWriter(cfg.ExtraConfig)
+
+	var zapWriter io.Writer
+	if gelfErr == nil {
+		zapWriter = gelfWriter
+	}
+	zapLogger, zapErr := zaplog.NewLogger(cfg, zapWriter)
+	if zapErr == nil {
+		if gelfErr != nil {
+			zapLogger.Error("unable to create the GELF writer:", gelfErr.Error())
+		}
+		return zapLogger, gelfWriter, nil
+	}
+
 	if gelfErr == nil {
 		writers = append(writers, gelfWriterWrapper{gelfWriter})
 		gologging.SetFormatterSelector(func(w io.Writer) string {
@@ -249,20 +420,57 @@ func (LoggerBuilder) NewLogger(cfg config.ServiceConfig) (logging.Logger, io.Wri
 			logger.Error("unable to create the gologging logger:", gologgingErr.Error())
 		}
 	}
+	if zapErr != zaplog.ErrNoConfig {
+		logger.Error("unable to create the zap logger:", zapErr.Error())
+	}
 	if gelfErr != nil {
 		logger.Error("unable to create the GELF writer:", gelfErr.Error())
 	}
 	return logger, gelfWriter, nil
 }
 
-// BloomFilterJWT is the default TokenRejecterFactory implementation.
+// BloomFilterJWT is a TokenRejecterFactory implementation without revocation registry.
 type BloomFilterJWT struct{}
 
 // NewTokenRejecter registers the bloomfilter component and links it to a token rejecter. Then it returns a chained
 // rejecter factory with the created token rejecter and other based on the CEL component.
 func (t BloomFilterJWT) NewTokenRejecter(ctx context.Context, cfg config.ServiceConfig, l logging.Logger, reg func(n string, p int)) (jose.ChainedRejecterFactory, error) {
 	rejecter, err := krakendbf.Register(ctx, "krakend-bf", cfg, l, reg)
+	return newChainedRejecterFactory(rejecter), err
+}
+
+// RevocableBloomFilterJWT is the default TokenRejecterFactory implementation. It works like the BloomFilterJWT,
+// but it also keeps the tokens revoked through the admin API in a revocation registry.
+type RevocableBloomFilterJWT struct {
+	registry *revocation.Registry
+}
+
+// NewTokenRejecter registers the bloomfilter component and the revocation registry using it. Then it returns
+// the same chained rejecter factory as the BloomFilterJWT.
+func (t *RevocableBloomFilterJWT) NewTokenRejecter(ctx context.Context, cfg config.ServiceConfig, l logging.Logger, reg func(n string, p int)) (jose.ChainedRejecterFactory, error) {
+	rejecter, err := krakendbf.Register(ctx, "krakend-bf", cfg, l, reg)
+	if err != nil {
+		return newChainedRejecterFactory(rejecter), err
+	}
+
+	var filterTTL time.Duration
+	if bf, ok := rejecter.BF.(*rotate.Bloomfilter); ok {
+		filterTTL = time.Duration(bf.Config.TTL) * time.Second
+	}
+	registry, rErr := revocation.New(ctx, cfg.ExtraConfig, rejecter.BF, rejecter.TokenKeys, filterTTL, l)
+	if rErr != nil {
+		l.Warning(rErr.Error())
+	}
+	t.registry = registry
+	return newChainedRejecterFactory(rejecter), nil
+}
+
+// RevocationRegistry implements the TokenRevoker interface
+func (t *RevocableBloomFilterJWT) RevocationRegistry() *revocation.Registry {
+	return t.registry
+}
 
+func newChainedRejecterFactory(rejecter krakendbf.Rejecter) jose.ChainedRejecterFactory {
 	return jose.ChainedRejecterFactory([]jose.RejecterFactory{
 		jose.RejecterFactoryFunc(func(_ logging.Logger, _ *config.EndpointConfig) jose.Rejecter {
 			return jose.RejecterFunc(rejecter.RejectToken)
@@ -273,27 +481,79 @@ func (t BloomFilterJWT) NewTokenRejecter(ctx context.Context, cfg config.Service
 			}
 			return jose.FixedRejecter(false)
 		}),
-	}), err
+	})
+}
+
+// ObservabilityFlusher is implemented by the MetricsAndTracesRegister able to report when the registered
+// components have flushed their data after the cancellation of their context
+type ObservabilityFlusher interface {
+	Flushed() <-chan struct{}
 }
 
 // MetricsAndTraces is the default implementation of the MetricsAndTracesRegister interface.
-type MetricsAndTraces struct{}
+type MetricsAndTraces struct {
+	err error
+	// flushed contains the channels closed by the components once they are flushed
+	flushed []<-chan struct{}
+}
 
-// Register registers the metrcis, influx and opencensus packages as required by the given configuration.
-func (MetricsAndTraces) Register(ctx context.Context, cfg config.ServiceConfig, l logging.Logger) *metrics.Metrics {
+// Register registers the metrcis, prometheus, influx, opencensus and opentelemetry packages as required by the given configuration.
+func (m *MetricsAndTraces) Register(ctx context.Context, cfg config.ServiceConfig, l logging.Logger) *metrics.Metrics {
 	metricCollector := metrics.New(ctx, cfg.ExtraConfig, l)
 
+	if err := prometheus.Register(ctx, cfg.ExtraConfig, metricCollector, l); err != nil {
+		l.Warning(err.Error())
+		m.err = err
+	}
+
 	if err := influxdb.New(ctx, cfg.ExtraConfig, metricCollector, l); err != nil {
 		l.Warning(err.Error())
+		if _, ok := cfg.ExtraConfig[influxdb.Namespace]; ok {
+			m.err = fmt.Errorf("influxdb: %s", err.Error())
+		}
 	}
 
-	if err := opencensus.Register(ctx, cfg, append(opencensus.DefaultViews, pubsub.OpenCensusViews...)...); err != nil {
+	if err := opencensus.Register(ctx, cfg, openCensusViews()...); err != nil {
 		l.Warning("opencensus:", err.Error())
+		if _, ok := cfg.ExtraConfig[opencensus.Namespace]; ok {
+			m.err = fmt.Errorf("opencensus: %s", err.Error())
+		}
+	}
+
+	otelFlushed, err := opentelemetry.RegisterWithDone(ctx, cfg, l)
+	if err != nil {
+		l.Warning(err.Error())
+		m.err = err
 	}
+	m.flushed = append(m.flushed, otelFlushed)
 
 	return metricCollector
 }
 
+// Flushed returns a channel closed once the registered components reporting their flush are done. The
+// opencensus exporters flush their data in the background without reporting it, so they are not waited.
+func (m *MetricsAndTraces) Flushed() <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for _, f := range m.flushed {
+			<-f
+		}
+		close(done)
+	}()
+	return done
+}
+
+// Health returns the last error registering the observability components, if any
+func (m *MetricsAndTraces) Health() error {
+	return m.err
+}
+
+func openCensusViews() []*view.View {
+	views := append([]*view.View{}, opencensus.DefaultViews...)
+	views = append(views, pubsub.OpenCensusViews...)
+	return append(views, retry.OpenCensusViews...)
+}
+
 const (
 	usageDisable = "USAGE_DISABLE"
 	usageDelay   = 5 * time.Second
@@ -0,0 +1,35 @@
+package krakend
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/luraproject/lura/config"
+)
+
+// parseExtraConfig decodes the content stored under the namespace of the extra config into v.
+// It returns false if the namespace is not defined.
+func parseExtraConfig(e config.ExtraConfig, namespace string, v interface{}) (bool, error) {
+	tmp, ok := e[namespace]
+	if !ok {
+		return false, nil
+	}
+	b, err := json.Marshal(tmp)
+	if err != nil {
+		return true, err
+	}
+	return true, json.Unmarshal(b, v)
+}
+
+// parseDuration parses the string s as a duration, returning the fallback value if s is empty
+// or not a valid duration
+func parseDuration(s string, fallback time.Duration) time.Duration {
+	if s == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
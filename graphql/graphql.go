@@ -0,0 +1,262 @@
+// Package graphql provides a backend middleware sending GraphQL queries built from the request and
+// returning the unwrapped data field of the response. The GraphQL errors are returned as backend errors.
+//
+// Sample backend extra config
+//
+//	...
+//	"url_pattern": "/graphql",
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/graphql": {
+//			"query_path": "./queries/user.graphql",
+//			"operation_name": "User",
+//			"variables": {"locale": "en"},
+//			"variable_mappings": {
+//				"id": "params.Id:int",
+//				"fields": "query.fields",
+//				"filter": "body.filter:json"
+//			}
+//		},
+//		...
+//	},
+//	...
+//
+// The mappings read the URL params (params.Name), the query string (query.name) and the JSON body (body for
+// the whole document or body.path.to.field for a nested one). The values from the params and the query
+// string are strings unless a type suffix (:int, :float, :bool or :json) is added.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/encoding"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"github.com/luraproject/lura/transport/http/client"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/graphql"
+
+// errorDetailsName is the name used to get the body of the failed responses from the http proxy
+const errorDetailsName = "graphql"
+
+var (
+	errNoConfig  = errors.New("graphql: no config")
+	errBadConfig = errors.New("graphql: unable to parse the config")
+	errNoQuery   = errors.New("graphql: no query defined")
+)
+
+// Config is the custom config struct containing the params for the GraphQL backend
+type Config struct {
+	Query            string                 `json:"query"`
+	QueryPath        string                 `json:"query_path"`
+	OperationName    string                 `json:"operation_name"`
+	Variables        map[string]interface{} `json:"variables"`
+	VariableMappings map[string]string      `json:"variable_mappings"`
+}
+
+func getConfig(remote *config.Backend) (Config, error) {
+	v, ok := remote.ExtraConfig[Namespace]
+	if !ok {
+		return Config{}, errNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, errBadConfig
+	}
+	if cfg.Query == "" && cfg.QueryPath != "" {
+		q, err := ioutil.ReadFile(cfg.QueryPath)
+		if err != nil {
+			return Config{}, fmt.Errorf("graphql: reading the query: %s", err.Error())
+		}
+		cfg.Query = string(q)
+	}
+	if cfg.Query == "" {
+		return Config{}, errNoQuery
+	}
+	return cfg, nil
+}
+
+// BackendFactory adds a GraphQL middleware wrapping the internal factory. The backends without the
+// GraphQL config are created by the internal factory as they are.
+func BackendFactory(logger logging.Logger, next proxy.BackendFactory) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		cfg, err := getConfig(remote)
+		if err != nil {
+			if err != errNoConfig {
+				logger.Error(err.Error(), remote.ExtraConfig[Namespace])
+			}
+			return next(remote)
+		}
+
+		mappings, err := parseMappings(cfg.VariableMappings)
+		if err != nil {
+			logger.Error("graphql:", err.Error())
+			return next(remote)
+		}
+
+		p := next(rawBackend(remote))
+		ef := proxy.NewEntityFormatter(remote)
+		detailsName := errorDetailsFor(remote)
+
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			variables, err := buildVariables(cfg.Variables, mappings, request)
+			if err != nil {
+				return nil, err
+			}
+			body, err := json.Marshal(graphQLRequest{
+				Query:         cfg.Query,
+				OperationName: cfg.OperationName,
+				Variables:     variables,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			r := request.Clone()
+			r.Method = http.MethodPost
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.Headers = make(map[string][]string, len(request.Headers)+2)
+			for k, v := range request.Headers {
+				r.Headers[k] = v
+			}
+			r.Headers["Content-Type"] = []string{"application/json"}
+			r.Headers["Content-Length"] = []string{strconv.Itoa(len(body))}
+
+			resp, err := p(ctx, &r)
+			if err != nil {
+				return nil, err
+			}
+			if resp == nil {
+				return nil, errors.New("graphql: empty response")
+			}
+
+			statusCode := resp.Metadata.StatusCode
+			data := resp.Data
+			if details, ok := data["error_"+errorDetailsName].(client.HTTPResponseError); ok {
+				statusCode = details.StatusCode()
+				data = map[string]interface{}{}
+				if err := json.Unmarshal([]byte(details.Msg), &data); err != nil {
+					return nil, newError(statusCode, nil, detailsName)
+				}
+			}
+
+			if errs, ok := data["errors"].([]interface{}); ok && len(errs) > 0 {
+				gqlErr := newError(statusCode, errs, detailsName)
+				if detailsName == "" {
+					return nil, gqlErr
+				}
+				// the response keeps the details, as the http proxy does, and the error is returned
+				// anyway so the circuit breaker accounts for it
+				return &proxy.Response{
+					Data:     map[string]interface{}{"error_" + detailsName: gqlErr},
+					Metadata: proxy.Metadata{StatusCode: gqlErr.StatusCode(), Headers: resp.Metadata.Headers},
+				}, gqlErr
+			}
+
+			unwrapped, _ := data["data"].(map[string]interface{})
+			if unwrapped == nil {
+				unwrapped = map[string]interface{}{}
+			}
+			formatted := ef.Format(proxy.Response{
+				Data:       unwrapped,
+				IsComplete: resp.IsComplete,
+				Metadata:   resp.Metadata,
+			})
+			return &formatted, nil
+		}
+	}
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// rawBackend returns a copy of the backend config without the response manipulations, so they are applied
+// over the unwrapped data instead of the GraphQL envelope. The failed responses keep their body, so the
+// GraphQL errors can be parsed.
+func rawBackend(remote *config.Backend) *config.Backend {
+	raw := *remote
+	raw.Method = http.MethodPost
+	raw.Encoding = encoding.JSON
+	raw.Decoder = encoding.NewJSONDecoder(false)
+	raw.IsCollection = false
+	raw.Target = ""
+	raw.Group = ""
+	raw.Mapping = nil
+	raw.Blacklist = nil
+	raw.Whitelist = nil
+	raw.AllowList = nil
+	raw.DenyList = nil
+
+	raw.ExtraConfig = make(config.ExtraConfig, len(remote.ExtraConfig))
+	for k, v := range remote.ExtraConfig {
+		if k == proxy.Namespace {
+			continue
+		}
+		raw.ExtraConfig[k] = v
+	}
+	raw.ExtraConfig[client.Namespace] = map[string]interface{}{"return_error_details": errorDetailsName}
+	return &raw
+}
+
+// errorDetailsFor returns the name defined for the error details of the backend, if any
+func errorDetailsFor(remote *config.Backend) string {
+	if m, ok := remote.ExtraConfig[client.Namespace].(map[string]interface{}); ok {
+		if name, ok := m["return_error_details"].(string); ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// Error is the backend error containing the GraphQL errors
+type Error struct {
+	Code   int           `json:"http_status_code"`
+	Errors []interface{} `json:"errors,omitempty"`
+	name   string
+}
+
+func newError(statusCode int, errs []interface{}, name string) Error {
+	if statusCode < http.StatusBadRequest {
+		statusCode = http.StatusInternalServerError
+	}
+	return Error{Code: statusCode, Errors: errs, name: name}
+}
+
+// Error returns the message of the first GraphQL error
+func (e Error) Error() string {
+	if len(e.Errors) > 0 {
+		if m, ok := e.Errors[0].(map[string]interface{}); ok {
+			if msg, ok := m["message"].(string); ok {
+				return "graphql: " + msg
+			}
+		}
+	}
+	return fmt.Sprintf("graphql: request failed with status %d", e.Code)
+}
+
+// Name returns the name of the backend defined for the error details
+func (e Error) Name() string {
+	return e.name
+}
+
+// StatusCode returns the status code to use in the response
+func (e Error) StatusCode() int {
+	return e.Code
+}
@@ -0,0 +1,235 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"github.com/luraproject/lura/transport/http/client"
+)
+
+func TestBackendFactory_variables(t *testing.T) {
+	var received graphQLRequest
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data":{"user":{"id":42,"name":"alice","email":"alice@example.com"}}}`))
+	}))
+	defer s.Close()
+
+	remote := newBackend(s.URL, map[string]interface{}{
+		"query":          "query User($id: Int!) { user(id: $id) { id name email } }",
+		"operation_name": "User",
+		"variables":      map[string]interface{}{"locale": "en", "id": 0},
+		"variable_mappings": map[string]string{
+			"id":      "params.Id:int",
+			"fields":  "query.fields",
+			"limit":   "query.limit:int",
+			"filter":  "body.filter:json",
+			"active":  "body.nested.active",
+			"missing": "query.missing",
+		},
+	})
+	remote.Target = "user"
+	remote.Blacklist = []string{"email"}
+
+	resp, err := BackendFactory(logging.NoOp, httpProxy)(remote)(context.Background(), newRequest(t, s.URL,
+		map[string]string{"Id": "42"},
+		url.Values{"fields": {"name"}, "limit": {"10"}},
+		`{"filter":"{\"role\":\"admin\"}","nested":{"active":true}}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received.OperationName != "User" || !strings.HasPrefix(received.Query, "query User") {
+		t.Errorf("unexpected query: %+v", received)
+	}
+	expected := map[string]interface{}{
+		"locale": "en",
+		"id":     float64(42),
+		"fields": "name",
+		"limit":  float64(10),
+		"filter": map[string]interface{}{"role": "admin"},
+		"active": true,
+	}
+	if !reflect.DeepEqual(received.Variables, expected) {
+		t.Errorf("unexpected variables: %v", received.Variables)
+	}
+	if !reflect.DeepEqual(resp.Data, map[string]interface{}{"id": json.Number("42"), "name": "alice"}) {
+		t.Errorf("the response manipulations were not applied to the unwrapped data: %v", resp.Data)
+	}
+}
+
+func TestBackendFactory_errors(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		status     int
+		body       string
+		details    bool
+		message    string
+		statusCode int
+	}{
+		{name: "graphql errors", status: 200, body: `{"errors":[{"message":"user not found"}]}`, message: "graphql: user not found", statusCode: 500},
+		{name: "failed request", status: 400, body: `{"errors":[{"message":"syntax error"}]}`, message: "graphql: syntax error", statusCode: 400},
+		{name: "non json failure", status: 502, body: `bad gateway`, message: "graphql: request failed with status 502", statusCode: 502},
+		{name: "graphql errors with details", status: 200, body: `{"errors":[{"message":"user not found"}]}`, details: true, message: "graphql: user not found", statusCode: 500},
+		{name: "failed request with details", status: 403, body: `{"errors":[{"message":"forbidden"}]}`, details: true, message: "graphql: forbidden", statusCode: 403},
+	} {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tc.status)
+			w.Write([]byte(tc.body))
+		}))
+
+		remote := newBackend(s.URL, map[string]interface{}{"query": "{ user { name } }"})
+		if tc.details {
+			remote.ExtraConfig[client.Namespace] = map[string]interface{}{"return_error_details": "users"}
+		}
+		resp, err := BackendFactory(logging.NoOp, httpProxy)(remote)(context.Background(), newRequest(t, s.URL, nil, nil, ""))
+		s.Close()
+
+		gqlErr, ok := err.(Error)
+		if !ok {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if gqlErr.Error() != tc.message || gqlErr.StatusCode() != tc.statusCode {
+			t.Errorf("%s: unexpected error: %s (%d)", tc.name, gqlErr.Error(), gqlErr.StatusCode())
+		}
+		if !tc.details {
+			if resp != nil {
+				t.Errorf("%s: unexpected response: %v", tc.name, resp)
+			}
+			continue
+		}
+		if gqlErr.Name() != "users" || resp == nil || resp.Metadata.StatusCode != tc.statusCode {
+			t.Errorf("%s: unexpected response: %v", tc.name, resp)
+			continue
+		}
+		if details, ok := resp.Data["error_users"].(Error); !ok || !reflect.DeepEqual(details, gqlErr) {
+			t.Errorf("%s: unexpected error details: %v", tc.name, resp.Data)
+		}
+	}
+}
+
+func TestBackendFactory_badVariable(t *testing.T) {
+	called := false
+	next := func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			called = true
+			return nil, nil
+		}
+	}
+	remote := newBackend("http://example.com", map[string]interface{}{
+		"query":             "{ user { name } }",
+		"variable_mappings": map[string]string{"id": "params.Id:int"},
+	})
+	_, err := BackendFactory(logging.NoOp, next)(remote)(context.Background(), &proxy.Request{Params: map[string]string{"Id": "abc"}})
+	if err == nil || !strings.HasPrefix(err.Error(), "graphql: invalid value for the variable id") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if called {
+		t.Error("the backend should not be called")
+	}
+}
+
+func TestParseMappings(t *testing.T) {
+	m, err := parseMappings(map[string]string{
+		"a": "params.Id:int",
+		"b": "query.q",
+		"c": "body",
+		"d": "body.x.y:json",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]mapping{
+		"a": {source: sourceParams, path: []string{"Id"}, kind: "int"},
+		"b": {source: sourceQuery, path: []string{"q"}},
+		"c": {source: sourceBody, path: []string{}},
+		"d": {source: sourceBody, path: []string{"x", "y"}, kind: "json"},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("unexpected mappings: %+v", m)
+	}
+
+	for _, def := range []string{"params.Id:uint", "params", "query.a.b", "header.X"} {
+		if _, err := parseMappings(map[string]string{"v": def}); err == nil {
+			t.Errorf("expecting an error with the mapping %q", def)
+		}
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "query.graphql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("{ user { name } }")
+
+	cfg, err := getConfig(&config.Backend{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"query_path": f.Name()}}})
+	if err != nil || cfg.Query != "{ user { name } }" {
+		t.Errorf("unexpected config: %+v %v", cfg, err)
+	}
+
+	for _, tc := range []struct {
+		extra    config.ExtraConfig
+		expected error
+	}{
+		{extra: config.ExtraConfig{}, expected: errNoConfig},
+		{extra: config.ExtraConfig{Namespace: "query"}, expected: errBadConfig},
+		{extra: config.ExtraConfig{Namespace: map[string]interface{}{}}, expected: errNoQuery},
+	} {
+		if _, err := getConfig(&config.Backend{ExtraConfig: tc.extra}); err != tc.expected {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func httpProxy(remote *config.Backend) proxy.Proxy {
+	return proxy.NewHTTPProxyWithHTTPExecutor(remote, client.DefaultHTTPRequestExecutor(client.NewHTTPClient), remote.Decoder)
+}
+
+func newBackend(host string, extra map[string]interface{}) *config.Backend {
+	return &config.Backend{
+		Method:      http.MethodGet,
+		Host:        []string{host},
+		URLPattern:  "/graphql",
+		ExtraConfig: config.ExtraConfig{Namespace: extra},
+	}
+}
+
+func newRequest(t *testing.T, host string, params map[string]string, query url.Values, body string) *proxy.Request {
+	u, err := url.Parse(host + "/graphql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &proxy.Request{
+		Method:  http.MethodGet,
+		Path:    "/graphql",
+		URL:     u,
+		Params:  params,
+		Query:   query,
+		Headers: map[string][]string{},
+	}
+	if body != "" {
+		r.Body = ioutil.NopCloser(strings.NewReader(body))
+	}
+	return r
+}
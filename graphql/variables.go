@@ -0,0 +1,163 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/luraproject/lura/proxy"
+)
+
+const (
+	sourceParams = "params"
+	sourceQuery  = "query"
+	sourceBody   = "body"
+)
+
+// mapping defines where the value of a variable is taken from
+type mapping struct {
+	source string
+	path   []string
+	kind   string
+}
+
+func parseMappings(m map[string]string) (map[string]mapping, error) {
+	res := make(map[string]mapping, len(m))
+	for name, def := range m {
+		kind := ""
+		if i := strings.LastIndex(def, ":"); i > 0 {
+			def, kind = def[:i], def[i+1:]
+			switch kind {
+			case "string", "int", "float", "bool", "json":
+			default:
+				return nil, fmt.Errorf("unknown type %q for the variable %s", kind, name)
+			}
+		}
+		parts := strings.Split(def, ".")
+		switch parts[0] {
+		case sourceParams, sourceQuery:
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid mapping %q for the variable %s", def, name)
+			}
+		case sourceBody:
+		default:
+			return nil, fmt.Errorf("unknown source %q for the variable %s", parts[0], name)
+		}
+		res[name] = mapping{source: parts[0], path: parts[1:], kind: kind}
+	}
+	return res, nil
+}
+
+// buildVariables merges the static variables with the ones mapped from the request
+func buildVariables(static map[string]interface{}, mappings map[string]mapping, r *proxy.Request) (map[string]interface{}, error) {
+	vars := make(map[string]interface{}, len(static)+len(mappings))
+	for k, v := range static {
+		vars[k] = v
+	}
+
+	var body interface{}
+	bodyParsed := false
+
+	for name, m := range mappings {
+		var v interface{}
+		var ok bool
+		switch m.source {
+		case sourceParams:
+			v, ok = lookupParam(r.Params, m.path[0])
+		case sourceQuery:
+			if vs, found := r.Query[m.path[0]]; found && len(vs) > 0 {
+				v, ok = vs[0], true
+			}
+		case sourceBody:
+			if !bodyParsed {
+				bodyParsed = true
+				var err error
+				if body, err = parseBody(r); err != nil {
+					return nil, err
+				}
+			}
+			v, ok = lookupPath(body, m.path)
+		}
+		if !ok {
+			continue
+		}
+
+		s, isString := v.(string)
+		if !isString || m.kind == "" || m.kind == "string" {
+			vars[name] = v
+			continue
+		}
+		typed, err := convert(s, m.kind)
+		if err != nil {
+			return nil, fmt.Errorf("graphql: invalid value for the variable %s: %s", name, err.Error())
+		}
+		vars[name] = typed
+	}
+	return vars, nil
+}
+
+// lookupParam finds the param ignoring the case, as the router capitalizes the param names
+func lookupParam(params map[string]string, name string) (string, bool) {
+	if v, ok := params[name]; ok {
+		return v, true
+	}
+	for k, v := range params {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func parseBody(r *proxy.Request) (interface{}, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(b))) == 0 {
+		return nil, nil
+	}
+	var body interface{}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, fmt.Errorf("graphql: decoding the request body: %s", err.Error())
+	}
+	return body, nil
+}
+
+func lookupPath(v interface{}, path []string) (interface{}, bool) {
+	if v == nil {
+		return nil, false
+	}
+	for _, k := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func convert(s, kind string) (interface{}, error) {
+	switch kind {
+	case "int":
+		return strconv.ParseInt(s, 10, 64)
+	case "float":
+		return strconv.ParseFloat(s, 64)
+	case "bool":
+		return strconv.ParseBool(s)
+	case "json":
+		var v interface{}
+		err := json.Unmarshal([]byte(s), &v)
+		return v, err
+	}
+	return s, nil
+}
@@ -0,0 +1,93 @@
+package grpc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// descriptorLoader parses the descriptor sets once and keeps the resulting registries
+type descriptorLoader struct {
+	mu    sync.Mutex
+	files map[string]*protoregistry.Files
+}
+
+func newDescriptorLoader() *descriptorLoader {
+	return &descriptorLoader{files: map[string]*protoregistry.Files{}}
+}
+
+// method returns the descriptor of the method defined by the descriptor sets. The name accepts both the
+// package.Service/Method and the package.Service.Method formats.
+func (d *descriptorLoader) method(paths []string, name string) (protoreflect.MethodDescriptor, error) {
+	files, err := d.load(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	name = strings.TrimPrefix(name, "/")
+	sep := strings.LastIndexAny(name, "/.")
+	if sep <= 0 || sep == len(name)-1 {
+		return nil, fmt.Errorf("invalid method name %q", name)
+	}
+
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(name[:sep]))
+	if err != nil {
+		return nil, fmt.Errorf("service %q: %s", name[:sep], err.Error())
+	}
+	service, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a service", name[:sep])
+	}
+	method := service.Methods().ByName(protoreflect.Name(name[sep+1:]))
+	if method == nil {
+		return nil, fmt.Errorf("method %q not found in the service %q", name[sep+1:], name[:sep])
+	}
+	if method.IsStreamingClient() || method.IsStreamingServer() {
+		return nil, fmt.Errorf("method %q is not unary", name)
+	}
+	return method, nil
+}
+
+func (d *descriptorLoader) load(paths []string) (*protoregistry.Files, error) {
+	key := strings.Join(paths, ",")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if files, ok := d.files[key]; ok {
+		return files, nil
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]struct{}{}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		fds := &descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(b, fds); err != nil {
+			return nil, fmt.Errorf("parsing the descriptor set %s: %s", path, err.Error())
+		}
+		for _, f := range fds.File {
+			if _, ok := seen[f.GetName()]; ok {
+				continue
+			}
+			seen[f.GetName()] = struct{}{}
+			set.File = append(set.File, f)
+		}
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	d.files[key] = files
+	return files, nil
+}
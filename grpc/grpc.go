@@ -0,0 +1,226 @@
+// Package grpc provides a backend factory calling unary gRPC methods. The request message is built from the
+// request params, query string and JSON body, and the response message is converted into the data map of
+// the proxy response, so the merging, filtering and flatmap features keep working.
+//
+// Sample backend extra config
+//
+//	...
+//	"host": ["localhost:50051"],
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/grpc": {
+//			"descriptor_sets": ["./protos/greeter.pb"],
+//			"method": "helloworld.Greeter/SayHello",
+//			"use_proto_names": true,
+//			"emit_unpopulated": false
+//		},
+//		...
+//	},
+//	...
+//
+// The descriptor sets can be generated with protoc --include_imports --descriptor_set_out. The hosts with
+// the https scheme are dialed using TLS.
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gogrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/grpc"
+
+var (
+	errNoConfig  = errors.New("grpc: no config")
+	errBadConfig = errors.New("grpc: unable to parse the config")
+	errNoHost    = errors.New("grpc: no host defined for the request")
+)
+
+// Config is the custom config struct containing the params for the gRPC backend
+type Config struct {
+	DescriptorSets  []string `json:"descriptor_sets"`
+	Method          string   `json:"method"`
+	UseProtoNames   bool     `json:"use_proto_names"`
+	EmitUnpopulated bool     `json:"emit_unpopulated"`
+}
+
+func getConfig(remote *config.Backend) (Config, error) {
+	v, ok := remote.ExtraConfig[Namespace]
+	if !ok {
+		return Config{}, errNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, errBadConfig
+	}
+	if len(cfg.DescriptorSets) == 0 || cfg.Method == "" {
+		return Config{}, errBadConfig
+	}
+	return cfg, nil
+}
+
+// BackendFactory returns a backend factory creating gRPC proxies for the backends with the gRPC config.
+// The rest of the backends are created by the next factory. The connections are closed once the
+// context is cancelled.
+func BackendFactory(ctx context.Context, logger logging.Logger, next proxy.BackendFactory) proxy.BackendFactory {
+	f := &backendFactory{
+		logger:      logger,
+		next:        next,
+		descriptors: newDescriptorLoader(),
+		conns:       newConnPool(ctx),
+	}
+	return f.New
+}
+
+type backendFactory struct {
+	logger      logging.Logger
+	next        proxy.BackendFactory
+	descriptors *descriptorLoader
+	conns       *connPool
+}
+
+func (f *backendFactory) New(remote *config.Backend) proxy.Proxy {
+	cfg, err := getConfig(remote)
+	if err != nil {
+		if err != errNoConfig {
+			f.logger.Error(err.Error(), remote.ExtraConfig[Namespace])
+		}
+		return f.next(remote)
+	}
+
+	method, err := f.descriptors.method(cfg.DescriptorSets, cfg.Method)
+	if err != nil {
+		f.logger.Error("grpc:", err.Error())
+		return f.next(remote)
+	}
+
+	fullMethod := fmt.Sprintf("/%s/%s", method.Parent().FullName(), method.Name())
+	marshaler := protojson.MarshalOptions{UseProtoNames: cfg.UseProtoNames, EmitUnpopulated: cfg.EmitUnpopulated}
+	ef := proxy.NewEntityFormatter(remote)
+
+	return func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		if r.URL == nil || r.URL.Host == "" {
+			return nil, errNoHost
+		}
+		conn, err := f.conns.get(r.URL.Scheme, r.URL.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		in := dynamicpb.NewMessage(method.Input())
+		if err := buildRequest(in, r); err != nil {
+			return nil, err
+		}
+		out := dynamicpb.NewMessage(method.Output())
+
+		ctx = metadata.NewOutgoingContext(ctx, outgoingMetadata(r.Headers))
+		var header metadata.MD
+		if err := conn.Invoke(ctx, fullMethod, in, out, gogrpc.Header(&header)); err != nil {
+			return nil, err
+		}
+
+		b, err := marshaler.Marshal(out)
+		if err != nil {
+			return nil, err
+		}
+		data := map[string]interface{}{}
+		if err := json.Unmarshal(b, &data); err != nil {
+			return nil, err
+		}
+
+		response := ef.Format(proxy.Response{
+			Metadata: proxy.Metadata{
+				StatusCode: 200,
+				Headers:    incomingHeaders(header),
+			},
+			Data:       data,
+			IsComplete: true,
+		})
+		return &response, nil
+	}
+}
+
+// outgoingMetadata forwards the request headers as gRPC metadata
+func outgoingMetadata(headers map[string][]string) metadata.MD {
+	md := metadata.MD{}
+	for k, vs := range headers {
+		k = strings.ToLower(k)
+		if k == "content-length" || k == "content-type" || k == "connection" || k == "te" {
+			continue
+		}
+		md[k] = append(md[k], vs...)
+	}
+	return md
+}
+
+func incomingHeaders(md metadata.MD) map[string][]string {
+	headers := map[string][]string{}
+	for k, vs := range md {
+		headers[k] = vs
+	}
+	return headers
+}
+
+// connPool keeps a single connection per target
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*gogrpc.ClientConn
+	ctx   context.Context
+}
+
+func newConnPool(ctx context.Context) *connPool {
+	p := &connPool{conns: map[string]*gogrpc.ClientConn{}, ctx: ctx}
+	go func() {
+		<-ctx.Done()
+		p.mu.Lock()
+		for k, c := range p.conns {
+			c.Close()
+			delete(p.conns, k)
+		}
+		p.mu.Unlock()
+	}()
+	return p
+}
+
+func (p *connPool) get(scheme, target string) (*gogrpc.ClientConn, error) {
+	key := scheme + "://" + target
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.conns[key]; ok {
+		return c, nil
+	}
+	if err := p.ctx.Err(); err != nil {
+		return nil, err
+	}
+	c, err := gogrpc.Dial(target, dialOptions(scheme)...)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[key] = c
+	return c, nil
+}
+
+func dialOptions(scheme string) []gogrpc.DialOption {
+	if scheme == "https" {
+		return []gogrpc.DialOption{gogrpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))}
+	}
+	return []gogrpc.DialOption{gogrpc.WithInsecure()}
+}
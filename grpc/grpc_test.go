@@ -0,0 +1,241 @@
+package grpc
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gogrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestBackendFactory(t *testing.T) {
+	fdp := greeterDescriptor()
+	descriptorSet := writeDescriptorSet(t, fdp)
+
+	fd, err := protodesc.NewFile(fdp, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := fd.Services().ByName("Greeter")
+	method := service.Methods().ByName("SayHello")
+
+	addr := startServer(t, method)
+
+	remote := &config.Backend{
+		Method: "GET",
+		Host:   []string{"http://" + addr},
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"descriptor_sets": []interface{}{descriptorSet},
+				"method":          "test.Greeter/SayHello",
+				"use_proto_names": true,
+			},
+		},
+		Blacklist: []string{"ignored"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logger := logging.NoOp
+	bf := BackendFactory(ctx, logger, func(_ *config.Backend) proxy.Proxy {
+		t.Error("the fallback backend factory should not be called")
+		return proxy.NoopProxy
+	})
+	p := bf(remote)
+
+	u, _ := url.Parse("http://" + addr + "/ignored")
+	resp, err := p(ctx, &proxy.Request{
+		Method:  "GET",
+		URL:     u,
+		Params:  map[string]string{"Id": "42"},
+		Query:   url.Values{"tags": []string{"a", "b"}, "meta.lang": []string{"en"}},
+		Headers: map[string][]string{"X-Tenant": {"acme"}},
+		Body:    ioutil.NopCloser(bytes.NewBufferString(`{"name":"gopher"}`)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsComplete {
+		t.Error("the response should be complete")
+	}
+
+	if v, ok := resp.Data["greeting"]; !ok || v != "hello gopher from acme in en" {
+		t.Errorf("unexpected greeting: %v", resp.Data)
+	}
+	// int64 values are encoded as strings by protojson
+	if v := resp.Data["user_id"]; v != "42" {
+		t.Errorf("unexpected user_id: %v", v)
+	}
+	if v, ok := resp.Data["tags"].([]interface{}); !ok || len(v) != 2 {
+		t.Errorf("unexpected tags: %v", resp.Data["tags"])
+	}
+	if _, ok := resp.Data["ignored"]; ok {
+		t.Error("the blacklisted field should be filtered")
+	}
+}
+
+func TestBackendFactory_fallback(t *testing.T) {
+	called := false
+	bf := BackendFactory(context.Background(), logging.NoOp, func(_ *config.Backend) proxy.Proxy {
+		called = true
+		return proxy.NoopProxy
+	})
+	bf(&config.Backend{ExtraConfig: config.ExtraConfig{}})
+	if !called {
+		t.Error("the fallback backend factory should be used for backends without config")
+	}
+
+	called = false
+	bf(&config.Backend{ExtraConfig: config.ExtraConfig{
+		Namespace: map[string]interface{}{
+			"descriptor_sets": []interface{}{"unknown.pb"},
+			"method":          "test.Greeter/SayHello",
+		},
+	}})
+	if !called {
+		t.Error("the fallback backend factory should be used for backends with invalid descriptors")
+	}
+}
+
+// startServer runs a gRPC server implementing the method with dynamic messages
+func startServer(t *testing.T, method protoreflect.MethodDescriptor) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := gogrpc.NewServer(gogrpc.UnknownServiceHandler(func(_ interface{}, stream gogrpc.ServerStream) error {
+		in := dynamicpb.NewMessage(method.Input())
+		if err := stream.RecvMsg(in); err != nil {
+			return err
+		}
+		md, _ := metadata.FromIncomingContext(stream.Context())
+
+		inFields := method.Input().Fields()
+		meta := in.Get(inFields.ByName("meta")).Message()
+		lang := meta.Get(meta.Descriptor().Fields().ByName("lang")).String()
+
+		out := dynamicpb.NewMessage(method.Output())
+		outFields := method.Output().Fields()
+		tenant := ""
+		if v := md.Get("x-tenant"); len(v) > 0 {
+			tenant = v[0]
+		}
+		out.Set(outFields.ByName("greeting"), protoreflect.ValueOfString(
+			"hello "+in.Get(inFields.ByName("name")).String()+" from "+tenant+" in "+lang,
+		))
+		out.Set(outFields.ByName("user_id"), in.Get(inFields.ByName("id")))
+		inTags := in.Get(inFields.ByName("tags")).List()
+		outTags := out.Mutable(outFields.ByName("tags")).List()
+		for i := 0; i < inTags.Len(); i++ {
+			outTags.Append(inTags.Get(i))
+		}
+		out.Set(outFields.ByName("ignored"), protoreflect.ValueOfString("secret"))
+		return stream.SendMsg(out)
+	}))
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	return l.Addr().String()
+}
+
+func writeDescriptorSet(t *testing.T, fdp *descriptorpb.FileDescriptorProto) string {
+	b, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fdp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "greeter.pb")
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// greeterDescriptor describes the following proto file:
+//
+//	syntax = "proto3";
+//	package test;
+//	message Meta { string lang = 1; }
+//	message HelloRequest { int64 id = 1; string name = 2; repeated string tags = 3; Meta meta = 4; }
+//	message HelloReply { string greeting = 1; int64 user_id = 2; repeated string tags = 3; string ignored = 4; }
+//	service Greeter { rpc SayHello (HelloRequest) returns (HelloReply); }
+func greeterDescriptor() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, repeated bool) *descriptorpb.FieldDescriptorProto {
+		label := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		if repeated {
+			label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		}
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Type:     kind.Enum(),
+			Label:    label.Enum(),
+		}
+	}
+	meta := field("meta", 4, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, false)
+	meta.TypeName = proto.String(".test.Meta")
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("greeter.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name:  proto.String("Meta"),
+				Field: []*descriptorpb.FieldDescriptorProto{field("lang", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, false)},
+			},
+			{
+				Name: proto.String("HelloRequest"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT64, false),
+					field("name", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, false),
+					field("tags", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, true),
+					meta,
+				},
+			},
+			{
+				Name: proto.String("HelloReply"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("greeting", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, false),
+					field("user_id", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, false),
+					field("tags", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, true),
+					field("ignored", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING, false),
+				},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{
+			{
+				Name: proto.String("Greeter"),
+				Method: []*descriptorpb.MethodDescriptorProto{
+					{
+						Name:       proto.String("SayHello"),
+						InputType:  proto.String(".test.HelloRequest"),
+						OutputType: proto.String(".test.HelloReply"),
+					},
+				},
+			},
+		},
+	}
+}
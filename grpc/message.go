@@ -0,0 +1,147 @@
+package grpc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/luraproject/lura/proxy"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+var unmarshaler = protojson.UnmarshalOptions{DiscardUnknown: true}
+
+// buildRequest populates the message with the JSON body, the query string and the params of the request,
+// in that order, so the params take precedence. The query string keys accept dots to reach nested fields.
+func buildRequest(msg protoreflect.Message, r *proxy.Request) error {
+	if r.Body != nil {
+		b, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(strings.TrimSpace(string(b))) > 0 {
+			if err := unmarshaler.Unmarshal(b, msg.Interface()); err != nil {
+				return fmt.Errorf("grpc: decoding the request body: %s", err.Error())
+			}
+		}
+	}
+
+	for k, vs := range r.Query {
+		if err := setPath(msg, strings.Split(k, "."), vs); err != nil {
+			return err
+		}
+	}
+	for k, v := range r.Params {
+		if err := setPath(msg, []string{k}, []string{v}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPath assigns the values to the field reached by the path. Unknown fields are ignored.
+func setPath(msg protoreflect.Message, path []string, values []string) error {
+	fd := findField(msg.Descriptor(), path[0])
+	if fd == nil || len(values) == 0 {
+		return nil
+	}
+
+	if len(path) > 1 {
+		if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return nil
+		}
+		return setPath(msg.Mutable(fd).Message(), path[1:], values)
+	}
+
+	if fd.IsMap() || fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+		return nil
+	}
+
+	if fd.IsList() {
+		list := msg.Mutable(fd).List()
+		for _, s := range values {
+			v, err := parseScalar(fd, s)
+			if err != nil {
+				return err
+			}
+			list.Append(v)
+		}
+		return nil
+	}
+
+	v, err := parseScalar(fd, values[0])
+	if err != nil {
+		return err
+	}
+	msg.Set(fd, v)
+	return nil
+}
+
+// findField looks for the field by its proto or JSON name, ignoring the case, as the router capitalizes
+// the param names
+func findField(md protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	fields := md.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if strings.EqualFold(string(fd.Name()), name) || strings.EqualFold(fd.JSONName(), name) {
+			return fd
+		}
+	}
+	return nil
+}
+
+func parseScalar(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	var v protoreflect.Value
+	var err error
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		v = protoreflect.ValueOfString(s)
+	case protoreflect.BytesKind:
+		v = protoreflect.ValueOfBytes([]byte(s))
+	case protoreflect.BoolKind:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		v = protoreflect.ValueOfBool(b)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		var i int64
+		i, err = strconv.ParseInt(s, 10, 32)
+		v = protoreflect.ValueOfInt32(int32(i))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		var i int64
+		i, err = strconv.ParseInt(s, 10, 64)
+		v = protoreflect.ValueOfInt64(i)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		var i uint64
+		i, err = strconv.ParseUint(s, 10, 32)
+		v = protoreflect.ValueOfUint32(uint32(i))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		var i uint64
+		i, err = strconv.ParseUint(s, 10, 64)
+		v = protoreflect.ValueOfUint64(i)
+	case protoreflect.FloatKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 32)
+		v = protoreflect.ValueOfFloat32(float32(f))
+	case protoreflect.DoubleKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		v = protoreflect.ValueOfFloat64(f)
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			v = protoreflect.ValueOfEnum(ev.Number())
+			break
+		}
+		var i int64
+		i, err = strconv.ParseInt(s, 10, 32)
+		v = protoreflect.ValueOfEnum(protoreflect.EnumNumber(i))
+	default:
+		err = fmt.Errorf("unsupported kind %s", fd.Kind())
+	}
+	if err != nil {
+		return v, fmt.Errorf("grpc: invalid value %q for the field %s: %s", s, fd.Name(), err.Error())
+	}
+	return v, nil
+}
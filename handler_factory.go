@@ -1,30 +1,141 @@
 package krakend
 
 import (
+	"context"
+
 	botdetector "github.com/devopsfaith/krakend-botdetector/gin"
+	botdetectorcfg "github.com/devopsfaith/krakend-botdetector/krakend"
+	"github.com/devopsfaith/krakend-ce/apikey"
+	"github.com/devopsfaith/krakend-ce/opentelemetry"
+	"github.com/devopsfaith/krakend-ce/propagation"
+	"github.com/devopsfaith/krakend-ce/quota"
+	"github.com/devopsfaith/krakend-ce/ratelimit"
+	"github.com/devopsfaith/krakend-ce/slo"
+	"github.com/devopsfaith/krakend-ce/streaming"
+	"github.com/devopsfaith/krakend-ce/websocket"
 	jose "github.com/devopsfaith/krakend-jose"
 	ginjose "github.com/devopsfaith/krakend-jose/gin"
+	luarouter "github.com/devopsfaith/krakend-lua/router"
 	lua "github.com/devopsfaith/krakend-lua/router/gin"
+	krakendmetrics "github.com/devopsfaith/krakend-metrics"
 	metrics "github.com/devopsfaith/krakend-metrics/gin"
-	juju "github.com/devopsfaith/krakend-ratelimit/juju/router/gin"
+	jujurouter "github.com/devopsfaith/krakend-ratelimit/juju/router"
 	"github.com/luraproject/lura/logging"
 	router "github.com/luraproject/lura/router/gin"
+	krakendopencensus "github.com/scriptdash/krakend-opencensus"
 	opencensus "github.com/scriptdash/krakend-opencensus/router/gin"
 )
 
-// NewHandlerFactory returns a HandlerFactory with a rate-limit and a metrics collector middleware injected
+// NewHandlerFactory returns a HandlerFactory with a rate-limit and a metrics collector middleware injected.
+// The endpoints with the websocket or the streaming config are not handled by the default endpoint handler.
 func NewHandlerFactory(logger logging.Logger, metricCollector *metrics.Metrics, rejecter jose.RejecterFactory) router.HandlerFactory {
-	handlerFactory := juju.HandlerFactory
-	handlerFactory = lua.HandlerFactory(logger, handlerFactory)
-	handlerFactory = ginjose.HandlerFactory(handlerFactory, logger, rejecter)
-	handlerFactory = metricCollector.NewHTTPHandlerFactory(handlerFactory)
-	handlerFactory = opencensus.New(handlerFactory)
-	handlerFactory = botdetector.New(handlerFactory, logger)
+	return NewHandlerFactoryWithContext(context.Background(), logger, metricCollector, rejecter)
+}
+
+// NewHandlerFactoryWithContext returns the same HandlerFactory as NewHandlerFactory, taking the stores and
+// registries shared by the router stacks from the received context.
+func NewHandlerFactoryWithContext(ctx context.Context, logger logging.Logger, metricCollector *metrics.Metrics, rejecter jose.RejecterFactory) router.HandlerFactory {
+	s := stackInspectorFromContext(ctx)
+	handlerFactory := recordHandlerLayer(s, "endpoint", router.EndpointHandler)
+	handlerFactory = recordHandlerLayer(s, "streaming", streaming.HandlerFactory(handlerFactory, logger, metricCollector))
+	handlerFactory = recordHandlerLayer(s, "websocket", websocket.HandlerFactory(hijackedConnectionsContext(ctx), handlerFactory, logger, metricCollector))
+	handlerFactory = recordHandlerLayer(s, "rate_limit", ratelimit.HandlerFactory(handlerFactory, rateLimitStoreFromContext(ctx), logger))
+	handlerFactory = recordHandlerLayer(s, "lua", lua.HandlerFactory(logger, handlerFactory))
+	handlerFactory = recordHandlerLayer(s, "quota", quota.HandlerFactory(handlerFactory, quotaStoreFromContext(ctx), logger, metricCollector))
+	handlerFactory = recordHandlerLayer(s, "propagation", propagation.HandlerFactory(handlerFactory, logger))
+	handlerFactory = recordHandlerLayer(s, "apikey", apikey.HandlerFactory(handlerFactory, apiKeyAuthenticatorFromContext(ctx), rejecter, logger))
+	handlerFactory = recordHandlerLayer(s, "jose", ginjose.HandlerFactory(handlerFactory, logger, rejecter))
+	handlerFactory = recordHandlerLayer(s, "slo", slo.HandlerFactory(handlerFactory, sloRegistryFromContext(ctx), logger))
+	handlerFactory = recordHandlerLayer(s, "metrics", metricCollector.NewHTTPHandlerFactory(handlerFactory))
+	handlerFactory = recordHandlerLayer(s, "opencensus", opencensus.New(handlerFactory))
+	handlerFactory = recordHandlerLayer(s, "opentelemetry", opentelemetry.HandlerFactory(handlerFactory))
+	handlerFactory = recordHandlerLayer(s, "botdetector", botdetector.New(handlerFactory, logger))
 	return handlerFactory
 }
 
+// handlerLayers describes the middlewares added by NewHandlerFactory, from the outermost to the innermost one.
+// The admin API uses it only for the stacks without the layers recorded by the factories.
+var handlerLayers = []layer{
+	{Name: "botdetector", Namespaces: []string{botdetectorcfg.Namespace}},
+	{Name: "opentelemetry", Namespaces: []string{opentelemetry.Namespace}, Service: true},
+	{Name: "opencensus", Namespaces: []string{krakendopencensus.Namespace}, Service: true},
+	{Name: "metrics", Namespaces: []string{krakendmetrics.Namespace}, Service: true},
+	{Name: "slo", Namespaces: []string{slo.Namespace}},
+	{Name: "jose", Namespaces: []string{jose.ValidatorNamespace, jose.SignerNamespace}},
+	{Name: "apikey", Namespaces: []string{apikey.Namespace}},
+	{Name: "propagation", Namespaces: []string{propagation.Namespace}},
+	{Name: "quota", Namespaces: []string{quota.Namespace}},
+	{Name: "lua", Namespaces: []string{luarouter.Namespace}},
+	{Name: "rate_limit", Namespaces: []string{jujurouter.Namespace}},
+	{Name: "websocket", Namespaces: []string{websocket.Namespace}},
+	{Name: "streaming", Namespaces: []string{streaming.Namespace}},
+	{Name: "endpoint", Always: true},
+}
+
 type handlerFactory struct{}
 
 func (h handlerFactory) NewHandlerFactory(l logging.Logger, m *metrics.Metrics, r jose.RejecterFactory) router.HandlerFactory {
 	return NewHandlerFactory(l, m, r)
 }
+
+func (h handlerFactory) NewHandlerFactoryWithContext(ctx context.Context, l logging.Logger, m *metrics.Metrics, r jose.RejecterFactory) router.HandlerFactory {
+	return NewHandlerFactoryWithContext(ctx, l, m, r)
+}
+
+type apiKeyContextKey struct{}
+
+func withAPIKeyAuthenticator(ctx context.Context, a *apikey.Authenticator) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, a)
+}
+
+func apiKeyAuthenticatorFromContext(ctx context.Context) *apikey.Authenticator {
+	a, _ := ctx.Value(apiKeyContextKey{}).(*apikey.Authenticator)
+	return a
+}
+
+type quotaStoreContextKey struct{}
+
+func withQuotaStore(ctx context.Context, s quota.Store) context.Context {
+	return context.WithValue(ctx, quotaStoreContextKey{}, s)
+}
+
+func quotaStoreFromContext(ctx context.Context) quota.Store {
+	s, _ := ctx.Value(quotaStoreContextKey{}).(quota.Store)
+	return s
+}
+
+type shutdownContextKey struct{}
+
+// withShutdown returns a copy of the context carrying the context cancelled when the shutdown starts
+func withShutdown(ctx context.Context, shutdown context.Context) context.Context {
+	return context.WithValue(ctx, shutdownContextKey{}, shutdown)
+}
+
+// hijackedConnectionsContext returns a context cancelled when the stack is replaced or the shutdown starts,
+// since neither the drain of the hot reload nor the one of the http server wait for the hijacked connections
+func hijackedConnectionsContext(ctx context.Context) context.Context {
+	shutdown, _ := ctx.Value(shutdownContextKey{}).(context.Context)
+	if shutdown == nil {
+		return ctx
+	}
+	res, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-shutdown.Done():
+			cancel()
+		case <-res.Done():
+		}
+	}()
+	return res
+}
+
+type sloRegistryContextKey struct{}
+
+func withSLORegistry(ctx context.Context, r *slo.Registry) context.Context {
+	return context.WithValue(ctx, sloRegistryContextKey{}, r)
+}
+
+func sloRegistryFromContext(ctx context.Context) *slo.Registry {
+	r, _ := ctx.Value(sloRegistryContextKey{}).(*slo.Registry)
+	return r
+}
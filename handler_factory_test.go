@@ -0,0 +1,29 @@
+package krakend
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHijackedConnectionsContext(t *testing.T) {
+	if ctx := hijackedConnectionsContext(context.Background()); ctx != context.Background() {
+		t.Error("the context without a shutdown signal should be returned as is")
+	}
+
+	for _, cancelShutdown := range []bool{true, false} {
+		stack, cancelStack := context.WithCancel(context.Background())
+		shutdown, cancel := context.WithCancel(context.Background())
+		ctx := hijackedConnectionsContext(withShutdown(stack, shutdown))
+		if ctx.Err() != nil {
+			t.Error("the context was cancelled before the stack or the shutdown")
+		}
+		if cancelShutdown {
+			cancel()
+		} else {
+			cancelStack()
+		}
+		<-ctx.Done()
+		cancel()
+		cancelStack()
+	}
+}
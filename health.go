@@ -0,0 +1,311 @@
+package krakend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	krakendbf "github.com/devopsfaith/bloomfilter/krakend"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/proxy"
+)
+
+// HealthNamespace is the key to use to store and access the health endpoints config
+const HealthNamespace = "github_com/devopsfaith/krakend-ce/health"
+
+const (
+	livenessPath           = "/__health/live"
+	readinessPath          = "/__health/ready"
+	defaultProbeTimeout    = time.Second
+	defaultProbeCacheTTL   = 5 * time.Second
+	healthComponentPlugins = "plugins"
+	healthComponentMetrics = "metrics"
+	healthComponentTokens  = "token_rejecter"
+	healthComponentSD      = "service_discovery"
+
+	pubsubPublisherNamespace  = "github.com/devopsfaith/krakend-pubsub/publisher"
+	pubsubSubscriberNamespace = "github.com/devopsfaith/krakend-pubsub/subscriber"
+	amqpConsumerNamespace     = "github.com/devopsfaith/krakend-amqp/consume"
+	amqpProducerNamespace     = "github.com/devopsfaith/krakend-amqp/produce"
+)
+
+type healthConfig struct {
+	ProbeBackends bool   `json:"probe_backends"`
+	ProbeTimeout  string `json:"probe_timeout"`
+	ProbeCacheTTL string `json:"probe_cache_ttl"`
+}
+
+// HealthReporter is an optional interface for the collaborators of the ExecutorBuilder. While a collaborator
+// implementing it returns an error, the readiness endpoint reports the gateway as not ready.
+type HealthReporter interface {
+	Health() error
+}
+
+// HealthRegistry keeps the state of the components required to consider the gateway ready
+type HealthRegistry struct {
+	mu         sync.RWMutex
+	components map[string]func() error
+	draining   int32
+}
+
+// NewHealthRegistry returns an empty HealthRegistry
+func NewHealthRegistry() *HealthRegistry {
+	return &HealthRegistry{components: map[string]func() error{}}
+}
+
+// Report sets the state of the named component. A nil error flags the component as healthy.
+func (h *HealthRegistry) Report(component string, err error) {
+	h.register(component, func() error { return err })
+}
+
+// ReportCollaborator links the state of the named component to the one exposed by the collaborator,
+// if it implements the HealthReporter interface
+func (h *HealthRegistry) ReportCollaborator(component string, collaborator interface{}) {
+	if r, ok := collaborator.(HealthReporter); ok {
+		h.register(component, r.Health)
+	}
+}
+
+func (h *HealthRegistry) register(component string, f func() error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.components[component] = f
+	h.mu.Unlock()
+}
+
+// Drain flags the gateway as not ready, so the load balancers stop sending new requests to it
+func (h *HealthRegistry) Drain() {
+	if h == nil {
+		return
+	}
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// Draining returns true if the gateway is shutting down
+func (h *HealthRegistry) Draining() bool {
+	return h != nil && atomic.LoadInt32(&h.draining) == 1
+}
+
+func (h *HealthRegistry) states() map[string]error {
+	res := map[string]error{}
+	if h == nil {
+		return res
+	}
+	h.mu.RLock()
+	for k, f := range h.components {
+		res[k] = f()
+	}
+	h.mu.RUnlock()
+	return res
+}
+
+type healthContextKey struct{}
+
+// withStackHealth returns a copy of the context carrying the stack health so the factories can report
+// the components failing at build time
+func withStackHealth(ctx context.Context, s *stackHealth) context.Context {
+	return context.WithValue(ctx, healthContextKey{}, s)
+}
+
+func stackHealthFromContext(ctx context.Context) *stackHealth {
+	s, _ := ctx.Value(healthContextKey{}).(*stackHealth)
+	return s
+}
+
+// stackHealth keeps the state of the components created along with a router stack, so it is replaced
+// every time the stack is rebuilt
+type stackHealth struct {
+	mu         sync.RWMutex
+	components map[string]error
+	prober     *backendProber
+}
+
+func newStackHealth(cfg config.ServiceConfig) *stackHealth {
+	s := &stackHealth{components: map[string]error{}}
+	hCfg := healthConfig{}
+	if ok, err := parseExtraConfig(cfg.ExtraConfig, HealthNamespace, &hCfg); ok && err == nil && hCfg.ProbeBackends {
+		s.prober = newBackendProber(
+			cfg,
+			parseDuration(hCfg.ProbeTimeout, defaultProbeTimeout),
+			parseDuration(hCfg.ProbeCacheTTL, defaultProbeCacheTTL),
+		)
+	}
+	return s
+}
+
+func (s *stackHealth) Report(component string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.components[component] = err
+	s.mu.Unlock()
+}
+
+func (s *stackHealth) states() map[string]error {
+	res := map[string]error{}
+	if s == nil {
+		return res
+	}
+	s.mu.RLock()
+	for k, v := range s.components {
+		res[k] = v
+	}
+	s.mu.RUnlock()
+	if s.prober != nil {
+		for k, v := range s.prober.check() {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// registerHealthEndpoints adds the liveness and readiness endpoints to the engine
+func registerHealthEndpoints(engine *gin.Engine, h *HealthRegistry, s *stackHealth) {
+	engine.GET(livenessPath, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	engine.GET(readinessPath, func(c *gin.Context) {
+		if h.Draining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+			return
+		}
+
+		status := http.StatusOK
+		components := map[string]string{}
+		for _, states := range []map[string]error{h.states(), s.states()} {
+			for k, err := range states {
+				if err != nil {
+					status = http.StatusServiceUnavailable
+					components[k] = err.Error()
+					continue
+				}
+				components[k] = "ok"
+			}
+		}
+
+		if status != http.StatusOK {
+			c.JSON(status, gin.H{"status": "unavailable", "components": components})
+			return
+		}
+		c.JSON(status, gin.H{"status": "ok", "components": components})
+	})
+}
+
+// reportFailedInit wraps the backend factory used as fallback by a component, so every backend reaching it
+// with the component configured is flagged as not initialised
+func reportFailedInit(ctx context.Context, component string, next proxy.BackendFactory, namespaces ...string) proxy.BackendFactory {
+	s := stackHealthFromContext(ctx)
+	if s == nil {
+		return next
+	}
+	return func(remote *config.Backend) proxy.Proxy {
+		for _, ns := range namespaces {
+			if _, ok := remote.ExtraConfig[ns]; ok {
+				s.Report(
+					fmt.Sprintf("%s %s%s", component, strings.Join(remote.Host, ","), remote.URLPattern),
+					errors.New("unable to initialise the backend"),
+				)
+				break
+			}
+		}
+		return next(remote)
+	}
+}
+
+// tokenRejecterHealth filters the error returned by the TokenRejecterFactory, so a bloomfilter not
+// present in the configuration is not considered a failure
+func tokenRejecterHealth(cfg config.ServiceConfig, err error) error {
+	if _, ok := cfg.ExtraConfig[krakendbf.Namespace]; !ok {
+		return nil
+	}
+	return err
+}
+
+// backendProber checks if the hosts of the statically resolved http backends accept connections
+type backendProber struct {
+	hosts   []string
+	timeout time.Duration
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	last    time.Time
+	results map[string]error
+}
+
+func newBackendProber(cfg config.ServiceConfig, timeout, ttl time.Duration) *backendProber {
+	unique := map[string]struct{}{}
+	for _, e := range cfg.Endpoints {
+		for _, b := range e.Backend {
+			if b.SD != "" && b.SD != "static" {
+				continue
+			}
+			for _, host := range b.Host {
+				u, err := url.Parse(host)
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					continue
+				}
+				addr := u.Host
+				if u.Port() == "" {
+					if u.Scheme == "https" {
+						addr = net.JoinHostPort(u.Hostname(), "443")
+					} else {
+						addr = net.JoinHostPort(u.Hostname(), "80")
+					}
+				}
+				unique[addr] = struct{}{}
+			}
+		}
+	}
+	hosts := make([]string, 0, len(unique))
+	for h := range unique {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return &backendProber{hosts: hosts, timeout: timeout, ttl: ttl}
+}
+
+func (p *backendProber) check() map[string]error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.results != nil && time.Since(p.last) < p.ttl {
+		return p.results
+	}
+
+	results := make(map[string]error, len(p.hosts))
+	resMu := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	wg.Add(len(p.hosts))
+	for _, host := range p.hosts {
+		go func(host string) {
+			defer wg.Done()
+			var err error
+			conn, dialErr := net.DialTimeout("tcp", host, p.timeout)
+			if dialErr != nil {
+				err = fmt.Errorf("unreachable: %s", dialErr.Error())
+			} else {
+				conn.Close()
+			}
+			resMu.Lock()
+			results["backend "+host] = err
+			resMu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+
+	p.results = results
+	p.last = time.Now()
+	return results
+}
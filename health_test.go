@@ -0,0 +1,192 @@
+package krakend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	krakendbf "github.com/devopsfaith/bloomfilter/krakend"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestRegisterHealthEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	h := NewHealthRegistry()
+	h.Report(healthComponentPlugins, nil)
+	collaborator := &healthReporter{}
+	h.ReportCollaborator("collaborator", collaborator)
+	h.ReportCollaborator("ignored", struct{}{})
+	s := newStackHealth(config.ServiceConfig{})
+	s.Report("pubsub backend", nil)
+
+	engine := gin.New()
+	registerHealthEndpoints(engine, h, s)
+
+	check := func(step, path string, status int, expected map[string]interface{}) {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: unexpected status code %d", step, w.Code)
+		}
+		body := map[string]interface{}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: %s", step, err.Error())
+		}
+		if !reflect.DeepEqual(body, expected) {
+			t.Errorf("%s: unexpected body %v", step, body)
+		}
+	}
+
+	components := map[string]interface{}{healthComponentPlugins: "ok", "collaborator": "ok", "pubsub backend": "ok"}
+	check("ready", readinessPath, http.StatusOK, map[string]interface{}{"status": "ok", "components": components})
+	check("live", livenessPath, http.StatusOK, map[string]interface{}{"status": "ok"})
+
+	collaborator.err = errors.New("disconnected")
+	s.Report("amqp backend", errors.New("unable to initialise the backend"))
+	components["collaborator"] = "disconnected"
+	components["amqp backend"] = "unable to initialise the backend"
+	check("unavailable", readinessPath, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "components": components})
+	check("live while unavailable", livenessPath, http.StatusOK, map[string]interface{}{"status": "ok"})
+
+	h.Drain()
+	if !h.Draining() {
+		t.Error("the registry is not draining")
+	}
+	check("draining", readinessPath, http.StatusServiceUnavailable, map[string]interface{}{"status": "draining"})
+	check("live while draining", livenessPath, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+func TestHealthRegistry_nil(t *testing.T) {
+	var h *HealthRegistry
+	h.Report("component", errors.New("ignored"))
+	h.Drain()
+	if h.Draining() || len(h.states()) != 0 {
+		t.Error("a nil registry should not keep any state")
+	}
+}
+
+func TestReportFailedInit(t *testing.T) {
+	for _, tc := range []struct {
+		component  string
+		namespaces []string
+	}{
+		{component: "pubsub", namespaces: []string{pubsubPublisherNamespace, pubsubSubscriberNamespace}},
+		{component: "amqp", namespaces: []string{amqpConsumerNamespace, amqpProducerNamespace}},
+	} {
+		s := newStackHealth(config.ServiceConfig{})
+		calls := 0
+		next := func(_ *config.Backend) proxy.Proxy {
+			calls++
+			return proxy.NoopProxy
+		}
+		bf := reportFailedInit(withStackHealth(context.Background(), s), tc.component, next, tc.namespaces...)
+
+		bf(&config.Backend{Host: []string{"http://a"}, URLPattern: "/plain"})
+		for _, ns := range tc.namespaces {
+			bf(&config.Backend{Host: []string{"http://a"}, URLPattern: "/" + ns, ExtraConfig: config.ExtraConfig{ns: map[string]interface{}{}}})
+		}
+		if calls != len(tc.namespaces)+1 {
+			t.Errorf("%s: the next factory was not used for every backend: %d", tc.component, calls)
+		}
+		states := s.states()
+		if len(states) != len(tc.namespaces) {
+			t.Errorf("%s: unexpected states: %v", tc.component, states)
+		}
+		for _, ns := range tc.namespaces {
+			if err := states[tc.component+" http://a/"+ns]; err == nil {
+				t.Errorf("%s: the backend with the namespace %s was not reported", tc.component, ns)
+			}
+		}
+
+		// without a stack health in the context, the next factory is returned as is
+		calls = 0
+		reportFailedInit(context.Background(), tc.component, next, tc.namespaces...)(&config.Backend{})
+		if calls != 1 {
+			t.Errorf("%s: the next factory was not used", tc.component)
+		}
+	}
+}
+
+func TestTokenRejecterHealth(t *testing.T) {
+	err := errors.New("bloomfilter failure")
+	if tokenRejecterHealth(config.ServiceConfig{}, err) != nil {
+		t.Error("the failure of a not configured bloomfilter should be ignored")
+	}
+	cfg := config.ServiceConfig{ExtraConfig: config.ExtraConfig{krakendbf.Namespace: map[string]interface{}{}}}
+	if tokenRejecterHealth(cfg, err) != err {
+		t.Error("the failure of a configured bloomfilter should be reported")
+	}
+}
+
+func TestBackendProber(t *testing.T) {
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downAddr := down.Addr().String()
+	down.Close()
+
+	cfg := config.ServiceConfig{
+		ExtraConfig: config.ExtraConfig{HealthNamespace: map[string]interface{}{"probe_backends": true, "probe_cache_ttl": "100ms"}},
+		Endpoints: []*config.EndpointConfig{
+			{Backend: []*config.Backend{
+				{Host: []string{"http://" + up.Addr().String(), "http://" + downAddr}},
+				{Host: []string{"http://" + up.Addr().String()}, SD: "static"},
+			}},
+			{Backend: []*config.Backend{
+				{Host: []string{"http://example.com", "https://example.com"}, SD: "static"},
+				{Host: []string{"http://service.consul"}, SD: "dns"},
+				{Host: []string{"amqp://broker:5672", "::bad"}},
+			}},
+		},
+	}
+	s := newStackHealth(cfg)
+	if s.prober == nil {
+		t.Fatal("the prober was not enabled")
+	}
+	p := s.prober
+	// the hosts are deduplicated and sorted, with the default ports of their schemes
+	expected := []string{up.Addr().String(), downAddr, "example.com:443", "example.com:80"}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(p.hosts, expected) {
+		t.Errorf("unexpected hosts: %v", p.hosts)
+	}
+	// the unresolvable example.com hosts are not relevant for the test
+	p.hosts = []string{up.Addr().String(), downAddr}
+	p.timeout = 100 * time.Millisecond
+
+	results := s.states()
+	if len(results) != 2 || results["backend "+up.Addr().String()] != nil || results["backend "+downAddr] == nil {
+		t.Errorf("unexpected results: %v", results)
+	}
+
+	// the results are cached for the ttl
+	up.Close()
+	if results := p.check(); results["backend "+up.Addr().String()] != nil {
+		t.Errorf("the cached results were not used: %v", results)
+	}
+	time.Sleep(p.ttl)
+	if results := p.check(); results["backend "+up.Addr().String()] == nil {
+		t.Errorf("the results were not refreshed after the ttl: %v", results)
+	}
+}
+
+type healthReporter struct {
+	err error
+}
+
+func (h *healthReporter) Health() error { return h.err }
@@ -0,0 +1,267 @@
+// Package hedging provides a backend middleware sending a second request to another host when the first one
+// takes too long, returning the first successful response and cancelling the other one.
+//
+// Sample backend extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/hedging": {
+//			"delay": "100ms",
+//			"percentile": 95,
+//			"min_samples": 100
+//		},
+//		...
+//	},
+//	...
+//
+// When the percentile is defined, the hedging delay is derived from the latency observed once there are
+// enough samples. Until then, the fixed delay is used.
+package hedging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"github.com/luraproject/lura/sd"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/hedging"
+
+const (
+	defaultDelay      = 100 * time.Millisecond
+	defaultMinSamples = 100
+)
+
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// Config is the custom config struct containing the params for the hedging middleware
+type Config struct {
+	Delay      time.Duration
+	Percentile float64
+	MinSamples int
+}
+
+// ZeroCfg is the zero value for the Config struct
+var ZeroCfg = Config{}
+
+type rawConfig struct {
+	Delay      string  `json:"delay"`
+	Percentile float64 `json:"percentile"`
+	MinSamples int     `json:"min_samples"`
+}
+
+// ConfigGetter implements the config.ConfigGetter interface. It parses the extra config for the
+// hedging middleware and returns a ZeroCfg if something goes wrong.
+func ConfigGetter(e config.ExtraConfig) interface{} {
+	v, ok := e[Namespace]
+	if !ok {
+		return ZeroCfg
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ZeroCfg
+	}
+	raw := rawConfig{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return ZeroCfg
+	}
+
+	cfg := Config{
+		Delay:      defaultDelay,
+		MinSamples: raw.MinSamples,
+	}
+	if d, err := time.ParseDuration(raw.Delay); err == nil && d > 0 {
+		cfg.Delay = d
+	}
+	if raw.Percentile > 0 && raw.Percentile < 100 {
+		cfg.Percentile = raw.Percentile
+	}
+	if cfg.MinSamples <= 0 {
+		cfg.MinSamples = defaultMinSamples
+	}
+	return cfg
+}
+
+// BackendFactory adds a hedging middleware wrapping the internal factory
+func BackendFactory(next proxy.BackendFactory, logger logging.Logger) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		return NewMiddleware(remote, logger)(next(remote))
+	}
+}
+
+// NewMiddleware builds a middleware based on the extra config params or fallbacks to the next proxy.
+// Only the idempotent backends are hedged.
+func NewMiddleware(remote *config.Backend, logger logging.Logger) proxy.Middleware {
+	cfg := ConfigGetter(remote.ExtraConfig).(Config)
+	if cfg == ZeroCfg {
+		return proxy.EmptyMiddleware
+	}
+	if !idempotentMethods[strings.ToUpper(remote.Method)] {
+		logger.Warning("hedging: ignoring the non idempotent backend", remote.Method, remote.URLPattern)
+		return proxy.EmptyMiddleware
+	}
+
+	lb := sd.NewRoundRobinLB(sd.GetSubscriber(remote))
+	var tracker *latencyTracker
+	if cfg.Percentile > 0 {
+		tracker = newLatencyTracker(cfg.Percentile, cfg.MinSamples)
+	}
+
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			var body []byte
+			if request.Body != nil {
+				var err error
+				body, err = ioutil.ReadAll(request.Body)
+				request.Body.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			results := make(chan result, 2)
+			cancels := make([]context.CancelFunc, 0, 2)
+			send := func(r *proxy.Request) {
+				attemptCtx, cancel := context.WithCancel(ctx)
+				cancels = append(cancels, cancel)
+				go func(idx int) {
+					begin := time.Now()
+					resp, err := next[0](attemptCtx, r)
+					results <- result{idx: idx, resp: resp, err: err, elapsed: time.Since(begin)}
+				}(len(cancels) - 1)
+			}
+
+			send(cloneRequest(request, body, ""))
+
+			timer := time.NewTimer(tracker.delay(cfg.Delay))
+			defer timer.Stop()
+
+			hedge := timer.C
+			pending := 1
+			var last result
+		loop:
+			for {
+				select {
+				case <-hedge:
+					hedge = nil
+					send(cloneRequest(request, body, anotherHost(lb, request.URL)))
+					pending++
+					continue
+				case last = <-results:
+				}
+				pending--
+				tracker.observe(last.elapsed)
+
+				// a failure waits for the other request, if there is one in flight. If the first request
+				// fails before the hedging delay, no hedged request is sent.
+				if last.err == nil || pending == 0 {
+					break loop
+				}
+			}
+
+			for i, cancel := range cancels {
+				if i != last.idx {
+					cancel()
+				}
+			}
+			// the winner keeps its context alive until its response body, if any, is consumed or closed
+			if last.resp == nil || last.resp.Io == nil {
+				cancels[last.idx]()
+				return last.resp, last.err
+			}
+			resp := *last.resp
+			resp.Io = &cancelOnDone{r: resp.Io, cancel: cancels[last.idx]}
+			return &resp, last.err
+		}
+	}
+}
+
+type result struct {
+	idx     int
+	resp    *proxy.Response
+	err     error
+	elapsed time.Duration
+}
+
+// cancelOnDone cancels the context of the request once its body is read to the end, fails or is closed
+type cancelOnDone struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnDone) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil {
+		c.cancel()
+	}
+	return n, err
+}
+
+func (c *cancelOnDone) Close() error {
+	defer c.cancel()
+	if closer, ok := c.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// cloneRequest returns a copy of the request with its own body, pointing to the given host if any
+func cloneRequest(request *proxy.Request, body []byte, host string) *proxy.Request {
+	r := request.Clone()
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if host == "" || r.URL == nil {
+		return &r
+	}
+	if u, err := url.Parse(host); err == nil {
+		target := *r.URL
+		target.Scheme = u.Scheme
+		target.Host = u.Host
+		r.URL = &target
+	}
+	return &r
+}
+
+// anotherHost returns a host from the balancer different from the one of the current request, if possible
+func anotherHost(lb sd.Balancer, current *url.URL) string {
+	first := ""
+	for i := 0; i < 3; i++ {
+		host, err := lb.Host()
+		if err != nil {
+			return ""
+		}
+		if i == 0 {
+			first = host
+		}
+		if current == nil {
+			return host
+		}
+		if u, err := url.Parse(host); err == nil && u.Host != current.Host {
+			return host
+		}
+	}
+	return first
+}
@@ -0,0 +1,216 @@
+package hedging
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	var nilTracker *latencyTracker
+	nilTracker.observe(time.Second)
+	if d := nilTracker.delay(time.Millisecond); d != time.Millisecond {
+		t.Errorf("unexpected delay of a nil tracker: %s", d)
+	}
+
+	tracker := newLatencyTracker(95, 100)
+	for i := 1; i < 100; i++ {
+		tracker.observe(time.Duration(i) * time.Millisecond)
+	}
+	if d := tracker.delay(time.Second); d != time.Second {
+		t.Errorf("the fallback delay should be used without enough samples: %s", d)
+	}
+	tracker.observe(100 * time.Millisecond)
+	if d := tracker.delay(time.Second); d != 95*time.Millisecond {
+		t.Errorf("unexpected p95 delay: %s", d)
+	}
+
+	// the window keeps only the latest samples
+	for i := 0; i < latencyWindow; i++ {
+		tracker.observe(10 * time.Millisecond)
+	}
+	if d := tracker.delay(time.Second); d != 10*time.Millisecond {
+		t.Errorf("unexpected p95 delay after the window rotation: %s", d)
+	}
+
+	if tracker := newLatencyTracker(50, 2*latencyWindow); tracker.minSamples != latencyWindow {
+		t.Errorf("the min samples should be capped by the window: %d", tracker.minSamples)
+	}
+}
+
+func TestNewMiddleware_idempotent(t *testing.T) {
+	for method, hedged := range map[string]bool{
+		"GET":    true,
+		"delete": true,
+		"POST":   false,
+		"PATCH":  false,
+	} {
+		var calls int32
+		p := NewMiddleware(newBackend(method), logging.NoOp)(func(ctx context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				time.Sleep(20 * time.Millisecond)
+			}
+			return &proxy.Response{IsComplete: true}, nil
+		})
+		if _, err := p(context.Background(), newRequest("http://a.example.com")); err != nil {
+			t.Errorf("%s: unexpected error: %v", method, err)
+		}
+		if expected := map[bool]int32{true: 2, false: 1}[hedged]; atomic.LoadInt32(&calls) != expected {
+			t.Errorf("%s: unexpected number of calls: %d", method, calls)
+		}
+	}
+}
+
+func TestNewMiddleware_hedge(t *testing.T) {
+	var mu sync.Mutex
+	hosts := []string{}
+	loserCancelled := make(chan struct{})
+	p := NewMiddleware(newBackend("GET"), logging.NoOp)(func(ctx context.Context, r *proxy.Request) (*proxy.Response, error) {
+		mu.Lock()
+		hosts = append(hosts, r.URL.Host)
+		first := len(hosts) == 1
+		mu.Unlock()
+		if first {
+			<-ctx.Done()
+			close(loserCancelled)
+			return nil, ctx.Err()
+		}
+		return &proxy.Response{Data: map[string]interface{}{"host": r.URL.Host}, IsComplete: true}, nil
+	})
+
+	resp, err := p(context.Background(), newRequest("http://a.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["host"] != "b.example.com" {
+		t.Errorf("unexpected response: %v", resp.Data)
+	}
+	select {
+	case <-loserCancelled:
+	case <-time.After(time.Second):
+		t.Error("the slow request was not cancelled")
+	}
+	if len(hosts) != 2 || hosts[0] != "a.example.com" || hosts[1] != "b.example.com" {
+		t.Errorf("unexpected hosts: %v", hosts)
+	}
+}
+
+func TestNewMiddleware_failureBeforeTheDelay(t *testing.T) {
+	var calls int32
+	errBackend := errors.New("backend failure")
+	p := NewMiddleware(newBackend("GET"), logging.NoOp)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errBackend
+	})
+	if _, err := p(context.Background(), newRequest("http://a.example.com")); err != errBackend {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("unexpected number of calls: %d", calls)
+	}
+}
+
+func TestNewMiddleware_winnerContext(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		body    bool
+		consume func(*proxy.Response)
+	}{
+		{name: "no body"},
+		{name: "body read", body: true, consume: func(r *proxy.Response) { ioutil.ReadAll(r.Io) }},
+		{name: "body closed", body: true, consume: func(r *proxy.Response) { r.Io.(interface{ Close() error }).Close() }},
+	} {
+		var attemptCtx context.Context
+		p := NewMiddleware(newBackend("GET"), logging.NoOp)(func(ctx context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			attemptCtx = ctx
+			resp := &proxy.Response{IsComplete: true}
+			if tc.body {
+				resp.Io = strings.NewReader("streamed body")
+			}
+			return resp, nil
+		})
+		resp, err := p(context.Background(), newRequest("http://a.example.com"))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if tc.consume != nil {
+			if attemptCtx.Err() != nil {
+				t.Errorf("%s: the context was cancelled before consuming the body", tc.name)
+			}
+			tc.consume(resp)
+		}
+		if attemptCtx.Err() != context.Canceled {
+			t.Errorf("%s: the context of the winner was not cancelled", tc.name)
+		}
+	}
+}
+
+func TestAnotherHost(t *testing.T) {
+	current, _ := url.Parse("http://a.example.com/path")
+	for _, tc := range []struct {
+		name     string
+		hosts    []string
+		current  *url.URL
+		expected string
+	}{
+		{name: "next host", hosts: []string{"http://b.example.com"}, current: current, expected: "http://b.example.com"},
+		{name: "skips the current host", hosts: []string{"http://a.example.com", "http://b.example.com"}, current: current, expected: "http://b.example.com"},
+		{name: "single host", hosts: []string{"http://a.example.com"}, current: current, expected: "http://a.example.com"},
+		{name: "no current url", hosts: []string{"http://a.example.com"}, expected: "http://a.example.com"},
+		{name: "no hosts", current: current, expected: ""},
+	} {
+		if host := anotherHost(&fakeBalancer{hosts: tc.hosts}, tc.current); host != tc.expected {
+			t.Errorf("%s: unexpected host %q", tc.name, host)
+		}
+	}
+}
+
+func TestCloneRequest(t *testing.T) {
+	r := newRequest("http://a.example.com")
+	clone := cloneRequest(r, []byte("body"), "https://b.example.com:8080")
+	if clone.URL.String() != "https://b.example.com:8080/path?q=1" || r.URL.Host != "a.example.com" {
+		t.Errorf("unexpected urls: %s %s", clone.URL, r.URL)
+	}
+	if b, _ := ioutil.ReadAll(clone.Body); string(b) != "body" {
+		t.Errorf("unexpected body: %s", b)
+	}
+}
+
+type fakeBalancer struct {
+	hosts []string
+	next  int
+}
+
+func (f *fakeBalancer) Host() (string, error) {
+	if len(f.hosts) == 0 {
+		return "", errors.New("no hosts")
+	}
+	h := f.hosts[f.next%len(f.hosts)]
+	f.next++
+	return h, nil
+}
+
+func newBackend(method string) *config.Backend {
+	return &config.Backend{
+		Method:      method,
+		URLPattern:  "/path",
+		Host:        []string{"http://a.example.com", "http://b.example.com"},
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"delay": "5ms"}},
+	}
+}
+
+func newRequest(host string) *proxy.Request {
+	u, _ := url.Parse(host + "/path?q=1")
+	return &proxy.Request{Method: "GET", Path: "/path", URL: u}
+}
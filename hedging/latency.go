@@ -0,0 +1,74 @@
+package hedging
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindow  = 1000
+	recomputeEvery = 50
+)
+
+// latencyTracker keeps the latest latencies of a backend and derives the hedging delay from them.
+// A nil latencyTracker always returns the fallback delay.
+type latencyTracker struct {
+	mu         sync.Mutex
+	percentile float64
+	minSamples int
+	samples    []time.Duration
+	next       int
+	observed   int
+	current    time.Duration
+}
+
+func newLatencyTracker(percentile float64, minSamples int) *latencyTracker {
+	if minSamples > latencyWindow {
+		minSamples = latencyWindow
+	}
+	return &latencyTracker{
+		percentile: percentile,
+		minSamples: minSamples,
+		samples:    make([]time.Duration, 0, latencyWindow),
+	}
+}
+
+func (t *latencyTracker) observe(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, d)
+	} else {
+		t.samples[t.next] = d
+		t.next = (t.next + 1) % latencyWindow
+	}
+	t.observed++
+
+	if len(t.samples) >= t.minSamples && t.observed%recomputeEvery == 0 {
+		sorted := append([]time.Duration{}, t.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		idx := int(math.Ceil(t.percentile/100*float64(len(sorted)))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		t.current = sorted[idx]
+	}
+}
+
+func (t *latencyTracker) delay(fallback time.Duration) time.Duration {
+	if t == nil {
+		return fallback
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current == 0 {
+		return fallback
+	}
+	return t.current
+}
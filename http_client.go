@@ -0,0 +1,353 @@
+package krakend
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/mtls"
+	httpcache "github.com/devopsfaith/krakend-httpcache"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	oauth2client "github.com/devopsfaith/krakend-oauth2-clientcredentials"
+	cache "github.com/gregjones/httpcache"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/transport/http/client"
+	"golang.org/x/oauth2"
+)
+
+// HTTPClientNamespace is the key to use to store and access the http client config of a backend
+const HTTPClientNamespace = "github_com/devopsfaith/krakend-ce/http-client"
+
+// the default dialer settings of the net/http package
+const (
+	defaultDialTimeout = 30 * time.Second
+	defaultKeepAlive   = 30 * time.Second
+)
+
+// TransportDecorator wraps the transport used to reach a backend. The decorators not enabled by the backend
+// config must return the received transport. The innermost transport is nil, meaning the default one.
+type TransportDecorator func(remote *config.Backend, logger logging.Logger, next http.RoundTripper) http.RoundTripper
+
+type httpClientConfig struct {
+	// Proxy is the URL of the proxy to use, "none" to ignore the proxy defined by the environment or
+	// "environment" to use it
+	Proxy string `json:"proxy"`
+	// DisableCompression disables the transparent gzip compression of the responses
+	DisableCompression bool                 `json:"disable_compression"`
+	Pool               *httpPoolConfig      `json:"pool"`
+	Transport          *httpTransportConfig `json:"transport"`
+}
+
+type httpPoolConfig struct {
+	MaxIdleConns        int    `json:"max_idle_conns"`
+	MaxIdleConnsPerHost int    `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int    `json:"max_conns_per_host"`
+	IdleConnTimeout     string `json:"idle_conn_timeout"`
+}
+
+type httpTransportConfig struct {
+	DialTimeout           string `json:"dial_timeout"`
+	KeepAlive             string `json:"keep_alive"`
+	TLSHandshakeTimeout   string `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout string `json:"response_header_timeout"`
+	ExpectContinueTimeout string `json:"expect_continue_timeout"`
+	DisableKeepAlives     bool   `json:"disable_keep_alives"`
+	// HTTP2 enables or disables the HTTP/2 support. It is enabled by default.
+	HTTP2 *bool `json:"http2"`
+}
+
+type namedTransportDecorator struct {
+	layer     layer
+	decorator TransportDecorator
+}
+
+// transportTuners are the innermost layers of the backend http clients. They tune the dedicated
+// *http.Transport of the backend, so they can not be stacked over other transports.
+var transportTuners = []namedTransportDecorator{
+	{
+		layer:     layer{Name: "pool", Namespaces: []string{HTTPClientNamespace}, Keys: []string{"pool"}},
+		decorator: poolTransport,
+	},
+	{
+		layer:     layer{Name: "transport", Namespaces: []string{HTTPClientNamespace}, Keys: []string{"transport"}},
+		decorator: tunedTransport,
+	},
+	{
+		layer:     layer{Name: "proxy", Namespaces: []string{HTTPClientNamespace}, Keys: []string{"proxy"}},
+		decorator: proxyTransport,
+	},
+	{
+		layer:     layer{Name: "compression", Namespaces: []string{HTTPClientNamespace}, Keys: []string{"disable_compression"}},
+		decorator: compressionTransport,
+	},
+	{
+		layer:     layer{Name: "mtls", Namespaces: []string{mtls.Namespace}},
+		decorator: mtlsTransport,
+	},
+}
+
+// transportStatsLayer describes the collector of the connection pool stats, stacked over the tuners
+var transportStatsLayer = layer{Name: "pool_stats", Namespaces: []string{HTTPClientNamespace}}
+
+// transportDecorators are the default layers of the backend http clients stacked over the transport
+// stats, from the innermost to the outermost one
+var transportDecorators = []namedTransportDecorator{
+	{
+		layer:     layer{Name: "oauth2_client_credentials", Namespaces: []string{oauth2client.Namespace}},
+		decorator: oauth2Transport,
+	},
+	{
+		layer:     layer{Name: "http_cache", Namespaces: []string{httpcache.Namespace}},
+		decorator: httpCacheTransport,
+	},
+}
+
+// newHTTPClientFactory stacks the default transport decorators and the extra ones for the backend. The
+// backends without any enabled layer share the default http client. The idle connections of the dedicated
+// transport are closed when the context is cancelled, so the transports of the replaced configs do not keep
+// their connections open.
+func newHTTPClientFactory(ctx context.Context, remote *config.Backend, logger logging.Logger, m *metrics.Metrics, extra []TransportDecorator) client.HTTPClientFactory {
+	var transport http.RoundTripper
+	for _, d := range transportTuners {
+		transport = d.decorator(remote, logger, transport)
+	}
+	if transportStatsLayer.enabled(nil, remote.ExtraConfig) {
+		transport = newTransportStats(remote, logger, m, transport)
+	}
+	if t := innerTransport(transport); t != nil && ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			t.CloseIdleConnections()
+		}()
+	}
+	for _, d := range transportDecorators {
+		transport = d.decorator(remote, logger, transport)
+	}
+	for _, d := range extra {
+		transport = d(remote, logger, transport)
+	}
+	if transport == nil {
+		return client.NewHTTPClient
+	}
+
+	c := &http.Client{Transport: transport}
+	return func(_ context.Context) *http.Client {
+		return c
+	}
+}
+
+// innerTransport returns the dedicated transport created by the tuners or the stats collector, if any
+func innerTransport(rt http.RoundTripper) *http.Transport {
+	if s, ok := rt.(*transportStats); ok {
+		rt = s.next
+	}
+	t, _ := rt.(*http.Transport)
+	return t
+}
+
+// dedicatedTransport returns the transport to tune. A new one, based on the default transport, is created
+// when there is no inner transport. It returns false if the inner transport can not be tuned.
+func dedicatedTransport(remote *config.Backend, logger logging.Logger, next http.RoundTripper, name string) (*http.Transport, bool) {
+	if next == nil {
+		return http.DefaultTransport.(*http.Transport).Clone(), true
+	}
+	// the transports created by the inner layers are owned by the backend
+	t, ok := next.(*http.Transport)
+	if !ok {
+		logger.Warning("http client: unable to apply the", name, "layer to the transport of", remote.URLPattern)
+	}
+	return t, ok
+}
+
+func getHTTPClientConfig(remote *config.Backend, logger logging.Logger) (httpClientConfig, bool) {
+	cfg := httpClientConfig{}
+	ok, err := parseExtraConfig(remote.ExtraConfig, HTTPClientNamespace, &cfg)
+	if err != nil {
+		logger.Error("http client: unable to parse the config of", remote.URLPattern, err.Error())
+		return cfg, false
+	}
+	return cfg, ok
+}
+
+func poolTransport(remote *config.Backend, logger logging.Logger, next http.RoundTripper) http.RoundTripper {
+	cfg, ok := getHTTPClientConfig(remote, logger)
+	if !ok || cfg.Pool == nil {
+		return next
+	}
+	t, ok := dedicatedTransport(remote, logger, next, "pool")
+	if !ok {
+		return next
+	}
+	if cfg.Pool.MaxIdleConns > 0 {
+		t.MaxIdleConns = cfg.Pool.MaxIdleConns
+	}
+	if cfg.Pool.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = cfg.Pool.MaxIdleConnsPerHost
+	}
+	if cfg.Pool.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = cfg.Pool.MaxConnsPerHost
+	}
+	t.IdleConnTimeout = parseDuration(cfg.Pool.IdleConnTimeout, t.IdleConnTimeout)
+	return t
+}
+
+func tunedTransport(remote *config.Backend, logger logging.Logger, next http.RoundTripper) http.RoundTripper {
+	cfg, ok := getHTTPClientConfig(remote, logger)
+	if !ok || cfg.Transport == nil {
+		return next
+	}
+	t, ok := dedicatedTransport(remote, logger, next, "transport")
+	if !ok {
+		return next
+	}
+	tc := cfg.Transport
+	dialer := &net.Dialer{
+		Timeout:   parseDuration(tc.DialTimeout, defaultDialTimeout),
+		KeepAlive: parseDuration(tc.KeepAlive, defaultKeepAlive),
+	}
+	t.DialContext = dialer.DialContext
+	t.TLSHandshakeTimeout = parseDuration(tc.TLSHandshakeTimeout, t.TLSHandshakeTimeout)
+	t.ResponseHeaderTimeout = parseDuration(tc.ResponseHeaderTimeout, t.ResponseHeaderTimeout)
+	t.ExpectContinueTimeout = parseDuration(tc.ExpectContinueTimeout, t.ExpectContinueTimeout)
+	t.DisableKeepAlives = tc.DisableKeepAlives
+	if tc.HTTP2 != nil && !*tc.HTTP2 {
+		// a non-nil empty map disables the HTTP/2 upgrade of the TLS connections
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+func proxyTransport(remote *config.Backend, logger logging.Logger, next http.RoundTripper) http.RoundTripper {
+	cfg, ok := getHTTPClientConfig(remote, logger)
+	if !ok || cfg.Proxy == "" {
+		return next
+	}
+	var proxy func(*http.Request) (*url.URL, error)
+	switch cfg.Proxy {
+	case "environment":
+		proxy = http.ProxyFromEnvironment
+	case "none":
+	default:
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			logger.Error("http client: invalid proxy for", remote.URLPattern, err.Error())
+			return next
+		}
+		proxy = http.ProxyURL(u)
+	}
+	t, ok := dedicatedTransport(remote, logger, next, "proxy")
+	if !ok {
+		return next
+	}
+	t.Proxy = proxy
+	return t
+}
+
+func compressionTransport(remote *config.Backend, logger logging.Logger, next http.RoundTripper) http.RoundTripper {
+	cfg, ok := getHTTPClientConfig(remote, logger)
+	if !ok || !cfg.DisableCompression {
+		return next
+	}
+	t, ok := dedicatedTransport(remote, logger, next, "compression")
+	if !ok {
+		return next
+	}
+	t.DisableCompression = true
+	return t
+}
+
+func mtlsTransport(remote *config.Backend, logger logging.Logger, next http.RoundTripper) http.RoundTripper {
+	tlsConfig := mtls.TLSClientConfig(remote, logger)
+	if tlsConfig == nil {
+		return next
+	}
+	t, ok := dedicatedTransport(remote, logger, next, "mtls")
+	if !ok {
+		return next
+	}
+	t.TLSClientConfig = tlsConfig
+	return t
+}
+
+// oauth2Transport reuses the token source of the oauth2 client credentials client on top of the inner
+// transport. The token endpoint is reached with the default client.
+func oauth2Transport(remote *config.Backend, _ logging.Logger, next http.RoundTripper) http.RoundTripper {
+	if _, ok := remote.ExtraConfig[oauth2client.Namespace]; !ok {
+		return next
+	}
+	t, ok := oauth2client.NewHTTPClient(remote)(context.Background()).Transport.(*oauth2.Transport)
+	if !ok {
+		// the client credentials are disabled
+		return next
+	}
+	return &oauth2.Transport{Source: t.Source, Base: next}
+}
+
+// httpCacheTransport reuses the in-memory cache of the http cache client on top of the inner transport, so
+// all the cached backends share the same cache
+func httpCacheTransport(remote *config.Backend, _ logging.Logger, next http.RoundTripper) http.RoundTripper {
+	if _, ok := remote.ExtraConfig[httpcache.Namespace]; !ok {
+		return next
+	}
+	t, ok := httpcache.NewHTTPClient(remote)(context.Background()).Transport.(*cache.Transport)
+	if !ok {
+		return next
+	}
+	return &cache.Transport{Transport: next, Cache: t.Cache, MarkCachedResponses: t.MarkCachedResponses}
+}
+
+type transportDecoratorsContextKey struct{}
+
+// withTransportDecorators returns a copy of the context carrying the extra transport decorators to add on
+// top of the default ones
+func withTransportDecorators(ctx context.Context, ds []TransportDecorator) context.Context {
+	return context.WithValue(ctx, transportDecoratorsContextKey{}, ds)
+}
+
+func transportDecoratorsFromContext(ctx context.Context) []TransportDecorator {
+	ds, _ := ctx.Value(transportDecoratorsContextKey{}).([]TransportDecorator)
+	return ds
+}
+
+// appliedTransportLayers returns the names of the transport layers newHTTPClientFactory applies to the
+// backend, from the innermost to the outermost one. The extra decorators are always applied.
+func appliedTransportLayers(remote *config.Backend, extra []TransportDecorator) []string {
+	res := []string{}
+	for _, d := range transportTuners {
+		if d.layer.enabled(nil, remote.ExtraConfig) {
+			res = append(res, d.layer.Name)
+		}
+	}
+	if transportStatsLayer.enabled(nil, remote.ExtraConfig) {
+		res = append(res, transportStatsLayer.Name)
+	}
+	for _, d := range transportDecorators {
+		if d.layer.enabled(nil, remote.ExtraConfig) {
+			res = append(res, d.layer.Name)
+		}
+	}
+	for i := range extra {
+		res = append(res, fmt.Sprintf("transport_decorator #%d", i+1))
+	}
+	return res
+}
+
+// httpClientLayers returns the layers of the default transport decorators, from the outermost to the
+// innermost one
+func httpClientLayers() []layer {
+	res := make([]layer, 0, len(transportDecorators)+len(transportTuners)+1)
+	for i := len(transportDecorators) - 1; i >= 0; i-- {
+		res = append(res, transportDecorators[i].layer)
+	}
+	res = append(res, transportStatsLayer)
+	for i := len(transportTuners) - 1; i >= 0; i-- {
+		res = append(res, transportTuners[i].layer)
+	}
+	return res
+}
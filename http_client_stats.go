@@ -0,0 +1,156 @@
+package krakend
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// transportStats tracks the connection pool of the dedicated transport of a backend. The open connections
+// are counted by the dialer and the ones in use by the round tripper, from the request until the response
+// body is closed, so the idle connections are the difference. With HTTP/2 several requests share the same
+// connection, so the idle connections are not reported.
+type transportStats struct {
+	next http.RoundTripper
+
+	open  int64
+	inUse int64
+
+	dials      gometrics.Counter
+	dialErrors gometrics.Counter
+	reused     gometrics.Counter
+	openConns  gometrics.Gauge
+	inUseConns gometrics.Gauge
+	idleConns  gometrics.Gauge
+}
+
+// newTransportStats instruments the dialer of the backend transport and wraps it with a round tripper
+// counting the connections in use. The dials are exposed as counters and the connections as gauges of the
+// proxy metrics collector.
+func newTransportStats(remote *config.Backend, logger logging.Logger, m *metrics.Metrics, next http.RoundTripper) http.RoundTripper {
+	t, ok := dedicatedTransport(remote, logger, next, transportStatsLayer.Name)
+	if !ok {
+		return next
+	}
+
+	name := strings.Join(remote.Host, ",") + remote.URLPattern
+	prefix := "http_client.backend." + name + ".pool."
+	counter := func(stat string) gometrics.Counter {
+		if m == nil || m.Metrics == nil || m.Proxy == nil {
+			return gometrics.NilCounter{}
+		}
+		return m.Proxy.Counter(prefix + stat)
+	}
+	gauge := func(stat string) gometrics.Gauge {
+		if m == nil || m.Metrics == nil || m.Registry == nil {
+			return gometrics.NilGauge{}
+		}
+		// the proxy metrics only create counters and histograms, so the gauges are registered in the same
+		// child registry
+		return gometrics.GetOrRegisterGauge(prefix+stat, gometrics.NewPrefixedChildRegistry(*m.Registry, "proxy."))
+	}
+	s := &transportStats{
+		next:       t,
+		dials:      counter("dials"),
+		dialErrors: counter("dial_errors"),
+		reused:     counter("reused"),
+		openConns:  gauge("open"),
+		inUseConns: gauge("in_use"),
+		idleConns:  gauge("idle"),
+	}
+
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: defaultDialTimeout, KeepAlive: defaultKeepAlive}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		s.dials.Inc(1)
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			s.dialErrors.Inc(1)
+			return nil, err
+		}
+		s.update(&s.open, s.openConns, 1)
+		return &statsConn{Conn: c, stats: s}, nil
+	}
+	return s
+}
+
+func (s *transportStats) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				s.reused.Inc(1)
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	s.update(&s.inUse, s.inUseConns, 1)
+	resp, err := s.next.RoundTrip(req)
+	if err != nil {
+		s.update(&s.inUse, s.inUseConns, -1)
+		return resp, err
+	}
+	resp.Body = &statsBody{ReadCloser: resp.Body, done: func() { s.update(&s.inUse, s.inUseConns, -1) }}
+	return resp, nil
+}
+
+// update applies the delta to the tracked value and refreshes its gauge and the idle connections
+func (s *transportStats) update(v *int64, g gometrics.Gauge, delta int64) {
+	g.Update(atomic.AddInt64(v, delta))
+
+	idle := atomic.LoadInt64(&s.open) - atomic.LoadInt64(&s.inUse)
+	if idle < 0 {
+		idle = 0
+	}
+	s.idleConns.Update(idle)
+}
+
+// CloseIdleConnections allows the http client to close the idle connections of the instrumented transport
+func (s *transportStats) CloseIdleConnections() {
+	if c, ok := s.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+type statsConn struct {
+	net.Conn
+	stats *transportStats
+	once  sync.Once
+}
+
+func (c *statsConn) Close() error {
+	c.once.Do(func() { c.stats.update(&c.stats.open, c.stats.openConns, -1) })
+	return c.Conn.Close()
+}
+
+// statsBody releases the connection in use once the body is consumed or closed
+type statsBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *statsBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.done)
+	}
+	return n, err
+}
+
+func (b *statsBody) Close() error {
+	b.once.Do(b.done)
+	return b.ReadCloser.Close()
+}
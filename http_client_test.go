@@ -0,0 +1,363 @@
+package krakend
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	httpcache "github.com/devopsfaith/krakend-httpcache"
+	krakendmetrics "github.com/devopsfaith/krakend-metrics"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	oauth2client "github.com/devopsfaith/krakend-oauth2-clientcredentials"
+	cache "github.com/gregjones/httpcache"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+func TestNewHTTPClientFactory_closesTheIdleConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	backend.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	remote := &config.Backend{ExtraConfig: config.ExtraConfig{HTTPClientNamespace: map[string]interface{}{
+		"pool": map[string]interface{}{"max_idle_conns_per_host": 4},
+	}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newHTTPClientFactory(ctx, remote, logging.NoOp, nil, nil)(context.Background())
+
+	resp, err := c.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-closed:
+		t.Fatal("the idle connection was closed before the cancellation")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("the idle connection was not closed after the cancellation")
+	}
+}
+
+func TestTransportTuners(t *testing.T) {
+	dedicated := http.DefaultTransport.(*http.Transport).Clone()
+	untunable := &stubTransport{}
+	for _, tc := range []struct {
+		name      string
+		decorator TransportDecorator
+		cfg       map[string]interface{}
+		next      http.RoundTripper
+		// check validates the tuned transport. The decorators without a check must return the next one.
+		check func(*http.Transport) bool
+	}{
+		{
+			name:      "pool",
+			decorator: poolTransport,
+			cfg: map[string]interface{}{"pool": map[string]interface{}{
+				"max_idle_conns":          10,
+				"max_idle_conns_per_host": 5,
+				"max_conns_per_host":      7,
+				"idle_conn_timeout":       "5s",
+			}},
+			check: func(t *http.Transport) bool {
+				return t.MaxIdleConns == 10 && t.MaxIdleConnsPerHost == 5 && t.MaxConnsPerHost == 7 && t.IdleConnTimeout == 5*time.Second
+			},
+		},
+		{
+			name:      "pool over a dedicated transport",
+			decorator: poolTransport,
+			cfg:       map[string]interface{}{"pool": map[string]interface{}{"max_idle_conns": 10}},
+			next:      dedicated,
+			check:     func(t *http.Transport) bool { return t == dedicated && t.MaxIdleConns == 10 },
+		},
+		{
+			name:      "pool over an untunable transport",
+			decorator: poolTransport,
+			cfg:       map[string]interface{}{"pool": map[string]interface{}{"max_idle_conns": 10}},
+			next:      untunable,
+		},
+		{name: "pool disabled", decorator: poolTransport, cfg: map[string]interface{}{"proxy": "none"}},
+		{
+			name:      "transport",
+			decorator: tunedTransport,
+			cfg: map[string]interface{}{"transport": map[string]interface{}{
+				"dial_timeout":            "1s",
+				"tls_handshake_timeout":   "2s",
+				"response_header_timeout": "3s",
+				"expect_continue_timeout": "4s",
+				"disable_keep_alives":     true,
+			}},
+			check: func(t *http.Transport) bool {
+				return t.DialContext != nil && t.TLSHandshakeTimeout == 2*time.Second && t.ResponseHeaderTimeout == 3*time.Second &&
+					t.ExpectContinueTimeout == 4*time.Second && t.DisableKeepAlives && t.ForceAttemptHTTP2 && t.TLSNextProto == nil
+			},
+		},
+		{
+			name:      "http2 disabled",
+			decorator: tunedTransport,
+			cfg:       map[string]interface{}{"transport": map[string]interface{}{"http2": false}},
+			check: func(t *http.Transport) bool {
+				return !t.ForceAttemptHTTP2 && t.TLSNextProto != nil && len(t.TLSNextProto) == 0
+			},
+		},
+		{
+			name:      "http2 enabled",
+			decorator: tunedTransport,
+			cfg:       map[string]interface{}{"transport": map[string]interface{}{"http2": true}},
+			check:     func(t *http.Transport) bool { return t.ForceAttemptHTTP2 && t.TLSNextProto == nil },
+		},
+		{
+			name:      "proxy url",
+			decorator: proxyTransport,
+			cfg:       map[string]interface{}{"proxy": "http://proxy.example.com:3128"},
+			check: func(t *http.Transport) bool {
+				u, err := t.Proxy(httptest.NewRequest("GET", "http://backend.example.com", nil))
+				return err == nil && u.Host == "proxy.example.com:3128"
+			},
+		},
+		{
+			name:      "no proxy",
+			decorator: proxyTransport,
+			cfg:       map[string]interface{}{"proxy": "none"},
+			check:     func(t *http.Transport) bool { return t.Proxy == nil },
+		},
+		{
+			name:      "environment proxy",
+			decorator: proxyTransport,
+			cfg:       map[string]interface{}{"proxy": "environment"},
+			check:     func(t *http.Transport) bool { return t.Proxy != nil },
+		},
+		{name: "bad proxy", decorator: proxyTransport, cfg: map[string]interface{}{"proxy": "%%"}},
+		{
+			name:      "compression disabled",
+			decorator: compressionTransport,
+			cfg:       map[string]interface{}{"disable_compression": true},
+			check:     func(t *http.Transport) bool { return t.DisableCompression },
+		},
+		{name: "compression enabled", decorator: compressionTransport, cfg: map[string]interface{}{"disable_compression": false}},
+	} {
+		remote := &config.Backend{ExtraConfig: config.ExtraConfig{HTTPClientNamespace: tc.cfg}}
+		res := tc.decorator(remote, logging.NoOp, tc.next)
+		if tc.check == nil {
+			if res != tc.next {
+				t.Errorf("%s: the next transport was not returned", tc.name)
+			}
+			continue
+		}
+		tuned, ok := res.(*http.Transport)
+		if !ok {
+			t.Errorf("%s: unexpected transport %T", tc.name, res)
+			continue
+		}
+		if tuned == http.DefaultTransport {
+			t.Errorf("%s: the default transport was tuned", tc.name)
+		}
+		if !tc.check(tuned) {
+			t.Errorf("%s: unexpected transport %+v", tc.name, tuned)
+		}
+	}
+}
+
+func TestAppliedTransportLayers(t *testing.T) {
+	for _, tc := range []struct {
+		cfg      map[string]interface{}
+		expected []string
+	}{
+		{cfg: map[string]interface{}{"pool": map[string]interface{}{}, "disable_compression": false, "proxy": ""}, expected: []string{"pool", "pool_stats"}},
+		{
+			cfg:      map[string]interface{}{"transport": map[string]interface{}{}, "proxy": "none", "disable_compression": true},
+			expected: []string{"transport", "proxy", "compression", "pool_stats"},
+		},
+	} {
+		remote := &config.Backend{ExtraConfig: config.ExtraConfig{HTTPClientNamespace: tc.cfg}}
+		if layers := appliedTransportLayers(remote, nil); !reflect.DeepEqual(layers, tc.expected) {
+			t.Errorf("unexpected layers for %v: %v", tc.cfg, layers)
+		}
+	}
+}
+
+func TestTransportStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	registry := gometrics.NewRegistry()
+	m := &metrics.Metrics{Metrics: &krakendmetrics.Metrics{Registry: &registry, Proxy: krakendmetrics.NewProxyMetrics(&registry)}}
+	remote := &config.Backend{Host: []string{backend.URL}, URLPattern: "/stats", ExtraConfig: config.ExtraConfig{HTTPClientNamespace: map[string]interface{}{}}}
+	c := &http.Client{Transport: newTransportStats(remote, logging.NoOp, m, nil)}
+
+	prefix := "proxy.http_client.backend." + backend.URL + "/stats.pool."
+	stat := func(name string) int64 {
+		switch v := registry.Get(prefix + name).(type) {
+		case gometrics.Gauge:
+			return v.Value()
+		case gometrics.Counter:
+			return v.Count()
+		}
+		t.Fatalf("the stat %s is not registered", name)
+		return 0
+	}
+	expect := func(step string, expected map[string]int64) {
+		for name, v := range expected {
+			if s := stat(name); s != v {
+				t.Errorf("%s: unexpected %s: %d", step, name, s)
+			}
+		}
+	}
+
+	resp, err := c.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("in use", map[string]int64{"dials": 1, "open": 1, "in_use": 1, "idle": 0})
+	// the connection returns to the pool once the body is consumed
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect("released", map[string]int64{"open": 1, "in_use": 0, "idle": 1})
+
+	resp, err = c.Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expect("reused", map[string]int64{"dials": 1, "reused": 1, "idle": 1})
+
+	c.CloseIdleConnections()
+	expect("closed", map[string]int64{"open": 0, "in_use": 0, "idle": 0})
+}
+
+func TestNewHTTPClientFactory_oauth2AndCache(t *testing.T) {
+	var tokens, hits int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&tokens, 1)
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"access_token":"secret-token","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer tokenServer.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret-token" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&hits, 1)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Write([]byte("cached"))
+	}))
+	defer backend.Close()
+
+	remote := &config.Backend{ExtraConfig: config.ExtraConfig{
+		oauth2client.Namespace: map[string]interface{}{
+			"client_id":     "id",
+			"client_secret": "secret",
+			"token_url":     tokenServer.URL,
+		},
+		httpcache.Namespace: map[string]interface{}{},
+	}}
+	if layers := appliedTransportLayers(remote, nil); !reflect.DeepEqual(layers, []string{"oauth2_client_credentials", "http_cache"}) {
+		t.Errorf("unexpected layers: %v", layers)
+	}
+	c := newHTTPClientFactory(context.Background(), remote, logging.NoOp, nil, nil)(context.Background())
+
+	// the path is unique, so the shared cache of the http_cache layer is empty
+	u := backend.URL + "/oauth2-and-cache"
+	for i := 0; i < 3; i++ {
+		resp, err := c.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(b) != "cached" {
+			t.Fatalf("unexpected response #%d: %d %s", i, resp.StatusCode, b)
+		}
+		if cached := resp.Header.Get(cache.XFromCache) == "1"; cached != (i > 0) {
+			t.Errorf("unexpected cache state of the response #%d: %v", i, cached)
+		}
+	}
+	if tokens != 1 || hits != 1 {
+		t.Errorf("unexpected calls. tokens: %d, backend: %d", tokens, hits)
+	}
+}
+
+func TestExecutorBuilder_transportDecoratorsOrder(t *testing.T) {
+	r, _, cancel := newTestReloader(t, false)
+	defer cancel()
+
+	var mu sync.Mutex
+	calls := []string{}
+	record := func(name string) TransportDecorator {
+		return func(_ *config.Backend, _ logging.Logger, next http.RoundTripper) http.RoundTripper {
+			if next == nil {
+				next = http.DefaultTransport
+			}
+			return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+				return next.RoundTrip(req)
+			})
+		}
+	}
+	r.builder.TransportDecorators = []TransportDecorator{record("first"), record("second"), record("third")}
+
+	g, err := r.build(r.current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.cancel()
+	if !serves(g.handler, "/initial") {
+		t.Fatal("unexpected response")
+	}
+	// the last decorator is the outermost one, so it sees the request first
+	if !reflect.DeepEqual(calls, []string{"third", "second", "first"}) {
+		t.Errorf("unexpected order: %v", calls)
+	}
+}
+
+func TestInnerTransport(t *testing.T) {
+	dedicated := &http.Transport{}
+	for _, tc := range []struct {
+		name      string
+		transport http.RoundTripper
+		expected  *http.Transport
+	}{
+		{name: "default"},
+		{name: "tuned", transport: dedicated, expected: dedicated},
+		{name: "stats", transport: &transportStats{next: dedicated}, expected: dedicated},
+		{name: "custom", transport: &stubTransport{}},
+	} {
+		if inner := innerTransport(tc.transport); inner != tc.expected {
+			t.Errorf("%s: unexpected transport %v", tc.name, inner)
+		}
+	}
+}
+
+type stubTransport struct{}
+
+func (*stubTransport) RoundTrip(_ *http.Request) (*http.Response, error) { return nil, nil }
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
@@ -0,0 +1,102 @@
+// Package jwtclaims gives access to the claims of the tokens validated by the JOSE validator of the endpoint.
+//
+// The JOSE handler does not expose the claims of the token to the inner handlers, so they are decoded again
+// from the request. The signature is not checked, so the extractors must be used only by the handlers
+// wrapped by the JOSE validator.
+package jwtclaims
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	auth0 "github.com/auth0-community/go-auth0"
+	krakendjose "github.com/devopsfaith/krakend-jose"
+	"github.com/luraproject/lura/config"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ErrNoValidator is returned when the endpoint does not validate the tokens
+var ErrNoValidator = errors.New("jwtclaims: the endpoint has no JOSE validator")
+
+// Extractor returns the claims of the token of the request
+type Extractor func(r *http.Request) (map[string]interface{}, error)
+
+// NewExtractor returns an Extractor looking for the token where the JOSE validator of the endpoint does,
+// first at the Authorization header and then at the cookie
+func NewExtractor(cfg *config.EndpointConfig) (Extractor, error) {
+	scfg, err := krakendjose.GetSignatureConfig(cfg)
+	if err == krakendjose.ErrNoValidatorCfg {
+		return nil, ErrNoValidator
+	}
+	if err != nil {
+		return nil, err
+	}
+	cookie := scfg.CookieKey
+	if cookie == "" {
+		cookie = "access_token"
+	}
+
+	return func(r *http.Request) (map[string]interface{}, error) {
+		token, err := auth0.FromHeader(r)
+		if err != nil {
+			c, cerr := r.Cookie(cookie)
+			if cerr != nil {
+				return nil, auth0.ErrTokenNotFound
+			}
+			if token, err = jwt.ParseSigned(c.Value); err != nil {
+				return nil, err
+			}
+		}
+		claims := map[string]interface{}{}
+		if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+			return nil, err
+		}
+		return claims, nil
+	}, nil
+}
+
+// Lookup returns the value of the claim. The nested claims are accessed with a dot separated path, unless
+// the claim name is a URL, as the namespaced claims usually are.
+func Lookup(claims map[string]interface{}, name string) (interface{}, bool) {
+	if v, ok := claims[name]; ok || strings.HasPrefix(name, "http") {
+		return v, ok
+	}
+	parts := strings.Split(name, ".")
+	var v interface{} = claims
+	for _, p := range parts {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[p]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// String returns the value of the claim as a string. The arrays are joined with the separator and the
+// numbers without decimals are printed as integers.
+func String(v interface{}, sep string) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		if t == float64(int64(t)) {
+			return fmt.Sprintf("%d", int64(t))
+		}
+		return fmt.Sprintf("%v", t)
+	case []interface{}:
+		parts := make([]string, len(t))
+		for i, e := range t {
+			parts[i] = String(e, sep)
+		}
+		return strings.Join(parts, sep)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
@@ -0,0 +1,76 @@
+package jwtclaims
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	krakendjose "github.com/devopsfaith/krakend-jose"
+	"github.com/luraproject/lura/config"
+)
+
+func TestNewExtractor(t *testing.T) {
+	enc := base64.RawURLEncoding.EncodeToString
+	token := enc([]byte(`{"alg":"HS256"}`)) + "." + enc([]byte(`{"sub":"1"}`)) + "." + enc([]byte("signature"))
+
+	extractor, err := NewExtractor(&config.EndpointConfig{ExtraConfig: config.ExtraConfig{
+		krakendjose.ValidatorNamespace: map[string]interface{}{"alg": "HS256", "jwk-url": "https://localhost/jwk", "cookie_key": "session"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fromHeader, _ := http.NewRequest("GET", "/", nil)
+	fromHeader.Header.Set("Authorization", "Bearer "+token)
+	fromCookie, _ := http.NewRequest("GET", "/", nil)
+	fromCookie.AddCookie(&http.Cookie{Name: "session", Value: token})
+
+	for _, r := range []*http.Request{fromHeader, fromCookie} {
+		claims, err := extractor(r)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if claims["sub"] != "1" {
+			t.Errorf("unexpected claims: %v", claims)
+		}
+	}
+
+	empty, _ := http.NewRequest("GET", "/", nil)
+	if _, err := extractor(empty); err == nil {
+		t.Error("an error was expected for the requests without token")
+	}
+
+	if _, err := NewExtractor(&config.EndpointConfig{}); err != ErrNoValidator {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	claims := map[string]interface{}{
+		"tenant":                   map[string]interface{}{"id": "acme", "plan": map[string]interface{}{"tier": float64(2)}},
+		"https://example.com/role": []interface{}{"admin", "user"},
+		"a.b":                      "flat",
+	}
+	for _, tc := range []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{name: "tenant.id", want: "acme", ok: true},
+		{name: "tenant.plan.tier", want: "2", ok: true},
+		{name: "https://example.com/role", want: "admin,user", ok: true},
+		{name: "a.b", want: "flat", ok: true},
+		{name: "tenant.unknown"},
+		{name: "https://example.com/unknown"},
+	} {
+		v, ok := Lookup(claims, tc.name)
+		if ok != tc.ok {
+			t.Errorf("%s: unexpected result: %v", tc.name, ok)
+			continue
+		}
+		if s := String(v, ","); s != tc.want {
+			t.Errorf("%s: unexpected value: %s", tc.name, s)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+)
+
+// certStore keeps the client certificate and the CA pool loaded from disk, loading them again when the
+// files are modified
+type certStore struct {
+	cfg    Config
+	logger logging.Logger
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+func newCertStore(cfg Config, logger logging.Logger) (*certStore, error) {
+	s := &certStore{cfg: cfg, logger: logger}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// tlsConfig returns a TLS config getting the certificates from the store on every handshake. When there is
+// a custom CA bundle, the verification of the server is done by the store, so the rotated CA files are
+// taken into account.
+func (s *certStore) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		ServerName: s.cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if s.cfg.CertFile != "" {
+		cfg.GetClientCertificate = s.clientCertificate
+	}
+	if len(s.cfg.CAFiles) > 0 {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = s.verifyConnection
+	}
+	return cfg
+}
+
+func (s *certStore) clientCertificate(_ *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.refresh()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+func (s *certStore) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("mtls: no server certificate")
+	}
+	s.refresh()
+	s.mu.RLock()
+	pool := s.pool
+	s.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// refresh loads the files again if any of them has been modified since the last load. The files are
+// checked once per reload interval and the current certificates are kept if the new ones are not valid.
+func (s *certStore) refresh() {
+	s.mu.RLock()
+	due := time.Since(s.lastCheck) >= s.cfg.ReloadInterval
+	s.mu.RUnlock()
+	if !due {
+		return
+	}
+
+	s.mu.Lock()
+	s.lastCheck = time.Now()
+	s.mu.Unlock()
+
+	if !s.modified() {
+		return
+	}
+	if err := s.load(); err != nil {
+		s.logger.Error("mtls: reloading the certificates:", err.Error())
+		return
+	}
+	s.logger.Info("mtls: certificates reloaded from", s.cfg.CertFile, s.cfg.CAFiles)
+}
+
+func (s *certStore) files() []string {
+	files := append([]string{}, s.cfg.CAFiles...)
+	if s.cfg.CertFile != "" {
+		files = append(files, s.cfg.CertFile, s.cfg.KeyFile)
+	}
+	return files
+}
+
+func (s *certStore) modified() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, f := range s.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(s.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *certStore) load() error {
+	modTimes := map[string]time.Time{}
+	for _, f := range s.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[f] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if s.cfg.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if len(s.cfg.CAFiles) > 0 {
+		pool = x509.NewCertPool()
+		for _, f := range s.cfg.CAFiles {
+			b, err := ioutil.ReadFile(f)
+			if err != nil {
+				return err
+			}
+			if !pool.AppendCertsFromPEM(b) {
+				return fmt.Errorf("no certificates found in %s", f)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.cert = cert
+	s.pool = pool
+	s.modTimes = modTimes
+	s.lastCheck = time.Now()
+	s.mu.Unlock()
+	return nil
+}
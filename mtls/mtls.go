@@ -0,0 +1,113 @@
+// Package mtls provides the TLS config of the http clients presenting a client certificate to the backend and
+// verifying it with a dedicated CA bundle and server name.
+//
+// Sample backend extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/mtls": {
+//			"cert_file": "/etc/krakend/certs/client.pem",
+//			"key_file": "/etc/krakend/certs/client-key.pem",
+//			"ca_files": ["/etc/krakend/certs/backend-ca.pem"],
+//			"server_name": "payments.internal",
+//			"reload_interval": "30s"
+//		},
+//		...
+//	},
+//	...
+//
+// The files are checked every reload_interval and loaded again when they are modified, so the rotated
+// certificates are used by the new connections without restarting the gateway. When no CA files are
+// defined, the backend certificate is verified with the system roots.
+//
+// The TLS config is set on the dedicated transport of the backend, so it composes with the rest of the http
+// client layers. Notice the oauth2 token endpoint is still reached without the client certificate.
+package mtls
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/mtls"
+
+const defaultReloadInterval = time.Minute
+
+var (
+	errNoConfig  = errors.New("mtls: no config")
+	errBadConfig = errors.New("mtls: unable to parse the config")
+	errNoKeyPair = errors.New("mtls: the cert_file and the key_file must be defined together")
+)
+
+// Config is the custom config struct containing the params for the mTLS client
+type Config struct {
+	CertFile       string
+	KeyFile        string
+	CAFiles        []string
+	ServerName     string
+	ReloadInterval time.Duration
+}
+
+type rawConfig struct {
+	CertFile       string   `json:"cert_file"`
+	KeyFile        string   `json:"key_file"`
+	CAFiles        []string `json:"ca_files"`
+	ServerName     string   `json:"server_name"`
+	ReloadInterval string   `json:"reload_interval"`
+}
+
+func getConfig(e config.ExtraConfig) (Config, error) {
+	v, ok := e[Namespace]
+	if !ok {
+		return Config{}, errNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, errBadConfig
+	}
+	raw := rawConfig{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return Config{}, errBadConfig
+	}
+	if (raw.CertFile == "") != (raw.KeyFile == "") {
+		return Config{}, errNoKeyPair
+	}
+
+	cfg := Config{
+		CertFile:       raw.CertFile,
+		KeyFile:        raw.KeyFile,
+		CAFiles:        raw.CAFiles,
+		ServerName:     raw.ServerName,
+		ReloadInterval: defaultReloadInterval,
+	}
+	if d, err := time.ParseDuration(raw.ReloadInterval); err == nil && d > 0 {
+		cfg.ReloadInterval = d
+	}
+	return cfg, nil
+}
+
+// TLSClientConfig returns the TLS config presenting the configured client certificate and verifying the
+// server with the configured CA bundle and server name. It returns nil for the backends without a valid
+// mTLS config.
+func TLSClientConfig(remote *config.Backend, logger logging.Logger) *tls.Config {
+	cfg, err := getConfig(remote.ExtraConfig)
+	if err != nil {
+		if err != errNoConfig {
+			logger.Error(err.Error(), remote.URLPattern)
+		}
+		return nil
+	}
+	s, err := newCertStore(cfg, logger)
+	if err != nil {
+		logger.Error("mtls:", err.Error(), remote.URLPattern)
+		return nil
+	}
+	return s.tlsConfig()
+}
@@ -0,0 +1,219 @@
+package mtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+func TestTLSClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newCA(t)
+	ca.writeCert(t, filepath.Join(dir, "ca.pem"))
+	ca.issue(t, "gateway-1", false).write(t, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	serverCert := ca.issue(t, "backend.test", true)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool(),
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	remote := &config.Backend{
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"cert_file":       filepath.Join(dir, "client.pem"),
+				"key_file":        filepath.Join(dir, "client-key.pem"),
+				"ca_files":        []interface{}{filepath.Join(dir, "ca.pem")},
+				"server_name":     "backend.test",
+				"reload_interval": "1ms",
+			},
+		},
+	}
+	c := newClient(t, remote)
+
+	if cn := get(t, c, backend.URL); cn != "gateway-1" {
+		t.Errorf("unexpected client certificate: %s", cn)
+	}
+
+	ca.issue(t, "gateway-2", false).write(t, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+	future := time.Now().Add(time.Minute)
+	for _, f := range []string{"client.pem", "client-key.pem"} {
+		if err := os.Chtimes(filepath.Join(dir, f), future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	c.CloseIdleConnections()
+
+	if cn := get(t, c, backend.URL); cn != "gateway-2" {
+		t.Errorf("the rotated client certificate should be used. have: %s", cn)
+	}
+}
+
+func TestTLSClientConfig_untrustedServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newCA(t).writeCert(t, filepath.Join(dir, "ca.pem"))
+
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {}))
+	defer backend.Close()
+
+	remote := &config.Backend{
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"ca_files": []interface{}{filepath.Join(dir, "ca.pem")},
+			},
+		},
+	}
+	c := newClient(t, remote)
+	if resp, err := c.Get(backend.URL); err == nil {
+		resp.Body.Close()
+		t.Error("the server certificate should be rejected")
+	}
+}
+
+func TestTLSClientConfig_fallback(t *testing.T) {
+	for _, e := range []config.ExtraConfig{
+		{},
+		{Namespace: map[string]interface{}{"cert_file": "client.pem"}},
+		{Namespace: map[string]interface{}{"cert_file": "unknown.pem", "key_file": "unknown-key.pem"}},
+	} {
+		if cfg := TLSClientConfig(&config.Backend{ExtraConfig: e}, logging.NoOp); cfg != nil {
+			t.Errorf("no TLS config expected with the config %v", e)
+		}
+	}
+}
+
+func newClient(t *testing.T, remote *config.Backend) *http.Client {
+	cfg := TLSClientConfig(remote, logging.NoOp)
+	if cfg == nil {
+		t.Fatal("no TLS config")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return &http.Client{Transport: transport}
+}
+
+func get(t *testing.T, c *http.Client, url string) string {
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T) testCert {
+	return newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func (ca testCert) issue(t *testing.T, name string, server bool) testCert {
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		tmpl.DNSNames = []string{name}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	return newCert(t, tmpl, &ca)
+}
+
+func newCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCert{cert: cert, der: der, key: key}
+}
+
+func (c testCert) pool() *x509.CertPool {
+	p := x509.NewCertPool()
+	p.AddCert(c.cert)
+	return p
+}
+
+func (c testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func (c testCert) writeCert(t *testing.T, path string) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c testCert) write(t *testing.T, certPath, keyPath string) {
+	c.writeCert(t, certPath)
+	b, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
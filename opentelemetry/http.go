@@ -0,0 +1,56 @@
+package opentelemetry
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	transport "github.com/luraproject/lura/transport/http/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HTTPRequestExecutor decorates the executor of the backend with a client span per request, injecting the
+// trace context and the baggage into the request headers. It returns the received executor if the
+// http_client layer is not enabled.
+func HTTPRequestExecutor(next transport.HTTPRequestExecutor, cfg *config.Backend) transport.HTTPRequestExecutor {
+	s, ok := enabled()
+	if !ok || !s.layers.HTTPClient {
+		return next
+	}
+	name := "http-client-" + cfg.URLPattern
+	return func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		ctx, span := s.tracer.Start(
+			fromContext(ctx),
+			name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...),
+		)
+		s.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+		resp, err := next(ctx, req.WithContext(ctx))
+
+		attrs := []attribute.KeyValue{
+			semconv.HTTPHostKey.String(req.Host),
+			semconv.HTTPMethodKey.String(req.Method),
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else {
+			span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(resp.StatusCode)...)
+			span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(resp.StatusCode))
+			attrs = append(attrs, semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		}
+		span.End()
+
+		s.instruments.httpClientRequests.Add(ctx, 1, attrs...)
+		s.instruments.httpClientDuration.Record(ctx, milliseconds(time.Since(start)), attrs...)
+		return resp, err
+	}
+}
@@ -0,0 +1,455 @@
+// Package opentelemetry instruments the gateway with OpenTelemetry, exporting the traces and the metrics to
+// a collector with the OTLP protocol, over gRPC or HTTP.
+//
+// Sample service extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/opentelemetry": {
+//			"service_name": "krakend-gateway",
+//			"sample_rate": 0.25,
+//			"metric_reporting_period": "30s",
+//			"exporter": {
+//				"protocol": "grpc",
+//				"endpoint": "otel-collector:4317",
+//				"insecure": true,
+//				"headers": {"x-tenant": "platform"},
+//				"timeout": "5s"
+//			},
+//			"enabled_layers": {
+//				"router": true,
+//				"pipe": true,
+//				"backend": true,
+//				"http_client": true
+//			},
+//			"propagators": ["tracecontext", "baggage"]
+//		},
+//		...
+//	},
+//	...
+//
+// The service_name defaults to the name of the service config or, if it is empty, to "krakend".
+//
+// The instrumented layers are the same ones covered by the opencensus component: the router handler, the
+// proxy pipe, the backend and the HTTP client executor. All of them are enabled when the enabled_layers are
+// not declared. Every layer records a span and a duration histogram, in milliseconds, and the router and
+// the HTTP client also count the requests.
+//
+// The W3C trace context and baggage received by the router are the parents of the spans of the request,
+// and they are injected into the requests sent to the backends. The propagators default to both of them.
+//
+// The component is enabled by the presence of its namespace and it does not replace the opencensus one, so
+// both of them can be used at the same time while migrating the exporters.
+package opentelemetry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/core"
+	"github.com/luraproject/lura/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/unit"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/metric/aggregator/histogram"
+	controller "go.opentelemetry.io/otel/sdk/metric/controller/basic"
+	processor "go.opentelemetry.io/otel/sdk/metric/processor/basic"
+	"go.opentelemetry.io/otel/sdk/metric/selector/simple"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/opentelemetry"
+
+// ContextKey is the key of the gin context holding the context of the router span, since the proxies
+// receive a context derived from the gin one and not from the request
+const ContextKey = "opentelemetry-request-context"
+
+const (
+	instrumentationName   = "github.com/devopsfaith/krakend-ce/opentelemetry"
+	defaultServiceName    = "krakend"
+	defaultReportPeriod   = time.Minute
+	defaultShutdownPeriod = time.Second
+
+	protocolGRPC = "grpc"
+	protocolHTTP = "http"
+)
+
+// durationBoundaries are the buckets of the duration histograms, in milliseconds
+var durationBoundaries = []float64{5, 10, 25, 50, 75, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+
+var (
+	errBadConfig          = errors.New("opentelemetry: unable to parse the config")
+	errUnknownPropagator  = errors.New("opentelemetry: unknown propagator")
+	errBadSampleRate      = errors.New("opentelemetry: the sample_rate must be between 0 and 1")
+	errNothingToExport    = errors.New("opentelemetry: the traces and the metrics are disabled")
+	errUnknownExportProto = errors.New("opentelemetry: unknown exporter protocol")
+)
+
+// Config is the custom config struct containing the params for the OpenTelemetry component
+type Config struct {
+	ServiceName           string         `json:"service_name"`
+	SampleRate            *float64       `json:"sample_rate"`
+	MetricReportingPeriod string         `json:"metric_reporting_period"`
+	Exporter              ExporterConfig `json:"exporter"`
+	EnabledLayers         *Layers        `json:"enabled_layers"`
+	Propagators           []string       `json:"propagators"`
+}
+
+// ExporterConfig defines the connection to the collector. The endpoint defaults to the one of the OTLP
+// exporters for the protocol (localhost:4317 for grpc and localhost:4318 for http).
+type ExporterConfig struct {
+	Protocol       string            `json:"protocol"`
+	Endpoint       string            `json:"endpoint"`
+	Insecure       bool              `json:"insecure"`
+	Headers        map[string]string `json:"headers"`
+	Timeout        string            `json:"timeout"`
+	DisableTraces  bool              `json:"disable_traces"`
+	DisableMetrics bool              `json:"disable_metrics"`
+}
+
+// Layers flags the instrumented layers
+type Layers struct {
+	Router     bool `json:"router"`
+	Pipe       bool `json:"pipe"`
+	Backend    bool `json:"backend"`
+	HTTPClient bool `json:"http_client"`
+}
+
+var allLayers = Layers{Router: true, Pipe: true, Backend: true, HTTPClient: true}
+
+func parseConfig(e config.ExtraConfig) (Config, bool, error) {
+	v, ok := e[Namespace]
+	if !ok {
+		return Config{}, false, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, true, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, true, errBadConfig
+	}
+	if cfg.SampleRate != nil && (*cfg.SampleRate < 0 || *cfg.SampleRate > 1) {
+		return Config{}, true, errBadSampleRate
+	}
+	if cfg.EnabledLayers == nil {
+		cfg.EnabledLayers = &allLayers
+	}
+	if cfg.Propagators == nil {
+		cfg.Propagators = []string{"tracecontext", "baggage"}
+	}
+	switch cfg.Exporter.Protocol {
+	case "":
+		cfg.Exporter.Protocol = protocolGRPC
+	case protocolGRPC, protocolHTTP:
+	default:
+		return Config{}, true, errUnknownExportProto
+	}
+	if cfg.Exporter.DisableTraces && cfg.Exporter.DisableMetrics {
+		return Config{}, true, errNothingToExport
+	}
+	return cfg, true, nil
+}
+
+func newPropagator(names []string) (propagation.TextMapPropagator, error) {
+	ps := make([]propagation.TextMapPropagator, 0, len(names))
+	for _, n := range names {
+		switch n {
+		case "tracecontext":
+			ps = append(ps, propagation.TraceContext{})
+		case "baggage":
+			ps = append(ps, propagation.Baggage{})
+		default:
+			return nil, fmt.Errorf("%s: %q", errUnknownPropagator.Error(), n)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(ps...), nil
+}
+
+// Register starts the exporters defined at the service config and enables the instrumentation of the
+// layers. The providers are flushed and stopped once the context is cancelled. Without config, the
+// component stays disabled.
+func Register(ctx context.Context, cfg config.ServiceConfig, l logging.Logger) error {
+	_, err := RegisterWithDone(ctx, cfg, l)
+	return err
+}
+
+// RegisterWithDone is like Register, also returning a channel closed once the providers are flushed and
+// stopped after the cancellation of the context. The channel is already closed when the component is not
+// enabled.
+func RegisterWithDone(ctx context.Context, cfg config.ServiceConfig, l logging.Logger) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	oCfg, ok, err := parseConfig(cfg.ExtraConfig)
+	if !ok || err != nil {
+		close(done)
+		return done, err
+	}
+	if oCfg.ServiceName == "" {
+		oCfg.ServiceName = cfg.Name
+	}
+	if oCfg.ServiceName == "" {
+		oCfg.ServiceName = defaultServiceName
+	}
+	prop, err := newPropagator(oCfg.Propagators)
+	if err != nil {
+		close(done)
+		return done, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(oCfg.ServiceName),
+		semconv.ServiceVersionKey.String(core.KrakendVersion),
+	))
+	if err != nil {
+		close(done)
+		return done, fmt.Errorf("opentelemetry: %s", err.Error())
+	}
+
+	var tp trace.TracerProvider = trace.NewNoopTracerProvider()
+	shutdowns := []func(context.Context) error{}
+	// fail stops the providers already started
+	fail := func(err error) (<-chan struct{}, error) {
+		for _, shutdown := range shutdowns {
+			shutdown(context.Background())
+		}
+		close(done)
+		return done, fmt.Errorf("opentelemetry: %s", err.Error())
+	}
+	if !oCfg.Exporter.DisableTraces {
+		exporter, err := otlptrace.New(ctx, newTraceClient(oCfg.Exporter))
+		if err != nil {
+			return fail(err)
+		}
+		sampler := sdktrace.AlwaysSample()
+		if oCfg.SampleRate != nil {
+			sampler = sdktrace.TraceIDRatioBased(*oCfg.SampleRate)
+		}
+		sdkProvider := sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(res),
+			sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		)
+		tp = sdkProvider
+		shutdowns = append(shutdowns, sdkProvider.Shutdown)
+	}
+
+	mp := metric.NewNoopMeterProvider()
+	if !oCfg.Exporter.DisableMetrics {
+		exporter, err := newMetricExporter(ctx, oCfg.Exporter)
+		if err != nil {
+			return fail(err)
+		}
+		period := defaultReportPeriod
+		if d, err := time.ParseDuration(oCfg.MetricReportingPeriod); err == nil && d > 0 {
+			period = d
+		}
+		pusher := controller.New(
+			processor.NewFactory(
+				simple.NewWithHistogramDistribution(histogram.WithExplicitBoundaries(durationBoundaries)),
+				exporter,
+			),
+			controller.WithExporter(exporter),
+			controller.WithResource(res),
+			controller.WithCollectPeriod(period),
+		)
+		if err := pusher.Start(ctx); err != nil {
+			exporter.Shutdown(context.Background())
+			return fail(err)
+		}
+		mp = pusher
+		shutdowns = append(shutdowns, pusher.Stop)
+	}
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(prop)
+	global.SetMeterProvider(mp)
+	enable(newState(*oCfg.EnabledLayers, tp, mp.Meter(instrumentationName), prop))
+
+	go func() {
+		<-ctx.Done()
+		sCtx, cancel := context.WithTimeout(context.Background(), defaultShutdownPeriod)
+		defer cancel()
+		defer close(done)
+		for _, shutdown := range shutdowns {
+			if err := shutdown(sCtx); err != nil {
+				l.Warning("opentelemetry: unable to flush the exporter:", err.Error())
+			}
+		}
+	}()
+
+	l.Info(fmt.Sprintf("opentelemetry: exporting to the collector with %s", oCfg.Exporter.Protocol))
+	return done, nil
+}
+
+func newTraceClient(cfg ExporterConfig) otlptrace.Client {
+	timeout, _ := time.ParseDuration(cfg.Timeout)
+	if cfg.Protocol == protocolHTTP {
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		if timeout > 0 {
+			opts = append(opts, otlptracehttp.WithTimeout(timeout))
+		}
+		return otlptracehttp.NewClient(opts...)
+	}
+
+	opts := []otlptracegrpc.Option{}
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(cfg.Headers))
+	}
+	if timeout > 0 {
+		opts = append(opts, otlptracegrpc.WithTimeout(timeout))
+	}
+	return otlptracegrpc.NewClient(opts...)
+}
+
+func newMetricExporter(ctx context.Context, cfg ExporterConfig) (*otlpmetric.Exporter, error) {
+	timeout, _ := time.ParseDuration(cfg.Timeout)
+	if cfg.Protocol == protocolHTTP {
+		opts := []otlpmetrichttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(cfg.Headers))
+		}
+		if timeout > 0 {
+			opts = append(opts, otlpmetrichttp.WithTimeout(timeout))
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+
+	opts := []otlpmetricgrpc.Option{}
+	if cfg.Endpoint != "" {
+		opts = append(opts, otlpmetricgrpc.WithEndpoint(cfg.Endpoint))
+	}
+	if cfg.Insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(cfg.Headers))
+	}
+	if timeout > 0 {
+		opts = append(opts, otlpmetricgrpc.WithTimeout(timeout))
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
+
+// state is the instrumentation enabled by the last registration
+type state struct {
+	layers      Layers
+	tracer      trace.Tracer
+	propagator  propagation.TextMapPropagator
+	instruments instruments
+}
+
+type instruments struct {
+	routerRequests     metric.Int64Counter
+	routerDuration     metric.Float64Histogram
+	pipeDuration       metric.Float64Histogram
+	backendDuration    metric.Float64Histogram
+	httpClientRequests metric.Int64Counter
+	httpClientDuration metric.Float64Histogram
+}
+
+func newState(layers Layers, tp trace.TracerProvider, meter metric.Meter, prop propagation.TextMapPropagator) *state {
+	m := metric.Must(meter)
+	ms := metric.WithUnit(unit.Milliseconds)
+	return &state{
+		layers:     layers,
+		tracer:     tp.Tracer(instrumentationName),
+		propagator: prop,
+		instruments: instruments{
+			routerRequests:     m.NewInt64Counter("krakend.router.requests", metric.WithDescription("Requests received by the router")),
+			routerDuration:     m.NewFloat64Histogram("krakend.router.duration", ms, metric.WithDescription("Duration of the router handlers")),
+			pipeDuration:       m.NewFloat64Histogram("krakend.pipe.duration", ms, metric.WithDescription("Duration of the endpoint proxies")),
+			backendDuration:    m.NewFloat64Histogram("krakend.backend.duration", ms, metric.WithDescription("Duration of the backend proxies")),
+			httpClientRequests: m.NewInt64Counter("krakend.http_client.requests", metric.WithDescription("Requests sent to the backends")),
+			httpClientDuration: m.NewFloat64Histogram("krakend.http_client.duration", ms, metric.WithDescription("Duration of the requests sent to the backends")),
+		},
+	}
+}
+
+var current atomic.Value
+
+func enable(s *state) {
+	current.Store(s)
+}
+
+// enabled returns the registered state, if any
+func enabled() (*state, bool) {
+	s, ok := current.Load().(*state)
+	return s, ok && s != nil
+}
+
+// TraceID returns the ID of the trace of the request of the context, if the router layer recorded it. The
+// context must be the gin one or derive from it.
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(fromContext(ctx))
+	if !sc.IsValid() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// fromContext returns a context holding the span and the baggage of the router, if the received one was
+// derived from the gin context instead of the request one
+func fromContext(ctx context.Context) context.Context {
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx
+	}
+	parent, ok := ctx.Value(ContextKey).(context.Context)
+	if !ok {
+		return ctx
+	}
+	ctx = trace.ContextWithSpan(ctx, trace.SpanFromContext(parent))
+	return baggage.ContextWithBaggage(ctx, baggage.FromContext(parent))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func errorAttrs(complete bool, err error) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Bool("krakend.complete", complete),
+		attribute.Bool("krakend.error", err != nil),
+	}
+}
@@ -0,0 +1,165 @@
+package opentelemetry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstrumentation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prop := propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+	enable(newState(allLayers, tp, metric.NewNoopMeterProvider().Meter(""), prop))
+	defer enable(nil)
+
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	backendCfg := &config.Backend{URLPattern: "/users"}
+	executor := HTTPRequestExecutor(func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		return http.DefaultClient.Do(req)
+	}, backendCfg)
+	bf := BackendFactory(func(_ *config.Backend) proxy.Proxy {
+		return func(ctx context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			req, _ := http.NewRequest("GET", backend.URL, nil)
+			resp, err := executor(ctx, req.WithContext(ctx))
+			if err != nil {
+				return nil, err
+			}
+			resp.Body.Close()
+			return &proxy.Response{IsComplete: true}, nil
+		}
+	})
+	pf := ProxyFactory(proxy.FactoryFunc(func(_ *config.EndpointConfig) (proxy.Proxy, error) {
+		return bf(backendCfg), nil
+	}))
+	endpointCfg := &config.EndpointConfig{Endpoint: "/users", Method: "GET"}
+	p, err := pf(endpointCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the proxy receives the gin context, as the default endpoint handler does
+	hf := HandlerFactory(func(_ *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			if _, err := p(c, &proxy.Request{}); err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+			c.Status(http.StatusOK)
+		}
+	})
+
+	engine := gin.New()
+	engine.GET("/users", hf(endpointCfg, p))
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("baggage", "tenant=acme")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+	}
+	if len(spans) != 4 {
+		t.Fatalf("unexpected number of spans: %d", len(spans))
+	}
+	parent := "00f067aa0ba902b7"
+	for _, name := range []string{"/users", "pipe-/users", "backend-/users", "http-client-/users"} {
+		s, ok := spans[name]
+		if !ok {
+			t.Fatalf("span %s not recorded", name)
+		}
+		if id := s.SpanContext().TraceID().String(); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("unexpected trace id of the span %s: %s", name, id)
+		}
+		if id := s.Parent().SpanID().String(); id != parent {
+			t.Errorf("unexpected parent of the span %s: %s", name, id)
+		}
+		parent = s.SpanContext().SpanID().String()
+	}
+
+	if tp := received.Get("traceparent"); !strings.Contains(tp, "4bf92f3577b34da6a3ce929d0e0e4736-"+parent) {
+		t.Errorf("unexpected traceparent sent to the backend: %q", tp)
+	}
+	if b := received.Get("baggage"); b != "tenant=acme" {
+		t.Errorf("unexpected baggage sent to the backend: %q", b)
+	}
+}
+
+func TestRegister_noConfig(t *testing.T) {
+	done, err := RegisterWithDone(context.Background(), config.ServiceConfig{}, logging.NoOp)
+	if err != nil {
+		t.Error(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("the done channel of a disabled component should be closed")
+	}
+	if _, ok := enabled(); ok {
+		t.Error("the instrumentation should be disabled")
+	}
+}
+
+func TestRegister_badConfig(t *testing.T) {
+	for _, tc := range []struct {
+		cfg map[string]interface{}
+		err string
+	}{
+		{cfg: map[string]interface{}{"sample_rate": 2}, err: errBadSampleRate.Error()},
+		{cfg: map[string]interface{}{"sample_rate": "all"}, err: errBadConfig.Error()},
+		{cfg: map[string]interface{}{"exporter": map[string]interface{}{"protocol": "thrift"}}, err: errUnknownExportProto.Error()},
+		{cfg: map[string]interface{}{"propagators": []string{"b3"}}, err: errUnknownPropagator.Error() + `: "b3"`},
+		{
+			cfg: map[string]interface{}{"exporter": map[string]interface{}{"disable_traces": true, "disable_metrics": true}},
+			err: errNothingToExport.Error(),
+		},
+	} {
+		err := Register(context.Background(), config.ServiceConfig{ExtraConfig: config.ExtraConfig{Namespace: tc.cfg}}, logging.NoOp)
+		if err == nil || err.Error() != tc.err {
+			t.Errorf("unexpected error with the config %v: %v", tc.cfg, err)
+		}
+	}
+	if _, ok := enabled(); ok {
+		t.Error("the instrumentation should be disabled")
+	}
+}
+
+func TestParseConfig_defaults(t *testing.T) {
+	cfg, ok, err := parseConfig(config.ExtraConfig{Namespace: map[string]interface{}{}})
+	if !ok || err != nil {
+		t.Fatalf("unexpected result: %v %v", ok, err)
+	}
+	if cfg.Exporter.Protocol != protocolGRPC {
+		t.Errorf("unexpected protocol: %s", cfg.Exporter.Protocol)
+	}
+	if *cfg.EnabledLayers != allLayers {
+		t.Errorf("unexpected layers: %+v", *cfg.EnabledLayers)
+	}
+	if len(cfg.Propagators) != 2 {
+		t.Errorf("unexpected propagators: %v", cfg.Propagators)
+	}
+}
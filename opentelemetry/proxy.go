@@ -0,0 +1,72 @@
+package opentelemetry
+
+import (
+	"context"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/proxy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ProxyFactory decorates the proxies of the endpoints with a "pipe" span and duration histogram. It returns
+// the received factory if the pipe layer is not enabled.
+func ProxyFactory(pf proxy.Factory) proxy.FactoryFunc {
+	s, ok := enabled()
+	if !ok || !s.layers.Pipe {
+		return pf.New
+	}
+	return func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		next, err := pf.New(cfg)
+		if err != nil {
+			return next, err
+		}
+		attrs := []attribute.KeyValue{attribute.String("krakend.endpoint", cfg.Endpoint)}
+		return middleware(s, "pipe-"+cfg.Endpoint, s.instruments.pipeDuration, attrs)(next), nil
+	}
+}
+
+// BackendFactory decorates the backend proxies with a span and a duration histogram. It returns the
+// received factory if the backend layer is not enabled.
+func BackendFactory(bf proxy.BackendFactory) proxy.BackendFactory {
+	s, ok := enabled()
+	if !ok || !s.layers.Backend {
+		return bf
+	}
+	return func(cfg *config.Backend) proxy.Proxy {
+		attrs := []attribute.KeyValue{attribute.String("krakend.backend", cfg.URLPattern)}
+		return middleware(s, "backend-"+cfg.URLPattern, s.instruments.backendDuration, attrs)(bf(cfg))
+	}
+}
+
+func middleware(s *state, name string, duration metric.Float64Histogram, attrs []attribute.KeyValue) proxy.Middleware {
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		if len(next) < 1 {
+			panic(proxy.ErrNotEnoughProxies)
+		}
+		return func(ctx context.Context, req *proxy.Request) (*proxy.Response, error) {
+			start := time.Now()
+			ctx, span := s.tracer.Start(fromContext(ctx), name, trace.WithAttributes(attrs...))
+			resp, err := next[0](ctx, req)
+
+			complete := resp != nil && resp.IsComplete
+			if err == context.Canceled {
+				span.SetAttributes(attribute.Bool("krakend.canceled", true))
+			} else if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.SetAttributes(attribute.Bool("krakend.complete", complete))
+			span.End()
+
+			duration.Record(ctx, milliseconds(time.Since(start)), append(errorAttrs(complete, err), attrs...)...)
+			return resp, err
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package opentelemetry
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HandlerFactory decorates the next handler factory with a server span per request, child of the trace
+// context received, and the router metrics. It returns the next one if the router layer is not enabled.
+func HandlerFactory(next router.HandlerFactory) router.HandlerFactory {
+	s, ok := enabled()
+	if !ok || !s.layers.Router {
+		return next
+	}
+	return func(cfg *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := next(cfg, p)
+		name := cfg.Endpoint
+		routeAttrs := []attribute.KeyValue{semconv.HTTPRouteKey.String(cfg.Endpoint), semconv.HTTPMethodKey.String(cfg.Method)}
+
+		return func(c *gin.Context) {
+			start := time.Now()
+			ctx := s.propagator.Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+			ctx, span := s.tracer.Start(
+				ctx,
+				name,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("", cfg.Endpoint, c.Request)...),
+				trace.WithAttributes(semconv.NetAttributesFromHTTPRequest("tcp", c.Request)...),
+			)
+			c.Request = c.Request.WithContext(ctx)
+			c.Set(ContextKey, ctx)
+
+			handler(c)
+
+			status := c.Writer.Status()
+			span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+			span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(status))
+			span.End()
+
+			attrs := append([]attribute.KeyValue{semconv.HTTPStatusCodeKey.Int(status)}, routeAttrs...)
+			s.instruments.routerRequests.Add(ctx, 1, attrs...)
+			s.instruments.routerDuration.Record(ctx, milliseconds(time.Since(start)), attrs...)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package krakend
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
 	"github.com/luraproject/lura/logging"
 	client "github.com/luraproject/lura/transport/http/client/plugin"
 	server "github.com/luraproject/lura/transport/http/server/plugin"
@@ -8,29 +14,90 @@ import (
 
 // LoadPlugins loads and registers the plugins so they can be used if enabled at the configuration
 func LoadPlugins(folder, pattern string, logger logging.Logger) {
+	loadPlugins(folder, pattern, logger)
+}
+
+func loadPlugins(folder, pattern string, logger logging.Logger) error {
+	var errs []error
 	n, err := client.Load(
 		folder,
 		pattern,
-		client.RegisterClient,
+		func(name string, handler func(context.Context, map[string]interface{}) (http.Handler, error)) {
+			registeredPlugins.add(pluginTypeClient, name)
+			client.RegisterClient(name, handler)
+		},
 	)
 	if err != nil {
 		logger.Warning("loading plugins:", err)
+		errs = append(errs, err)
 	}
 	logger.Info("total http executor plugins loaded:", n)
 
 	n, err = server.Load(
 		folder,
 		pattern,
-		server.RegisterHandler,
+		func(name string, handler func(context.Context, map[string]interface{}, http.Handler) (http.Handler, error)) {
+			registeredPlugins.add(pluginTypeServer, name)
+			server.RegisterHandler(name, handler)
+		},
 	)
 	if err != nil {
 		logger.Warning("loading plugins:", err)
+		errs = append(errs, err)
 	}
 	logger.Info("total http handler plugins loaded:", n)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("loading plugins: %v", errs)
+	}
+	return nil
 }
 
-type pluginLoader struct{}
+// LoadedPlugins returns the names of the plugins registered by LoadPlugins, grouped by type
+func LoadedPlugins() map[string][]string {
+	return registeredPlugins.list()
+}
+
+const (
+	pluginTypeClient = "http_client"
+	pluginTypeServer = "http_server"
+)
+
+var registeredPlugins = &pluginNames{names: map[string][]string{}}
+
+type pluginNames struct {
+	mu    sync.RWMutex
+	names map[string][]string
+}
+
+func (p *pluginNames) add(kind, name string) {
+	p.mu.Lock()
+	p.names[kind] = append(p.names[kind], name)
+	p.mu.Unlock()
+}
+
+func (p *pluginNames) list() map[string][]string {
+	res := map[string][]string{
+		pluginTypeClient: {},
+		pluginTypeServer: {},
+	}
+	p.mu.RLock()
+	for k, names := range p.names {
+		res[k] = append([]string{}, names...)
+		sort.Strings(res[k])
+	}
+	p.mu.RUnlock()
+	return res
+}
+
+type pluginLoader struct {
+	err error
+}
+
+func (d *pluginLoader) Load(folder, pattern string, logger logging.Logger) {
+	d.err = loadPlugins(folder, pattern, logger)
+}
 
-func (d pluginLoader) Load(folder, pattern string, logger logging.Logger) {
-	LoadPlugins(folder, pattern, logger)
+func (d *pluginLoader) Health() error {
+	return d.err
 }
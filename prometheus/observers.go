@@ -0,0 +1,214 @@
+package prometheus
+
+import (
+	"regexp"
+	"sync"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// otherLabelValue replaces the values of a label once it reaches the max number of values
+const otherLabelValue = "other"
+
+// the names of the metrics recorded by the collector, relative to its registry
+var (
+	routerStatusPattern    = regexp.MustCompile(`^router\.response\.(.+)\.status\.(\d{3})\.count$`)
+	routerHistogramPattern = regexp.MustCompile(`^router\.response\.(.+)\.(time|size)$`)
+	proxyPattern           = regexp.MustCompile(`^proxy\.(requests|latency)\.layer\.(pipe|backend)\.name\.(.+)\.complete\.(true|false)\.error\.(true|false)$`)
+)
+
+// observers are the Prometheus series fed by the collector metrics. The series resolved for every metric
+// name are cached, since the collector gets the metrics by name on every request.
+type observers struct {
+	routerRequests  *prom.CounterVec
+	routerDuration  *prom.HistogramVec
+	routerSize      *prom.HistogramVec
+	proxyRequests   *prom.CounterVec
+	proxyDuration   *prom.HistogramVec
+	backendRequests *prom.CounterVec
+	backendDuration *prom.HistogramVec
+
+	endpoints *labelLimiter
+	backends  *labelLimiter
+
+	counters   sync.Map
+	histograms sync.Map
+}
+
+func newObservers(registry prom.Registerer, cfg Config) *observers {
+	proxyLabels := []string{"endpoint", "complete", "error"}
+	backendLabels := []string{"backend", "complete", "error"}
+	o := &observers{
+		routerRequests: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: "krakend", Subsystem: "router", Name: "requests_total",
+			Help: "Requests handled by the router.",
+		}, []string{"endpoint", "status"}),
+		routerDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: "krakend", Subsystem: "router", Name: "response_duration_seconds",
+			Help: "Duration of the router responses.", Buckets: cfg.DurationBuckets,
+		}, []string{"endpoint"}),
+		routerSize: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: "krakend", Subsystem: "router", Name: "response_size_bytes",
+			Help: "Size of the router responses.", Buckets: cfg.SizeBuckets,
+		}, []string{"endpoint"}),
+		proxyRequests: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: "krakend", Subsystem: "proxy", Name: "requests_total",
+			Help: "Requests handled by the endpoint proxies.",
+		}, proxyLabels),
+		proxyDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: "krakend", Subsystem: "proxy", Name: "duration_seconds",
+			Help: "Duration of the endpoint proxies.", Buckets: cfg.DurationBuckets,
+		}, proxyLabels),
+		backendRequests: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: "krakend", Subsystem: "backend", Name: "requests_total",
+			Help: "Requests sent to the backends.",
+		}, backendLabels),
+		backendDuration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: "krakend", Subsystem: "backend", Name: "duration_seconds",
+			Help: "Duration of the backend proxies.", Buckets: cfg.DurationBuckets,
+		}, backendLabels),
+		endpoints: newLabelLimiter(cfg.MaxLabelValues),
+		backends:  newLabelLimiter(cfg.MaxLabelValues),
+	}
+	registry.MustRegister(
+		o.routerRequests,
+		o.routerDuration,
+		o.routerSize,
+		o.proxyRequests,
+		o.proxyDuration,
+		o.backendRequests,
+		o.backendDuration,
+	)
+	return o
+}
+
+// counter returns the series for the counter of the collector, if it is exported
+func (o *observers) counter(name string) (prom.Counter, bool) {
+	if c, ok := o.counters.Load(name); ok {
+		return c.(prom.Counter), true
+	}
+	var c prom.Counter
+	if m := routerStatusPattern.FindStringSubmatch(name); m != nil {
+		c = o.routerRequests.WithLabelValues(o.endpoints.value(m[1]), m[2])
+	} else if m := proxyPattern.FindStringSubmatch(name); m != nil && m[1] == "requests" {
+		if m[2] == "pipe" {
+			c = o.proxyRequests.WithLabelValues(o.endpoints.value(m[3]), m[4], m[5])
+		} else {
+			c = o.backendRequests.WithLabelValues(o.backends.value(m[3]), m[4], m[5])
+		}
+	}
+	if c == nil {
+		return nil, false
+	}
+	actual, _ := o.counters.LoadOrStore(name, c)
+	return actual.(prom.Counter), true
+}
+
+// histogram returns the series for the histogram of the collector, if it is exported, and the factor
+// converting the recorded values to the unit of the series
+func (o *observers) histogram(name string) (scaledObserver, bool) {
+	if h, ok := o.histograms.Load(name); ok {
+		return h.(scaledObserver), true
+	}
+	var h scaledObserver
+	if m := routerHistogramPattern.FindStringSubmatch(name); m != nil {
+		if m[2] == "time" {
+			h = scaledObserver{o.routerDuration.WithLabelValues(o.endpoints.value(m[1])), 1e-9}
+		} else {
+			h = scaledObserver{o.routerSize.WithLabelValues(o.endpoints.value(m[1])), 1}
+		}
+	} else if m := proxyPattern.FindStringSubmatch(name); m != nil && m[1] == "latency" {
+		if m[2] == "pipe" {
+			h = scaledObserver{o.proxyDuration.WithLabelValues(o.endpoints.value(m[3]), m[4], m[5]), 1e-9}
+		} else {
+			h = scaledObserver{o.backendDuration.WithLabelValues(o.backends.value(m[3]), m[4], m[5]), 1e-9}
+		}
+	}
+	if h.Observer == nil {
+		return scaledObserver{}, false
+	}
+	actual, _ := o.histograms.LoadOrStore(name, h)
+	return actual.(scaledObserver), true
+}
+
+// scaledObserver converts the values before observing them, since the collector records the durations
+// in nanoseconds
+type scaledObserver struct {
+	prom.Observer
+	factor float64
+}
+
+func (s scaledObserver) observe(v int64) {
+	s.Observe(float64(v) * s.factor)
+}
+
+// labelLimiter caps the number of values of a label
+type labelLimiter struct {
+	max    int
+	mu     sync.Mutex
+	values map[string]struct{}
+}
+
+func newLabelLimiter(max int) *labelLimiter {
+	return &labelLimiter{max: max, values: map[string]struct{}{}}
+}
+
+// value returns the received value or, if the label already has the max number of values, the
+// otherLabelValue
+func (l *labelLimiter) value(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.values[v]; ok {
+		return v
+	}
+	if len(l.values) >= l.max {
+		return otherLabelValue
+	}
+	l.values[v] = struct{}{}
+	return v
+}
+
+// registry wraps the registry of the collector, so the counters and the histograms it returns also feed
+// the exported series
+type registry struct {
+	gometrics.Registry
+	observers *observers
+}
+
+func (r *registry) GetOrRegister(name string, i interface{}) interface{} {
+	v := r.Registry.GetOrRegister(name, i)
+	switch m := v.(type) {
+	case gometrics.Counter:
+		if c, ok := r.observers.counter(name); ok {
+			return counter{Counter: m, series: c}
+		}
+	case gometrics.Histogram:
+		if h, ok := r.observers.histogram(name); ok {
+			return histogram{Histogram: m, series: h}
+		}
+	}
+	return v
+}
+
+type counter struct {
+	gometrics.Counter
+	series prom.Counter
+}
+
+func (c counter) Inc(i int64) {
+	c.Counter.Inc(i)
+	if i > 0 {
+		c.series.Add(float64(i))
+	}
+}
+
+type histogram struct {
+	gometrics.Histogram
+	series scaledObserver
+}
+
+func (h histogram) Update(v int64) {
+	h.Histogram.Update(v)
+	h.series.observe(v)
+}
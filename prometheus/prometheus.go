@@ -0,0 +1,212 @@
+// Package prometheus exposes the router, proxy and backend metrics recorded by the gin metrics collector
+// in the Prometheus text format, on a dedicated listener.
+//
+// Sample service extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-metrics": {
+//			"collection_time": "60s",
+//			"listen_address": ":8090"
+//		},
+//		"github_com/devopsfaith/krakend-ce/prometheus": {
+//			"listen_address": ":9091",
+//			"path": "/metrics",
+//			"duration_buckets": [0.005, 0.01, 0.05, 0.1, 0.5, 1, 5],
+//			"size_buckets": [128, 1024, 8192, 65536, 524288],
+//			"max_label_values": 500
+//		},
+//		...
+//	},
+//	...
+//
+// The metrics collector must be enabled, since the exporter observes the values it records: every counter
+// increment and every histogram update of the collector is also added to the Prometheus series. The layers
+// disabled at the collector config are not exported either. The exported series are:
+//
+//	krakend_router_requests_total{endpoint, status}
+//	krakend_router_response_duration_seconds{endpoint}
+//	krakend_router_response_size_bytes{endpoint}
+//	krakend_proxy_requests_total{endpoint, complete, error}
+//	krakend_proxy_duration_seconds{endpoint, complete, error}
+//	krakend_backend_requests_total{backend, complete, error}
+//	krakend_backend_duration_seconds{backend, complete, error}
+//	krakend_slo_requests{method, endpoint, sli, window}
+//	krakend_slo_good_requests{method, endpoint, sli, window}
+//	krakend_slo_burn_rate{method, endpoint, sli, window}
+//	krakend_slo_error_budget_remaining{method, endpoint, sli}
+//
+// along with the go runtime and process collectors. The listen_address defaults to ":9091", the path to
+// "/metrics", the duration buckets to the Prometheus default ones and the size buckets to powers of 10 from
+// 100 bytes to 10MB.
+//
+// The max_label_values (1000 by default) caps the number of values of the endpoint and the backend labels.
+// Once it is reached, the new values are reported as "other", so the series count stays bounded.
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	krakendmetrics "github.com/devopsfaith/krakend-metrics"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/prometheus"
+
+const (
+	// collectorPrefix is the prefix of the names of the metrics in the registry of the collector
+	collectorPrefix       = "krakend."
+	defaultListenAddress  = ":9091"
+	defaultPath           = "/metrics"
+	defaultMaxLabelValues = 1000
+)
+
+var defaultSizeBuckets = prom.ExponentialBuckets(100, 10, 6)
+
+var (
+	errBadConfig   = errors.New("prometheus: unable to parse the config")
+	errNoCollector = errors.New("prometheus: the metrics collector is not enabled")
+)
+
+// Config is the custom config struct containing the params for the Prometheus exporter
+type Config struct {
+	ListenAddress   string    `json:"listen_address"`
+	Path            string    `json:"path"`
+	DurationBuckets []float64 `json:"duration_buckets"`
+	SizeBuckets     []float64 `json:"size_buckets"`
+	MaxLabelValues  int       `json:"max_label_values"`
+}
+
+func getConfig(e config.ExtraConfig) (Config, bool, error) {
+	v, ok := e[Namespace]
+	if !ok {
+		return Config{}, false, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, true, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, true, errBadConfig
+	}
+	if cfg.ListenAddress == "" {
+		cfg.ListenAddress = defaultListenAddress
+	}
+	if cfg.Path == "" {
+		cfg.Path = defaultPath
+	}
+	if cfg.DurationBuckets == nil {
+		cfg.DurationBuckets = prom.DefBuckets
+	}
+	if cfg.SizeBuckets == nil {
+		cfg.SizeBuckets = defaultSizeBuckets
+	}
+	for name, buckets := range map[string][]float64{"duration_buckets": cfg.DurationBuckets, "size_buckets": cfg.SizeBuckets} {
+		if !increasing(buckets) {
+			return Config{}, true, fmt.Errorf("prometheus: the %s must be in increasing order", name)
+		}
+	}
+	if cfg.MaxLabelValues < 0 {
+		return Config{}, true, fmt.Errorf("prometheus: invalid max_label_values %d", cfg.MaxLabelValues)
+	}
+	if cfg.MaxLabelValues == 0 {
+		cfg.MaxLabelValues = defaultMaxLabelValues
+	}
+	return cfg, true, nil
+}
+
+func increasing(buckets []float64) bool {
+	if len(buckets) == 0 {
+		return false
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// Register hooks the exporter into the metrics collector and starts the listener of the exposition
+// endpoint, stopped once the context is cancelled. It must be called before building the factories
+// instrumented by the collector. Without config, it does nothing.
+func Register(ctx context.Context, e config.ExtraConfig, m *metrics.Metrics, l logging.Logger) error {
+	cfg, ok, err := getConfig(e)
+	if !ok || err != nil {
+		return err
+	}
+	if m == nil || m.Metrics == nil || m.Config == nil {
+		return errNoCollector
+	}
+
+	ln, err := net.Listen("tcp", cfg.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("prometheus: %s", err.Error())
+	}
+
+	exp := newExporter(cfg)
+	exp.instrument(m)
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, exp.handler())
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(ln); err != http.ErrServerClosed {
+			l.Error("prometheus:", err.Error())
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		sCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		server.Shutdown(sCtx)
+		cancel()
+	}()
+
+	l.Info(fmt.Sprintf("prometheus: exposing the metrics at %s%s", cfg.ListenAddress, cfg.Path))
+	return nil
+}
+
+// exporter keeps the Prometheus series fed by the metrics collector
+type exporter struct {
+	registry  *prom.Registry
+	observers *observers
+}
+
+func newExporter(cfg Config) *exporter {
+	registry := prom.NewRegistry()
+	registry.MustRegister(prom.NewGoCollector(), prom.NewProcessCollector(prom.ProcessCollectorOpts{}))
+	return &exporter{
+		registry:  registry,
+		observers: newObservers(registry, cfg),
+	}
+}
+
+// instrument replaces the registries used by the router and the proxy metrics of the collector with
+// wrappers of the same registry, so the metrics are still recorded by the collector and also observed by
+// the exporter. The connection counters of the router are not replaced. The gauges of the SLO registry
+// are read from the registry of the collector at scrape time.
+func (e *exporter) instrument(m *metrics.Metrics) {
+	e.registry.MustRegister(newSLOCollector(*m.Registry, collectorPrefix))
+	var parent gometrics.Registry = &registry{Registry: *m.Registry, observers: e.observers}
+	m.Router.ProxyMetrics = krakendmetrics.NewRouterMetrics(&parent).ProxyMetrics
+	m.Proxy = krakendmetrics.NewProxyMetrics(&parent)
+}
+
+func (e *exporter) handler() http.Handler {
+	return promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,185 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	krakendmetrics "github.com/devopsfaith/krakend-metrics"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+func TestExporter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newCollector(ctx)
+	exp := newExporter(Config{
+		DurationBuckets: []float64{0.5, 1},
+		SizeBuckets:     []float64{10, 100},
+		MaxLabelValues:  2,
+	})
+	exp.instrument(m)
+
+	bf := m.BackendFactory("backend", func(remote *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			if remote.URLPattern == "/fail" {
+				return nil, errors.New("backend error")
+			}
+			return &proxy.Response{IsComplete: true, Data: map[string]interface{}{"ok": true}}, nil
+		}
+	})
+	pf := m.ProxyFactory("pipe", proxy.FactoryFunc(func(cfg *config.EndpointConfig) (proxy.Proxy, error) {
+		return bf(cfg.Backend[0]), nil
+	}))
+	hf := m.NewHTTPHandlerFactory(func(_ *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			resp, err := p(c, &proxy.Request{})
+			if err != nil {
+				c.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, resp.Data)
+		}
+	})
+
+	engine := gin.New()
+	for _, e := range []struct{ endpoint, backend string }{{"/a", "/ok"}, {"/b", "/fail"}, {"/c", "/ok"}} {
+		cfg := &config.EndpointConfig{Endpoint: e.endpoint, Backend: []*config.Backend{{URLPattern: e.backend}}}
+		p, err := pf(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		engine.GET(e.endpoint, hf(cfg, p))
+	}
+	for _, path := range []string{"/a", "/a", "/b", "/c"} {
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	// the proxy metrics are recorded in the background
+	var body string
+	for i := 0; i < 50; i++ {
+		body = scrape(exp)
+		if strings.Contains(body, `krakend_proxy_requests_total{complete="false",endpoint="/b",error="true"} 1`) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, line := range []string{
+		`krakend_router_requests_total{endpoint="/a",status="200"} 2`,
+		`krakend_router_requests_total{endpoint="/b",status="500"} 1`,
+		`krakend_router_requests_total{endpoint="other",status="200"} 1`,
+		`krakend_router_response_duration_seconds_bucket{endpoint="/a",le="0.5"} 2`,
+		`krakend_router_response_size_bytes_bucket{endpoint="/a",le="100"} 2`,
+		`krakend_router_response_size_bytes_count{endpoint="/b"} 1`,
+		`krakend_proxy_requests_total{complete="true",endpoint="/a",error="false"} 2`,
+		`krakend_proxy_requests_total{complete="false",endpoint="/b",error="true"} 1`,
+		`krakend_proxy_duration_seconds_count{complete="true",endpoint="/a",error="false"} 2`,
+		`krakend_backend_requests_total{backend="/ok",complete="true",error="false"} 3`,
+		`krakend_backend_requests_total{backend="/fail",complete="false",error="true"} 1`,
+		`krakend_backend_duration_seconds_bucket{backend="/ok",complete="true",error="false",le="+Inf"} 3`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("line not found: %s", line)
+		}
+	}
+	if strings.Contains(body, `endpoint="/c"`) {
+		t.Error("the endpoint label exceeded the max number of values")
+	}
+
+	// the collector keeps recording its own metrics
+	if c := (*m.Registry).Get("router.response./a.status.200.count"); c == nil {
+		t.Error("the collector metrics are not registered")
+	}
+}
+
+func TestExporter_slo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := newCollector(ctx)
+	exp := newExporter(Config{DurationBuckets: []float64{1}, SizeBuckets: []float64{1}, MaxLabelValues: 10})
+	exp.instrument(m)
+
+	r := *m.Registry
+	r.Register("router.slo.GET /v1.2/items.availability.5m.total", gometrics.NewFunctionalGauge(func() int64 { return 10 }))
+	r.Register("router.slo.GET /v1.2/items.availability.5m.good", gometrics.NewFunctionalGauge(func() int64 { return 9 }))
+	r.Register("router.slo.GET /v1.2/items.availability.5m.burn_rate", gometrics.NewFunctionalGaugeFloat64(func() float64 { return 2.5 }))
+	r.Register("router.slo.GET /v1.2/items.availability.error_budget_remaining", gometrics.NewFunctionalGaugeFloat64(func() float64 { return 0.75 }))
+
+	body := scrape(exp)
+	for _, line := range []string{
+		`krakend_slo_requests{endpoint="/v1.2/items",method="GET",sli="availability",window="5m"} 10`,
+		`krakend_slo_good_requests{endpoint="/v1.2/items",method="GET",sli="availability",window="5m"} 9`,
+		`krakend_slo_burn_rate{endpoint="/v1.2/items",method="GET",sli="availability",window="5m"} 2.5`,
+		`krakend_slo_error_budget_remaining{endpoint="/v1.2/items",method="GET",sli="availability"} 0.75`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("line not found: %s", line)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := Register(ctx, config.ExtraConfig{}, newCollector(ctx), logging.NoOp); err != nil {
+		t.Errorf("unexpected error without config: %v", err)
+	}
+
+	e := config.ExtraConfig{Namespace: map[string]interface{}{}}
+	if err := Register(ctx, e, metrics.New(ctx, config.ExtraConfig{}, logging.NoOp), logging.NoOp); err != errNoCollector {
+		t.Errorf("unexpected error without collector: %v", err)
+	}
+
+	for _, cfg := range []map[string]interface{}{
+		{"duration_buckets": []float64{1, 0.5}},
+		{"size_buckets": []float64{}},
+		{"max_label_values": -1},
+		{"path": 42},
+	} {
+		e := config.ExtraConfig{Namespace: cfg}
+		if err := Register(ctx, e, newCollector(ctx), logging.NoOp); err == nil {
+			t.Errorf("expecting an error with the config %v", cfg)
+		}
+	}
+}
+
+func TestGetConfig_defaults(t *testing.T) {
+	cfg, ok, err := getConfig(config.ExtraConfig{Namespace: map[string]interface{}{}})
+	if !ok || err != nil {
+		t.Fatalf("unexpected result: %v %v", ok, err)
+	}
+	if cfg.ListenAddress != defaultListenAddress || cfg.Path != defaultPath || cfg.MaxLabelValues != defaultMaxLabelValues {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if len(cfg.DurationBuckets) == 0 || len(cfg.SizeBuckets) != 6 {
+		t.Errorf("unexpected buckets: %v %v", cfg.DurationBuckets, cfg.SizeBuckets)
+	}
+}
+
+func newCollector(ctx context.Context) *metrics.Metrics {
+	return metrics.New(ctx, config.ExtraConfig{
+		krakendmetrics.Namespace: map[string]interface{}{"endpoint_disabled": true, "collection_time": "1h"},
+	}, logging.NoOp)
+}
+
+func scrape(exp *exporter) string {
+	w := httptest.NewRecorder()
+	exp.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	b, _ := ioutil.ReadAll(w.Body)
+	return string(b)
+}
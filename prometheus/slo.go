@@ -0,0 +1,89 @@
+package prometheus
+
+import (
+	"regexp"
+	"strings"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// the names of the gauges of the SLO registry, relative to the registry of the collector. The endpoint is
+// matched greedily, so it can contain dots.
+var (
+	sloWindowPattern = regexp.MustCompile(`^router\.slo\.(.+)\.(availability|latency)\.(.+)\.(good|total|burn_rate)$`)
+	sloBudgetPattern = regexp.MustCompile(`^router\.slo\.(.+)\.(availability|latency)\.error_budget_remaining$`)
+)
+
+// sloCollector exports the gauges of the SLO registry at scrape time, since they are computed on read
+type sloCollector struct {
+	registry  gometrics.Registry
+	prefix    string
+	good      *prom.Desc
+	total     *prom.Desc
+	burnRate  *prom.Desc
+	remaining *prom.Desc
+}
+
+func newSLOCollector(registry gometrics.Registry, prefix string) *sloCollector {
+	windowLabels := []string{"method", "endpoint", "sli", "window"}
+	return &sloCollector{
+		registry: registry,
+		prefix:   prefix,
+		good: prom.NewDesc("krakend_slo_good_requests",
+			"Good requests of the service level indicator over the window.", windowLabels, nil),
+		total: prom.NewDesc("krakend_slo_requests",
+			"Requests of the service level indicator over the window.", windowLabels, nil),
+		burnRate: prom.NewDesc("krakend_slo_burn_rate",
+			"Burn rate of the error budget over the window.", windowLabels, nil),
+		remaining: prom.NewDesc("krakend_slo_error_budget_remaining",
+			"Fraction of the error budget not spent over the objective window.", []string{"method", "endpoint", "sli"}, nil),
+	}
+}
+
+func (s *sloCollector) Describe(ch chan<- *prom.Desc) {
+	ch <- s.good
+	ch <- s.total
+	ch <- s.burnRate
+	ch <- s.remaining
+}
+
+func (s *sloCollector) Collect(ch chan<- prom.Metric) {
+	s.registry.Each(func(name string, i interface{}) {
+		name = strings.TrimPrefix(name, s.prefix)
+		if m := sloWindowPattern.FindStringSubmatch(name); m != nil {
+			method, endpoint := splitEndpoint(m[1])
+			labels := []string{method, endpoint, m[2], m[3]}
+			switch m[4] {
+			case "good":
+				if g, ok := i.(gometrics.Gauge); ok {
+					ch <- prom.MustNewConstMetric(s.good, prom.GaugeValue, float64(g.Value()), labels...)
+				}
+			case "total":
+				if g, ok := i.(gometrics.Gauge); ok {
+					ch <- prom.MustNewConstMetric(s.total, prom.GaugeValue, float64(g.Value()), labels...)
+				}
+			case "burn_rate":
+				if g, ok := i.(gometrics.GaugeFloat64); ok {
+					ch <- prom.MustNewConstMetric(s.burnRate, prom.GaugeValue, g.Value(), labels...)
+				}
+			}
+			return
+		}
+		if m := sloBudgetPattern.FindStringSubmatch(name); m != nil {
+			if g, ok := i.(gometrics.GaugeFloat64); ok {
+				method, endpoint := splitEndpoint(m[1])
+				ch <- prom.MustNewConstMetric(s.remaining, prom.GaugeValue, g.Value(), method, endpoint, m[2])
+			}
+		}
+	})
+}
+
+// splitEndpoint splits the "METHOD /path" names of the SLO registry
+func splitEndpoint(name string) (string, string) {
+	parts := strings.SplitN(name, " ", 2)
+	if len(parts) != 2 {
+		return "", name
+	}
+	return parts[0], parts[1]
+}
@@ -0,0 +1,261 @@
+// Package propagation provides a handler middleware forwarding the claims of the JWT validated by the endpoint
+// to the backends, as request headers or query string params.
+//
+// Sample endpoint extra config
+//
+//	...
+//	"headers_to_pass": ["X-Tenant", "X-Roles", "X-Address-City", "X-Address-Country"],
+//	"querystring_params": ["user"],
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/propagation": {
+//			"claims": [
+//				{"claim": "tenant.id", "header": "X-Tenant", "case": "lower"},
+//				{"claim": "roles", "header": "X-Roles", "separator": " "},
+//				{"claim": "sub", "query": "user", "prefix": "user-"},
+//				{"claim": "address", "header": "X-Address", "required": true}
+//			]
+//		},
+//		...
+//	},
+//	...
+//
+// Every mapping copies the value of a claim to a header, a query string param or both. The nested claims are
+// accessed with a dot separated path and the arrays are joined with the separator (a comma by default). The
+// claims holding an object are flattened into one header or param per nested value, appending the nested
+// names to the header with a dash (X-Address-City) and to the param with a dot (address.city). The prefix is
+// added and the case is changed after joining the value.
+//
+// The headers and params with the names of the mappings, including the flattened ones, are always removed
+// from the request before adding the claims, so the clients can not send them. A missing claim is not
+// forwarded unless the mapping requires it, rejecting the request with a 403.
+//
+// The middleware is applied after the token validation and the lura endpoint handler forwards only the
+// headers listed in the headers_to_pass and the params listed in the querystring_params, so they must
+// include the names of the mappings.
+package propagation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"github.com/devopsfaith/krakend-ce/jwtclaims"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/propagation"
+
+const defaultSeparator = ","
+
+var (
+	errNoConfig     = errors.New("propagation: no config")
+	errBadConfig    = errors.New("propagation: unable to parse the config")
+	errNoClaims     = errors.New("propagation: at least one claim is required")
+	errMissingClaim = errors.New("propagation: the token has no value for a required claim")
+)
+
+// Config is the custom config struct containing the params for the claim propagation
+type Config struct {
+	Claims []Mapping `json:"claims"`
+}
+
+// Mapping defines where and how a claim is forwarded
+type Mapping struct {
+	Claim     string `json:"claim"`
+	Header    string `json:"header"`
+	Query     string `json:"query"`
+	Separator string `json:"separator"`
+	Prefix    string `json:"prefix"`
+	// Case is "lower", "upper" or empty, keeping the original case
+	Case     string `json:"case"`
+	Required bool   `json:"required"`
+}
+
+func (m Mapping) format(v interface{}) string {
+	s := m.Prefix + jwtclaims.String(v, m.Separator)
+	switch m.Case {
+	case "lower":
+		return strings.ToLower(s)
+	case "upper":
+		return strings.ToUpper(s)
+	}
+	return s
+}
+
+func getConfig(remote *config.EndpointConfig) (Config, error) {
+	v, ok := remote.ExtraConfig[Namespace]
+	if !ok {
+		return Config{}, errNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, errBadConfig
+	}
+	if len(cfg.Claims) == 0 {
+		return Config{}, errNoClaims
+	}
+	for i, m := range cfg.Claims {
+		if m.Claim == "" {
+			return Config{}, fmt.Errorf("propagation: the mapping #%d has no claim", i)
+		}
+		if m.Header == "" && m.Query == "" {
+			return Config{}, fmt.Errorf("propagation: the claim %q has no header nor query param", m.Claim)
+		}
+		switch m.Case {
+		case "", "lower", "upper":
+		default:
+			return Config{}, fmt.Errorf("propagation: unknown case %q", m.Case)
+		}
+		if m.Separator == "" {
+			m.Separator = defaultSeparator
+		}
+		m.Header = textproto.CanonicalMIMEHeaderKey(m.Header)
+		cfg.Claims[i] = m
+	}
+	return cfg, nil
+}
+
+// HandlerFactory decorates the next handler factory with the claim propagation, if the endpoint has the
+// config. The endpoints with a bad config, or without a JOSE validator, reject all the requests.
+func HandlerFactory(next router.HandlerFactory, logger logging.Logger) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := next(remote, p)
+
+		cfg, err := getConfig(remote)
+		if err != nil {
+			if err != errNoConfig {
+				logger.Error(err.Error(), remote.Endpoint)
+				return reject(http.StatusInternalServerError, err)
+			}
+			return handler
+		}
+		claims, err := jwtclaims.NewExtractor(remote)
+		if err != nil {
+			logger.Error("propagation:", err.Error(), remote.Endpoint)
+			return reject(http.StatusInternalServerError, err)
+		}
+		logger.Debug("propagation: forwarding", len(cfg.Claims), "claims to the backends of", remote.Endpoint)
+
+		return func(c *gin.Context) {
+			if propagate(c, cfg.Claims, claims) {
+				handler(c)
+			}
+		}
+	}
+}
+
+func propagate(c *gin.Context, mappings []Mapping, extractor jwtclaims.Extractor) bool {
+	query := c.Request.URL.Query()
+	for _, m := range mappings {
+		strip(c.Request.Header, query, m)
+	}
+
+	claims, err := extractor(c.Request)
+	if err != nil {
+		c.AbortWithError(http.StatusUnauthorized, err)
+		return false
+	}
+	for _, m := range mappings {
+		v, ok := jwtclaims.Lookup(claims, m.Claim)
+		if !ok || v == nil {
+			if m.Required {
+				c.AbortWithError(http.StatusForbidden, errMissingClaim)
+				return false
+			}
+			continue
+		}
+		for _, f := range flatten(v) {
+			if m.Header != "" {
+				c.Request.Header.Set(m.Header+headerSuffix(f.path), m.format(f.value))
+			}
+			if m.Query != "" {
+				query.Set(m.Query+querySuffix(f.path), m.format(f.value))
+			}
+		}
+	}
+	c.Request.URL.RawQuery = query.Encode()
+	return true
+}
+
+// strip removes the headers and params of the mapping sent by the client, including the flattened ones
+func strip(headers http.Header, query map[string][]string, m Mapping) {
+	if m.Header != "" {
+		for k := range headers {
+			if k == m.Header || strings.HasPrefix(k, m.Header+"-") {
+				delete(headers, k)
+			}
+		}
+	}
+	if m.Query != "" {
+		for k := range query {
+			if k == m.Query || strings.HasPrefix(k, m.Query+".") {
+				delete(query, k)
+			}
+		}
+	}
+}
+
+// field is a value of a flattened claim with the path of nested names leading to it
+type field struct {
+	path  []string
+	value interface{}
+}
+
+// flatten returns the values of the nested objects of the claim, sorted by their path. The values of other
+// types, arrays included, are returned as they are.
+func flatten(v interface{}) []field {
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return []field{{value: v}}
+	}
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := []field{}
+	for _, k := range keys {
+		if obj[k] == nil {
+			continue
+		}
+		for _, f := range flatten(obj[k]) {
+			res = append(res, field{path: append([]string{k}, f.path...), value: f.value})
+		}
+	}
+	return res
+}
+
+func headerSuffix(path []string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	return "-" + strings.Join(path, "-")
+}
+
+func querySuffix(path []string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	return "." + strings.Join(path, ".")
+}
+
+func reject(status int, err error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.AbortWithError(status, err)
+	}
+}
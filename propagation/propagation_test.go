@@ -0,0 +1,148 @@
+package propagation
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	krakendjose "github.com/devopsfaith/krakend-jose"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	engine := newEngine(map[string]interface{}{
+		"claims": []interface{}{
+			map[string]interface{}{"claim": "tenant.id", "header": "x-tenant", "case": "upper"},
+			map[string]interface{}{"claim": "roles", "header": "X-Roles", "query": "roles", "separator": " "},
+			map[string]interface{}{"claim": "sub", "query": "user", "prefix": "user-"},
+			map[string]interface{}{"claim": "address", "header": "X-Address", "query": "address"},
+			map[string]interface{}{"claim": "missing", "header": "X-Missing"},
+		},
+	})
+
+	req, _ := http.NewRequest("GET", "/?user=admin&address.city=spoofed&page=2", nil)
+	req.Header.Set("Authorization", "Bearer "+token(`{
+		"sub": "42",
+		"tenant": {"id": "acme"},
+		"roles": ["reader", "writer"],
+		"address": {"city": "Barcelona", "geo": {"lat": 41.4}}
+	}`))
+	req.Header.Set("X-Tenant", "spoofed")
+	req.Header.Set("X-Address-Country", "spoofed")
+	req.Header.Set("X-Missing", "spoofed")
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+	res := struct {
+		Headers http.Header
+		Query   map[string][]string
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]string{
+		"X-Tenant":          "ACME",
+		"X-Roles":           "reader writer",
+		"X-Address-City":    "Barcelona",
+		"X-Address-Geo-Lat": "41.4",
+		"X-Address-Country": "",
+		"X-Missing":         "",
+	} {
+		if h := res.Headers.Get(k); h != v {
+			t.Errorf("unexpected value of the header %s: %q", k, h)
+		}
+	}
+	for k, v := range map[string]string{
+		"user":            "user-42",
+		"roles":           "reader writer",
+		"address.city":    "Barcelona",
+		"address.geo.lat": "41.4",
+		"page":            "2",
+	} {
+		if q := res.Query[k]; len(q) != 1 || q[0] != v {
+			t.Errorf("unexpected value of the param %s: %v", k, q)
+		}
+	}
+}
+
+func TestHandlerFactory_rejectedTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	engine := newEngine(map[string]interface{}{
+		"claims": []interface{}{
+			map[string]interface{}{"claim": "tenant", "header": "X-Tenant", "required": true},
+		},
+	})
+
+	if w := do(engine, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status code without token: %d", w.Code)
+	}
+	if w := do(engine, token(`{"sub":"1"}`)); w.Code != http.StatusForbidden {
+		t.Errorf("unexpected status code without the required claim: %d", w.Code)
+	}
+	if w := do(engine, token(`{"tenant":"acme"}`)); w.Code != http.StatusOK {
+		t.Errorf("unexpected status code: %d", w.Code)
+	}
+}
+
+func TestHandlerFactory_badConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, cfg := range []map[string]interface{}{
+		{},
+		{"claims": []interface{}{map[string]interface{}{"header": "X-Tenant"}}},
+		{"claims": []interface{}{map[string]interface{}{"claim": "tenant"}}},
+		{"claims": []interface{}{map[string]interface{}{"claim": "tenant", "header": "X-Tenant", "case": "title"}}},
+	} {
+		if w := do(newEngine(cfg), token(`{"tenant":"acme"}`)); w.Code != http.StatusInternalServerError {
+			t.Errorf("unexpected status code with the config %v: %d", cfg, w.Code)
+		}
+	}
+}
+
+// token returns an unsigned JWT, since the signature is checked by the JOSE validator wrapping the middleware
+func token(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc([]byte(claims)) + "." + enc([]byte("signature"))
+}
+
+func do(engine *gin.Engine, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+// newEngine returns an engine echoing the headers and the query string received by the endpoint handler
+func newEngine(cfg map[string]interface{}) *gin.Engine {
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) {
+			c.JSON(http.StatusOK, gin.H{"headers": c.Request.Header, "query": c.Request.URL.Query()})
+		}
+	}, logging.NoOp)
+
+	remote := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace:                      cfg,
+			krakendjose.ValidatorNamespace: map[string]interface{}{"alg": "HS256", "jwk-url": "https://localhost/jwk"},
+		},
+	}
+	engine := gin.New()
+	engine.GET("/", hf(remote, proxy.NoopProxy))
+	return engine
+}
@@ -1,9 +1,13 @@
 package krakend
 
 import (
+	"context"
+
+	"github.com/devopsfaith/krakend-ce/opentelemetry"
 	cel "github.com/devopsfaith/krakend-cel"
 	jsonschema "github.com/devopsfaith/krakend-jsonschema"
 	lua "github.com/devopsfaith/krakend-lua/proxy"
+	krakendmetrics "github.com/devopsfaith/krakend-metrics"
 	metrics "github.com/devopsfaith/krakend-metrics/gin"
 	"github.com/luraproject/lura/logging"
 	"github.com/luraproject/lura/proxy"
@@ -12,18 +16,42 @@ import (
 
 // NewProxyFactory returns a new ProxyFactory wrapping the injected BackendFactory with the default proxy stack and a metrics collector
 func NewProxyFactory(logger logging.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
-	proxyFactory := proxy.NewDefaultFactory(backendFactory, logger)
-	proxyFactory = proxy.NewShadowFactory(proxyFactory)
-	proxyFactory = jsonschema.ProxyFactory(proxyFactory)
-	proxyFactory = cel.ProxyFactory(logger, proxyFactory)
-	proxyFactory = lua.ProxyFactory(logger, proxyFactory)
-	proxyFactory = metricCollector.ProxyFactory("pipe", proxyFactory)
-	proxyFactory = opencensus.ProxyFactory(proxyFactory)
+	return NewProxyFactoryWithContext(context.Background(), logger, backendFactory, metricCollector)
+}
+
+// NewProxyFactoryWithContext returns the same ProxyFactory as NewProxyFactory, recording every layer in the
+// stack inspector of the context, if any
+func NewProxyFactoryWithContext(ctx context.Context, logger logging.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
+	s := stackInspectorFromContext(ctx)
+	proxyFactory := recordProxyLayer(s, "merger", proxy.NewDefaultFactory(backendFactory, logger))
+	proxyFactory = recordProxyLayer(s, "shadow", proxy.NewShadowFactory(proxyFactory))
+	proxyFactory = recordProxyLayer(s, "jsonschema", jsonschema.ProxyFactory(proxyFactory))
+	proxyFactory = recordProxyLayer(s, "cel", cel.ProxyFactory(logger, proxyFactory))
+	proxyFactory = recordProxyLayer(s, "lua", lua.ProxyFactory(logger, proxyFactory))
+	proxyFactory = recordProxyLayer(s, "metrics", metricCollector.ProxyFactory("pipe", proxyFactory))
+	proxyFactory = recordProxyLayer(s, "opencensus", opencensus.ProxyFactory(proxyFactory))
+	proxyFactory = recordProxyLayer(s, "opentelemetry", opentelemetry.ProxyFactory(proxyFactory))
 	return proxyFactory
 }
 
+// proxyLayers describes the middlewares added by NewProxyFactory, from the outermost to the innermost one.
+// The admin API uses it only for the stacks without the layers recorded by the factories.
+var proxyLayers = []layer{
+	{Name: "opentelemetry", Namespaces: []string{opentelemetry.Namespace}, Service: true},
+	{Name: "opencensus", Namespaces: []string{opencensus.Namespace}, Service: true},
+	{Name: "metrics", Namespaces: []string{krakendmetrics.Namespace}, Service: true},
+	{Name: "lua", Namespaces: []string{lua.ProxyNamespace}},
+	{Name: "cel", Namespaces: []string{celNamespace}},
+	{Name: "jsonschema", Namespaces: []string{jsonschema.Namespace}},
+	{Name: "merger", Always: true},
+}
+
 type proxyFactory struct{}
 
 func (p proxyFactory) NewProxyFactory(logger logging.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
 	return NewProxyFactory(logger, backendFactory, metricCollector)
 }
+
+func (p proxyFactory) NewProxyFactoryWithContext(ctx context.Context, logger logging.Logger, backendFactory proxy.BackendFactory, metricCollector *metrics.Metrics) proxy.Factory {
+	return NewProxyFactoryWithContext(ctx, logger, backendFactory, metricCollector)
+}
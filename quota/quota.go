@@ -0,0 +1,324 @@
+// Package quota provides a handler middleware limiting the requests of every consumer, identified by a claim
+// of the JWT validated by the endpoint.
+//
+// Sample endpoint extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/quota": {
+//			"name": "plan-basic",
+//			"claim": "tenant.id",
+//			"limits": {
+//				"second": 10,
+//				"day": 10000,
+//				"month": 200000
+//			}
+//		},
+//		...
+//	},
+//	...
+//
+// The available windows are second, minute, hour, day and month. They are fixed windows aligned to the UTC
+// calendar, so the monthly quotas are reset at the beginning of every month. A request is accepted only if
+// all the windows have room for it, and the rejected requests are not counted.
+//
+// The endpoints sharing the same name share the counters, so a quota can cover several endpoints. The name
+// defaults to the endpoint path.
+//
+// The responses include the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers of the window
+// with less room, and the RateLimit-Policy header with all the windows. The rejected requests get a 429 with
+// the Retry-After header. If the store fails, the requests are accepted.
+//
+// The middleware is applied after the token validation and the claim propagation, so the rejected tokens
+// are not counted.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/jwtclaims"
+	"github.com/devopsfaith/krakend-ce/requestid"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/quota"
+
+var (
+	errNoConfig     = errors.New("quota: no config")
+	errBadConfig    = errors.New("quota: unable to parse the config")
+	errNoClaim      = errors.New("quota: the claim is required")
+	errNoLimits     = errors.New("quota: at least one limit is required")
+	errMissingClaim = errors.New("quota: the token has no value for the claim")
+	errExceeded     = errors.New("quota: exceeded")
+)
+
+// Config is the custom config struct containing the params for the quota
+type Config struct {
+	Name   string           `json:"name"`
+	Claim  string           `json:"claim"`
+	Limits map[string]int64 `json:"limits"`
+}
+
+func getConfig(remote *config.EndpointConfig) (Config, []limit, error) {
+	v, ok := remote.ExtraConfig[Namespace]
+	if !ok {
+		return Config{}, nil, errNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, nil, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, nil, errBadConfig
+	}
+	if cfg.Claim == "" {
+		return Config{}, nil, errNoClaim
+	}
+	if cfg.Name == "" {
+		cfg.Name = remote.Endpoint
+	}
+
+	limits := []limit{}
+	for name, max := range cfg.Limits {
+		w, ok := windows[name]
+		if !ok {
+			return Config{}, nil, fmt.Errorf("quota: unknown window %q", name)
+		}
+		if max <= 0 {
+			return Config{}, nil, fmt.Errorf("quota: the limit of the window %q must be positive", name)
+		}
+		limits = append(limits, limit{window: w, max: max})
+	}
+	if len(limits) == 0 {
+		return Config{}, nil, errNoLimits
+	}
+	sort.Slice(limits, func(i, j int) bool { return limits[i].window.order < limits[j].window.order })
+	return cfg, limits, nil
+}
+
+// window returns the boundaries of the period containing the time
+type window struct {
+	name   string
+	order  int
+	bounds func(time.Time) (time.Time, time.Time)
+}
+
+func truncated(d time.Duration) func(time.Time) (time.Time, time.Time) {
+	return func(t time.Time) (time.Time, time.Time) {
+		start := t.Truncate(d)
+		return start, start.Add(d)
+	}
+}
+
+var windows = map[string]window{
+	"second": {name: "second", order: 0, bounds: truncated(time.Second)},
+	"minute": {name: "minute", order: 1, bounds: truncated(time.Minute)},
+	"hour":   {name: "hour", order: 2, bounds: truncated(time.Hour)},
+	"day": {name: "day", order: 3, bounds: func(t time.Time) (time.Time, time.Time) {
+		start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}},
+	"month": {name: "month", order: 4, bounds: func(t time.Time) (time.Time, time.Time) {
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}},
+}
+
+type limit struct {
+	window window
+	max    int64
+}
+
+// HandlerFactory adds the quotas to the endpoints with the quota config. The endpoints must validate the
+// tokens with the JOSE validator, wrapping this middleware. If the store is nil, the counters are kept in
+// memory.
+func HandlerFactory(next router.HandlerFactory, store Store, logger logging.Logger, m *metrics.Metrics) router.HandlerFactory {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := next(remote, p)
+
+		cfg, limits, err := getConfig(remote)
+		if err != nil {
+			if err != errNoConfig {
+				logger.Error(err.Error(), remote.Endpoint)
+				return reject(http.StatusInternalServerError, err)
+			}
+			return handler
+		}
+		claims, err := jwtclaims.NewExtractor(remote)
+		if err != nil {
+			logger.Error("quota:", err.Error(), remote.Endpoint)
+			return reject(http.StatusInternalServerError, err)
+		}
+
+		q := &quota{
+			name:    cfg.Name,
+			claim:   cfg.Claim,
+			limits:  limits,
+			store:   store,
+			claims:  claims,
+			logger:  logger,
+			metrics: newCounters(m, cfg.Name),
+		}
+		logger.Info("quota: enabled for the endpoint", remote.Endpoint)
+
+		return func(c *gin.Context) {
+			if q.allow(c) {
+				handler(c)
+			}
+		}
+	}
+}
+
+type quota struct {
+	name    string
+	claim   string
+	limits  []limit
+	store   Store
+	claims  jwtclaims.Extractor
+	logger  logging.Logger
+	metrics counters
+}
+
+// usage is the state of a window after counting a request
+type usage struct {
+	limit limit
+	value int64
+	reset time.Time
+}
+
+func (u usage) remaining() int64 {
+	if r := u.limit.max - u.value; r > 0 {
+		return r
+	}
+	return 0
+}
+
+func (q *quota) allow(c *gin.Context) bool {
+	claims, err := q.claims(c.Request)
+	if err != nil {
+		c.AbortWithError(http.StatusUnauthorized, err)
+		return false
+	}
+	v, ok := jwtclaims.Lookup(claims, q.claim)
+	consumer := jwtclaims.String(v, ",")
+	if !ok || consumer == "" {
+		c.AbortWithError(http.StatusForbidden, errMissingClaim)
+		return false
+	}
+
+	ctx := c.Request.Context()
+	now := timeNow().UTC()
+	keys := make([]string, 0, len(q.limits))
+	usages := make([]usage, 0, len(q.limits))
+	for _, l := range q.limits {
+		start, end := l.window.bounds(now)
+		key := strings.Join([]string{"quota", q.name, l.window.name, strconv.FormatInt(start.Unix(), 10), consumer}, ":")
+		value, err := q.store.Incr(ctx, key, 1, end)
+		if err != nil {
+			q.metrics.storeErrors.Inc(1)
+			requestid.Logger(c, q.logger).Error("quota: unable to count the request:", err.Error())
+			q.rollback(c, keys, usages)
+			return true
+		}
+		keys = append(keys, key)
+		usages = append(usages, usage{limit: l, value: value, reset: end})
+	}
+
+	var exceeded *usage
+	for i, u := range usages {
+		if u.value > u.limit.max && (exceeded == nil || u.reset.After(exceeded.reset)) {
+			exceeded = &usages[i]
+		}
+	}
+	if exceeded != nil {
+		q.rollback(c, keys, usages)
+		q.metrics.rejected.Inc(1)
+		q.setHeaders(c, *exceeded, now)
+		c.Header("Retry-After", strconv.FormatInt(seconds(exceeded.reset.Sub(now)), 10))
+		c.AbortWithError(http.StatusTooManyRequests, errExceeded)
+		return false
+	}
+
+	tightest := usages[0]
+	for _, u := range usages[1:] {
+		if u.remaining() < tightest.remaining() {
+			tightest = u
+		}
+	}
+	q.setHeaders(c, tightest, now)
+	return true
+}
+
+// rollback discounts the request from the windows already counted
+func (q *quota) rollback(c *gin.Context, keys []string, usages []usage) {
+	for i, key := range keys {
+		if _, err := q.store.Incr(c.Request.Context(), key, -1, usages[i].reset); err != nil {
+			q.metrics.storeErrors.Inc(1)
+			requestid.Logger(c, q.logger).Error("quota: unable to discount the request:", err.Error())
+		}
+	}
+}
+
+func (q *quota) setHeaders(c *gin.Context, u usage, now time.Time) {
+	c.Header("RateLimit-Limit", strconv.FormatInt(u.limit.max, 10))
+	c.Header("RateLimit-Remaining", strconv.FormatInt(u.remaining(), 10))
+	c.Header("RateLimit-Reset", strconv.FormatInt(seconds(u.reset.Sub(now)), 10))
+
+	policies := make([]string, len(q.limits))
+	for i, l := range q.limits {
+		start, end := l.window.bounds(now)
+		policies[i] = fmt.Sprintf("%d;w=%d", l.max, seconds(end.Sub(start)))
+	}
+	c.Header("RateLimit-Policy", strings.Join(policies, ", "))
+}
+
+// seconds rounds up the duration, so the clients do not retry before the window is reset
+func seconds(d time.Duration) int64 {
+	s := int64(d / time.Second)
+	if d%time.Second > 0 {
+		s++
+	}
+	return s
+}
+
+func reject(status int, err error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.AbortWithError(status, err)
+	}
+}
+
+// counters are the metrics of a quota
+type counters struct {
+	rejected    gometrics.Counter
+	storeErrors gometrics.Counter
+}
+
+func newCounters(m *metrics.Metrics, name string) counters {
+	if m == nil || m.Metrics == nil || m.Router == nil {
+		return counters{rejected: gometrics.NilCounter{}, storeErrors: gometrics.NilCounter{}}
+	}
+	prefix := "quota." + name
+	return counters{
+		rejected:    m.Router.Counter(prefix, "rejected"),
+		storeErrors: m.Router.Counter(prefix, "store_errors"),
+	}
+}
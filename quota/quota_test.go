@@ -0,0 +1,167 @@
+package quota
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	krakendjose "github.com/devopsfaith/krakend-jose"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	now := time.Date(2021, 3, 15, 12, 0, 0, 500*int(time.Millisecond), time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	engine := newEngine(NewMemoryStore(), map[string]interface{}{
+		"claim":  "tenant.id",
+		"limits": map[string]interface{}{"second": 2, "month": 3},
+	})
+
+	acme := token(`{"sub":"1","tenant":{"id":"acme"}}`)
+	other := token(`{"sub":"2","tenant":{"id":"other"}}`)
+
+	for i, tc := range []struct {
+		token     string
+		status    int
+		remaining string
+		reset     string
+	}{
+		{token: acme, status: 200, remaining: "1", reset: "1"},
+		{token: acme, status: 200, remaining: "0", reset: "1"},
+		{token: acme, status: http.StatusTooManyRequests, remaining: "0", reset: "1"},
+		{token: other, status: 200, remaining: "1", reset: "1"},
+	} {
+		w := do(engine, tc.token)
+		if w.Code != tc.status {
+			t.Errorf("#%d: unexpected status code: %d", i, w.Code)
+		}
+		if h := w.Header().Get("RateLimit-Remaining"); h != tc.remaining {
+			t.Errorf("#%d: unexpected remaining requests: %s", i, h)
+		}
+		if h := w.Header().Get("RateLimit-Reset"); h != tc.reset {
+			t.Errorf("#%d: unexpected reset: %s", i, h)
+		}
+	}
+
+	now = now.Add(time.Second)
+	w := do(engine, acme)
+	if w.Code != 200 {
+		t.Errorf("the rejected requests should not be counted. status code: %d", w.Code)
+	}
+	if h := w.Header().Get("RateLimit-Limit"); h != "3" {
+		t.Errorf("the monthly limit should be reported. have: %s", h)
+	}
+	if h := w.Header().Get("RateLimit-Policy"); h != "2;w=1, 3;w=2678400" {
+		t.Errorf("unexpected policy: %s", h)
+	}
+
+	now = now.Add(time.Second)
+	w = do(engine, acme)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("unexpected status code: %d", w.Code)
+	}
+	if h := w.Header().Get("Retry-After"); h != "1425598" {
+		t.Errorf("the client should wait until the next month. have: %s", h)
+	}
+
+	now = time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC)
+	if w := do(engine, acme); w.Code != 200 {
+		t.Errorf("the quota should be reset. status code: %d", w.Code)
+	}
+}
+
+func TestHandlerFactory_rejectedTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	engine := newEngine(NewMemoryStore(), map[string]interface{}{
+		"claim":  "tenant",
+		"limits": map[string]interface{}{"day": 10},
+	})
+
+	if w := do(engine, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status code without token: %d", w.Code)
+	}
+	if w := do(engine, token(`{"sub":"1"}`)); w.Code != http.StatusForbidden {
+		t.Errorf("unexpected status code without claim: %d", w.Code)
+	}
+}
+
+func TestHandlerFactory_storeErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	engine := newEngine(erroredStore{}, map[string]interface{}{
+		"claim":  "tenant",
+		"limits": map[string]interface{}{"second": 1},
+	})
+
+	for i := 0; i < 3; i++ {
+		if w := do(engine, token(`{"tenant":"acme"}`)); w.Code != 200 {
+			t.Errorf("the requests should be accepted when the store fails. status code: %d", w.Code)
+		}
+	}
+}
+
+func TestHandlerFactory_badConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, cfg := range []map[string]interface{}{
+		{"limits": map[string]interface{}{"day": 10}},
+		{"claim": "tenant"},
+		{"claim": "tenant", "limits": map[string]interface{}{"week": 10}},
+		{"claim": "tenant", "limits": map[string]interface{}{"day": 0}},
+	} {
+		if w := do(newEngine(nil, cfg), token(`{"tenant":"acme"}`)); w.Code != http.StatusInternalServerError {
+			t.Errorf("unexpected status code with the config %v: %d", cfg, w.Code)
+		}
+	}
+}
+
+type erroredStore struct{}
+
+func (erroredStore) Incr(_ context.Context, _ string, _ int64, _ time.Time) (int64, error) {
+	return 0, errors.New("unreachable")
+}
+
+// token returns an unsigned JWT, since the signature is checked by the JOSE validator wrapping the quota
+func token(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc([]byte(claims)) + "." + enc([]byte("signature"))
+}
+
+func do(engine *gin.Engine, token string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func newEngine(store Store, cfg map[string]interface{}) *gin.Engine {
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.String(200, "ok") }
+	}, store, logging.NoOp, nil)
+
+	remote := &config.EndpointConfig{
+		Endpoint: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace:                      cfg,
+			krakendjose.ValidatorNamespace: map[string]interface{}{"alg": "HS256", "jwk-url": "https://localhost/jwk"},
+		},
+	}
+	engine := gin.New()
+	engine.GET("/", hf(remote, proxy.NoopProxy))
+	return engine
+}
@@ -0,0 +1,61 @@
+package quota
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store keeps the counters of the quotas. The counters can be shared by several gateways, so the
+// implementations must apply the increments atomically.
+type Store interface {
+	// Incr adds the delta to the counter of the key and returns its new value. The counter is removed
+	// after the expiration time.
+	Incr(ctx context.Context, key string, delta int64, expiration time.Time) (int64, error)
+}
+
+const sweepInterval = time.Minute
+
+var timeNow = time.Now
+
+// MemoryStore is a Store keeping the counters in the memory of the process
+type MemoryStore struct {
+	mu        sync.Mutex
+	counters  map[string]*counter
+	lastSweep time.Time
+}
+
+type counter struct {
+	value      int64
+	expiration time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counters: map[string]*counter{}, lastSweep: timeNow()}
+}
+
+// Incr implements the Store interface
+func (s *MemoryStore) Incr(_ context.Context, key string, delta int64, expiration time.Time) (int64, error) {
+	now := timeNow()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > sweepInterval {
+		for k, c := range s.counters {
+			if !now.Before(c.expiration) {
+				delete(s.counters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expiration) {
+		c = &counter{expiration: expiration}
+		s.counters[key] = c
+	}
+	c.value += delta
+	return c.value, nil
+}
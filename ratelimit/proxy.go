@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+
+	krakendrate "github.com/devopsfaith/krakend-ratelimit"
+	"github.com/devopsfaith/krakend-ratelimit/juju"
+	jujuproxy "github.com/devopsfaith/krakend-ratelimit/juju/proxy"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+// BackendFactory adds the juju proxy rate limits to the backends. The limits of the backends with the
+// distributed mode are shared through the store. If the store is nil, all the limits are local.
+func BackendFactory(next proxy.BackendFactory, store *SharedStore, logger logging.Logger) proxy.BackendFactory {
+	local := jujuproxy.BackendFactory(next)
+	return func(remote *config.Backend) proxy.Proxy {
+		if !distributed(remote.ExtraConfig) {
+			return local(remote)
+		}
+		if store == nil {
+			logger.Warning("ratelimit: no store defined, using the local limiter for", remote.URLPattern)
+			return local(remote)
+		}
+
+		p := next(remote)
+		cfg := jujuproxy.ConfigGetter(remote.ExtraConfig).(jujuproxy.Config)
+		if cfg.MaxRate <= 0 {
+			return p
+		}
+
+		c := capacity(cfg.MaxRate, cfg.Capacity)
+		name := "backend:" + strings.Join(remote.Host, ",") + remote.URLPattern
+		l := newLimiter(store, name, cfg.MaxRate, c, juju.NewLimiter(cfg.MaxRate, c))
+		logger.Info("ratelimit: distributed limiter enabled for the backend", remote.URLPattern)
+
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			if !l.Allow() {
+				return nil, krakendrate.ErrLimited
+			}
+			return p(ctx, request)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Package ratelimit provides distributed versions of the juju rate limiters, sharing the counters of all the
+// gateways in a store speaking the Redis protocol.
+//
+// Sample service extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/ratelimit": {
+//			"store": {
+//				"address": "redis:6379",
+//				"password": "secret",
+//				"db": 0,
+//				"timeout": "100ms",
+//				"pool_size": 16
+//			},
+//			"prefix": "krakend:",
+//			"fallback_interval": "5s"
+//		},
+//		...
+//	},
+//	...
+//
+// Sample endpoint or backend extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github.com/devopsfaith/krakend-ratelimit/juju/router": {
+//			"maxRate": 2000,
+//			"strategy": "header",
+//			"clientMaxRate": 100,
+//			"key": "X-Private-Token"
+//		},
+//		"github_com/devopsfaith/krakend-ce/ratelimit": {
+//			"mode": "distributed"
+//		},
+//		...
+//	},
+//	...
+//
+// The rates are the ones of the juju router and proxy configs. The limiters of the endpoints and backends with
+// the distributed mode count the requests in fixed windows of the store, long enough to refill the bucket
+// of the juju limiter, so the limit is shared by all the gateways instead of multiplied by their number.
+// The rest of the endpoints and backends keep the local juju limiters.
+//
+// When the store fails, the limiters fall back to the local ones, limiting every gateway with the configured
+// rate, and the store is not used again until the fallback_interval is over.
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	krakendrate "github.com/devopsfaith/krakend-ratelimit"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+// Namespace is the key to use to store and access the custom config data, both at the service and the
+// endpoint or backend level
+const Namespace = "github_com/devopsfaith/krakend-ce/ratelimit"
+
+const (
+	modeDistributed         = "distributed"
+	defaultPrefix           = "krakend:ratelimit:"
+	defaultFallbackInterval = 5 * time.Second
+)
+
+var (
+	errNoConfig     = errors.New("ratelimit: no config")
+	errBadConfig    = errors.New("ratelimit: unable to parse the config")
+	errNoAddress    = errors.New("ratelimit: the address of the store is required")
+	errStoreSkipped = errors.New("ratelimit: the store is skipped after a failure")
+)
+
+// Store keeps the counters of the distributed limiters
+type Store interface {
+	// Incr adds the delta to the counter of the key and returns its new value. The counter is removed
+	// after the expiration time.
+	Incr(ctx context.Context, key string, delta int64, expiration time.Time) (int64, error)
+}
+
+// Config is the service config struct containing the params for the shared store
+type Config struct {
+	Store            RedisConfig `json:"store"`
+	Prefix           string      `json:"prefix"`
+	FallbackInterval string      `json:"fallback_interval"`
+}
+
+type localConfig struct {
+	Mode string `json:"mode"`
+}
+
+func parse(e config.ExtraConfig, v interface{}) error {
+	tmp, ok := e[Namespace]
+	if !ok {
+		return errNoConfig
+	}
+	b, err := json.Marshal(tmp)
+	if err != nil {
+		return errBadConfig
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errBadConfig
+	}
+	return nil
+}
+
+// distributed returns true if the extra config of the endpoint or backend enables the distributed mode
+func distributed(e config.ExtraConfig) bool {
+	cfg := localConfig{}
+	return parse(e, &cfg) == nil && cfg.Mode == modeDistributed
+}
+
+// SharedStore is the store of the distributed limiters. After a failure, the store is skipped during the
+// fallback interval.
+type SharedStore struct {
+	// skipUntil is the first field, so it is aligned for the atomic operations
+	skipUntil        int64
+	store            Store
+	prefix           string
+	fallbackInterval time.Duration
+	logger           logging.Logger
+}
+
+// New returns the SharedStore defined by the service config, connected to a Redis server. It returns nil
+// and no error if the service config does not define the store. The connections are closed when the
+// context is cancelled.
+func New(ctx context.Context, e config.ExtraConfig, logger logging.Logger) (*SharedStore, error) {
+	cfg := Config{}
+	if err := parse(e, &cfg); err != nil {
+		if err == errNoConfig {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if cfg.Store.Address == "" {
+		return nil, errNoAddress
+	}
+	s := NewSharedStore(NewRedisStore(ctx, cfg.Store), cfg.Prefix, logger)
+	if d, err := time.ParseDuration(cfg.FallbackInterval); err == nil && d > 0 {
+		s.fallbackInterval = d
+	}
+	return s, nil
+}
+
+// NewSharedStore returns a SharedStore keeping the counters in the received store
+func NewSharedStore(store Store, prefix string, logger logging.Logger) *SharedStore {
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	return &SharedStore{store: store, prefix: prefix, fallbackInterval: defaultFallbackInterval, logger: logger}
+}
+
+func (s *SharedStore) incr(key string, expiration time.Time) (int64, error) {
+	now := time.Now()
+	if now.UnixNano() < atomic.LoadInt64(&s.skipUntil) {
+		return 0, errStoreSkipped
+	}
+	v, err := s.store.Incr(context.Background(), s.prefix+key, 1, expiration)
+	if err == errPoolSaturated {
+		// the store is busy, not failing, so only this request uses the local limiter
+		return v, err
+	}
+	if err != nil {
+		atomic.StoreInt64(&s.skipUntil, now.Add(s.fallbackInterval).UnixNano())
+		s.logger.Error("ratelimit: falling back to the local limiters:", err.Error())
+	}
+	return v, err
+}
+
+// limiter counts the requests in fixed windows of the shared store, long enough to get the capacity of the
+// bucket at the configured rate. It uses the local limiter while the store is not available.
+type limiter struct {
+	store    *SharedStore
+	key      string
+	max      int64
+	window   time.Duration
+	fallback krakendrate.Limiter
+}
+
+func newLimiter(store *SharedStore, key string, maxRate float64, capacity int64, fallback krakendrate.Limiter) *limiter {
+	window := time.Duration(float64(capacity) / maxRate * float64(time.Second))
+	if window < time.Millisecond {
+		window = time.Millisecond
+	}
+	return &limiter{store: store, key: key, max: capacity, window: window, fallback: fallback}
+}
+
+// Allow implements the krakendrate.Limiter interface
+func (l *limiter) Allow() bool {
+	n := time.Now().UnixNano() / int64(l.window)
+	end := time.Unix(0, (n+1)*int64(l.window))
+	v, err := l.store.incr(l.key+":"+strconv.FormatInt(n, 10), end)
+	if err != nil {
+		return l.fallback.Allow()
+	}
+	return v <= l.max
+}
+
+// capacity returns the capacity of the bucket, defaulting to the rate as the juju limiters do
+func capacity(maxRate float64, capacity int64) int64 {
+	if capacity > 0 {
+		return capacity
+	}
+	if c := int64(maxRate); c > 0 {
+		return c
+	}
+	return 1
+}
@@ -0,0 +1,157 @@
+package ratelimit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	krakendrate "github.com/devopsfaith/krakend-ratelimit"
+	jujuproxy "github.com/devopsfaith/krakend-ratelimit/juju/proxy"
+	jujurouter "github.com/devopsfaith/krakend-ratelimit/juju/router"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+)
+
+func TestHandlerFactory_distributed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	srv := newFakeRedis(t, "")
+	defer srv.Close()
+	store := NewSharedStore(NewRedisStore(context.Background(), RedisConfig{Address: srv.Addr()}), "", logging.NoOp)
+
+	cfg := config.ExtraConfig{
+		jujurouter.Namespace: map[string]interface{}{"maxRate": 100, "clientMaxRate": 3, "strategy": "header", "key": "X-Client"},
+		Namespace:            map[string]interface{}{"mode": "distributed"},
+	}
+	// two gateways sharing the store
+	gateways := []*gin.Engine{newEngine(store, cfg), newEngine(store, cfg)}
+
+	waitForNewWindow(time.Second)
+	accepted := 0
+	for i := 0; i < 6; i++ {
+		if do(gateways[i%2], "client-a") == http.StatusOK {
+			accepted++
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("the client limit should be shared by the gateways. accepted: %d", accepted)
+	}
+	if do(gateways[0], "client-b") != http.StatusOK {
+		t.Error("the limit of every client should be independent")
+	}
+}
+
+func TestHandlerFactory_fallback(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	srv := newFakeRedis(t, "")
+	defer srv.Close()
+	srv.setDown(true)
+	store := NewSharedStore(NewRedisStore(context.Background(), RedisConfig{Address: srv.Addr()}), "", logging.NoOp)
+
+	engine := newEngine(store, config.ExtraConfig{
+		jujurouter.Namespace: map[string]interface{}{"maxRate": 2},
+		Namespace:            map[string]interface{}{"mode": "distributed"},
+	})
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		statuses = append(statuses, do(engine, ""))
+	}
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusOK || statuses[2] != http.StatusServiceUnavailable {
+		t.Errorf("the local limiter should be used while the store is down: %v", statuses)
+	}
+	if srv.dials() != 1 {
+		t.Errorf("the store should be skipped after a failure. dials: %d", srv.dials())
+	}
+}
+
+func TestHandlerFactory_local(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	srv := newFakeRedis(t, "")
+	defer srv.Close()
+	store := NewSharedStore(NewRedisStore(context.Background(), RedisConfig{Address: srv.Addr()}), "", logging.NoOp)
+
+	for _, engine := range []*gin.Engine{
+		newEngine(store, config.ExtraConfig{jujurouter.Namespace: map[string]interface{}{"maxRate": 1}}),
+		newEngine(nil, config.ExtraConfig{
+			jujurouter.Namespace: map[string]interface{}{"maxRate": 1},
+			Namespace:            map[string]interface{}{"mode": "distributed"},
+		}),
+	} {
+		if s := do(engine, ""); s != http.StatusOK {
+			t.Errorf("unexpected status code: %d", s)
+		}
+		if s := do(engine, ""); s != http.StatusServiceUnavailable {
+			t.Errorf("unexpected status code: %d", s)
+		}
+	}
+	if srv.dials() != 0 {
+		t.Errorf("the store should not be used by the local limiters. dials: %d", srv.dials())
+	}
+}
+
+func TestBackendFactory_distributed(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	defer srv.Close()
+	store := NewSharedStore(NewRedisStore(context.Background(), RedisConfig{Address: srv.Addr()}), "", logging.NoOp)
+
+	next := func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return &proxy.Response{IsComplete: true}, nil
+		}
+	}
+	remote := &config.Backend{
+		Host:       []string{"http://backend"},
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			jujuproxy.Namespace: map[string]interface{}{"maxRate": 10, "capacity": 2},
+			Namespace:           map[string]interface{}{"mode": "distributed"},
+		},
+	}
+	proxies := []proxy.Proxy{
+		BackendFactory(next, store, logging.NoOp)(remote),
+		BackendFactory(next, store, logging.NoOp)(remote),
+	}
+
+	waitForNewWindow(200 * time.Millisecond)
+	errs := []error{}
+	for i := 0; i < 3; i++ {
+		_, err := proxies[i%2](context.Background(), &proxy.Request{})
+		errs = append(errs, err)
+	}
+	if errs[0] != nil || errs[1] != nil || errs[2] != krakendrate.ErrLimited {
+		t.Errorf("the backend limit should be shared by the gateways: %v", errs)
+	}
+}
+
+// waitForNewWindow avoids starting the tests at the end of a window
+func waitForNewWindow(window time.Duration) {
+	if remaining := window - time.Duration(time.Now().UnixNano()%int64(window)); remaining < window/2 {
+		time.Sleep(remaining)
+	}
+}
+
+func do(engine *gin.Engine, client string) int {
+	req, _ := http.NewRequest("GET", "/", nil)
+	if client != "" {
+		req.Header.Set("X-Client", client)
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w.Code
+}
+
+func newEngine(store *SharedStore, e config.ExtraConfig) *gin.Engine {
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	}, store, logging.NoOp)
+	engine := gin.New()
+	engine.GET("/", hf(&config.EndpointConfig{Endpoint: "/", Method: "GET", ExtraConfig: e}, proxy.NoopProxy))
+	return engine
+}
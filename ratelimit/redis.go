@@ -0,0 +1,288 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRedisTimeout  = 100 * time.Millisecond
+	defaultRedisPoolSize = 16
+)
+
+var (
+	errUnexpectedReply = errors.New("ratelimit: unexpected reply from the store")
+	errPoolSaturated   = errors.New("ratelimit: all the connections to the store are in use")
+)
+
+// RedisConfig is the config struct of the connection to the store
+type RedisConfig struct {
+	Address  string `json:"address"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	Timeout  string `json:"timeout"`
+	PoolSize int    `json:"pool_size"`
+}
+
+// RedisStore is a Store keeping the counters in a server speaking the Redis protocol. Every increment is a
+// single round trip, pipelining the INCRBY and PEXPIREAT commands. No more than pool_size connections are
+// open at the same time and the operations finding all of them in use fail without waiting, so the limiters
+// use the local ones. Every operation, including the dial, must be completed before the timeout.
+type RedisStore struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	pool     chan *redisConn
+	// conns holds a token for every open connection, idle or in use
+	conns chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewRedisStore returns a RedisStore connecting lazily to the server. The idle connections are closed when
+// the context is cancelled.
+func NewRedisStore(ctx context.Context, cfg RedisConfig) *RedisStore {
+	s := &RedisStore{
+		address:  cfg.Address,
+		password: cfg.Password,
+		db:       cfg.DB,
+		timeout:  defaultRedisTimeout,
+	}
+	poolSize := defaultRedisPoolSize
+	if cfg.PoolSize > 0 {
+		poolSize = cfg.PoolSize
+	}
+	s.pool = make(chan *redisConn, poolSize)
+	s.conns = make(chan struct{}, poolSize)
+	if d, err := time.ParseDuration(cfg.Timeout); err == nil && d > 0 {
+		s.timeout = d
+	}
+	go func() {
+		<-ctx.Done()
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		for {
+			select {
+			case c := <-s.pool:
+				s.discard(c)
+			default:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// Incr implements the Store interface
+func (s *RedisStore) Incr(ctx context.Context, key string, delta int64, expiration time.Time) (int64, error) {
+	ms := expiration.UnixNano() / int64(time.Millisecond)
+	replies, err := s.do(ctx,
+		[]string{"INCRBY", key, strconv.FormatInt(delta, 10)},
+		[]string{"PEXPIREAT", key, strconv.FormatInt(ms, 10)},
+	)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range replies {
+		if err, ok := r.(redisError); ok {
+			return 0, err
+		}
+	}
+	v, ok := replies[0].(int64)
+	if !ok {
+		return 0, errUnexpectedReply
+	}
+	return v, nil
+}
+
+func (s *RedisStore) do(ctx context.Context, cmds ...[]string) ([]interface{}, error) {
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	c, err := s.get(deadline)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := c.do(deadline, cmds...)
+	if err != nil {
+		s.discard(c)
+		return nil, err
+	}
+	s.put(c)
+	return replies, nil
+}
+
+func (s *RedisStore) get(deadline time.Time) (*redisConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+	}
+
+	select {
+	case s.conns <- struct{}{}:
+	default:
+		return nil, errPoolSaturated
+	}
+	conn, err := net.DialTimeout("tcp", s.address, time.Until(deadline))
+	if err != nil {
+		<-s.conns
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	cmds := [][]string{}
+	if s.password != "" {
+		cmds = append(cmds, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if len(cmds) == 0 {
+		return c, nil
+	}
+	replies, err := c.do(deadline, cmds...)
+	if err == nil {
+		for _, r := range replies {
+			if rerr, ok := r.(redisError); ok {
+				err = rerr
+				break
+			}
+		}
+	}
+	if err != nil {
+		s.discard(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *RedisStore) put(c *redisConn) {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		s.discard(c)
+		return
+	}
+	select {
+	case s.pool <- c:
+	default:
+		s.discard(c)
+	}
+}
+
+// discard closes the connection and releases its token
+func (s *RedisStore) discard(c *redisConn) {
+	c.Close()
+	<-s.conns
+}
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string { return "ratelimit: store error: " + string(e) }
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// do sends the commands in a single write and reads their replies
+func (c *redisConn) do(deadline time.Time, cmds ...[]string) ([]interface{}, error) {
+	if err := c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for _, cmd := range cmds {
+		fmt.Fprintf(c.w, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		r, err := readReply(c.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = r
+	}
+	return replies, nil
+}
+
+// readReply parses a RESP reply. The error replies are returned as redisError values, since they do not
+// break the connection.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errUnexpectedReply
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return redisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		res := make([]interface{}, n)
+		for i := range res {
+			if res[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	default:
+		return nil, errUnexpectedReply
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errUnexpectedReply
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,224 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/logging"
+)
+
+func TestRedisStore(t *testing.T) {
+	srv := newFakeRedis(t, "secret")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewRedisStore(ctx, RedisConfig{Address: srv.Addr(), Password: "secret", DB: 2, PoolSize: 1})
+
+	expiration := time.Now().Add(time.Minute)
+	for i := int64(1); i <= 3; i++ {
+		v, err := s.Incr(context.Background(), "key", 1, expiration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != i {
+			t.Errorf("unexpected counter: %d", v)
+		}
+	}
+	if v, _ := s.Incr(context.Background(), "key", -2, expiration); v != 1 {
+		t.Errorf("unexpected counter: %d", v)
+	}
+	if srv.dials() != 1 {
+		t.Errorf("the connection should be reused. dials: %d", srv.dials())
+	}
+	if e := srv.expiration("2", "key"); e != expiration.UnixNano()/int64(time.Millisecond) {
+		t.Errorf("unexpected expiration: %d", e)
+	}
+
+	if _, err := NewRedisStore(ctx, RedisConfig{Address: srv.Addr(), Password: "wrong"}).Incr(context.Background(), "key", 1, expiration); err == nil {
+		t.Error("an error was expected with the wrong password")
+	}
+}
+
+func TestRedisStore_poolSaturated(t *testing.T) {
+	srv := newFakeRedis(t, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewRedisStore(ctx, RedisConfig{Address: srv.Addr(), PoolSize: 1})
+	shared := NewSharedStore(s, "", logging.NoOp)
+	expiration := time.Now().Add(time.Minute)
+
+	c, err := s.get(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shared.incr("key", expiration); err != errPoolSaturated {
+		t.Errorf("unexpected error with all the connections in use: %v", err)
+	}
+	if shared.skipUntil != 0 {
+		t.Error("the store should not be skipped when the pool is saturated")
+	}
+	if srv.dials() != 1 {
+		t.Errorf("unexpected dials: %d", srv.dials())
+	}
+
+	s.put(c)
+	if _, err := shared.incr("key", expiration); err != nil {
+		t.Errorf("unexpected error with an idle connection: %v", err)
+	}
+
+	// the broken connections release their slot
+	srv.setDown(true)
+	if _, err := s.Incr(context.Background(), "key", 1, expiration); err == nil || err == errPoolSaturated {
+		t.Errorf("unexpected error with the store down: %v", err)
+	}
+	srv.setDown(false)
+	if _, err := s.Incr(context.Background(), "key", 1, expiration); err != nil {
+		t.Errorf("unexpected error after the store recovery: %v", err)
+	}
+	if srv.dials() != 2 {
+		t.Errorf("unexpected dials: %d", srv.dials())
+	}
+}
+
+func TestRedisStore_unreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := NewRedisStore(context.Background(), RedisConfig{Address: addr, Timeout: "50ms"})
+	if _, err := s.Incr(context.Background(), "key", 1, time.Now().Add(time.Second)); err == nil {
+		t.Error("an error was expected")
+	}
+}
+
+// fakeRedis is an in-process server implementing the commands used by the RedisStore
+type fakeRedis struct {
+	net.Listener
+	password string
+
+	mu          sync.Mutex
+	values      map[string]int64
+	expirations map[string]int64
+	dialCount   int
+	down        bool
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{Listener: l, password: password, values: map[string]int64{}, expirations: map[string]int64{}}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.dialCount++
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) Addr() string { return s.Listener.Addr().String() }
+
+func (s *fakeRedis) dials() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dialCount
+}
+
+func (s *fakeRedis) expiration(db, key string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expirations[db+"/"+key]
+}
+
+// setDown makes the server close the connections without replying
+func (s *fakeRedis) setDown(down bool) {
+	s.mu.Lock()
+	s.down = down
+	s.mu.Unlock()
+}
+
+func (s *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authenticated := s.password == ""
+	db := "0"
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return
+		}
+		args, ok := v.([]interface{})
+		if !ok || len(args) == 0 {
+			return
+		}
+		cmd := make([]string, len(args))
+		for i, a := range args {
+			cmd[i], _ = a.(string)
+		}
+
+		s.mu.Lock()
+		down := s.down
+		s.mu.Unlock()
+		if down {
+			return
+		}
+
+		var reply string
+		switch {
+		case strings.EqualFold(cmd[0], "AUTH"):
+			authenticated = len(cmd) == 2 && cmd[1] == s.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case strings.EqualFold(cmd[0], "SELECT"):
+			db = cmd[1]
+			reply = "+OK\r\n"
+		case strings.EqualFold(cmd[0], "INCRBY"):
+			delta, _ := strconv.ParseInt(cmd[2], 10, 64)
+			s.mu.Lock()
+			k := db + "/" + cmd[1]
+			if e, ok := s.expirations[k]; ok && e <= time.Now().UnixNano()/int64(time.Millisecond) {
+				delete(s.values, k)
+				delete(s.expirations, k)
+			}
+			s.values[k] += delta
+			reply = fmt.Sprintf(":%d\r\n", s.values[k])
+			s.mu.Unlock()
+		case strings.EqualFold(cmd[0], "PEXPIREAT"):
+			ms, _ := strconv.ParseInt(cmd[2], 10, 64)
+			s.mu.Lock()
+			s.expirations[db+"/"+cmd[1]] = ms
+			s.mu.Unlock()
+			reply = ":1\r\n"
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		if _, err := c.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strings"
+
+	krakendrate "github.com/devopsfaith/krakend-ratelimit"
+	"github.com/devopsfaith/krakend-ratelimit/juju"
+	jujurouter "github.com/devopsfaith/krakend-ratelimit/juju/router"
+	jujugin "github.com/devopsfaith/krakend-ratelimit/juju/router/gin"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+// HandlerFactory adds the juju router rate limits to the endpoints. The limits of the endpoints with the
+// distributed mode are shared through the store. If the store is nil, all the limits are local.
+func HandlerFactory(next router.HandlerFactory, store *SharedStore, logger logging.Logger) router.HandlerFactory {
+	local := jujugin.NewRateLimiterMw(next)
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		if !distributed(remote.ExtraConfig) {
+			return local(remote, p)
+		}
+		if store == nil {
+			logger.Warning("ratelimit: no store defined, using the local limiters for", remote.Endpoint)
+			return local(remote, p)
+		}
+
+		handler := next(remote, p)
+		cfg := jujurouter.ConfigGetter(remote.ExtraConfig).(jujurouter.Config)
+		if cfg.MaxRate <= 0 && cfg.ClientMaxRate <= 0 {
+			return handler
+		}
+
+		name := "endpoint:" + remote.Method + ":" + remote.Endpoint
+		if cfg.MaxRate > 0 {
+			rate, c := float64(cfg.MaxRate), capacity(float64(cfg.MaxRate), cfg.MaxRate)
+			l := newLimiter(store, name, rate, c, juju.NewLimiter(rate, c))
+			handler = endpointLimiter(l, handler)
+		}
+		if cfg.ClientMaxRate > 0 {
+			var extractor jujugin.TokenExtractor
+			switch strings.ToLower(cfg.Strategy) {
+			case "ip":
+				extractor = jujugin.IPTokenExtractor
+				if cfg.Key != "" {
+					extractor = jujugin.NewIPTokenExtractor(cfg.Key)
+				}
+			case "header":
+				extractor = jujugin.HeaderTokenExtractor(cfg.Key)
+			}
+			if extractor != nil {
+				rate, c := float64(cfg.ClientMaxRate), capacity(float64(cfg.ClientMaxRate), cfg.ClientMaxRate)
+				handler = jujugin.NewTokenLimiterMw(extractor, clientLimiters(store, name, rate, c))(handler)
+			}
+		}
+		logger.Info("ratelimit: distributed limiter enabled for the endpoint", remote.Endpoint)
+		return handler
+	}
+}
+
+// endpointLimiter rejects the requests like the juju endpoint limiter
+func endpointLimiter(l krakendrate.Limiter, next gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.Allow() {
+			c.AbortWithError(http.StatusServiceUnavailable, krakendrate.ErrLimited)
+			return
+		}
+		next(c)
+	}
+}
+
+// clientLimiters returns a distributed limiter for every client, falling back to the local limiter of the
+// client
+func clientLimiters(store *SharedStore, name string, rate float64, c int64) krakendrate.LimiterStore {
+	fallback := juju.NewMemoryStore(rate, c)
+	return func(client string) krakendrate.Limiter {
+		return newLimiter(store, name+":"+client, rate, c, fallback(client))
+	}
+}
@@ -0,0 +1,315 @@
+package krakend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/zaplog"
+	cmd "github.com/devopsfaith/krakend-cobra"
+	"github.com/fsnotify/fsnotify"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+)
+
+// ReloadNamespace is the key to use to store and access the hot reload config
+const ReloadNamespace = "github_com/devopsfaith/krakend-ce/reload"
+
+const (
+	defaultReloadDebounce     = time.Second
+	defaultReloadDrainTimeout = 30 * time.Second
+	drainPollInterval         = 100 * time.Millisecond
+)
+
+type reloadConfig struct {
+	DisableWatch bool   `json:"disable_watch"`
+	Debounce     string `json:"debounce"`
+	DrainTimeout string `json:"drain_timeout"`
+}
+
+// reloader rebuilds the router, proxy and backend stacks every time the configuration file changes or the
+// process receives a SIGHUP, and swaps the served handler once the new stacks are ready.
+// The logger, the metrics collector, the token rejecter and the loaded plugins are created once and shared
+// by every rebuild, as well as the settings consumed by the RunServer (port, TLS, CORS and server plugins),
+// so changes in those sections require a restart.
+type reloader struct {
+	ctx          context.Context
+	builder      *ExecutorBuilder
+	deps         routerDeps
+	parser       config.Parser
+	path         string
+	watch        bool
+	debounce     time.Duration
+	drainTimeout time.Duration
+	handler      *swappableHandler
+	current      config.ServiceConfig
+	hash         string
+}
+
+func newReloader(ctx context.Context, e *ExecutorBuilder, deps routerDeps, cfg config.ServiceConfig) (*reloader, bool) {
+	if e.ConfigParser == nil {
+		return nil, false
+	}
+	rCfg := reloadConfig{}
+	ok, err := parseExtraConfig(cfg.ExtraConfig, ReloadNamespace, &rCfg)
+	if !ok {
+		return nil, false
+	}
+	if err != nil {
+		deps.logger.Warning("reload: unable to parse the config:", err.Error())
+		return nil, false
+	}
+	path := cmd.GetConfigFlag()
+	if path == "" {
+		deps.logger.Warning("reload: unable to locate the configuration file")
+		return nil, false
+	}
+	return &reloader{
+		ctx:          ctx,
+		builder:      e,
+		deps:         deps,
+		parser:       e.ConfigParser,
+		path:         filepath.Clean(path),
+		watch:        !rCfg.DisableWatch,
+		debounce:     parseDuration(rCfg.Debounce, defaultReloadDebounce),
+		drainTimeout: parseDuration(rCfg.DrainTimeout, defaultReloadDrainTimeout),
+		handler:      new(swappableHandler),
+	}, true
+}
+
+// Run builds the first version of the gateway, starts listening for configuration changes and blocks
+// running the server until the received context is cancelled. The stacks are bound to the context
+// injected at creation time.
+func (r *reloader) Run(ctx context.Context, cfg config.ServiceConfig, runServer router.RunServerFunc) {
+	g, err := r.build(cfg)
+	if g == nil {
+		r.deps.logger.Error("building the gateway:", err.Error())
+		return
+	}
+	if err != nil {
+		r.deps.logger.Error(err.Error())
+	}
+	r.handler.swap(g)
+	r.current = cfg
+	r.hash, _ = cfg.Hash()
+	r.deps.admin.publish(cfg, g.inspector)
+
+	go r.listen(ctx)
+
+	if err := runServer(ctx, cfg, r.handler); err != nil {
+		r.deps.logger.Error(err.Error())
+	}
+
+	r.deps.logger.Info("Router execution ended")
+}
+
+func (r *reloader) listen(ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	var events <-chan fsnotify.Event
+	var watchErrs <-chan error
+	if r.watch {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			r.deps.logger.Warning("reload: unable to watch the configuration file:", err.Error())
+		} else {
+			defer watcher.Close()
+			// watch the folder instead of the file so replacements done by editors and config maps are detected
+			if err := watcher.Add(filepath.Dir(r.path)); err != nil {
+				r.deps.logger.Warning("reload: unable to watch the configuration file:", err.Error())
+			}
+			events = watcher.Events
+			watchErrs = watcher.Errors
+		}
+	}
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			r.deps.logger.Info("reload: SIGHUP received")
+			r.reload()
+		case ev, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if filepath.Clean(ev.Name) != r.path || ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			pending = time.After(r.debounce)
+		case err, ok := <-watchErrs:
+			if !ok {
+				watchErrs = nil
+				continue
+			}
+			r.deps.logger.Warning("reload: watching the configuration file:", err.Error())
+		case <-pending:
+			pending = nil
+			r.deps.logger.Info("reload: configuration file changed")
+			r.reload()
+		}
+	}
+}
+
+func (r *reloader) reload() {
+	cfg, err := r.parser.Parse(r.path)
+	if err != nil {
+		r.deps.logger.Error("reload: keeping the current configuration:", err.Error())
+		return
+	}
+	cfg.Debug = cfg.Debug || cmd.GetDebugFlag()
+	if cfg.Port != r.current.Port {
+		r.deps.logger.Warning("reload: the port can not be changed without a restart")
+		cfg.Port = r.current.Port
+	}
+
+	hash, err := cfg.Hash()
+	if err == nil && hash == r.hash {
+		r.deps.logger.Info("reload: the configuration has not changed")
+		return
+	}
+
+	g, err := r.build(cfg)
+	if err != nil {
+		if g != nil {
+			g.cancel()
+		}
+		r.deps.logger.Error("reload: keeping the current configuration:", err.Error())
+		return
+	}
+
+	old := r.handler.swap(g)
+	r.current = cfg
+	r.hash = hash
+	if l, ok := r.deps.logger.(*zaplog.Logger); ok {
+		l.SetConfigHash(hash)
+	}
+	r.deps.admin.publish(cfg, g.inspector)
+	r.deps.logger.Info(fmt.Sprintf("reload: configuration applied, serving %d endpoints", len(cfg.Endpoints)))
+
+	if old == nil {
+		return
+	}
+	go func() {
+		if !old.drain(r.drainTimeout) {
+			r.deps.logger.Warning("reload: drain timeout reached, closing the previous stacks with requests in flight")
+		}
+		old.cancel()
+	}()
+}
+
+// build composes a new version of the gateway without serving it. The returned generation is nil only if
+// the handler could not be created. A non-nil generation with an error means that some endpoints were
+// not registered.
+func (r *reloader) build(cfg config.ServiceConfig) (g *handlerGeneration, err error) {
+	genCtx, cancel := context.WithCancel(r.ctx)
+	defer func() {
+		if rec := recover(); rec != nil {
+			g = nil
+			err = fmt.Errorf("%v", rec)
+		}
+		if g == nil {
+			cancel()
+		}
+	}()
+
+	routerCfg, inspector, err := r.builder.newRouterConfig(genCtx, cfg, r.deps)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	pf := routerCfg.ProxyFactory
+	routerCfg.ProxyFactory = proxy.FactoryFunc(func(e *config.EndpointConfig) (proxy.Proxy, error) {
+		p, err := pf.New(e)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s: %s", e.Method, e.Endpoint, err.Error()))
+		}
+		return p, err
+	})
+
+	var h http.Handler
+	routerCfg.RunServer = func(_ context.Context, _ config.ServiceConfig, handler http.Handler) error {
+		h = handler
+		return nil
+	}
+	router.NewFactory(routerCfg).NewWithContext(genCtx).Run(cfg)
+
+	if h == nil {
+		return nil, errors.New("the router did not produce a handler")
+	}
+	g = &handlerGeneration{handler: h, cancel: cancel, inspector: inspector}
+	if len(errs) > 0 {
+		return g, fmt.Errorf("unable to build %d endpoints: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return g, nil
+}
+
+// handlerGeneration is a gateway handler built from a single version of the configuration
+type handlerGeneration struct {
+	inFlight  int64
+	handler   http.Handler
+	cancel    context.CancelFunc
+	inspector *stackInspector
+}
+
+// drain waits until there are no requests in flight or the timeout is reached
+func (g *handlerGeneration) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if atomic.LoadInt64(&g.inFlight) == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+	}
+	return false
+}
+
+// swappableHandler is a http.Handler delegating every request to the current handler generation.
+// Replacing the generation does not affect the requests already being served by the previous one.
+type swappableHandler struct {
+	current atomic.Value
+}
+
+func (s *swappableHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	g := s.acquire()
+	defer atomic.AddInt64(&g.inFlight, -1)
+	g.handler.ServeHTTP(rw, req)
+}
+
+// acquire returns the current generation with the request already counted as in flight. The generation is
+// checked again after the increment, so a drain started by a concurrent swap can not miss the request.
+func (s *swappableHandler) acquire() *handlerGeneration {
+	for {
+		g := s.current.Load().(*handlerGeneration)
+		atomic.AddInt64(&g.inFlight, 1)
+		if s.current.Load().(*handlerGeneration) == g {
+			return g
+		}
+		atomic.AddInt64(&g.inFlight, -1)
+	}
+}
+
+func (s *swappableHandler) swap(g *handlerGeneration) *handlerGeneration {
+	old, _ := s.current.Load().(*handlerGeneration)
+	s.current.Store(g)
+	return old
+}
@@ -0,0 +1,271 @@
+package krakend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/quota"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+func TestReloader_fsnotify(t *testing.T) {
+	r, write, cancel := newTestReloader(t, true)
+	defer cancel()
+
+	go r.listen(r.ctx)
+	// the watcher is added by the listener goroutine, so the file is written until the change is detected
+	waitFor(t, func() bool {
+		write("/fsnotify", "")
+		return serves(r.handler, "/fsnotify")
+	})
+	if serves(r.handler, "/initial") {
+		t.Error("the previous endpoints are still served")
+	}
+}
+
+func TestReloader_sighup(t *testing.T) {
+	// a registered channel prevents the signals sent before the listener is ready from killing the process
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	r, write, cancel := newTestReloader(t, false)
+	defer cancel()
+
+	write("/sighup", "")
+	go r.listen(r.ctx)
+	waitFor(t, func() bool {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		return serves(r.handler, "/sighup")
+	})
+}
+
+func TestReloader_keepsTheCurrentConfig(t *testing.T) {
+	r, write, cancel := newTestReloader(t, false)
+	defer cancel()
+
+	g := r.handler.current.Load().(*handlerGeneration)
+	hash := r.hash
+
+	for _, extra := range []string{
+		// a file that can not be parsed
+		`,`,
+		// a config that can not be built
+		fmt.Sprintf(`, "extra_config": {%q: {"order": ["unknown"]}}`, BackendMiddlewaresNamespace),
+	} {
+		write("/broken", extra)
+		r.reload()
+
+		if r.handler.current.Load().(*handlerGeneration) != g || r.hash != hash {
+			t.Errorf("the generation was replaced by a broken config: %s", extra)
+		}
+		if !serves(r.handler, "/initial") || serves(r.handler, "/broken") {
+			t.Errorf("unexpected endpoints after the broken config: %s", extra)
+		}
+	}
+
+	// the unchanged configs are not rebuilt
+	write("/initial", "")
+	r.reload()
+	if r.handler.current.Load().(*handlerGeneration) != g {
+		t.Error("the generation was replaced by the same config")
+	}
+}
+
+func TestReloader_drain(t *testing.T) {
+	r, write, cancel := newTestReloader(t, false)
+	defer cancel()
+	r.drainTimeout = time.Second
+
+	old := r.handler.current.Load().(*handlerGeneration)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := old.handler
+	old.handler = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		handler.ServeHTTP(rw, req)
+	})
+	oldCtx, oldCancel := context.WithCancel(context.Background())
+	cancelOld := old.cancel
+	old.cancel = func() {
+		cancelOld()
+		oldCancel()
+	}
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		r.handler.ServeHTTP(w, httptest.NewRequest("GET", "/initial", nil))
+		close(done)
+	}()
+	<-started
+
+	write("/drained", "")
+	r.reload()
+	if !serves(r.handler, "/drained") {
+		t.Fatal("the new config is not served")
+	}
+
+	select {
+	case <-oldCtx.Done():
+		t.Fatal("the previous generation was cancelled with a request in flight")
+	case <-time.After(3 * drainPollInterval):
+	}
+
+	close(release)
+	<-done
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status code of the request in flight: %d", w.Code)
+	}
+	select {
+	case <-oldCtx.Done():
+	case <-time.After(time.Second):
+		t.Error("the previous generation was not cancelled after the drain")
+	}
+}
+
+func TestHandlerGeneration_drainTimeout(t *testing.T) {
+	g := &handlerGeneration{inFlight: 1}
+	if g.drain(drainPollInterval) {
+		t.Error("the drain should time out with requests in flight")
+	}
+	g.inFlight = 0
+	if !g.drain(time.Second) {
+		t.Error("the drain should end without requests in flight")
+	}
+}
+
+func TestSwappableHandler_swapWhileServing(t *testing.T) {
+	var drained int32
+	newGeneration := func(track bool) *handlerGeneration {
+		return &handlerGeneration{handler: http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+			if track && atomic.LoadInt32(&drained) == 1 {
+				t.Error("a request was served by a drained generation")
+			}
+		})}
+	}
+	s := new(swappableHandler)
+	s.swap(newGeneration(true))
+
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					s.ServeHTTP(nil, nil)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	old := s.swap(newGeneration(false))
+	if !old.drain(time.Second) {
+		t.Error("the previous generation was not drained")
+	}
+	atomic.StoreInt32(&drained, 1)
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+}
+
+// newTestReloader returns a reloader serving the /initial endpoint and a function rewriting its config
+// file with a single endpoint and the given extra content
+func newTestReloader(t *testing.T, watch bool) (*reloader, func(endpoint, extra string), context.CancelFunc) {
+	gin.SetMode(gin.TestMode)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(`{"ok":true}`))
+	}))
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "krakend.json")
+
+	var mu sync.Mutex
+	write := func(endpoint, extra string) {
+		mu.Lock()
+		defer mu.Unlock()
+		content := fmt.Sprintf(`{"version": 2, "port": 8080, "endpoints": [{"endpoint": %q, "backend": [{"host": [%q], "url_pattern": "/"}]}]%s}`,
+			endpoint, backend.URL, extra)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("/initial", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &ExecutorBuilder{ConfigParser: config.NewParser()}
+	e.checkCollaborators()
+	cfg, err := e.ConfigParser.Parse(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &reloader{
+		ctx:     ctx,
+		builder: e,
+		deps: routerDeps{
+			logger:          logging.NoOp,
+			metricCollector: e.MetricsAndTracesRegister.Register(ctx, cfg, logging.NoOp),
+			health:          e.HealthRegistry,
+			quotas:          quota.NewMemoryStore(),
+		},
+		parser:       e.ConfigParser,
+		path:         path,
+		watch:        watch,
+		debounce:     10 * time.Millisecond,
+		drainTimeout: time.Second,
+		handler:      new(swappableHandler),
+	}
+
+	g, err := r.build(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.handler.swap(g)
+	r.current = cfg
+	r.hash, _ = cfg.Hash()
+
+	return r, write, func() {
+		cancel()
+		backend.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func serves(h http.Handler, path string) bool {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w.Code == http.StatusOK
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the reload")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
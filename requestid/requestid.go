@@ -0,0 +1,215 @@
+// Package requestid provides the generation and the propagation of the request IDs. Every request gets the
+// ID received from the client or a new one, returned in the response and forwarded to the backends.
+//
+// Sample service extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/request-id": {
+//			"header": "X-Correlation-Id",
+//			"format": "ulid"
+//		},
+//		...
+//	},
+//	...
+//
+// The header defaults to X-Request-Id and the format of the generated IDs to "uuid" (random UUID v4). The
+// "ulid" format generates lexicographically sortable IDs. The IDs received with more than 128 chars are
+// replaced by a new one.
+//
+// The middleware is always enabled, so the config is only required to change the defaults. The ID is kept
+// in the gin context and in the request one, so the proxies can read it from the context they receive, and
+// the loggers returned by Logger add it to every message.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-contrib/uuid"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	transport "github.com/luraproject/lura/transport/http/client"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/request-id"
+
+// ContextKey is the key of the gin context holding the ID of the request
+const ContextKey = "krakend-request-id"
+
+// contextKey is the key of the request context holding the ID, for the handlers using it instead of the
+// gin one
+type contextKey struct{}
+
+const (
+	// DefaultHeader is the header used when the config does not declare one
+	DefaultHeader = "X-Request-Id"
+
+	formatUUID = "uuid"
+	formatULID = "ulid"
+	maxLength  = 128
+)
+
+// Config is the custom config struct containing the params for the request IDs
+type Config struct {
+	Header string `json:"header"`
+	// Format is "uuid" or "ulid"
+	Format string `json:"format"`
+}
+
+func getConfig(e config.ExtraConfig) (Config, error) {
+	cfg := Config{}
+	if v, ok := e[Namespace]; ok {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return Config{Header: DefaultHeader, Format: formatUUID}, err
+		}
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return Config{Header: DefaultHeader, Format: formatUUID}, err
+		}
+	}
+	if cfg.Header == "" {
+		cfg.Header = DefaultHeader
+	}
+	cfg.Header = textproto.CanonicalMIMEHeaderKey(cfg.Header)
+	switch cfg.Format {
+	case "":
+		cfg.Format = formatUUID
+	case formatUUID, formatULID:
+	default:
+		err := fmt.Errorf("unknown format %q", cfg.Format)
+		cfg.Format = formatUUID
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// requestID is the value stored in the gin context
+type requestID struct {
+	header string
+	value  string
+}
+
+// New returns an engine middleware assigning an ID to every request. A bad config is logged and replaced
+// by the default values.
+func New(e config.ExtraConfig, l logging.Logger) gin.HandlerFunc {
+	cfg, err := getConfig(e)
+	if err != nil {
+		l.Warning("request id: using the default config:", err.Error())
+	}
+	generate := newUUID
+	if cfg.Format == formatULID {
+		generate = newULID
+	}
+
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(cfg.Header)
+		if id == "" || len(id) > maxLength {
+			id = generate()
+			c.Request.Header.Set(cfg.Header, id)
+		}
+		rid := requestID{header: cfg.Header, value: id}
+		c.Set(ContextKey, rid)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), contextKey{}, rid))
+		c.Header(cfg.Header, id)
+		c.Next()
+	}
+}
+
+// FromContext returns the ID of the request of the context, if any. The context must derive from the gin
+// one or from the one of the request.
+func FromContext(ctx context.Context) string {
+	id, _ := fromContext(ctx)
+	return id.value
+}
+
+func fromContext(ctx context.Context) (requestID, bool) {
+	if id, ok := ctx.Value(contextKey{}).(requestID); ok {
+		return id, true
+	}
+	id, ok := ctx.Value(ContextKey).(requestID)
+	return id, ok
+}
+
+// HTTPRequestExecutor decorates the executor of the backend, adding the ID of the request to the requests
+// sent to the backends
+func HTTPRequestExecutor(next transport.HTTPRequestExecutor) transport.HTTPRequestExecutor {
+	return func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		if id, ok := fromContext(ctx); ok {
+			req.Header.Set(id.header, id.value)
+		}
+		return next(ctx, req)
+	}
+}
+
+// Logger returns a logger adding the ID of the request of the context to every message, as a request_id
+// field if the logger is a structured one. It returns the received logger if the context has no ID.
+func Logger(ctx context.Context, l logging.Logger) logging.Logger {
+	id := FromContext(ctx)
+	if id == "" {
+		return l
+	}
+	if f, ok := l.(fieldLogger); ok {
+		return f.WithField("request_id", id)
+	}
+	return requestLogger{prefix: "request_id=" + id, next: l}
+}
+
+// fieldLogger is implemented by the structured loggers
+type fieldLogger interface {
+	WithField(key string, value interface{}) logging.Logger
+}
+
+type requestLogger struct {
+	prefix string
+	next   logging.Logger
+}
+
+func (r requestLogger) Debug(v ...interface{})    { r.next.Debug(r.with(v)...) }
+func (r requestLogger) Info(v ...interface{})     { r.next.Info(r.with(v)...) }
+func (r requestLogger) Warning(v ...interface{})  { r.next.Warning(r.with(v)...) }
+func (r requestLogger) Error(v ...interface{})    { r.next.Error(r.with(v)...) }
+func (r requestLogger) Critical(v ...interface{}) { r.next.Critical(r.with(v)...) }
+func (r requestLogger) Fatal(v ...interface{})    { r.next.Fatal(r.with(v)...) }
+
+func (r requestLogger) with(v []interface{}) []interface{} {
+	return append([]interface{}{r.prefix}, v...)
+}
+
+func newUUID() string {
+	return uuid.NewV4().String()
+}
+
+// crockford is the alphabet of the ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: 48 bits with the timestamp in milliseconds followed by 80 random bits, encoded
+// as 26 chars of base32
+func newULID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()/int64(time.Millisecond))<<16)
+	rand.Read(b[6:])
+	return encodeULID(b)
+}
+
+func encodeULID(b [16]byte) string {
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	out := make([]byte, 26)
+	// the 128 bits are encoded from the last 5 bits, the first char holding the 3 leading ones
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out)
+}
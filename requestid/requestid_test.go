@@ -0,0 +1,176 @@
+package requestid
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulidPattern = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+)
+
+func TestNew(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var forwarded string
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(DefaultHeader)
+	}))
+	defer backend.Close()
+
+	executor := HTTPRequestExecutor(func(_ context.Context, req *http.Request) (*http.Response, error) {
+		return http.DefaultClient.Do(req)
+	})
+	engine := gin.New()
+	engine.Use(New(config.ExtraConfig{}, logging.NoOp))
+	engine.GET("/", func(c *gin.Context) {
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		resp, err := executor(c, req)
+		if err != nil {
+			c.AbortWithError(http.StatusBadGateway, err)
+			return
+		}
+		resp.Body.Close()
+		c.String(http.StatusOK, FromContext(c.Request.Context()))
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	id := w.Header().Get(DefaultHeader)
+	if !uuidPattern.MatchString(id) {
+		t.Errorf("unexpected id: %q", id)
+	}
+	if forwarded != id {
+		t.Errorf("unexpected id sent to the backend: %q", forwarded)
+	}
+	if body := w.Body.String(); body != id {
+		t.Errorf("unexpected id in the request context: %q", body)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(DefaultHeader, "abc-123")
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if id := w.Header().Get(DefaultHeader); id != "abc-123" {
+		t.Errorf("the received id was not kept: %q", id)
+	}
+	if forwarded != "abc-123" {
+		t.Errorf("unexpected id sent to the backend: %q", forwarded)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(DefaultHeader, strings.Repeat("a", maxLength+1))
+	w = httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	if id := w.Header().Get(DefaultHeader); !uuidPattern.MatchString(id) {
+		t.Errorf("the long id was not replaced: %q", id)
+	}
+}
+
+func TestNew_customConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	engine := gin.New()
+	engine.Use(New(config.ExtraConfig{Namespace: map[string]interface{}{"header": "x-correlation-id", "format": "ulid"}}, logging.NoOp))
+	engine.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.Request.Header.Get("X-Correlation-Id"))
+	})
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	id := w.Header().Get("X-Correlation-Id")
+	if !ulidPattern.MatchString(id) {
+		t.Errorf("unexpected id: %q", id)
+	}
+	if w.Body.String() != id {
+		t.Errorf("the request header was not updated: %q", w.Body.String())
+	}
+	if h := w.Header().Get(DefaultHeader); h != "" {
+		t.Errorf("unexpected default header: %q", h)
+	}
+}
+
+func TestGetConfig_badConfig(t *testing.T) {
+	for _, v := range []interface{}{
+		map[string]interface{}{"format": "snowflake"},
+		map[string]interface{}{"header": 42},
+	} {
+		cfg, err := getConfig(config.ExtraConfig{Namespace: v})
+		if err == nil {
+			t.Errorf("expecting an error with the config %v", v)
+		}
+		if cfg.Header != DefaultHeader || cfg.Format != formatUUID {
+			t.Errorf("unexpected fallback config: %+v", cfg)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l, _ := logging.NewLogger("DEBUG", buf, "")
+
+	Logger(context.Background(), l).Info("no id")
+	ctx := context.WithValue(context.Background(), contextKey{}, requestID{header: DefaultHeader, value: "abc-123"})
+	Logger(ctx, l).Error("with id")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+	if strings.Contains(lines[0], "request_id") {
+		t.Errorf("unexpected request id: %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "request_id=abc-123 with id") {
+		t.Errorf("the request id is missing: %q", lines[1])
+	}
+}
+
+func TestLogger_fieldLogger(t *testing.T) {
+	ctx := context.WithValue(context.Background(), contextKey{}, requestID{header: DefaultHeader, value: "abc-123"})
+	l := Logger(ctx, &dummyFieldLogger{Logger: logging.NoOp})
+	f, ok := l.(*dummyFieldLogger)
+	if !ok {
+		t.Fatalf("unexpected logger: %T", l)
+	}
+	if f.key != "request_id" || f.value != "abc-123" {
+		t.Errorf("unexpected field: %s=%v", f.key, f.value)
+	}
+}
+
+type dummyFieldLogger struct {
+	logging.Logger
+	key   string
+	value interface{}
+}
+
+func (d *dummyFieldLogger) WithField(key string, value interface{}) logging.Logger {
+	return &dummyFieldLogger{Logger: d.Logger, key: key, value: value}
+}
+
+func TestEncodeULID(t *testing.T) {
+	var b [16]byte
+	if id := encodeULID(b); id != "00000000000000000000000000" {
+		t.Errorf("unexpected encoding: %s", id)
+	}
+	for i := range b {
+		b[i] = 0xff
+	}
+	if id := encodeULID(b); id != "7ZZZZZZZZZZZZZZZZZZZZZZZZZ" {
+		t.Errorf("unexpected encoding: %s", id)
+	}
+	// the timestamp of the sample ULID of the spec, 1469918176385
+	b = [16]byte{0x01, 0x56, 0x3d, 0xf3, 0x64, 0x81}
+	if id := encodeULID(b); !strings.HasPrefix(id, "01ARYZ6S41") {
+		t.Errorf("unexpected timestamp encoding: %s", id)
+	}
+}
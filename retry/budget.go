@@ -0,0 +1,82 @@
+package retry
+
+import (
+	"sync"
+
+	"github.com/luraproject/lura/config"
+)
+
+const (
+	defaultBudgetRatio      = .2
+	defaultBudgetMinRetries = 10
+)
+
+// BudgetConfig is the custom config struct containing the params for the retry budget
+type BudgetConfig struct {
+	// Ratio is the number of retries allowed per request
+	Ratio float64 `json:"budget_ratio"`
+	// MinRetries is the number of retries allowed regardless of the traffic, so the backends with
+	// low traffic can be retried too
+	MinRetries float64 `json:"budget_min_retries"`
+}
+
+// BudgetConfigGetter parses the retry budget defined at the service extra config, returning the default
+// values if it is not present
+func BudgetConfigGetter(e config.ExtraConfig) BudgetConfig {
+	cfg := BudgetConfig{}
+	decode(e, &cfg)
+	if cfg.Ratio <= 0 {
+		cfg.Ratio = defaultBudgetRatio
+	}
+	if cfg.MinRetries <= 0 {
+		cfg.MinRetries = defaultBudgetMinRetries
+	}
+	return cfg
+}
+
+// Budget limits the ratio of retries to requests, so the retries can not amplify an outage.
+// Every request deposits a fraction of a token and every retry withdraws a full one. The balance can not
+// exceed the minimum retries, so the budget recovers after a burst of failures.
+// A nil Budget does not limit the retries.
+type Budget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+// NewBudget returns a full Budget
+func NewBudget(cfg BudgetConfig) *Budget {
+	return &Budget{
+		ratio:  cfg.Ratio,
+		max:    cfg.MinRetries,
+		tokens: cfg.MinRetries,
+	}
+}
+
+// Deposit adds the tokens earned by a request
+func (b *Budget) Deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+	b.mu.Unlock()
+}
+
+// Withdraw takes the token required by a retry. It returns false if the budget is exhausted.
+func (b *Budget) Withdraw() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,127 @@
+package retry
+
+import (
+	"context"
+
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+)
+
+// Observer is notified about the retries executed by the middleware
+type Observer interface {
+	// Retry is called before every retry with the number of the failed attempt and the failure class
+	Retry(ctx context.Context, backend string, attempt int, reason string)
+	// Exhausted is called when a retry is discarded because the budget is exhausted
+	Exhausted(ctx context.Context, backend string)
+	// Done is called once the request is completed with the number of attempts executed
+	Done(ctx context.Context, backend string, attempts int)
+}
+
+// Observers is an Observer notifying all its members
+type Observers []Observer
+
+func (os Observers) Retry(ctx context.Context, backend string, attempt int, reason string) {
+	for _, o := range os {
+		o.Retry(ctx, backend, attempt, reason)
+	}
+}
+
+func (os Observers) Exhausted(ctx context.Context, backend string) {
+	for _, o := range os {
+		o.Exhausted(ctx, backend)
+	}
+}
+
+func (os Observers) Done(ctx context.Context, backend string, attempts int) {
+	for _, o := range os {
+		o.Done(ctx, backend, attempts)
+	}
+}
+
+type noopObserver struct{}
+
+func (noopObserver) Retry(_ context.Context, _ string, _ int, _ string) {}
+func (noopObserver) Exhausted(_ context.Context, _ string)              {}
+func (noopObserver) Done(_ context.Context, _ string, _ int)            {}
+
+// NewMetricsObserver returns an Observer updating the counters of the proxy metrics collector
+func NewMetricsObserver(m *metrics.Metrics) Observer {
+	if m == nil || m.Metrics == nil || m.Proxy == nil {
+		return noopObserver{}
+	}
+	return metricsObserver{m}
+}
+
+type metricsObserver struct {
+	m *metrics.Metrics
+}
+
+func (o metricsObserver) Retry(_ context.Context, backend string, _ int, reason string) {
+	o.m.Proxy.Counter("retry.retries.backend." + backend + ".reason." + reason).Inc(1)
+}
+
+func (o metricsObserver) Exhausted(_ context.Context, backend string) {
+	o.m.Proxy.Counter("retry.budget_exhausted.backend." + backend).Inc(1)
+}
+
+func (metricsObserver) Done(_ context.Context, _ string, _ int) {}
+
+var (
+	retryMeasure     = stats.Int64("krakend.io/retry/retries", "Number of backend retries", stats.UnitDimensionless)
+	exhaustedMeasure = stats.Int64("krakend.io/retry/budget_exhausted", "Number of retries discarded by the budget", stats.UnitDimensionless)
+
+	backendKey = tag.MustNewKey("krakend.retry.backend")
+	reasonKey  = tag.MustNewKey("krakend.retry.reason")
+
+	// OpenCensusViews are the views exposing the retry measures. They should be registered along with the
+	// rest of the opencensus views.
+	OpenCensusViews = []*view.View{
+		{
+			Name:        "krakend.io/retry/retries",
+			Description: "Number of backend retries",
+			Measure:     retryMeasure,
+			TagKeys:     []tag.Key{backendKey, reasonKey},
+			Aggregation: view.Count(),
+		},
+		{
+			Name:        "krakend.io/retry/budget_exhausted",
+			Description: "Number of retries discarded by the budget",
+			Measure:     exhaustedMeasure,
+			TagKeys:     []tag.Key{backendKey},
+			Aggregation: view.Count(),
+		},
+	}
+)
+
+// NewOpenCensusObserver returns an Observer recording the retry measures and annotating the current span
+func NewOpenCensusObserver() Observer {
+	return openCensusObserver{}
+}
+
+type openCensusObserver struct{}
+
+func (openCensusObserver) Retry(ctx context.Context, backend string, attempt int, reason string) {
+	stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(backendKey, backend), tag.Upsert(reasonKey, reason)}, retryMeasure.M(1))
+	if span := trace.FromContext(ctx); span != nil {
+		span.Annotate([]trace.Attribute{
+			trace.Int64Attribute("krakend.retry.attempt", int64(attempt)),
+			trace.StringAttribute("krakend.retry.reason", reason),
+		}, "retrying the backend request")
+	}
+}
+
+func (openCensusObserver) Exhausted(ctx context.Context, backend string) {
+	stats.RecordWithTags(ctx, []tag.Mutator{tag.Upsert(backendKey, backend)}, exhaustedMeasure.M(1))
+	if span := trace.FromContext(ctx); span != nil {
+		span.Annotate(nil, "retry budget exhausted")
+	}
+}
+
+func (openCensusObserver) Done(ctx context.Context, _ string, attempts int) {
+	if span := trace.FromContext(ctx); span != nil {
+		span.AddAttributes(trace.Int64Attribute("krakend.retry.attempts", int64(attempts)))
+	}
+}
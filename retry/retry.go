@@ -0,0 +1,335 @@
+// Package retry provides a backend middleware retrying the failed requests with an exponential backoff,
+// limited by a retry budget shared by all the backends.
+//
+// Sample backend extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/retry": {
+//			"max_attempts": 3,
+//			"retry_on_status": [502, 503, 504],
+//			"retry_on_errors": ["connection", "timeout"],
+//			"initial_backoff": "50ms",
+//			"max_backoff": "1s",
+//			"multiplier": 2,
+//			"jitter": 0.2
+//		},
+//		...
+//	},
+//	...
+//
+// The retry_on_status codes are checked also when the backend reports an invalid status code as an error,
+// with or without the return_error_details option. The retry_on_errors class invalid_status matches the
+// rest of the invalid status codes.
+//
+// The same namespace at the service extra config defines the retry budget:
+//
+//	"github_com/devopsfaith/krakend-ce/retry": {
+//		"budget_ratio": 0.2,
+//		"budget_min_retries": 10
+//	}
+package retry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"github.com/luraproject/lura/transport/http/client"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/retry"
+
+const (
+	// ErrorConnection matches the errors dialing, reading from or writing to the backend
+	ErrorConnection = "connection"
+	// ErrorTimeout matches the timeouts of the transport, but not the ones of the request context
+	ErrorTimeout = "timeout"
+	// ErrorInvalidStatus matches the unexpected status codes not listed at retry_on_status
+	ErrorInvalidStatus = "invalid_status"
+
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 50 * time.Millisecond
+	defaultMaxBackoff     = time.Second
+	defaultMultiplier     = 2
+	defaultJitter         = .2
+)
+
+var (
+	defaultRetryOnStatus = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	defaultRetryOnErrors = []string{ErrorConnection, ErrorTimeout}
+
+	idempotentMethods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodOptions: true,
+		http.MethodTrace:   true,
+		http.MethodPut:     true,
+		http.MethodDelete:  true,
+	}
+)
+
+// Config is the custom config struct containing the params for the retry middleware
+type Config struct {
+	MaxAttempts    int
+	RetryOnStatus  map[int]bool
+	RetryOnErrors  map[string]bool
+	NonIdempotent  bool
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         float64
+}
+
+// ZeroCfg is the zero value for the Config struct
+var ZeroCfg = Config{}
+
+type rawConfig struct {
+	MaxAttempts        int      `json:"max_attempts"`
+	RetryOnStatus      []int    `json:"retry_on_status"`
+	RetryOnErrors      []string `json:"retry_on_errors"`
+	RetryNonIdempotent bool     `json:"retry_non_idempotent"`
+	InitialBackoff     string   `json:"initial_backoff"`
+	MaxBackoff         string   `json:"max_backoff"`
+	Multiplier         float64  `json:"multiplier"`
+	Jitter             *float64 `json:"jitter"`
+}
+
+// ConfigGetter implements the config.ConfigGetter interface. It parses the extra config for the
+// retry middleware and returns a ZeroCfg if something goes wrong.
+func ConfigGetter(e config.ExtraConfig) interface{} {
+	raw := rawConfig{}
+	if !decode(e, &raw) {
+		return ZeroCfg
+	}
+
+	cfg := Config{
+		MaxAttempts:    raw.MaxAttempts,
+		RetryOnStatus:  map[int]bool{},
+		RetryOnErrors:  map[string]bool{},
+		NonIdempotent:  raw.RetryNonIdempotent,
+		InitialBackoff: parseDuration(raw.InitialBackoff, defaultInitialBackoff),
+		MaxBackoff:     parseDuration(raw.MaxBackoff, defaultMaxBackoff),
+		Multiplier:     raw.Multiplier,
+		Jitter:         defaultJitter,
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.Multiplier < 1 {
+		cfg.Multiplier = defaultMultiplier
+	}
+	if raw.Jitter != nil && *raw.Jitter >= 0 && *raw.Jitter <= 1 {
+		cfg.Jitter = *raw.Jitter
+	}
+
+	if raw.RetryOnStatus == nil {
+		raw.RetryOnStatus = defaultRetryOnStatus
+	}
+	for _, s := range raw.RetryOnStatus {
+		cfg.RetryOnStatus[s] = true
+	}
+	if raw.RetryOnErrors == nil {
+		raw.RetryOnErrors = defaultRetryOnErrors
+	}
+	for _, s := range raw.RetryOnErrors {
+		cfg.RetryOnErrors[strings.ToLower(s)] = true
+	}
+	return cfg
+}
+
+// BackendFactory adds a retry middleware wrapping the internal factory. The retries are limited by the
+// budget, if any, and reported to the observer, if any.
+func BackendFactory(next proxy.BackendFactory, b *Budget, o Observer, logger logging.Logger) proxy.BackendFactory {
+	return func(remote *config.Backend) proxy.Proxy {
+		return NewMiddleware(remote, b, o, logger)(next(remote))
+	}
+}
+
+// NewMiddleware builds a middleware based on the extra config params or fallbacks to the next proxy
+func NewMiddleware(remote *config.Backend, b *Budget, o Observer, logger logging.Logger) proxy.Middleware {
+	cfg := ConfigGetter(remote.ExtraConfig).(Config)
+	if cfg.MaxAttempts <= 1 {
+		return proxy.EmptyMiddleware
+	}
+	if !cfg.NonIdempotent && !idempotentMethods[strings.ToUpper(remote.Method)] {
+		logger.Debug("retry: skipping the non idempotent backend", remote.Method, remote.URLPattern)
+		return proxy.EmptyMiddleware
+	}
+	if o == nil {
+		o = noopObserver{}
+	}
+	name := strings.Join(remote.Host, ",") + remote.URLPattern
+
+	return func(next ...proxy.Proxy) proxy.Proxy {
+		if len(next) > 1 {
+			panic(proxy.ErrTooManyProxies)
+		}
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			b.Deposit()
+
+			var body []byte
+			if request.Body != nil {
+				var err error
+				body, err = ioutil.ReadAll(request.Body)
+				request.Body.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			var resp *proxy.Response
+			var err error
+			for attempt := 1; ; attempt++ {
+				r := request.Clone()
+				if body != nil {
+					r.Body = ioutil.NopCloser(bytes.NewReader(body))
+				}
+				status := new(statusRecorder)
+				resp, err = next[0](context.WithValue(ctx, statusRecorderKey{}, status), &r)
+
+				reason := cfg.retryReason(resp, err, status.code)
+				if reason == "" || attempt >= cfg.MaxAttempts || ctx.Err() != nil {
+					o.Done(ctx, name, attempt)
+					return resp, err
+				}
+				if !b.Withdraw() {
+					o.Exhausted(ctx, name)
+					o.Done(ctx, name, attempt)
+					return resp, err
+				}
+
+				// the discarded response of a retried status keeps its body, and the connection, open
+				if resp != nil {
+					if closer, ok := resp.Io.(io.Closer); ok {
+						closer.Close()
+					}
+				}
+				select {
+				case <-ctx.Done():
+					o.Done(ctx, name, attempt)
+					return nil, ctx.Err()
+				case <-time.After(cfg.backoff(attempt)):
+				}
+				o.Retry(ctx, name, attempt, reason)
+			}
+		}
+	}
+}
+
+// retryReason returns the class of the failure if it is retryable or an empty string otherwise. The
+// status is the one recorded by the HTTPRequestExecutor, if any, since the default status handler of the
+// http client discards the response and returns a client.ErrInvalidStatusCode.
+func (c Config) retryReason(resp *proxy.Response, err error, status int) string {
+	if err == nil {
+		if resp != nil && c.RetryOnStatus[resp.Metadata.StatusCode] {
+			return "status"
+		}
+		return ""
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return ""
+	}
+	if httpErr, ok := err.(client.HTTPResponseError); ok {
+		status = httpErr.StatusCode()
+		err = client.ErrInvalidStatusCode
+	}
+	if err == client.ErrInvalidStatusCode {
+		if c.RetryOnStatus[status] {
+			return "status"
+		}
+		if c.RetryOnErrors[ErrorInvalidStatus] {
+			return ErrorInvalidStatus
+		}
+		return ""
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if c.RetryOnErrors[ErrorTimeout] {
+			return ErrorTimeout
+		}
+		return ""
+	}
+	if c.RetryOnErrors[ErrorConnection] && isConnectionError(err) {
+		return ErrorConnection
+	}
+	return ""
+}
+
+type statusRecorderKey struct{}
+
+type statusRecorder struct {
+	code int
+}
+
+// HTTPRequestExecutor records the status code of the backend responses, so the middleware can check it
+// against the retry_on_status list even when the http client reports just a client.ErrInvalidStatusCode
+func HTTPRequestExecutor(next client.HTTPRequestExecutor) client.HTTPRequestExecutor {
+	return func(ctx context.Context, req *http.Request) (*http.Response, error) {
+		resp, err := next(ctx, req)
+		if s, ok := ctx.Value(statusRecorderKey{}).(*statusRecorder); ok && resp != nil {
+			s.code = resp.StatusCode
+		}
+		return resp, err
+	}
+}
+
+func isConnectionError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// backoff returns the time to wait before the next attempt, growing exponentially with random jitter
+func (c Config) backoff(attempt int) time.Duration {
+	d := float64(c.InitialBackoff) * math.Pow(c.Multiplier, float64(attempt-1))
+	if max := float64(c.MaxBackoff); d > max {
+		d = max
+	}
+	if c.Jitter > 0 {
+		d += d * c.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+func decode(e config.ExtraConfig, v interface{}) bool {
+	tmp, ok := e[Namespace]
+	if !ok {
+		return false
+	}
+	b, err := json.Marshal(tmp)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
+
+func parseDuration(s string, fallback time.Duration) time.Duration {
+	if s == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,266 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/encoding"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"github.com/luraproject/lura/transport/http/client"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var errTimeout net.Error = timeoutError{}
+
+func TestConfig_retryReason(t *testing.T) {
+	cfg := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{}}).(Config)
+	withInvalidStatus := ConfigGetter(config.ExtraConfig{Namespace: map[string]interface{}{
+		"retry_on_errors": []string{"invalid_status"},
+	}}).(Config)
+
+	for i, tc := range []struct {
+		cfg      Config
+		resp     *proxy.Response
+		err      error
+		status   int
+		expected string
+	}{
+		{cfg: cfg, resp: &proxy.Response{Metadata: proxy.Metadata{StatusCode: 200}}},
+		{cfg: cfg, resp: &proxy.Response{Metadata: proxy.Metadata{StatusCode: 503}}, expected: "status"},
+		{cfg: cfg, err: client.ErrInvalidStatusCode, status: 503, expected: "status"},
+		{cfg: cfg, err: client.ErrInvalidStatusCode, status: 500},
+		{cfg: cfg, err: client.ErrInvalidStatusCode},
+		{cfg: withInvalidStatus, err: client.ErrInvalidStatusCode, status: 500, expected: ErrorInvalidStatus},
+		{cfg: cfg, err: client.HTTPResponseError{Code: 502}, expected: "status"},
+		{cfg: cfg, err: client.HTTPResponseError{Code: 404}},
+		{cfg: withInvalidStatus, err: client.HTTPResponseError{Code: 404}, expected: ErrorInvalidStatus},
+		{cfg: cfg, err: errTimeout, expected: ErrorTimeout},
+		{cfg: withInvalidStatus, err: errTimeout},
+		{cfg: cfg, err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, expected: ErrorConnection},
+		{cfg: cfg, err: io.ErrUnexpectedEOF, expected: ErrorConnection},
+		{cfg: withInvalidStatus, err: io.EOF},
+		{cfg: cfg, err: io.EOF, expected: ErrorConnection},
+		{cfg: cfg, err: context.Canceled},
+		{cfg: cfg, err: context.DeadlineExceeded},
+		{cfg: cfg, err: errors.New("unknown")},
+	} {
+		if reason := tc.cfg.retryReason(tc.resp, tc.err, tc.status); reason != tc.expected {
+			t.Errorf("#%d: unexpected reason. have: %q, want: %q", i, reason, tc.expected)
+		}
+	}
+}
+
+func TestConfig_backoff(t *testing.T) {
+	cfg := Config{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         .2,
+	}
+	for attempt, base := range map[int]time.Duration{
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		3: 400 * time.Millisecond,
+		5: time.Second,
+	} {
+		for i := 0; i < 100; i++ {
+			d := cfg.backoff(attempt)
+			if min, max := base*8/10, base*12/10; d < min || d > max {
+				t.Fatalf("attempt %d: the backoff %s is not in [%s, %s]", attempt, d, min, max)
+			}
+		}
+	}
+
+	cfg.Jitter = 0
+	if d := cfg.backoff(2); d != 200*time.Millisecond {
+		t.Errorf("unexpected backoff without jitter: %s", d)
+	}
+}
+
+func TestNewMiddleware_idempotent(t *testing.T) {
+	for _, tc := range []struct {
+		method        string
+		nonIdempotent bool
+		attempts      int
+	}{
+		{method: "GET", attempts: 3},
+		{method: "put", attempts: 3},
+		{method: "POST", attempts: 1},
+		{method: "PATCH", attempts: 1},
+		{method: "POST", nonIdempotent: true, attempts: 3},
+	} {
+		e := config.ExtraConfig{Namespace: map[string]interface{}{
+			"max_attempts":         3,
+			"initial_backoff":      "1ms",
+			"retry_non_idempotent": tc.nonIdempotent,
+		}}
+		var calls int32
+		p := NewMiddleware(&config.Backend{Method: tc.method, ExtraConfig: e}, nil, nil, logging.NoOp)(
+			func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+				atomic.AddInt32(&calls, 1)
+				return nil, errTimeout
+			},
+		)
+		if _, err := p(context.Background(), &proxy.Request{}); err != errTimeout {
+			t.Errorf("%s: unexpected error: %v", tc.method, err)
+		}
+		if int(calls) != tc.attempts {
+			t.Errorf("%s: unexpected number of attempts: %d", tc.method, calls)
+		}
+	}
+}
+
+func TestNewMiddleware_closesTheDiscardedBodies(t *testing.T) {
+	remote := &config.Backend{
+		Method: "GET",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"max_attempts":    3,
+			"initial_backoff": "1ms",
+			"retry_on_status": []int{503},
+		}},
+	}
+	bodies := []*closeCounter{}
+	p := NewMiddleware(remote, nil, nil, logging.NoOp)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		b := &closeCounter{}
+		bodies = append(bodies, b)
+		return &proxy.Response{Io: b, Metadata: proxy.Metadata{StatusCode: 503}}, nil
+	})
+
+	resp, err := p(context.Background(), &proxy.Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 3 || resp.Io != bodies[2] {
+		t.Fatalf("unexpected attempts: %d", len(bodies))
+	}
+	for i, b := range bodies {
+		if expected := map[bool]int{true: 1, false: 0}[i < 2]; b.closed != expected {
+			t.Errorf("the body of the attempt #%d was closed %d times", i+1, b.closed)
+		}
+	}
+}
+
+func TestNewMiddleware_budgetExhausted(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/a",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"max_attempts":    5,
+			"initial_backoff": "1ms",
+			"retry_on_errors": []string{"timeout", "invalid_status"},
+		}},
+	}
+	b := NewBudget(BudgetConfig{Ratio: .1, MinRetries: 2})
+	o := &recorderObserver{}
+
+	var calls int32
+	errs := []error{client.ErrInvalidStatusCode, errTimeout}
+	p := NewMiddleware(remote, b, o, logging.NoOp)(func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+		n := atomic.AddInt32(&calls, 1)
+		return nil, errs[int(n)%len(errs)]
+	})
+
+	// the first request spends the two tokens of the budget, so the third attempt is discarded
+	if _, err := p(context.Background(), &proxy.Request{}); err == nil {
+		t.Error("expecting an error")
+	}
+	if calls != 3 {
+		t.Errorf("unexpected number of attempts: %d", calls)
+	}
+	if o.retries != 2 || o.exhausted != 1 || o.done != 1 || o.attempts != 3 {
+		t.Errorf("unexpected observations: %+v", o)
+	}
+	if o.reasons[0] != ErrorTimeout || o.reasons[1] != ErrorInvalidStatus {
+		t.Errorf("unexpected reasons: %v", o.reasons)
+	}
+
+	// the deposit of the second request is not enough for a retry
+	calls = 0
+	p(context.Background(), &proxy.Request{})
+	if calls != 1 || o.exhausted != 2 {
+		t.Errorf("unexpected number of attempts with the budget exhausted: %d", calls)
+	}
+}
+
+func TestHTTPRequestExecutor(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer s.Close()
+
+	remote := &config.Backend{
+		Method:      "GET",
+		URLPattern:  "/",
+		Host:        []string{s.URL},
+		Decoder:     encoding.JSONDecoder,
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{"initial_backoff": "1ms"}},
+	}
+	executor := HTTPRequestExecutor(client.DefaultHTTPRequestExecutor(client.NewHTTPClient))
+	o := &recorderObserver{}
+	p := NewMiddleware(remote, nil, o, logging.NoOp)(proxy.NewHTTPProxyWithHTTPExecutor(remote, executor, remote.Decoder))
+
+	u, _ := url.Parse(s.URL)
+	resp, err := p(context.Background(), &proxy.Request{Method: "GET", Path: "/", URL: u})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.IsComplete || resp.Data["ok"] != true {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+	if calls != 3 || o.retries != 2 || o.reasons[0] != "status" {
+		t.Errorf("unexpected observations after %d calls: %+v", calls, o)
+	}
+}
+
+type recorderObserver struct {
+	retries   int
+	exhausted int
+	done      int
+	attempts  int
+	reasons   []string
+}
+
+func (r *recorderObserver) Retry(_ context.Context, _ string, _ int, reason string) {
+	r.retries++
+	r.reasons = append(r.reasons, reason)
+}
+
+func (r *recorderObserver) Exhausted(_ context.Context, _ string) { r.exhausted++ }
+
+func (r *recorderObserver) Done(_ context.Context, _ string, attempts int) {
+	r.done++
+	r.attempts = attempts
+}
+
+type closeCounter struct {
+	closed int
+}
+
+func (*closeCounter) Read(_ []byte) (int, error) { return 0, io.EOF }
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
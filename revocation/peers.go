@@ -0,0 +1,97 @@
+package revocation
+
+import (
+	"net"
+	"net/rpc"
+	"strings"
+	"sync"
+	"time"
+
+	rpcbf "github.com/devopsfaith/bloomfilter/rpc"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/sd"
+)
+
+const (
+	peerTimeout = time.Second
+	// maxPeerRequests is the number of peers receiving the revocations at the same time
+	maxPeerRequests = 8
+)
+
+// Peers sends the revocations to the bloomfilter RPC port of the other replicas. The hosts are resolved
+// with the subscriber registered for the sd of the config (the fixed list when it is empty), so the list
+// follows the replicas found by the service discovery. The local replica can be part of the list, since
+// adding the same element twice to the bloomfilter has no effect.
+type Peers struct {
+	subscriber sd.Subscriber
+	timeout    time.Duration
+}
+
+// NewPeers returns the Peers defined by the config. A nil config means no peers.
+func NewPeers(cfg *PeersConfig) Peers {
+	if cfg == nil || (cfg.SD == "" && len(cfg.Host) == 0) {
+		return Peers{}
+	}
+	return Peers{
+		subscriber: sd.GetSubscriber(&config.Backend{Host: cfg.Host, SD: cfg.SD}),
+		timeout:    peerTimeout,
+	}
+}
+
+func (p Peers) enabled() bool {
+	return p.subscriber != nil
+}
+
+// Add sends the elements to every peer, with up to maxPeerRequests requests at the same time. The errors
+// are logged, since the registry sends them again on the next refresh.
+func (p Peers) Add(elems [][]byte, logger logging.Logger) {
+	if p.subscriber == nil {
+		return
+	}
+	hosts, err := p.subscriber.Hosts()
+	if err != nil {
+		logger.Error("revocation: unable to resolve the peers:", err.Error())
+		return
+	}
+	sem := make(chan struct{}, maxPeerRequests)
+	wg := sync.WaitGroup{}
+	for _, h := range hosts {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(h string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := p.add(peerAddress(h), elems); err != nil {
+				logger.Warning("revocation: unable to send the revocations to", h, err.Error())
+			}
+		}(h)
+	}
+	wg.Wait()
+}
+
+func (p Peers) add(address string, elems [][]byte) error {
+	conn, err := net.DialTimeout("tcp", address, p.timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(p.timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var out rpcbf.AddOutput
+	return client.Call("BloomfilterRPC.Add", rpcbf.AddInput{Elems: elems}, &out)
+}
+
+// peerAddress removes the scheme added by the service discovery to the hosts
+func peerAddress(host string) string {
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	return strings.TrimSuffix(host, "/")
+}
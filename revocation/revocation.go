@@ -0,0 +1,406 @@
+// Package revocation keeps the tokens revoked through the admin API in the bloomfilter of the token rejecter,
+// with an expiration time per entry, and shares them with the rest of the replicas.
+//
+// Sample service extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/bloomfilter": {
+//			"N": 10000000,
+//			"P": 0.0000001,
+//			"HashName": "optimal",
+//			"TTL": 1500,
+//			"port": 1234,
+//			"TokenKeys": ["jti", "sub"]
+//		},
+//		"github_com/devopsfaith/krakend-ce/revocation": {
+//			"default_ttl": "24h",
+//			"persist_path": "/var/lib/krakend/revocations.json",
+//			"persist_interval": "1m",
+//			"peers": {
+//				"sd": "dns",
+//				"host": ["krakend-bf.service.consul"]
+//			}
+//		},
+//		...
+//	},
+//	...
+//
+// The bloomfilter rotates its sets every TTL seconds, so the registry adds the revoked tokens again until
+// they expire. The expired entries are removed from the filter after, at most, two rotations.
+//
+// The registry is saved at the persist_path every persist_interval, a second after a burst of
+// revocations and when the gateway stops, and restored when it starts. The saved file includes a copy of
+// the filter, so the revocations sent directly to the bloomfilter RPC port are restored too.
+//
+// The revocations are sent in the background to the bloomfilter RPC port of the peers, resolved with the
+// service discovery registered by the gateway, every time the registry adds them again, so the new replicas
+// receive the active revocations after one refresh.
+package revocation
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/devopsfaith/bloomfilter"
+	"github.com/devopsfaith/bloomfilter/rotate"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/revocation"
+
+const (
+	defaultTTL             = 24 * time.Hour
+	defaultPersistInterval = time.Minute
+	minRefreshInterval     = time.Second
+)
+
+// persistDelay is the time waited after a revocation before saving the registry, so a burst of
+// revocations is saved once
+var persistDelay = time.Second
+
+var (
+	errBadConfig    = errors.New("revocation: unable to parse the config")
+	errEmptyValue   = errors.New("revocation: the value is required")
+	errNegativeTTL  = errors.New("revocation: the ttl must be positive")
+	errUnknownClaim = errors.New("revocation: the claim is not checked by the token rejecter")
+)
+
+// Config is the custom config struct containing the params for the revocation registry
+type Config struct {
+	DefaultTTL      string       `json:"default_ttl"`
+	PersistPath     string       `json:"persist_path"`
+	PersistInterval string       `json:"persist_interval"`
+	Peers           *PeersConfig `json:"peers"`
+}
+
+// PeersConfig defines how to find the bloomfilter RPC ports of the other replicas
+type PeersConfig struct {
+	SD   string   `json:"sd"`
+	Host []string `json:"host"`
+}
+
+// Entry is a revoked token
+type Entry struct {
+	Claim     string    `json:"claim"`
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// key returns the element checked by the bloomfilter rejecter for the entry
+func (e Entry) key() []byte {
+	return []byte(e.Claim + "-" + e.Value)
+}
+
+// Registry keeps the revoked tokens in the bloomfilter until they expire
+type Registry struct {
+	bf           bloomfilter.Bloomfilter
+	claims       map[string]bool
+	defaultTTL   time.Duration
+	path         string
+	persistDelay time.Duration
+	peers        Peers
+	logger       logging.Logger
+
+	mu      sync.Mutex
+	entries map[string]Entry
+	// pending contains the elements waiting to be sent to the peers
+	pending map[string][]byte
+
+	peersReady   chan struct{}
+	persistReady chan struct{}
+}
+
+// New returns a Registry for the bloomfilter, accepting the claims checked by the rejecter. The filter TTL
+// is the rotation period of the bloomfilter. The registry is restored from the persist path, if defined,
+// and it is refreshed until the context is cancelled.
+func New(ctx context.Context, e config.ExtraConfig, bf bloomfilter.Bloomfilter, claims []string, filterTTL time.Duration, logger logging.Logger) (*Registry, error) {
+	cfg := Config{}
+	if v, ok := e[Namespace]; ok {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, errBadConfig
+		}
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			return nil, errBadConfig
+		}
+	}
+
+	r := &Registry{
+		bf:           bf,
+		claims:       map[string]bool{},
+		defaultTTL:   defaultTTL,
+		path:         cfg.PersistPath,
+		persistDelay: persistDelay,
+		peers:        NewPeers(cfg.Peers),
+		logger:       logger,
+		entries:      map[string]Entry{},
+		pending:      map[string][]byte{},
+		peersReady:   make(chan struct{}, 1),
+		persistReady: make(chan struct{}, 1),
+	}
+	for _, c := range claims {
+		r.claims[c] = true
+	}
+	if d, err := time.ParseDuration(cfg.DefaultTTL); err == nil && d > 0 {
+		r.defaultTTL = d
+	}
+	persistInterval := defaultPersistInterval
+	if d, err := time.ParseDuration(cfg.PersistInterval); err == nil && d > 0 {
+		persistInterval = d
+	}
+
+	if err := r.restore(); err != nil {
+		logger.Error("revocation: unable to restore the registry:", err.Error())
+	}
+
+	refreshInterval := filterTTL / 2
+	if refreshInterval < minRefreshInterval {
+		refreshInterval = minRefreshInterval
+	}
+	go r.run(ctx, refreshInterval, persistInterval)
+	if r.peers.enabled() {
+		go r.dispatch(ctx)
+	}
+	return r, nil
+}
+
+// Revoke adds the value of the claim to the bloomfilter until the ttl expires. A zero ttl means the
+// default one.
+func (r *Registry) Revoke(claim, value string, ttl time.Duration) (Entry, error) {
+	if value == "" {
+		return Entry{}, errEmptyValue
+	}
+	if !r.claims[claim] {
+		return Entry{}, errUnknownClaim
+	}
+	if ttl < 0 {
+		return Entry{}, errNegativeTTL
+	}
+	if ttl == 0 {
+		ttl = r.defaultTTL
+	}
+
+	entry := Entry{Claim: claim, Value: value, ExpiresAt: time.Now().Add(ttl).UTC()}
+	r.mu.Lock()
+	if prev, ok := r.entries[string(entry.key())]; ok && prev.ExpiresAt.After(entry.ExpiresAt) {
+		entry.ExpiresAt = prev.ExpiresAt
+	}
+	r.entries[string(entry.key())] = entry
+	r.mu.Unlock()
+
+	r.bf.Add(entry.key())
+	r.sendToPeers([][]byte{entry.key()})
+	notify(r.persistReady)
+	return entry, nil
+}
+
+// Entries returns the active revocations, sorted by expiration time
+func (r *Registry) Entries() []Entry {
+	now := time.Now()
+	r.mu.Lock()
+	res := make([]Entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		if e.ExpiresAt.After(now) {
+			res = append(res, e)
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].ExpiresAt.Before(res[j].ExpiresAt) })
+	return res
+}
+
+// Claims returns the claims accepted by the registry
+func (r *Registry) Claims() []string {
+	res := make([]string, 0, len(r.claims))
+	for c := range r.claims {
+		res = append(res, c)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (r *Registry) run(ctx context.Context, refreshInterval, persistInterval time.Duration) {
+	refresh := time.NewTicker(refreshInterval)
+	defer refresh.Stop()
+	persist := time.NewTicker(persistInterval)
+	defer persist.Stop()
+	var delayed <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			if err := r.persist(); err != nil {
+				r.logger.Error("revocation: unable to persist the registry:", err.Error())
+			}
+			return
+		case <-refresh.C:
+			r.refresh()
+		case <-r.persistReady:
+			if delayed == nil {
+				delayed = time.After(r.persistDelay)
+			}
+		case <-delayed:
+			delayed = nil
+			if err := r.persist(); err != nil {
+				r.logger.Error("revocation: unable to persist the registry:", err.Error())
+			}
+		case <-persist.C:
+			if err := r.persist(); err != nil {
+				r.logger.Error("revocation: unable to persist the registry:", err.Error())
+			}
+		}
+	}
+}
+
+// sendToPeers queues the elements for the peers, so the callers do not wait for them
+func (r *Registry) sendToPeers(keys [][]byte) {
+	if !r.peers.enabled() || len(keys) == 0 {
+		return
+	}
+	r.mu.Lock()
+	for _, k := range keys {
+		r.pending[string(k)] = k
+	}
+	r.mu.Unlock()
+	notify(r.peersReady)
+}
+
+// dispatch sends the queued elements to the peers until the context is cancelled. The elements queued
+// while a batch is being sent are grouped in the next one.
+func (r *Registry) dispatch(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.peersReady:
+		}
+		r.mu.Lock()
+		keys := make([][]byte, 0, len(r.pending))
+		for _, k := range r.pending {
+			keys = append(keys, k)
+		}
+		r.pending = map[string][]byte{}
+		r.mu.Unlock()
+		r.peers.Add(keys, r.logger)
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// refresh drops the expired entries and adds the active ones again, to the local bloomfilter and to the
+// peers, so they survive the next rotation
+func (r *Registry) refresh() {
+	now := time.Now()
+	keys := [][]byte{}
+	r.mu.Lock()
+	for k, e := range r.entries {
+		if !e.ExpiresAt.After(now) {
+			delete(r.entries, k)
+			continue
+		}
+		keys = append(keys, e.key())
+	}
+	r.mu.Unlock()
+
+	for _, k := range keys {
+		r.bf.Add(k)
+	}
+	r.sendToPeers(keys)
+}
+
+// snapshot is the content of the persisted file
+type snapshot struct {
+	Entries []Entry `json:"entries"`
+	Filter  []byte  `json:"filter,omitempty"`
+}
+
+func (r *Registry) persist() error {
+	if r.path == "" {
+		return nil
+	}
+	s := snapshot{Entries: r.Entries()}
+	if m, ok := r.bf.(encoding.BinaryMarshaler); ok {
+		b, err := m.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		s.Filter = b
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), filepath.Base(r.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+func (r *Registry) restore() error {
+	if r.path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s := snapshot{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	for _, e := range s.Entries {
+		if e.ExpiresAt.After(now) {
+			r.entries[string(e.key())] = e
+			r.bf.Add(e.key())
+		}
+	}
+	r.mu.Unlock()
+
+	if len(s.Filter) == 0 {
+		return nil
+	}
+	// the snapshot of the filter keeps the revocations received by the RPC port
+	saved := new(rotate.Bloomfilter)
+	if err := saved.UnmarshalBinary(s.Filter); err != nil {
+		return err
+	}
+	saved.Close()
+	if _, err := r.bf.Union(saved); err != nil {
+		return fmt.Errorf("the saved filter can not be merged: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package revocation
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devopsfaith/bloomfilter"
+	"github.com/devopsfaith/bloomfilter/rotate"
+	rpcbf "github.com/devopsfaith/bloomfilter/rpc"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+func TestRegistry_Revoke(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bf := newFilter(ctx)
+
+	r, err := New(ctx, config.ExtraConfig{Namespace: map[string]interface{}{"default_ttl": "1h"}}, bf, []string{"jti", "sub"}, time.Minute, logging.NoOp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		claim, value string
+		ttl          time.Duration
+		err          error
+	}{
+		{"iss", "issuer", 0, errUnknownClaim},
+		{"jti", "", 0, errEmptyValue},
+		{"jti", "token", -time.Second, errNegativeTTL},
+	} {
+		if _, err := r.Revoke(tc.claim, tc.value, tc.ttl); err != tc.err {
+			t.Errorf("unexpected error revoking %s=%s: %v", tc.claim, tc.value, err)
+		}
+	}
+
+	before := time.Now()
+	e, err := r.Revoke("sub", "alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.ExpiresAt.Before(before.Add(time.Hour)) || e.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("the default ttl should be used: %v", e.ExpiresAt)
+	}
+	if !bf.Check([]byte("sub-alice")) {
+		t.Error("the revoked token should be in the filter")
+	}
+	// a shorter ttl does not reduce the previous one
+	if e, _ := r.Revoke("sub", "alice", time.Second); e.ExpiresAt.Before(before.Add(time.Hour)) {
+		t.Errorf("the expiration should be kept: %v", e.ExpiresAt)
+	}
+	if entries := r.Entries(); len(entries) != 1 {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+}
+
+func TestRegistry_refresh(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bf := new(recorder)
+
+	r, _ := New(ctx, config.ExtraConfig{}, bf, []string{"jti"}, time.Hour, logging.NoOp)
+	r.Revoke("jti", "short", 20*time.Millisecond)
+	r.Revoke("jti", "long", time.Hour)
+	bf.reset()
+
+	time.Sleep(30 * time.Millisecond)
+	r.refresh()
+	if added := bf.added(); len(added) != 1 || added[0] != "jti-long" {
+		t.Errorf("only the active entries should be added again: %v", added)
+	}
+	if entries := r.Entries(); len(entries) != 1 || entries[0].Value != "long" {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+}
+
+func TestRegistry_persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := config.ExtraConfig{Namespace: map[string]interface{}{"persist_path": filepath.Join(dir, "revocations.json")}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bf := newFilter(ctx)
+	r, _ := New(ctx, cfg, bf, []string{"jti"}, time.Minute, logging.NoOp)
+	r.Revoke("jti", "revoked", time.Hour)
+	// added through the RPC port
+	bf.Add([]byte("jti-external"))
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	bf = newFilter(ctx)
+	r, _ = New(ctx, cfg, bf, []string{"jti"}, time.Minute, logging.NoOp)
+	if entries := r.Entries(); len(entries) != 1 || entries[0].Value != "revoked" {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+	for _, k := range []string{"jti-revoked", "jti-external"} {
+		if !bf.Check([]byte(k)) {
+			t.Errorf("%s should be restored", k)
+		}
+	}
+}
+
+func TestPeers(t *testing.T) {
+	peer := newFakePeer(t)
+	defer peer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := config.ExtraConfig{Namespace: map[string]interface{}{
+		"peers": map[string]interface{}{"host": []string{"tcp://" + peer.Addr().String()}},
+	}}
+	r, _ := New(ctx, cfg, new(recorder), []string{"jti"}, time.Hour, logging.NoOp)
+
+	r.Revoke("jti", "a", time.Hour)
+	waitForPeer(t, peer, 1)
+	r.refresh()
+	waitForPeer(t, peer, 2)
+	if added := peer.added(); added[0] != "jti-a" || added[1] != "jti-a" {
+		t.Errorf("the revocations should be sent to the peers: %v", added)
+	}
+}
+
+func TestPeers_slow(t *testing.T) {
+	// the peer accepts the connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	peer := newFakePeer(t)
+	defer peer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hosts := []string{peer.Addr().String()}
+	for i := 0; i < 2*maxPeerRequests; i++ {
+		hosts = append(hosts, l.Addr().String())
+	}
+	cfg := config.ExtraConfig{Namespace: map[string]interface{}{"peers": map[string]interface{}{"host": hosts}}}
+	r, _ := New(ctx, cfg, new(recorder), []string{"jti"}, time.Hour, logging.NoOp)
+
+	start := time.Now()
+	for _, v := range []string{"a", "b", "c"} {
+		r.Revoke("jti", v, time.Hour)
+	}
+	if d := time.Since(start); d > peerTimeout/2 {
+		t.Errorf("the revocations waited for the peers: %s", d)
+	}
+	waitForPeer(t, peer, 1)
+}
+
+func TestRegistry_persistDelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "revocations.json")
+
+	defer func(d time.Duration) { persistDelay = d }(persistDelay)
+	persistDelay = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, _ := New(ctx, config.ExtraConfig{Namespace: map[string]interface{}{"persist_path": path}}, new(recorder), []string{"jti"}, time.Hour, logging.NoOp)
+	for _, v := range []string{"a", "b", "c"} {
+		r.Revoke("jti", v, time.Hour)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the registry should not be saved by every revocation: %v", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := snapshot{}
+	if err := json.Unmarshal(b, &s); err != nil || len(s.Entries) != 3 {
+		t.Errorf("unexpected snapshot: %s", b)
+	}
+}
+
+func waitForPeer(t *testing.T, peer *fakePeer, n int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(peer.added()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("the peer received %d elements", len(peer.added()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPeers_unreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := NewPeers(&PeersConfig{Host: []string{addr}})
+	p.timeout = 50 * time.Millisecond
+	p.Add([][]byte{[]byte("jti-a")}, logging.NoOp)
+}
+
+func newFilter(ctx context.Context) *rotate.Bloomfilter {
+	return rotate.New(ctx, rotate.Config{
+		Config: bloomfilter.Config{N: 1000, P: 0.0001, HashName: "optimal"},
+		TTL:    60,
+	})
+}
+
+// recorder is a bloomfilter recording the added elements
+type recorder struct {
+	mu    sync.Mutex
+	elems []string
+}
+
+func (r *recorder) Add(elem []byte) {
+	r.mu.Lock()
+	r.elems = append(r.elems, string(elem))
+	r.mu.Unlock()
+}
+
+func (r *recorder) Check(elem []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.elems {
+		if e == string(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *recorder) Union(interface{}) (float64, error) { return 0, nil }
+
+func (r *recorder) added() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.elems...)
+}
+
+func (r *recorder) reset() {
+	r.mu.Lock()
+	r.elems = nil
+	r.mu.Unlock()
+}
+
+// fakePeer serves the Add method of the bloomfilter RPC port
+type fakePeer struct {
+	net.Listener
+	*recorder
+}
+
+type fakeBloomfilterRPC struct {
+	r *recorder
+}
+
+func (f *fakeBloomfilterRPC) Add(in rpcbf.AddInput, out *rpcbf.AddOutput) error {
+	for _, e := range in.Elems {
+		f.r.Add(e)
+	}
+	out.Count = len(in.Elems)
+	return nil
+}
+
+func newFakePeer(t *testing.T) *fakePeer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePeer{Listener: l, recorder: new(recorder)}
+	s := rpc.NewServer()
+	if err := s.RegisterName("BloomfilterRPC", &fakeBloomfilterRPC{r: p.recorder}); err != nil {
+		t.Fatal(err)
+	}
+	go s.Accept(l)
+	return p
+}
@@ -2,26 +2,24 @@ package krakend
 
 import (
 	"io"
-	"time"
 
 	botdetector "github.com/devopsfaith/krakend-botdetector/gin"
+	"github.com/devopsfaith/krakend-ce/requestid"
 	httpsecure "github.com/devopsfaith/krakend-httpsecure/gin"
 	lua "github.com/devopsfaith/krakend-lua/router/gin"
 	"github.com/gin-gonic/gin"
 	"github.com/luraproject/lura/config"
 	"github.com/luraproject/lura/logging"
-	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
-// NewEngine creates a new gin engine with some default values and a secure middleware
+// NewEngine creates a new gin engine with some default values, a request ID and a secure middleware
 func NewEngine(cfg config.ServiceConfig, logger logging.Logger, w io.Writer) *gin.Engine {
 	if !cfg.Debug {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
 	engine := gin.New()
-	engine.Use(zapLogger(), gin.Recovery())
+	engine.Use(requestid.New(cfg.ExtraConfig, logger), zapLogger(cfg, logger), gin.Recovery())
 
 	engine.RedirectTrailingSlash = true
 	engine.RedirectFixedPath = true
@@ -43,55 +41,3 @@ type engineFactory struct{}
 func (e engineFactory) NewEngine(cfg config.ServiceConfig, l logging.Logger, w io.Writer) *gin.Engine {
 	return NewEngine(cfg, l, w)
 }
-
-// zapLogger returns a zap logger middleware.
-func zapLogger() gin.HandlerFunc {
-	logCfg := zap.NewProductionConfig()
-	logCfg.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
-	logCfg.EncoderConfig.EncodeDuration = zapcore.MillisDurationEncoder
-	logger, _ := logCfg.Build()
-
-	// TODO: populate with skipped paths via config
-	var skip map[string]struct{}
-
-	return func(c *gin.Context) {
-		// Start timer
-		// TODO: add utc support
-		start := time.Now()
-		path := c.Request.URL.Path
-
-		// Process request
-		c.Next()
-
-		// Log only when path is not being skipped
-		if _, ok := skip[path]; !ok {
-			// TODO: add utc support
-			end := time.Now()
-			status := c.Writer.Status()
-			latency := end.Sub(start)
-
-			fields := []zapcore.Field{
-				zap.Duration("duration", latency),
-				zap.String("host", c.Request.URL.Host),
-				zap.String("ip", c.ClientIP()),
-				zap.String("method", c.Request.Method),
-				zap.String("path", path),
-				zap.String("request_id", c.Request.Header.Get("X-Request-Id")),
-				zap.Int("status", status),
-				zap.String("trace_id", c.Request.Header.Get("traceparent")),
-				zap.String("user_agent", c.Request.UserAgent()),
-			}
-			if len(c.Errors) > 0 {
-				fields = append(fields, zap.Strings("errors", c.Errors.Errors()))
-			}
-
-			if status >= 200 && status < 400 {
-				logger.Info("request", fields...)
-			} else if status >= 400 && status < 500 {
-				logger.Warn("bad request", fields...)
-			} else {
-				logger.Error("request error", fields...)
-			}
-		}
-	}
-}
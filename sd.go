@@ -3,6 +3,7 @@ package krakend
 import (
 	"context"
 	"fmt"
+	"sync"
 
 	consul "github.com/devopsfaith/krakend-consul"
 	"github.com/luraproject/lura/config"
@@ -12,18 +13,39 @@ import (
 
 // RegisterSubscriberFactories registers all the available sd adaptors
 func RegisterSubscriberFactories(ctx context.Context, cfg config.ServiceConfig, logger logging.Logger) func(n string, p int) {
+	return registerSubscriberFactoriesWithCallback(ctx, cfg, logger, func(error) {})
+}
+
+func registerSubscriberFactoriesWithCallback(ctx context.Context, cfg config.ServiceConfig, logger logging.Logger, cb func(error)) func(n string, p int) {
 	// register the dns service discovery
 	dnssrv.Register()
 
 	return func(name string, port int) {
 		if err := consul.Register(ctx, cfg.ExtraConfig, port, name, logger); err != nil {
 			logger.Error(fmt.Sprintf("Couldn't register %s:%d in consul: %s", name, port, err.Error()))
+			if err == consul.ErrNoConfig {
+				return
+			}
+			cb(fmt.Errorf("registering %s:%d in consul: %s", name, port, err.Error()))
 		}
 	}
 }
 
-type registerSubscriberFactories struct{}
+type registerSubscriberFactories struct {
+	mu  sync.RWMutex
+	err error
+}
+
+func (d *registerSubscriberFactories) Register(ctx context.Context, cfg config.ServiceConfig, logger logging.Logger) func(n string, p int) {
+	return registerSubscriberFactoriesWithCallback(ctx, cfg, logger, func(err error) {
+		d.mu.Lock()
+		d.err = err
+		d.mu.Unlock()
+	})
+}
 
-func (d registerSubscriberFactories) Register(ctx context.Context, cfg config.ServiceConfig, logger logging.Logger) func(n string, p int) {
-	return RegisterSubscriberFactories(ctx, cfg, logger)
+func (d *registerSubscriberFactories) Health() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.err
 }
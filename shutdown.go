@@ -0,0 +1,154 @@
+package krakend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/transport/http/server"
+)
+
+// ShutdownNamespace is the key to use to store and access the graceful shutdown config
+const ShutdownNamespace = "github_com/devopsfaith/krakend-ce/shutdown"
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	defaultFlushTimeout = time.Second
+)
+
+var errDrainTimeout = errors.New("shutdown: drain timeout reached with requests in flight")
+
+type shutdownConfig struct {
+	PreStopDelay string `json:"pre_stop_delay"`
+	DrainTimeout string `json:"drain_timeout"`
+	FlushTimeout string `json:"flush_timeout"`
+}
+
+type shutdownSettings struct {
+	preStopDelay time.Duration
+	drainTimeout time.Duration
+	flushTimeout time.Duration
+}
+
+func newShutdownSettings(cfg config.ServiceConfig, l logging.Logger) shutdownSettings {
+	sCfg := shutdownConfig{}
+	if _, err := parseExtraConfig(cfg.ExtraConfig, ShutdownNamespace, &sCfg); err != nil {
+		l.Warning("shutdown: unable to parse the config:", err.Error())
+	}
+	return shutdownSettings{
+		preStopDelay: parseDuration(sCfg.PreStopDelay, 0),
+		drainTimeout: parseDuration(sCfg.DrainTimeout, defaultDrainTimeout),
+		flushTimeout: parseDuration(sCfg.FlushTimeout, defaultFlushTimeout),
+	}
+}
+
+// NewGracefulRunServer returns a RunServer wrapping the injected one. Once the received context is cancelled,
+// it flags the gateway as draining, waits for the pre-stop delay and then stops the wrapped RunServer, so it
+// closes the listener and waits for the in-flight requests to complete until the drain timeout is reached.
+// Then it returns without waiting for the wrapped RunServer: the default one closes the connections still
+// open at the same deadline, but the ones injected by the users are responsible for it.
+func NewGracefulRunServer(l logging.Logger, h *HealthRegistry, next RunServer) RunServer {
+	return func(ctx context.Context, cfg config.ServiceConfig, handler http.Handler) error {
+		s := newShutdownSettings(cfg, l)
+
+		serverCtx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		done := make(chan error, 1)
+		go func() { done <- next(serverCtx, cfg, handler) }()
+
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+		}
+
+		l.Info("shutdown: flagging the gateway as not ready")
+		h.Drain()
+
+		if s.preStopDelay > 0 {
+			l.Info(fmt.Sprintf("shutdown: waiting %s before closing the listener", s.preStopDelay))
+			select {
+			case err := <-done:
+				return err
+			case <-time.After(s.preStopDelay):
+			}
+		}
+
+		l.Info("shutdown: draining the connections")
+		cancel()
+
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(s.drainTimeout):
+			return errDrainTimeout
+		}
+	}
+}
+
+// runHTTPServer runs the lura http server like the lura RunServer but, once the context is cancelled, it
+// waits for the in-flight requests until the drain timeout is reached and then closes the connections still
+// open, returning errDrainTimeout
+func runHTTPServer(ctx context.Context, cfg config.ServiceConfig, handler http.Handler) error {
+	s := server.NewServer(cfg, handler)
+
+	done := make(chan error, 1)
+	if s.TLSConfig == nil {
+		go func() { done <- s.ListenAndServe() }()
+	} else {
+		if cfg.TLS.PublicKey == "" {
+			return server.ErrPublicKey
+		}
+		if cfg.TLS.PrivateKey == "" {
+			return server.ErrPrivateKey
+		}
+		go func() { done <- s.ListenAndServeTLS(cfg.TLS.PublicKey, cfg.TLS.PrivateKey) }()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	sCtx, cancel := context.WithTimeout(context.Background(), newShutdownSettings(cfg, logging.NoOp).drainTimeout)
+	defer cancel()
+	if err := s.Shutdown(sCtx); err != context.DeadlineExceeded {
+		return err
+	}
+	s.Close()
+	return errDrainTimeout
+}
+
+// flushObservability cancels the context of the observability components, so the exporters push their
+// buffered data, and closes the access log and the GELF writer once the components report that they are
+// flushed or, at most, when the flush timeout is reached. Without a register reporting it, the whole
+// flush timeout is waited.
+func flushObservability(l logging.Logger, s shutdownSettings, cancel context.CancelFunc, r MetricsAndTracesRegister, gelfWriter io.Writer) {
+	l.Info("shutdown: flushing the exporters")
+	var flushed <-chan struct{}
+	if f, ok := r.(ObservabilityFlusher); ok {
+		flushed = f.Flushed()
+	}
+	cancel()
+	if s.flushTimeout > 0 {
+		select {
+		case <-flushed:
+		case <-time.After(s.flushTimeout):
+		}
+	}
+
+	accessLoggers.close()
+
+	if c, ok := gelfWriter.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			l.Warning("shutdown: closing the GELF writer:", err.Error())
+		}
+	}
+}
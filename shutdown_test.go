@@ -0,0 +1,121 @@
+package krakend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+)
+
+func TestFlushObservability(t *testing.T) {
+	s := shutdownSettings{flushTimeout: time.Second}
+	for _, tc := range []struct {
+		name     string
+		register MetricsAndTracesRegister
+		min, max time.Duration
+	}{
+		{name: "flushed", register: &MetricsAndTraces{}, max: s.flushTimeout / 2},
+		{name: "slow exporter", register: &MetricsAndTraces{flushed: []<-chan struct{}{closedAfter(200 * time.Millisecond)}}, min: 200 * time.Millisecond, max: s.flushTimeout / 2},
+		{name: "stuck exporter", register: &MetricsAndTraces{flushed: []<-chan struct{}{make(chan struct{})}}, min: s.flushTimeout, max: 2 * s.flushTimeout},
+		{name: "custom register", register: customRegister{}, min: s.flushTimeout, max: 2 * s.flushTimeout},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		start := time.Now()
+		flushObservability(logging.NoOp, s, cancel, tc.register, nil)
+		elapsed := time.Since(start)
+		if ctx.Err() == nil {
+			t.Errorf("%s: the context was not cancelled", tc.name)
+		}
+		if elapsed < tc.min || elapsed > tc.max {
+			t.Errorf("%s: unexpected flush time %s", tc.name, elapsed)
+		}
+	}
+}
+
+func TestRunHTTPServer_drainTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	cfg := config.ServiceConfig{
+		Port:        port,
+		ExtraConfig: config.ExtraConfig{ShutdownNamespace: map[string]interface{}{"drain_timeout": "100ms"}},
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		close(started)
+		<-release
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runHTTPServer(ctx, cfg, handler) }()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 100 {
+			t.Fatal("the server is not listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reqErr := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err == nil {
+			resp.Body.Close()
+		}
+		reqErr <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("the request was not received")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != errDrainTimeout {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the server did not stop at the drain timeout")
+	}
+	select {
+	case err := <-reqErr:
+		if err == nil {
+			t.Error("the connection of the request in flight was not closed")
+		}
+	case <-time.After(time.Second):
+		t.Error("the connection of the request in flight is still open")
+	}
+}
+
+func closedAfter(d time.Duration) <-chan struct{} {
+	c := make(chan struct{})
+	time.AfterFunc(d, func() { close(c) })
+	return c
+}
+
+type customRegister struct{}
+
+func (customRegister) Register(_ context.Context, _ config.ServiceConfig, _ logging.Logger) *metrics.Metrics {
+	return nil
+}
@@ -0,0 +1,483 @@
+// Package slo tracks the service level objectives declared by the endpoints, keeping the service level
+// indicators over rolling windows, the burn rates of the error budget and the remaining budget.
+//
+// Sample endpoint extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/slo": {
+//			"availability": {"objective": 0.999},
+//			"latency": {"objective": 0.99, "threshold": "300ms"},
+//			"window": "720h",
+//			"burn_rate_windows": ["5m", "1h", "6h"]
+//		},
+//		...
+//	},
+//	...
+//
+// The availability indicator is the ratio of responses without a 5xx status and the latency one the ratio
+// of responses served within the threshold. At least one of them is required and the objectives must be
+// between 0 and 1. The window of the error budget defaults to 30 days and the burn rates are computed over
+// the 5m, 30m, 1h and 6h windows by default. Every window is split into 60 buckets, so the oldest bucket
+// is discarded at once when it leaves the window.
+//
+// The burn rate is the ratio of bad requests over the window divided by the allowed one (1 - objective),
+// so a burn rate of 1 spends the whole budget at the end of the budget window. The remaining error budget
+// is the fraction of the allowed bad requests not spent yet over the budget window, negative once it is
+// exhausted.
+//
+// The state of every endpoint is kept by the Registry, shared by the router stacks, so the budgets are
+// not reset by the hot reload unless the objectives of the endpoint change. The registry exposes the
+// indicators as gauges of the metrics collector:
+//
+//	router.slo.<endpoint>.<sli>.<window>.good
+//	router.slo.<endpoint>.<sli>.<window>.total
+//	router.slo.<endpoint>.<sli>.<window>.burn_rate
+//	router.slo.<endpoint>.<sli>.error_budget_remaining
+package slo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/slo"
+
+const (
+	availabilitySLI = "availability"
+	latencySLI      = "latency"
+
+	defaultWindow = 30 * 24 * time.Hour
+	// buckets is the number of slots of every rolling window
+	buckets = 60
+)
+
+var defaultBurnRateWindows = []string{"5m", "30m", "1h", "6h"}
+
+var timeNow = time.Now
+
+var (
+	errNoConfig      = errors.New("slo: no config")
+	errBadConfig     = errors.New("slo: unable to parse the config")
+	errNoObjectives  = errors.New("slo: at least one objective is required")
+	errBadObjective  = errors.New("slo: the objectives must be between 0 and 1")
+	errBadThreshold  = errors.New("slo: the latency objective requires a positive threshold")
+	errWindowTooLong = errors.New("slo: the burn rate windows can not be longer than the budget window")
+)
+
+// Config is the custom config struct containing the objectives of an endpoint
+type Config struct {
+	Availability    *Objective `json:"availability"`
+	Latency         *Objective `json:"latency"`
+	Window          string     `json:"window"`
+	BurnRateWindows []string   `json:"burn_rate_windows"`
+}
+
+// Objective is the target ratio of good requests. The threshold applies only to the latency objective.
+type Objective struct {
+	Objective float64 `json:"objective"`
+	Threshold string  `json:"threshold"`
+}
+
+// spec is the parsed config of an endpoint, comparable so the registry can detect the changes
+type spec struct {
+	availability float64
+	latency      float64
+	threshold    time.Duration
+	window       time.Duration
+	burnWindows  string
+}
+
+func getConfig(remote *config.EndpointConfig) (spec, []time.Duration, error) {
+	v, ok := remote.ExtraConfig[Namespace]
+	if !ok {
+		return spec{}, nil, errNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return spec{}, nil, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return spec{}, nil, errBadConfig
+	}
+	if cfg.Availability == nil && cfg.Latency == nil {
+		return spec{}, nil, errNoObjectives
+	}
+
+	s := spec{window: defaultWindow}
+	if cfg.Availability != nil {
+		if !validObjective(cfg.Availability.Objective) {
+			return spec{}, nil, errBadObjective
+		}
+		s.availability = cfg.Availability.Objective
+	}
+	if cfg.Latency != nil {
+		if !validObjective(cfg.Latency.Objective) {
+			return spec{}, nil, errBadObjective
+		}
+		threshold, err := time.ParseDuration(cfg.Latency.Threshold)
+		if err != nil || threshold <= 0 {
+			return spec{}, nil, errBadThreshold
+		}
+		s.latency = cfg.Latency.Objective
+		s.threshold = threshold
+	}
+	if cfg.Window != "" {
+		d, err := time.ParseDuration(cfg.Window)
+		if err != nil || d <= 0 {
+			return spec{}, nil, fmt.Errorf("slo: invalid window %q", cfg.Window)
+		}
+		s.window = d
+	}
+
+	names := cfg.BurnRateWindows
+	if names == nil {
+		names = defaultBurnRateWindows
+	}
+	burnWindows := make([]time.Duration, 0, len(names))
+	for _, name := range names {
+		d, err := time.ParseDuration(name)
+		if err != nil || d <= 0 {
+			return spec{}, nil, fmt.Errorf("slo: invalid burn rate window %q", name)
+		}
+		if d > s.window {
+			return spec{}, nil, errWindowTooLong
+		}
+		burnWindows = append(burnWindows, d)
+	}
+	sort.Slice(burnWindows, func(i, j int) bool { return burnWindows[i] < burnWindows[j] })
+	s.burnWindows = fmt.Sprint(burnWindows)
+	return s, burnWindows, nil
+}
+
+func validObjective(o float64) bool {
+	return o > 0 && o < 1
+}
+
+// HandlerFactory tracks the objectives of the endpoints with the slo config in the registry. The
+// endpoints with a bad config are not tracked, but their requests are served. If the registry is nil, the
+// objectives are kept by a registry of the factory, without gauges.
+func HandlerFactory(next router.HandlerFactory, r *Registry, logger logging.Logger) router.HandlerFactory {
+	if r == nil {
+		r = NewRegistry(nil)
+	}
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		handler := next(remote, p)
+
+		s, burnWindows, err := getConfig(remote)
+		if err != nil {
+			if err != errNoConfig {
+				logger.Error(err.Error(), remote.Endpoint)
+			}
+			return handler
+		}
+		e := r.track(remote.Method+" "+remote.Endpoint, s, burnWindows)
+		logger.Debug("slo: tracking the objectives of", remote.Method, remote.Endpoint)
+
+		return func(c *gin.Context) {
+			start := timeNow()
+			handler(c)
+			now := timeNow()
+			e.observe(now, c.Writer.Status(), now.Sub(start))
+		}
+	}
+}
+
+// Registry keeps the state of the tracked endpoints
+type Registry struct {
+	m         *metrics.Metrics
+	mu        sync.Mutex
+	endpoints map[string]*endpoint
+}
+
+// NewRegistry returns an empty registry, publishing the gauges in the metrics collector, if any
+func NewRegistry(m *metrics.Metrics) *Registry {
+	return &Registry{m: m, endpoints: map[string]*endpoint{}}
+}
+
+// track returns the state of the endpoint, replacing it if the objectives changed
+func (r *Registry) track(name string, s spec, burnWindows []time.Duration) *endpoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.endpoints[name]; ok {
+		if e.spec == s {
+			return e
+		}
+		r.unregister(e)
+	}
+	e := newEndpoint(name, s, burnWindows)
+	r.endpoints[name] = e
+	r.register(e)
+	return e
+}
+
+func (r *Registry) registry() gometrics.Registry {
+	if r.m == nil || r.m.Metrics == nil || r.m.Registry == nil {
+		return nil
+	}
+	return *r.m.Registry
+}
+
+func (r *Registry) register(e *endpoint) {
+	registry := r.registry()
+	if registry == nil {
+		return
+	}
+	for name, g := range e.gauges() {
+		registry.Unregister(name)
+		registry.Register(name, g)
+	}
+}
+
+func (r *Registry) unregister(e *endpoint) {
+	registry := r.registry()
+	if registry == nil {
+		return
+	}
+	for name := range e.gauges() {
+		registry.Unregister(name)
+	}
+}
+
+// Report is the state of an objective of an endpoint
+type Report struct {
+	Endpoint  string  `json:"endpoint"`
+	SLI       string  `json:"sli"`
+	Objective float64 `json:"objective"`
+	Threshold string  `json:"threshold,omitempty"`
+	Window    string  `json:"window"`
+	Good      uint64  `json:"good"`
+	Total     uint64  `json:"total"`
+	// Ratio is the ratio of good requests over the budget window, 1 without requests
+	Ratio                float64            `json:"ratio"`
+	ErrorBudgetRemaining float64            `json:"error_budget_remaining"`
+	BurnRates            map[string]float64 `json:"burn_rates"`
+}
+
+// Reports returns the state of the objectives of all the tracked endpoints
+func (r *Registry) Reports() []Report {
+	res := []Report{}
+	if r == nil {
+		return res
+	}
+	now := timeNow()
+	r.mu.Lock()
+	for _, e := range r.endpoints {
+		for _, i := range e.indicators {
+			good, total := i.budget.sum(now)
+			report := Report{
+				Endpoint:             e.name,
+				SLI:                  i.name,
+				Objective:            i.objective,
+				Window:               windowName(i.budget.size),
+				Good:                 good,
+				Total:                total,
+				Ratio:                ratio(good, total),
+				ErrorBudgetRemaining: i.remaining(now),
+				BurnRates:            map[string]float64{},
+			}
+			if i.name == latencySLI {
+				report.Threshold = e.spec.threshold.String()
+			}
+			for _, w := range i.burn {
+				report.BurnRates[windowName(w.size)] = i.burnRate(w, now)
+			}
+			res = append(res, report)
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Endpoint != res[j].Endpoint {
+			return res[i].Endpoint < res[j].Endpoint
+		}
+		return res[i].SLI < res[j].SLI
+	})
+	return res
+}
+
+// endpoint keeps the indicators of the objectives declared by an endpoint
+type endpoint struct {
+	name       string
+	spec       spec
+	indicators []*indicator
+}
+
+func newEndpoint(name string, s spec, burnWindows []time.Duration) *endpoint {
+	e := &endpoint{name: name, spec: s}
+	if s.availability > 0 {
+		e.indicators = append(e.indicators, newIndicator(availabilitySLI, s.availability, s.window, burnWindows))
+	}
+	if s.latency > 0 {
+		e.indicators = append(e.indicators, newIndicator(latencySLI, s.latency, s.window, burnWindows))
+	}
+	return e
+}
+
+func (e *endpoint) observe(now time.Time, status int, d time.Duration) {
+	for _, i := range e.indicators {
+		switch i.name {
+		case availabilitySLI:
+			i.add(now, status < 500)
+		case latencySLI:
+			i.add(now, d <= e.spec.threshold)
+		}
+	}
+}
+
+// gauges returns the gauges of the indicators, by name
+func (e *endpoint) gauges() map[string]interface{} {
+	res := map[string]interface{}{}
+	for _, i := range e.indicators {
+		i := i
+		prefix := "router.slo." + e.name + "." + i.name + "."
+		for _, w := range append([]*rollingCounter{i.budget}, i.burn...) {
+			w := w
+			name := prefix + windowName(w.size) + "."
+			res[name+"good"] = gometrics.NewFunctionalGauge(func() int64 {
+				good, _ := w.sum(timeNow())
+				return int64(good)
+			})
+			res[name+"total"] = gometrics.NewFunctionalGauge(func() int64 {
+				_, total := w.sum(timeNow())
+				return int64(total)
+			})
+			res[name+"burn_rate"] = gometrics.NewFunctionalGaugeFloat64(func() float64 {
+				return i.burnRate(w, timeNow())
+			})
+		}
+		res[prefix+"error_budget_remaining"] = gometrics.NewFunctionalGaugeFloat64(func() float64 {
+			return i.remaining(timeNow())
+		})
+	}
+	return res
+}
+
+// indicator counts the good and the total requests of an objective over the budget window and the burn
+// rate windows
+type indicator struct {
+	name      string
+	objective float64
+	budget    *rollingCounter
+	burn      []*rollingCounter
+}
+
+func newIndicator(name string, objective float64, window time.Duration, burnWindows []time.Duration) *indicator {
+	i := &indicator{name: name, objective: objective, budget: newRollingCounter(window)}
+	for _, w := range burnWindows {
+		i.burn = append(i.burn, newRollingCounter(w))
+	}
+	return i
+}
+
+func (i *indicator) add(now time.Time, good bool) {
+	i.budget.add(now, good)
+	for _, w := range i.burn {
+		w.add(now, good)
+	}
+}
+
+// burnRate returns the ratio of bad requests over the window divided by the allowed one
+func (i *indicator) burnRate(w *rollingCounter, now time.Time) float64 {
+	good, total := w.sum(now)
+	if total == 0 {
+		return 0
+	}
+	return (1 - ratio(good, total)) / (1 - i.objective)
+}
+
+// remaining returns the fraction of the error budget not spent over the budget window
+func (i *indicator) remaining(now time.Time) float64 {
+	good, total := i.budget.sum(now)
+	if total == 0 {
+		return 1
+	}
+	allowed := (1 - i.objective) * float64(total)
+	return 1 - float64(total-good)/allowed
+}
+
+func ratio(good, total uint64) float64 {
+	if total == 0 {
+		return 1
+	}
+	return float64(good) / float64(total)
+}
+
+// rollingCounter counts the requests over a window, split in buckets
+type rollingCounter struct {
+	size  time.Duration
+	width int64
+	mu    sync.Mutex
+	slots [buckets]slot
+}
+
+type slot struct {
+	index int64
+	good  uint64
+	total uint64
+}
+
+func newRollingCounter(size time.Duration) *rollingCounter {
+	width := int64(size) / buckets
+	if width < 1 {
+		width = 1
+	}
+	return &rollingCounter{size: size, width: width}
+}
+
+func (r *rollingCounter) add(now time.Time, good bool) {
+	i := now.UnixNano() / r.width
+	r.mu.Lock()
+	s := &r.slots[i%buckets]
+	if s.index != i {
+		*s = slot{index: i}
+	}
+	s.total++
+	if good {
+		s.good++
+	}
+	r.mu.Unlock()
+}
+
+func (r *rollingCounter) sum(now time.Time) (good, total uint64) {
+	i := now.UnixNano() / r.width
+	r.mu.Lock()
+	for _, s := range r.slots {
+		if s.index > i-buckets && s.index <= i {
+			good += s.good
+			total += s.total
+		}
+	}
+	r.mu.Unlock()
+	return good, total
+}
+
+// windowName formats the window with its largest exact unit: 30d, 6h, 5m or 30s
+func windowName(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	case d%time.Hour == 0:
+		return strconv.FormatInt(int64(d/time.Hour), 10) + "h"
+	case d%time.Minute == 0:
+		return strconv.FormatInt(int64(d/time.Minute), 10) + "m"
+	case d%time.Second == 0:
+		return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+	}
+	return d.String()
+}
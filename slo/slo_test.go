@@ -0,0 +1,177 @@
+package slo
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	krakendmetrics "github.com/devopsfaith/krakend-metrics"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+func TestHandlerFactory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	now := time.Date(2021, 3, 15, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := metrics.New(ctx, config.ExtraConfig{
+		krakendmetrics.Namespace: map[string]interface{}{"endpoint_disabled": true, "collection_time": "1h"},
+	}, logging.NoOp)
+	r := NewRegistry(m)
+
+	engine := newEngine(r, map[string]interface{}{
+		"availability":      map[string]interface{}{"objective": 0.9},
+		"latency":           map[string]interface{}{"objective": 0.5, "threshold": "100ms"},
+		"window":            "1h",
+		"burn_rate_windows": []string{"5m"},
+	}, func(c *gin.Context) {
+		if c.Query("slow") != "" {
+			now = now.Add(200 * time.Millisecond)
+		}
+		if c.Query("fail") != "" {
+			c.AbortWithStatus(http.StatusBadGateway)
+			return
+		}
+		c.String(http.StatusOK, "ok")
+	})
+
+	for _, path := range []string{"/slo", "/slo", "/slo?slow=1", "/slo?fail=1"} {
+		engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	reports := r.Reports()
+	if len(reports) != 2 {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	availability, latency := reports[0], reports[1]
+	if availability.Endpoint != "GET /slo" || availability.SLI != availabilitySLI || availability.Window != "1h" {
+		t.Errorf("unexpected report: %+v", availability)
+	}
+	if availability.Good != 3 || availability.Total != 4 {
+		t.Errorf("unexpected availability counters: %d/%d", availability.Good, availability.Total)
+	}
+	// 1 bad request out of 4 with a 10% allowance: 0.25 / 0.1
+	assertFloat(t, "availability burn rate", availability.BurnRates["5m"], 2.5)
+	// 0.4 allowed bad requests, 1 spent
+	assertFloat(t, "availability budget", availability.ErrorBudgetRemaining, -1.5)
+
+	if latency.SLI != latencySLI || latency.Threshold != "100ms" || latency.Good != 3 || latency.Total != 4 {
+		t.Errorf("unexpected report: %+v", latency)
+	}
+	assertFloat(t, "latency burn rate", latency.BurnRates["5m"], 0.5)
+	assertFloat(t, "latency budget", latency.ErrorBudgetRemaining, 0.5)
+
+	registry := *m.Registry
+	if g, ok := registry.Get("router.slo.GET /slo.availability.1h.total").(gometrics.Gauge); !ok || g.Value() != 4 {
+		t.Errorf("unexpected total gauge: %v", registry.Get("router.slo.GET /slo.availability.1h.total"))
+	}
+	if g, ok := registry.Get("router.slo.GET /slo.latency.5m.burn_rate").(gometrics.GaugeFloat64); !ok || g.Value() != 0.5 {
+		t.Errorf("unexpected burn rate gauge: %v", registry.Get("router.slo.GET /slo.latency.5m.burn_rate"))
+	}
+
+	// the burn rate window slides, while the budget window keeps the requests
+	now = now.Add(10 * time.Minute)
+	reports = r.Reports()
+	if reports[0].BurnRates["5m"] != 0 || reports[0].Total != 4 {
+		t.Errorf("unexpected report after 10 minutes: %+v", reports[0])
+	}
+	now = now.Add(time.Hour)
+	if reports = r.Reports(); reports[0].Total != 0 || reports[0].ErrorBudgetRemaining != 1 {
+		t.Errorf("unexpected report after the window: %+v", reports[0])
+	}
+}
+
+func TestRegistry_reload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := NewRegistry(nil)
+	cfg := map[string]interface{}{"availability": map[string]interface{}{"objective": 0.99}}
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+
+	engine := newEngine(r, cfg, ok)
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slo", nil))
+
+	// the same objectives keep the counters
+	engine = newEngine(r, cfg, ok)
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slo", nil))
+	if reports := r.Reports(); len(reports) != 1 || reports[0].Total != 2 {
+		t.Errorf("unexpected reports: %+v", reports)
+	}
+
+	// new objectives reset them
+	engine = newEngine(r, map[string]interface{}{"availability": map[string]interface{}{"objective": 0.95}}, ok)
+	engine.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slo", nil))
+	if reports := r.Reports(); len(reports) != 1 || reports[0].Total != 1 || reports[0].Objective != 0.95 {
+		t.Errorf("unexpected reports: %+v", reports)
+	}
+}
+
+func TestHandlerFactory_badConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	for _, cfg := range []interface{}{
+		map[string]interface{}{},
+		map[string]interface{}{"availability": map[string]interface{}{"objective": 1}},
+		map[string]interface{}{"latency": map[string]interface{}{"objective": 0.9}},
+		map[string]interface{}{"availability": map[string]interface{}{"objective": 0.9}, "window": "1h", "burn_rate_windows": []string{"2h"}},
+		map[string]interface{}{"availability": map[string]interface{}{"objective": 0.9}, "window": "a month"},
+		"invalid",
+	} {
+		r := NewRegistry(nil)
+		engine := newEngine(r, cfg, func(c *gin.Context) { c.Status(http.StatusOK) })
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest("GET", "/slo", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("unexpected status code with the config %v: %d", cfg, w.Code)
+		}
+		if reports := r.Reports(); len(reports) != 0 {
+			t.Errorf("unexpected reports with the config %v: %+v", cfg, reports)
+		}
+	}
+}
+
+func TestWindowName(t *testing.T) {
+	for d, name := range map[time.Duration]string{
+		720 * time.Hour:         "30d",
+		6 * time.Hour:           "6h",
+		90 * time.Minute:        "90m",
+		30 * time.Second:        "30s",
+		1500 * time.Millisecond: "1.5s",
+	} {
+		if res := windowName(d); res != name {
+			t.Errorf("unexpected name for %s: %s", d, res)
+		}
+	}
+}
+
+func newEngine(r *Registry, cfg interface{}, h gin.HandlerFunc) *gin.Engine {
+	hf := HandlerFactory(func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		return h
+	}, r, logging.NoOp)
+	engine := gin.New()
+	engine.GET("/slo", hf(&config.EndpointConfig{
+		Method:      "GET",
+		Endpoint:    "/slo",
+		ExtraConfig: config.ExtraConfig{Namespace: cfg},
+	}, proxy.NoopProxy))
+	return engine
+}
+
+func assertFloat(t *testing.T, name string, have, want float64) {
+	t.Helper()
+	if math.Abs(have-want) > 1e-9 {
+		t.Errorf("unexpected %s: %f, want %f", name, have, want)
+	}
+}
@@ -0,0 +1,441 @@
+package krakend
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	gcb "github.com/devopsfaith/krakend-circuitbreaker/gobreaker"
+	krakendrate "github.com/devopsfaith/krakend-ratelimit"
+	jujuproxy "github.com/devopsfaith/krakend-ratelimit/juju/proxy"
+	jujurouter "github.com/devopsfaith/krakend-ratelimit/juju/router"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+	"github.com/sony/gobreaker"
+)
+
+// layer describes a middleware added by one of the factories and the namespaces enabling it
+type layer struct {
+	Name       string
+	Namespaces []string
+	// Keys restricts the layer to the namespaces setting any of the keys. The keys set to null, false or an
+	// empty string do not enable the layer.
+	Keys []string
+	// Service flags the layers enabled by the service extra config instead of the local one
+	Service bool
+	// Always flags the layers added to every stack, regardless of the configuration
+	Always bool
+}
+
+func (l layer) enabled(service, local config.ExtraConfig) bool {
+	if l.Always {
+		return true
+	}
+	e := local
+	if l.Service {
+		e = service
+	}
+	for _, ns := range l.Namespaces {
+		v, ok := e[ns]
+		if !ok {
+			continue
+		}
+		if len(l.Keys) == 0 {
+			return true
+		}
+		m, _ := v.(map[string]interface{})
+		for _, k := range l.Keys {
+			switch v := m[k].(type) {
+			case nil:
+			case bool:
+				if v {
+					return true
+				}
+			case string:
+				if v != "" {
+					return true
+				}
+			default:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enabledLayers returns the names of the layers enabled by the configuration, keeping their order
+func enabledLayers(ls []layer, service, local config.ExtraConfig) []string {
+	res := []string{}
+	for _, l := range ls {
+		if l.enabled(service, local) {
+			res = append(res, l.Name)
+		}
+	}
+	return res
+}
+
+type inspectorContextKey struct{}
+
+// withStackInspector returns a copy of the context carrying the stack inspector so the factories can
+// register the components to expose
+func withStackInspector(ctx context.Context, s *stackInspector) context.Context {
+	return context.WithValue(ctx, inspectorContextKey{}, s)
+}
+
+func stackInspectorFromContext(ctx context.Context) *stackInspector {
+	s, _ := ctx.Value(inspectorContextKey{}).(*stackInspector)
+	return s
+}
+
+// stackInspector collects the stateful components created along with a router stack and the layers
+// stacked by the factories for every endpoint
+type stackInspector struct {
+	mu       sync.RWMutex
+	breakers map[string]*gobreaker.CircuitBreaker
+	limiters map[string]*rateLimitCounter
+	chains   map[string][]chainLink
+	// backends maps the backends of the built endpoints to the key of their chain
+	backends map[*config.Backend]string
+	// building is the key of the backend chain under construction, used for the copies of the backend
+	// passed to the inner layers
+	building string
+}
+
+func newStackInspector() *stackInspector {
+	return &stackInspector{
+		breakers: map[string]*gobreaker.CircuitBreaker{},
+		limiters: map[string]*rateLimitCounter{},
+		chains:   map[string][]chainLink{},
+		backends: map[*config.Backend]string{},
+	}
+}
+
+// chainLink is a layer of a chain along with the code pointer of the handler, the proxy or the request
+// executor it returned
+type chainLink struct {
+	name string
+	fn   uintptr
+	// applied flags the layers known to be applied, whatever they returned
+	applied bool
+}
+
+// recordLayer adds the layer to the chain of the key. The layers are recorded from the innermost to the
+// outermost one, as the factories return. Building the same chain again restarts it from the layer.
+func (s *stackInspector) recordLayer(key, name string, fn interface{}) {
+	if s == nil {
+		return
+	}
+	var ptr uintptr
+	if v := reflect.ValueOf(fn); v.Kind() == reflect.Func {
+		ptr = v.Pointer()
+	}
+	s.addLink(key, chainLink{name: name, fn: ptr})
+}
+
+// recordAppliedLayer adds a layer that does not return a function to compare, like the transport ones
+func (s *stackInspector) recordAppliedLayer(key, name string) {
+	if s == nil {
+		return
+	}
+	s.addLink(key, chainLink{name: name, applied: true})
+}
+
+func (s *stackInspector) addLink(key string, l chainLink) {
+	s.mu.Lock()
+	links := s.chains[key]
+	for i, link := range links {
+		if link.name == l.name {
+			links = links[:i]
+			break
+		}
+	}
+	s.chains[key] = append(links, l)
+	s.mu.Unlock()
+}
+
+// chain returns the layers of the key, from the outermost to the innermost one, and false if the
+// factories did not record any. A layer returning what the inner ones built is not part of the chain.
+func (s *stackInspector) chain(key string) ([]string, bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.RLock()
+	links := s.chains[key]
+	s.mu.RUnlock()
+	if len(links) == 0 {
+		return nil, false
+	}
+	res := []string{}
+	for i := len(links) - 1; i >= 0; i-- {
+		if links[i].applied || i == 0 || links[i].fn != links[i-1].fn {
+			res = append(res, links[i].name)
+		}
+	}
+	return res, true
+}
+
+func handlerChainKey(remote *config.EndpointConfig) string {
+	return "handler " + remote.Method + " " + remote.Endpoint
+}
+
+func proxyChainKey(remote *config.EndpointConfig) string {
+	return "proxy " + remote.Method + " " + remote.Endpoint
+}
+
+// backendChainKey identifies the backend by its endpoint and its position, as the middlewares can pass a
+// copy of the backend config to the inner layers
+func backendChainKey(e *config.EndpointConfig, i int) string {
+	return fmt.Sprintf("backend %s %s #%d", e.Method, e.Endpoint, i)
+}
+
+// registerBackends stores the chain keys of the backends of the endpoint before they are built
+func (s *stackInspector) registerBackends(e *config.EndpointConfig) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	for i, b := range e.Backend {
+		s.backends[b] = backendChainKey(e, i)
+	}
+	s.mu.Unlock()
+}
+
+// backendKey returns the chain key of the backend. The unknown backends are the copies built by an outer
+// layer, so they share the chain under construction.
+func (s *stackInspector) backendKey(remote *config.Backend) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if key, ok := s.backends[remote]; ok {
+		return key
+	}
+	if s.building != "" {
+		return s.building
+	}
+	return fmt.Sprintf("backend %p", remote)
+}
+
+// build sets the key of the backend chain under construction and returns the previous one
+func (s *stackInspector) build(key string) string {
+	s.mu.Lock()
+	prev := s.building
+	s.building = key
+	s.mu.Unlock()
+	return prev
+}
+
+// recordHandlerLayer records the handlers returned by the factory in the chain of their endpoint
+func recordHandlerLayer(s *stackInspector, name string, next router.HandlerFactory) router.HandlerFactory {
+	if s == nil {
+		return next
+	}
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		h := next(remote, p)
+		s.recordLayer(handlerChainKey(remote), name, h)
+		return h
+	}
+}
+
+// recordProxyLayer records the proxies returned by the factory in the chain of their endpoint
+func recordProxyLayer(s *stackInspector, name string, next proxy.Factory) proxy.Factory {
+	if s == nil {
+		return next
+	}
+	return proxy.FactoryFunc(func(remote *config.EndpointConfig) (proxy.Proxy, error) {
+		s.registerBackends(remote)
+		p, err := next.New(remote)
+		if err == nil {
+			s.recordLayer(proxyChainKey(remote), name, p)
+		}
+		return p, err
+	})
+}
+
+// recordBackendLayer records the proxies returned by the factory in the chain of their backend
+func recordBackendLayer(s *stackInspector, name string, next proxy.BackendFactory) proxy.BackendFactory {
+	if s == nil {
+		return next
+	}
+	return func(remote *config.Backend) proxy.Proxy {
+		key := s.backendKey(remote)
+		prev := s.build(key)
+		p := next(remote)
+		s.build(prev)
+		s.recordLayer(key, name, p)
+		return p
+	}
+}
+
+func (s *stackInspector) addBreaker(name string, cb *gobreaker.CircuitBreaker) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.breakers[uniqueName(name, func(k string) bool { _, ok := s.breakers[k]; return ok })] = cb
+	s.mu.Unlock()
+}
+
+func (s *stackInspector) addLimiter(name string, limits map[string]interface{}) *rateLimitCounter {
+	c := &rateLimitCounter{limits: limits}
+	if s == nil {
+		return c
+	}
+	s.mu.Lock()
+	s.limiters[uniqueName(name, func(k string) bool { _, ok := s.limiters[k]; return ok })] = c
+	s.mu.Unlock()
+	return c
+}
+
+// uniqueName appends a suffix to the name if it is already taken, as the same backend can be declared by
+// several endpoints
+func uniqueName(name string, taken func(string) bool) string {
+	if !taken(name) {
+		return name
+	}
+	for i := 2; ; i++ {
+		if k := fmt.Sprintf("%s #%d", name, i); !taken(k) {
+			return k
+		}
+	}
+}
+
+func (s *stackInspector) breakerStates() map[string]string {
+	res := map[string]string{}
+	if s == nil {
+		return res
+	}
+	s.mu.RLock()
+	for k, cb := range s.breakers {
+		res[k] = cb.State().String()
+	}
+	s.mu.RUnlock()
+	return res
+}
+
+type rateLimitUsage struct {
+	Name    string                 `json:"name"`
+	Limits  map[string]interface{} `json:"limits"`
+	Allowed uint64                 `json:"allowed"`
+	Limited uint64                 `json:"limited"`
+}
+
+func (s *stackInspector) rateLimits() []rateLimitUsage {
+	res := []rateLimitUsage{}
+	if s == nil {
+		return res
+	}
+	s.mu.RLock()
+	for k, c := range s.limiters {
+		res = append(res, rateLimitUsage{
+			Name:    k,
+			Limits:  c.limits,
+			Allowed: atomic.LoadUint64(&c.allowed),
+			Limited: atomic.LoadUint64(&c.limited),
+		})
+	}
+	s.mu.RUnlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// rateLimitCounter tracks the requests accepted and rejected by a rate limiter
+type rateLimitCounter struct {
+	limits  map[string]interface{}
+	allowed uint64
+	limited uint64
+}
+
+func (c *rateLimitCounter) observe(limited bool) {
+	if limited {
+		atomic.AddUint64(&c.limited, 1)
+		return
+	}
+	atomic.AddUint64(&c.allowed, 1)
+}
+
+// backendName identifies a backend in the messages and the inspection endpoints
+func backendName(remote *config.Backend) string {
+	return fmt.Sprintf("%s %s%s", remote.Method, strings.Join(remote.Host, ","), remote.URLPattern)
+}
+
+// circuitBreakerFactory adds the gobreaker middleware wrapping the internal factory and registers every
+// created circuit breaker in the stack inspector
+func circuitBreakerFactory(ctx context.Context, next proxy.BackendFactory, logger logging.Logger) proxy.BackendFactory {
+	s := stackInspectorFromContext(ctx)
+	return func(remote *config.Backend) proxy.Proxy {
+		data := gcb.ConfigGetter(remote.ExtraConfig).(gcb.Config)
+		if data == gcb.ZeroCfg {
+			return next(remote)
+		}
+		cb := gcb.NewCircuitBreaker(data, logger)
+		s.addBreaker(backendName(remote), cb)
+
+		p := next(remote)
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			// the response is kept along with the error, as the backends returning the error details (the
+			// graphql adapter and the http proxy with return_error_details) send them in the response, so
+			// the breaker counts the failure and the endpoint still renders the details
+			result, err := cb.Execute(func() (interface{}, error) { return p(ctx, request) })
+			resp, _ := result.(*proxy.Response)
+			return resp, err
+		}
+	}
+}
+
+// countBackendRateLimits wraps the rate limited backends so the requests rejected by the limiter are
+// exposed by the stack inspector
+func countBackendRateLimits(ctx context.Context, next proxy.BackendFactory) proxy.BackendFactory {
+	s := stackInspectorFromContext(ctx)
+	if s == nil {
+		return next
+	}
+	return func(remote *config.Backend) proxy.Proxy {
+		p := next(remote)
+		limits, ok := remote.ExtraConfig[jujuproxy.Namespace].(map[string]interface{})
+		if !ok {
+			return p
+		}
+		c := s.addLimiter("backend "+backendName(remote), limits)
+		return func(ctx context.Context, request *proxy.Request) (*proxy.Response, error) {
+			resp, err := p(ctx, request)
+			c.observe(err == krakendrate.ErrLimited)
+			return resp, err
+		}
+	}
+}
+
+// countEndpointRateLimits wraps the rate limited endpoints so the requests rejected by the limiter are
+// exposed by the stack inspector
+func countEndpointRateLimits(s *stackInspector, next router.HandlerFactory) router.HandlerFactory {
+	if s == nil {
+		return next
+	}
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		h := next(remote, p)
+		limits, ok := remote.ExtraConfig[jujurouter.Namespace].(map[string]interface{})
+		if !ok {
+			return h
+		}
+		counter := s.addLimiter(fmt.Sprintf("endpoint %s %s", remote.Method, remote.Endpoint), limits)
+		return func(c *gin.Context) {
+			h(c)
+			limited := false
+			for _, err := range c.Errors {
+				if err.Err == krakendrate.ErrLimited {
+					limited = true
+					break
+				}
+			}
+			counter.observe(limited)
+		}
+	}
+}
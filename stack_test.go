@@ -0,0 +1,53 @@
+package krakend
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	gcb "github.com/devopsfaith/krakend-circuitbreaker/gobreaker"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	"github.com/sony/gobreaker"
+)
+
+func TestCircuitBreakerFactory_keepsTheResponseOfTheFailures(t *testing.T) {
+	remote := &config.Backend{
+		URLPattern: "/a",
+		ExtraConfig: config.ExtraConfig{gcb.Namespace: map[string]interface{}{
+			"interval":  60,
+			"timeout":   10,
+			"maxErrors": 1,
+		}},
+	}
+	// the backends returning the error details, like the http proxy with return_error_details or the
+	// graphql adapter, return the failed response along with the error, so the breaker counts the failure
+	// and the endpoint still renders the details
+	errBackend := errors.New("backend failure")
+	details := &proxy.Response{Data: map[string]interface{}{"error_backend": "details"}}
+	bf := circuitBreakerFactory(withStackInspector(context.Background(), newStackInspector()), func(_ *config.Backend) proxy.Proxy {
+		return func(_ context.Context, _ *proxy.Request) (*proxy.Response, error) {
+			return details, errBackend
+		}
+	}, logging.NoOp)
+	p := bf(remote)
+
+	for i := 0; i < 2; i++ {
+		resp, err := p(context.Background(), &proxy.Request{})
+		if err != errBackend {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+		}
+		if resp != details {
+			t.Errorf("#%d: the response of the failure was not kept: %v", i, resp)
+		}
+	}
+
+	resp, err := p(context.Background(), &proxy.Request{})
+	if err != gobreaker.ErrOpenState {
+		t.Errorf("the breaker did not count the failures: %v", err)
+	}
+	if resp != nil {
+		t.Errorf("unexpected response with the breaker open: %v", resp)
+	}
+}
@@ -0,0 +1,245 @@
+// Package streaming provides a handler copying the backend response body to the client as it arrives,
+// flushing every chunk, so the Server-Sent Events and the long running downloads are not buffered by the
+// gateway.
+//
+// Sample endpoint extra config
+//
+//	...
+//	"endpoint": "/events",
+//	"output_encoding": "no-op",
+//	"backend": [
+//		{
+//			"host": ["http://events:8080"],
+//			"url_pattern": "/stream"
+//		}
+//	],
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/streaming": {
+//			"buffer_size": 4096,
+//			"idle_timeout": "30s"
+//		},
+//		...
+//	},
+//	...
+//
+// The endpoint must use the no-op encoding, so the backend body reaches the handler unparsed. The endpoint
+// timeout only limits the time to get the response headers and the backend request is cancelled as soon as
+// the client disconnects. The idle_timeout, disabled by default, cancels the backend request when no data is
+// received from the backend for that long, so a stalled backend does not hold the stream forever. Notice the
+// write_timeout of the service still applies to the whole response.
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/requestid"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/core"
+	"github.com/luraproject/lura/encoding"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	krakendrouter "github.com/luraproject/lura/router"
+	router "github.com/luraproject/lura/router/gin"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/streaming"
+
+const defaultBufferSize = 32 * 1024
+
+var (
+	errNoConfig  = errors.New("streaming: no config")
+	errBadConfig = errors.New("streaming: unable to parse the config")
+	errNoOp      = errors.New("streaming: the endpoint must use the no-op encoding")
+)
+
+// Config is the custom config struct containing the params for the streaming handler
+type Config struct {
+	// BufferSize is the max number of bytes read from the backend before flushing them to the client
+	BufferSize int `json:"buffer_size"`
+	// IdleTimeout is the max time between two reads of the backend response. Empty means no limit.
+	IdleTimeout string `json:"idle_timeout"`
+}
+
+func getConfig(remote *config.EndpointConfig) (Config, error) {
+	v, ok := remote.ExtraConfig[Namespace]
+	if !ok {
+		return Config{}, errNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, errBadConfig
+	}
+	if remote.OutputEncoding != encoding.NOOP {
+		return Config{}, errNoOp
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = defaultBufferSize
+	}
+	return cfg, nil
+}
+
+// HandlerFactory returns a streaming handler for the endpoints with the streaming config. The rest of the
+// endpoints are handled by the next factory.
+func HandlerFactory(next router.HandlerFactory, logger logging.Logger, m *metrics.Metrics) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		cfg, err := getConfig(remote)
+		if err != nil {
+			if err != errNoConfig {
+				logger.Error(err.Error(), remote.Endpoint)
+			}
+			return next(remote, p)
+		}
+		var idleTimeout time.Duration
+		if d, err := time.ParseDuration(cfg.IdleTimeout); err == nil && d > 0 {
+			idleTimeout = d
+		}
+		h := &handler{
+			cfg:         cfg,
+			timeout:     remote.Timeout,
+			idleTimeout: idleTimeout,
+			newRequest:  router.NewRequest(remote.HeadersToPass),
+			query:       remote.QueryString,
+			proxy:       p,
+			logger:      logger,
+			counters:    newCounters(m, remote.Endpoint),
+		}
+		return h.serve
+	}
+}
+
+type handler struct {
+	cfg         Config
+	timeout     time.Duration
+	idleTimeout time.Duration
+	newRequest  func(*gin.Context, []string) *proxy.Request
+	query       []string
+	proxy       proxy.Proxy
+	logger      logging.Logger
+	counters    counters
+}
+
+func (h *handler) serve(c *gin.Context) {
+	// the request context is cancelled when the client goes away, cancelling the backend request
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	var timer *time.Timer
+	if h.timeout > 0 {
+		timer = time.AfterFunc(h.timeout, cancel)
+	}
+
+	c.Header(core.KrakendHeaderName, core.KrakendHeaderValue)
+
+	response, err := h.proxy(ctx, h.newRequest(c, h.query))
+	if timer != nil && !timer.Stop() && err == nil {
+		err = krakendrouter.ErrInternalError
+	}
+	if response != nil && response.Io != nil {
+		if closer, ok := response.Io.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+	if err != nil {
+		c.Error(err)
+		if response == nil {
+			if t, ok := err.(responseError); ok {
+				c.Status(t.StatusCode())
+			} else {
+				c.Status(krakendrouter.DefaultToHTTPError(err))
+			}
+			return
+		}
+	}
+	if response == nil {
+		c.Status(http.StatusInternalServerError)
+		return
+	}
+
+	for k, vs := range response.Metadata.Headers {
+		for _, v := range vs {
+			c.Writer.Header().Add(k, v)
+		}
+	}
+	c.Status(response.Metadata.StatusCode)
+	// the headers are sent before the first chunk, so the client knows the stream is open
+	c.Writer.Flush()
+	if response.Io == nil {
+		return
+	}
+
+	h.counters.open.Inc(1)
+	defer h.counters.open.Dec(1)
+
+	// the backend request is cancelled when the backend stalls, so the read below returns
+	var stalled int32
+	var idle *time.Timer
+	if h.idleTimeout > 0 {
+		idle = time.AfterFunc(h.idleTimeout, func() {
+			atomic.StoreInt32(&stalled, 1)
+			cancel()
+		})
+		defer idle.Stop()
+	}
+
+	buf := make([]byte, h.cfg.BufferSize)
+	for {
+		n, err := response.Io.Read(buf)
+		if idle != nil {
+			idle.Reset(h.idleTimeout)
+		}
+		if n > 0 {
+			if _, werr := c.Writer.Write(buf[:n]); werr != nil {
+				return
+			}
+			c.Writer.Flush()
+			h.counters.bytes.Inc(int64(n))
+		}
+		if err != nil {
+			if atomic.LoadInt32(&stalled) == 1 {
+				requestid.Logger(ctx, h.logger).Warning("streaming: no data received from the backend in", h.idleTimeout.String())
+				return
+			}
+			if err != io.EOF && ctx.Err() == nil {
+				requestid.Logger(ctx, h.logger).Debug("streaming: reading the backend response:", err.Error())
+			}
+			return
+		}
+	}
+}
+
+type responseError interface {
+	error
+	StatusCode() int
+}
+
+// counters are the metrics of a streaming endpoint. The response size and duration are recorded by the
+// metrics collector of the router once the stream is completed.
+type counters struct {
+	open  gometrics.Counter
+	bytes gometrics.Counter
+}
+
+func newCounters(m *metrics.Metrics, endpoint string) counters {
+	if m == nil || m.Metrics == nil || m.Router == nil {
+		return counters{open: gometrics.NilCounter{}, bytes: gometrics.NilCounter{}}
+	}
+	return counters{
+		open:  m.Router.Counter("streaming."+endpoint, "streams"),
+		bytes: m.Router.Counter("streaming."+endpoint, "bytes"),
+	}
+}
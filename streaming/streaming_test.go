@@ -0,0 +1,160 @@
+package streaming
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/encoding"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+	"github.com/luraproject/lura/transport/http/client"
+)
+
+func TestHandlerFactory(t *testing.T) {
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-release:
+			fmt.Fprint(w, "data: second\n\n")
+		case <-r.Context().Done():
+			close(cancelled)
+		}
+	}))
+	defer backend.Close()
+
+	gateway := newGateway(t, backend.URL, map[string]interface{}{})
+	defer gateway.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, gateway.URL+"/events", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+
+	// the first event must arrive while the backend is still streaming
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "data: first\n" {
+		t.Errorf("unexpected line: %q", line)
+	}
+
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the backend request was not cancelled after the client disconnection")
+		close(release)
+	}
+}
+
+func TestHandlerFactory_idleTimeout(t *testing.T) {
+	cancelled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		// the events sent before the idle timeout keep the stream open
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer backend.Close()
+
+	gateway := newGateway(t, backend.URL, map[string]interface{}{"idle_timeout": "100ms"})
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	done := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(resp.Body)
+		done <- b
+	}()
+	select {
+	case b := <-done:
+		if string(b) != "data: 0\n\ndata: 1\n\ndata: 2\n\n" {
+			t.Errorf("unexpected body: %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the stream was not closed after the backend stalled")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("the backend request was not cancelled after the idle timeout")
+	}
+}
+
+func TestHandlerFactory_fallback(t *testing.T) {
+	for _, e := range []*config.EndpointConfig{
+		{},
+		{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{}}, OutputEncoding: encoding.JSON},
+	} {
+		called := false
+		next := func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+			called = true
+			return func(_ *gin.Context) {}
+		}
+		HandlerFactory(next, logging.NoOp, nil)(e, proxy.NoopProxy)
+		if !called {
+			t.Errorf("the next handler factory should be used for %v", e)
+		}
+	}
+}
+
+func newGateway(t *testing.T, backendURL string, extra map[string]interface{}) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	backend := &config.Backend{
+		Method:     http.MethodGet,
+		Host:       []string{backendURL},
+		URLPattern: "/stream",
+		Encoding:   encoding.NOOP,
+	}
+	endpoint := &config.EndpointConfig{
+		Endpoint:       "/events",
+		Method:         http.MethodGet,
+		Timeout:        time.Second,
+		OutputEncoding: encoding.NOOP,
+		Backend:        []*config.Backend{backend},
+		ExtraConfig:    config.ExtraConfig{Namespace: extra},
+	}
+	bp := proxy.NewHTTPProxyWithHTTPExecutor(backend, client.DefaultHTTPRequestExecutor(client.NewHTTPClient), backend.Decoder)
+	p := proxy.NewRoundRobinLoadBalancedMiddleware(backend)(bp)
+
+	engine := gin.New()
+	engine.GET(endpoint.Endpoint, HandlerFactory(router.EndpointHandler, logging.NoOp, nil)(endpoint, p))
+	return httptest.NewServer(engine)
+}
@@ -409,11 +409,11 @@ type mockBackendBuilder struct{}
 func (mockBackendBuilder) New(cfg *Config) http.Server {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/param_forwarding/", checkXForwardedFor(http.HandlerFunc(echoEndpoint)))
-	mux.HandleFunc("/xml", checkXForwardedFor(http.HandlerFunc(xmlEndpoint)))
-	mux.HandleFunc("/collection/", checkXForwardedFor(http.HandlerFunc(collectionEndpoint)))
-	mux.HandleFunc("/delayed/", checkXForwardedFor(delayedEndpoint(cfg.getDelay(), http.HandlerFunc(echoEndpoint))))
-	mux.HandleFunc("/redirect/", checkXForwardedFor(http.HandlerFunc(redirectEndpoint)))
+	mux.HandleFunc("/param_forwarding/", checkXForwardedFor(checkRequestID(http.HandlerFunc(echoEndpoint))))
+	mux.HandleFunc("/xml", checkXForwardedFor(checkRequestID(http.HandlerFunc(xmlEndpoint))))
+	mux.HandleFunc("/collection/", checkXForwardedFor(checkRequestID(http.HandlerFunc(collectionEndpoint))))
+	mux.HandleFunc("/delayed/", checkXForwardedFor(checkRequestID(delayedEndpoint(cfg.getDelay(), http.HandlerFunc(echoEndpoint)))))
+	mux.HandleFunc("/redirect/", checkXForwardedFor(checkRequestID(http.HandlerFunc(redirectEndpoint))))
 	mux.HandleFunc("/jwk/symmetric", http.HandlerFunc(symmetricJWKEndpoint))
 
 	return http.Server{
@@ -446,6 +446,19 @@ func checkXForwardedFor(h http.Handler) http.HandlerFunc {
 	}
 }
 
+// checkRequestID rejects the requests without the ID added by the gateway. The value is random, so it is
+// removed before reaching the endpoint.
+func checkRequestID(h http.Handler) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Request-Id") == "" {
+			http.Error(rw, "missing X-Request-Id", 400)
+			return
+		}
+		r.Header.Del("X-Request-Id")
+		h.ServeHTTP(rw, r)
+	}
+}
+
 func delayedEndpoint(d time.Duration, h http.Handler) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
 		<-time.After(d)
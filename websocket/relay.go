@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// relayConnections copies the messages between the client and the backend until one of them closes the
+// connection or fails, or the context is cancelled. Both connections are closed on return.
+func relayConnections(ctx context.Context, client, backend *websocket.Conn, c counters) {
+	done := make(chan struct{}, 2)
+	go func() {
+		relay(backend, client, c.bytesIn, c.messageIn)
+		done <- struct{}{}
+	}()
+	go func() {
+		relay(client, backend, c.bytesOut, c.messageOut)
+		done <- struct{}{}
+	}()
+
+	pending := 2
+	select {
+	case <-done:
+		pending--
+	case <-ctx.Done():
+		// the stack was replaced or the gateway is shutting down
+		writeClose(client, websocket.CloseGoingAway, "")
+		writeClose(backend, websocket.CloseGoingAway, "")
+	}
+	// closing the connections unblocks the readers still running
+	client.Close()
+	backend.Close()
+	for ; pending > 0; pending-- {
+		<-done
+	}
+}
+
+// relay copies the messages from src to dst. Once src can not be read, the close frame with the reason is
+// sent to dst.
+func relay(dst, src *websocket.Conn, bytes, messages gometrics.Counter) {
+	for {
+		messageType, msg, err := src.ReadMessage()
+		if err != nil {
+			code, text := closeReason(err)
+			if code == websocket.CloseMessageTooBig {
+				writeClose(src, code, text)
+			}
+			writeClose(dst, code, text)
+			return
+		}
+		if err := dst.WriteMessage(messageType, msg); err != nil {
+			return
+		}
+		bytes.Inc(int64(len(msg)))
+		messages.Inc(1)
+	}
+}
+
+// closeReason returns the close code and text to send to the other peer after a read error
+func closeReason(err error) (int, string) {
+	if err == websocket.ErrReadLimit {
+		return websocket.CloseMessageTooBig, "message too big"
+	}
+	if e, ok := err.(*websocket.CloseError); ok {
+		switch e.Code {
+		case websocket.CloseNoStatusReceived:
+			return websocket.CloseNormalClosure, ""
+		case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+			return websocket.CloseGoingAway, ""
+		}
+		return e.Code, e.Text
+	}
+	return websocket.CloseGoingAway, ""
+}
+
+func writeClose(conn *websocket.Conn, code int, text string) {
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(closeTimeout))
+}
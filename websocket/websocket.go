@@ -0,0 +1,331 @@
+// Package websocket provides a handler upgrading the endpoint connections to WebSocket and relaying the
+// frames to the first backend of the endpoint in both directions.
+//
+// Sample endpoint extra config
+//
+//	...
+//	"endpoint": "/ws/{room}",
+//	"backend": [
+//		{
+//			"host": ["http://chat:8080"],
+//			"url_pattern": "/rooms/{room}"
+//		}
+//	],
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/websocket": {
+//			"max_connections": 1000,
+//			"max_message_size": 65536,
+//			"read_buffer_size": 4096,
+//			"write_buffer_size": 4096,
+//			"allowed_origins": ["https://example.com"]
+//		},
+//		...
+//	},
+//	...
+//
+// The handler replaces the default endpoint handler, so the rest of the router middlewares (jose, bot
+// detection, rate limit...) are executed before the upgrade. The http and https schemes of the backend hosts
+// are replaced by ws and wss. The headers and the query string are forwarded following the endpoint config.
+// When no allowed origins are defined, only the requests from the same host are upgraded.
+//
+// The http server does not track the hijacked connections, so neither its shutdown nor the drain of the hot
+// reload wait for them. The relayed connections are closed with the going away code as soon as the context
+// received by the HandlerFactory is cancelled.
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devopsfaith/krakend-ce/requestid"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+	"github.com/luraproject/lura/sd"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/websocket"
+
+const closeTimeout = time.Second
+
+var (
+	errNoConfig           = errors.New("websocket: no config")
+	errBadConfig          = errors.New("websocket: unable to parse the config")
+	errNoBackend          = errors.New("websocket: the endpoint has no backend")
+	errNotUpgrade         = errors.New("websocket: not a websocket handshake")
+	errTooManyConnections = errors.New("websocket: too many connections")
+)
+
+// handshakeHeaders are generated by the dialer, so they can not be forwarded to the backend
+var handshakeHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+}
+
+// Config is the custom config struct containing the params for the websocket handler
+type Config struct {
+	// MaxConnections limits the connections open at the same time. Zero means no limit.
+	MaxConnections int64 `json:"max_connections"`
+	// MaxMessageSize limits the size in bytes of the messages read from both peers. Zero means no limit.
+	MaxMessageSize  int64    `json:"max_message_size"`
+	ReadBufferSize  int      `json:"read_buffer_size"`
+	WriteBufferSize int      `json:"write_buffer_size"`
+	AllowedOrigins  []string `json:"allowed_origins"`
+}
+
+func getConfig(remote *config.EndpointConfig) (Config, error) {
+	v, ok := remote.ExtraConfig[Namespace]
+	if !ok {
+		return Config{}, errNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, errBadConfig
+	}
+	if len(remote.Backend) == 0 {
+		return Config{}, errNoBackend
+	}
+	return cfg, nil
+}
+
+// HandlerFactory returns a websocket handler for the endpoints with the websocket config. The rest of the
+// endpoints are handled by the next factory. The relayed connections are closed when the context is cancelled.
+func HandlerFactory(ctx context.Context, next router.HandlerFactory, logger logging.Logger, m *metrics.Metrics) router.HandlerFactory {
+	return func(remote *config.EndpointConfig, p proxy.Proxy) gin.HandlerFunc {
+		cfg, err := getConfig(remote)
+		if err != nil {
+			if err != errNoConfig {
+				logger.Error(err.Error(), remote.Endpoint)
+			}
+			return next(remote, p)
+		}
+		if len(remote.Backend) > 1 {
+			logger.Warning("websocket: only the first backend is used by", remote.Endpoint)
+		}
+		return newHandler(ctx, remote, cfg, logger, newCounters(m, remote.Endpoint)).serve
+	}
+}
+
+type handler struct {
+	ctx         context.Context
+	cfg         Config
+	logger      logging.Logger
+	counters    counters
+	backend     *config.Backend
+	lb          sd.Balancer
+	newRequest  func(*gin.Context, []string) *proxy.Request
+	queryString []string
+	dialer      *websocket.Dialer
+	upgrader    *websocket.Upgrader
+	open        int64
+}
+
+func newHandler(ctx context.Context, remote *config.EndpointConfig, cfg Config, logger logging.Logger, c counters) *handler {
+	backend := remote.Backend[0]
+	h := &handler{
+		ctx:         ctx,
+		cfg:         cfg,
+		logger:      logger,
+		counters:    c,
+		backend:     backend,
+		lb:          sd.NewRoundRobinLB(sd.GetSubscriber(backend)),
+		newRequest:  router.NewRequest(remote.HeadersToPass),
+		queryString: remote.QueryString,
+		dialer: &websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: remote.Timeout,
+			ReadBufferSize:   cfg.ReadBufferSize,
+			WriteBufferSize:  cfg.WriteBufferSize,
+		},
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:  cfg.ReadBufferSize,
+			WriteBufferSize: cfg.WriteBufferSize,
+		},
+	}
+	if len(cfg.AllowedOrigins) > 0 {
+		h.upgrader.CheckOrigin = checkOrigin(cfg.AllowedOrigins)
+	}
+	return h
+}
+
+func (h *handler) serve(c *gin.Context) {
+	if !websocket.IsWebSocketUpgrade(c.Request) {
+		c.AbortWithError(http.StatusBadRequest, errNotUpgrade)
+		return
+	}
+	if open := atomic.AddInt64(&h.open, 1); h.cfg.MaxConnections > 0 && open > h.cfg.MaxConnections {
+		atomic.AddInt64(&h.open, -1)
+		h.counters.rejected.Inc(1)
+		c.AbortWithError(http.StatusServiceUnavailable, errTooManyConnections)
+		return
+	}
+	defer atomic.AddInt64(&h.open, -1)
+
+	target, header, err := h.backendRequest(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadGateway, err)
+		return
+	}
+	dialer := *h.dialer
+	dialer.Subprotocols = websocket.Subprotocols(c.Request)
+
+	backendConn, resp, err := dialer.DialContext(c.Request.Context(), target, header)
+	if err != nil {
+		requestid.Logger(c, h.logger).Error("websocket: dialing", target, err.Error())
+		if resp != nil && resp.StatusCode >= http.StatusBadRequest {
+			c.AbortWithError(resp.StatusCode, err)
+			return
+		}
+		c.AbortWithError(http.StatusBadGateway, err)
+		return
+	}
+	defer backendConn.Close()
+
+	var responseHeader http.Header
+	if p := backendConn.Subprotocol(); p != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {p}}
+	}
+	clientConn, err := h.upgrader.Upgrade(c.Writer, c.Request, responseHeader)
+	if err != nil {
+		// the upgrader has already replied to the client
+		requestid.Logger(c, h.logger).Debug("websocket: upgrading the connection:", err.Error())
+		return
+	}
+	defer clientConn.Close()
+
+	if h.cfg.MaxMessageSize > 0 {
+		clientConn.SetReadLimit(h.cfg.MaxMessageSize)
+		backendConn.SetReadLimit(h.cfg.MaxMessageSize)
+	}
+
+	h.counters.updateOpen(1)
+	defer h.counters.updateOpen(-1)
+
+	relayConnections(h.ctx, clientConn, backendConn, h.counters)
+}
+
+// backendRequest returns the websocket URL of the backend and the headers to forward
+func (h *handler) backendRequest(c *gin.Context) (string, http.Header, error) {
+	host, err := h.lb.Host()
+	if err != nil {
+		return "", nil, err
+	}
+	switch {
+	case strings.HasPrefix(host, "https://"):
+		host = "wss://" + strings.TrimPrefix(host, "https://")
+	case strings.HasPrefix(host, "http://"):
+		host = "ws://" + strings.TrimPrefix(host, "http://")
+	}
+
+	r := h.newRequest(c, h.queryString)
+	r.GeneratePath(h.backend.URLPattern)
+	target := host + r.Path
+	if len(r.Query) > 0 {
+		target += "?" + r.Query.Encode()
+	}
+
+	header := make(http.Header, len(r.Headers))
+	for k, v := range r.Headers {
+		header[k] = v
+	}
+	for _, k := range handshakeHeaders {
+		header.Del(k)
+	}
+	return target, header, nil
+}
+
+func checkOrigin(allowed []string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, o := range allowed {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// openConnections keeps the number of relayed connections of every endpoint, shared by the handlers of the
+// stacks built by the hot reloads, so the gauge reports the connections of all of them
+var openConnections = struct {
+	sync.Mutex
+	m map[string]*int64
+}{m: map[string]*int64{}}
+
+func openConnectionsOf(endpoint string) *int64 {
+	openConnections.Lock()
+	defer openConnections.Unlock()
+	v, ok := openConnections.m[endpoint]
+	if !ok {
+		v = new(int64)
+		openConnections.m[endpoint] = v
+	}
+	return v
+}
+
+// counters are the metrics of a websocket endpoint
+type counters struct {
+	open       gometrics.Gauge
+	openCount  *int64
+	rejected   gometrics.Counter
+	bytesIn    gometrics.Counter
+	bytesOut   gometrics.Counter
+	messageIn  gometrics.Counter
+	messageOut gometrics.Counter
+}
+
+func newCounters(m *metrics.Metrics, endpoint string) counters {
+	if m == nil || m.Metrics == nil || m.Router == nil || m.Registry == nil {
+		return counters{
+			open:       gometrics.NilGauge{},
+			openCount:  new(int64),
+			rejected:   gometrics.NilCounter{},
+			bytesIn:    gometrics.NilCounter{},
+			bytesOut:   gometrics.NilCounter{},
+			messageIn:  gometrics.NilCounter{},
+			messageOut: gometrics.NilCounter{},
+		}
+	}
+	prefix := "websocket." + endpoint
+	// the router metrics only create counters and histograms, so the gauge is registered in the same child
+	// registry
+	registry := gometrics.NewPrefixedChildRegistry(*m.Registry, "router.")
+	return counters{
+		open:       gometrics.GetOrRegisterGauge(prefix+".connections", registry),
+		openCount:  openConnectionsOf(endpoint),
+		rejected:   m.Router.Counter(prefix, "rejected"),
+		bytesIn:    m.Router.Counter(prefix, "bytes", "in"),
+		bytesOut:   m.Router.Counter(prefix, "bytes", "out"),
+		messageIn:  m.Router.Counter(prefix, "messages", "in"),
+		messageOut: m.Router.Counter(prefix, "messages", "out"),
+	}
+}
+
+func (c counters) updateOpen(delta int64) {
+	c.open.Update(atomic.AddInt64(c.openCount, delta))
+}
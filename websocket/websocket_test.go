@@ -0,0 +1,195 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	krakendmetrics "github.com/devopsfaith/krakend-metrics"
+	metrics "github.com/devopsfaith/krakend-metrics/gin"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"github.com/luraproject/lura/proxy"
+	router "github.com/luraproject/lura/router/gin"
+	gometrics "github.com/rcrowley/go-metrics"
+)
+
+func TestHandlerFactory(t *testing.T) {
+	backend := httptest.NewServer(echoHandler(t))
+	defer backend.Close()
+
+	gateway := newGateway(context.Background(), t, nil, backend.URL, map[string]interface{}{
+		"max_connections":  1,
+		"max_message_size": 32,
+	})
+	defer gateway.Close()
+
+	url := "ws" + strings.TrimPrefix(gateway.URL, "http") + "/ws/lobby?token=abc&ignored=1"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "/rooms/lobby?token=abc hello" {
+		t.Errorf("unexpected message: %s", msg)
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Error("the connection over the limit should be rejected")
+	} else if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 64))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestHandlerFactory_cancel(t *testing.T) {
+	backendClosed := make(chan error, 1)
+	upgrader := websocket.Upgrader{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		_, _, err = conn.ReadMessage()
+		backendClosed <- err
+	}))
+	defer backend.Close()
+
+	registry := gometrics.NewRegistry()
+	m := &metrics.Metrics{Metrics: &krakendmetrics.Metrics{Registry: &registry, Router: krakendmetrics.NewRouterMetrics(&registry)}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gateway := newGateway(ctx, t, m, backend.URL, map[string]interface{}{})
+	defer gateway.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gateway.URL, "http")+"/ws/lobby", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	open := func() int64 {
+		g, _ := registry.Get("router.websocket./ws/:room.connections").(gometrics.Gauge)
+		if g == nil {
+			return -1
+		}
+		return g.Value()
+	}
+	waitFor(t, func() bool { return open() == 1 })
+
+	cancel()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("unexpected error of the client: %v", err)
+	}
+	select {
+	case err := <-backendClosed:
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Errorf("unexpected error of the backend: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the backend connection was not closed")
+	}
+	waitFor(t, func() bool { return open() == 0 })
+}
+
+func TestHandlerFactory_notUpgrade(t *testing.T) {
+	gateway := newGateway(context.Background(), t, nil, "http://127.0.0.1:1", map[string]interface{}{})
+	defer gateway.Close()
+
+	resp, err := http.Get(gateway.URL + "/ws/lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerFactory_fallback(t *testing.T) {
+	called := false
+	next := func(_ *config.EndpointConfig, _ proxy.Proxy) gin.HandlerFunc {
+		called = true
+		return func(_ *gin.Context) {}
+	}
+	HandlerFactory(context.Background(), next, logging.NoOp, nil)(&config.EndpointConfig{}, proxy.NoopProxy)
+	if !called {
+		t.Error("the next handler factory should be used for endpoints without config")
+	}
+}
+
+func newGateway(ctx context.Context, t *testing.T, m *metrics.Metrics, backendURL string, cfg map[string]interface{}) *httptest.Server {
+	gin.SetMode(gin.TestMode)
+	endpoint := &config.EndpointConfig{
+		Endpoint:    "/ws/:room",
+		Method:      http.MethodGet,
+		Timeout:     time.Second,
+		QueryString: []string{"token"},
+		Backend: []*config.Backend{
+			{
+				Host:       []string{backendURL},
+				URLPattern: "/rooms/{{.Room}}",
+			},
+		},
+		ExtraConfig: config.ExtraConfig{Namespace: cfg},
+	}
+	engine := gin.New()
+	engine.GET(endpoint.Endpoint, HandlerFactory(ctx, router.EndpointHandler, logging.NoOp, m)(endpoint, proxy.NoopProxy))
+	return httptest.NewServer(engine)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echoHandler replies every message with the request URI of the handshake and the received message
+func echoHandler(t *testing.T) http.Handler {
+	upgrader := websocket.Upgrader{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, []byte(r.URL.RequestURI()+" "+string(msg))); err != nil {
+				return
+			}
+		}
+	})
+}
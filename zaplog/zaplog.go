@@ -0,0 +1,234 @@
+// Package zaplog provides a structured logger backed by zap, so the messages of the gateway components and
+// the access log share the same encoder, sinks and fields.
+//
+// Sample service extra config
+//
+//	...
+//	"extra_config": {
+//		...
+//		"github_com/devopsfaith/krakend-ce/zap": {
+//			"level": "INFO",
+//			"encoder": "json",
+//			"output": "stdout",
+//			"time_format": "iso8601",
+//			"service_name": "my-gateway",
+//			"gelf": true
+//		},
+//		...
+//	},
+//	...
+//
+// The level is one of DEBUG, INFO (default), WARNING, ERROR or CRITICAL and the encoder one of json
+// (default) or console. The output is a zap sink: stdout (default), stderr or a file path. The time_format
+// is one of epoch (default), iso8601 or rfc3339. The service_name defaults to the name of the service.
+//
+// With the gelf flag, the entries are also sent to the GELF writer configured at the
+// github_com/devopsfaith/krakend-gelf namespace.
+//
+// Every entry has the level, the service name and the hash of the config in use, so the entries written
+// before and after a hot reload can be told apart. The loggers returned by WithField add a field to every
+// entry, as the request loggers do with the request ID.
+package zaplog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"github.com/luraproject/lura/config"
+	"github.com/luraproject/lura/logging"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Namespace is the key to use to store and access the custom config data
+const Namespace = "github_com/devopsfaith/krakend-ce/zap"
+
+const (
+	encoderJSON    = "json"
+	encoderConsole = "console"
+)
+
+var (
+	// ErrNoConfig is returned by NewLogger when the service has no config for the structured logger
+	ErrNoConfig  = errors.New("zap: no config")
+	errBadConfig = errors.New("zap: unable to parse the config")
+)
+
+// Config is the custom config struct containing the params for the structured logger
+type Config struct {
+	Level       string `json:"level"`
+	Encoder     string `json:"encoder"`
+	Output      string `json:"output"`
+	TimeFormat  string `json:"time_format"`
+	ServiceName string `json:"service_name"`
+	GELF        bool   `json:"gelf"`
+}
+
+func getConfig(e config.ExtraConfig) (Config, error) {
+	v, ok := e[Namespace]
+	if !ok {
+		return Config{}, ErrNoConfig
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return Config{}, errBadConfig
+	}
+	cfg := Config{}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return Config{}, errBadConfig
+	}
+	if cfg.Level == "" {
+		cfg.Level = "INFO"
+	}
+	if cfg.Encoder == "" {
+		cfg.Encoder = encoderJSON
+	}
+	if cfg.Encoder != encoderJSON && cfg.Encoder != encoderConsole {
+		return Config{}, fmt.Errorf("zap: unknown encoder %q", cfg.Encoder)
+	}
+	if cfg.Output == "" {
+		cfg.Output = "stdout"
+	}
+	return cfg, nil
+}
+
+// NewLogger returns a structured logger with the config of the service, writing also to the GELF writer, if
+// the config requires it and the writer is not nil. It returns ErrNoConfig if the service has no config
+// for the structured logger.
+func NewLogger(cfg config.ServiceConfig, gelf io.Writer) (*Logger, error) {
+	lCfg, err := getConfig(cfg.ExtraConfig)
+	if err != nil {
+		return nil, err
+	}
+	level, ok := parseLevel(lCfg.Level)
+	if !ok {
+		return nil, fmt.Errorf("zap: unknown level %q", lCfg.Level)
+	}
+
+	sink, _, err := zap.Open(lCfg.Output)
+	if err != nil {
+		return nil, fmt.Errorf("zap: %s", err.Error())
+	}
+	sinks := []zapcore.WriteSyncer{sink}
+	if lCfg.GELF && gelf != nil {
+		sinks = append(sinks, zapcore.AddSync(gelf))
+	}
+
+	core := zapcore.NewCore(newEncoder(lCfg), zapcore.NewMultiWriteSyncer(sinks...), level)
+	name := lCfg.ServiceName
+	if name == "" {
+		name = cfg.Name
+	}
+
+	l := &Logger{
+		zap:  zap.New(core, zap.ErrorOutput(sink)).With(zap.String("service", name)),
+		hash: new(atomic.Value),
+	}
+	hash, _ := cfg.Hash()
+	l.SetConfigHash(hash)
+
+	if lCfg.GELF && gelf == nil {
+		l.Warning("zap: the GELF writer is not available, the entries are only written to", lCfg.Output)
+	}
+	return l, nil
+}
+
+func newEncoder(cfg Config) zapcore.Encoder {
+	encCfg := zap.NewProductionEncoderConfig()
+	encCfg.EncodeLevel = encodeLevel
+	encCfg.EncodeDuration = zapcore.MillisDurationEncoder
+	switch cfg.TimeFormat {
+	case "iso8601":
+		encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	case "rfc3339":
+		encCfg.EncodeTime = zapcore.RFC3339TimeEncoder
+	default:
+		encCfg.EncodeTime = zapcore.EpochTimeEncoder
+	}
+	if cfg.Encoder == encoderConsole {
+		return zapcore.NewConsoleEncoder(encCfg)
+	}
+	return zapcore.NewJSONEncoder(encCfg)
+}
+
+// parseLevel maps the levels of the lura loggers to the zap ones. The CRITICAL level is the DPanic one,
+// since the logger is never built in development mode, so it does not panic.
+func parseLevel(level string) (zapcore.Level, bool) {
+	switch strings.ToUpper(level) {
+	case "DEBUG":
+		return zapcore.DebugLevel, true
+	case "INFO":
+		return zapcore.InfoLevel, true
+	case "WARNING", "WARN":
+		return zapcore.WarnLevel, true
+	case "ERROR":
+		return zapcore.ErrorLevel, true
+	case "CRITICAL":
+		return zapcore.DPanicLevel, true
+	}
+	return zapcore.InfoLevel, false
+}
+
+// encodeLevel encodes the levels with the names used by the lura loggers
+func encodeLevel(l zapcore.Level, enc zapcore.PrimitiveArrayEncoder) {
+	switch l {
+	case zapcore.WarnLevel:
+		enc.AppendString("WARNING")
+	case zapcore.DPanicLevel:
+		enc.AppendString("CRITICAL")
+	default:
+		enc.AppendString(l.CapitalString())
+	}
+}
+
+// Logger is a logging.Logger writing structured entries. The operands of every call are formatted as the
+// message of the entry.
+type Logger struct {
+	zap    *zap.Logger
+	hash   *atomic.Value
+	fields []zap.Field
+}
+
+// Zap returns the zap logger used by the logger, with the service field but without the config hash and
+// the fields added by WithField
+func (l *Logger) Zap() *zap.Logger {
+	return l.zap
+}
+
+// SetConfigHash replaces the hash of the config added to the entries, shared by all the loggers derived
+// from this one
+func (l *Logger) SetConfigHash(hash string) {
+	l.hash.Store(hash)
+}
+
+// WithField returns a logger adding the field to every entry
+func (l *Logger) WithField(key string, value interface{}) logging.Logger {
+	fields := make([]zap.Field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{zap: l.zap, hash: l.hash, fields: append(fields, zap.Any(key, value))}
+}
+
+func (l *Logger) Debug(v ...interface{})    { l.log(zapcore.DebugLevel, v) }
+func (l *Logger) Info(v ...interface{})     { l.log(zapcore.InfoLevel, v) }
+func (l *Logger) Warning(v ...interface{})  { l.log(zapcore.WarnLevel, v) }
+func (l *Logger) Error(v ...interface{})    { l.log(zapcore.ErrorLevel, v) }
+func (l *Logger) Critical(v ...interface{}) { l.log(zapcore.DPanicLevel, v) }
+
+// Fatal logs the message and exits, like the lura loggers
+func (l *Logger) Fatal(v ...interface{}) { l.log(zapcore.FatalLevel, v) }
+
+func (l *Logger) log(level zapcore.Level, v []interface{}) {
+	if !l.zap.Core().Enabled(level) {
+		return
+	}
+	ce := l.zap.Check(level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+	if ce == nil {
+		return
+	}
+	hash, _ := l.hash.Load().(string)
+	ce.Write(append([]zap.Field{zap.String("config_hash", hash)}, l.fields...)...)
+}
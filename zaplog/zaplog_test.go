@@ -0,0 +1,123 @@
+package zaplog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luraproject/lura/config"
+)
+
+func TestNewLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zaplog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "krakend.log")
+
+	gelf := new(bytes.Buffer)
+	cfg := config.ServiceConfig{
+		Name: "gateway",
+		ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+			"level":  "warning",
+			"output": output,
+			"gelf":   true,
+		}},
+	}
+	l, err := NewLogger(cfg, gelf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := cfg.Hash()
+
+	l.Info("filtered")
+	l.Warning("first", 1)
+	l.SetConfigHash("reloaded")
+	l.WithField("request_id", "abc-123").Critical("second")
+	l.Zap().Sync()
+
+	b, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := decode(t, b)
+	if len(entries) != 2 {
+		t.Fatalf("unexpected entries: %s", b)
+	}
+	for k, v := range map[string]interface{}{"level": "WARNING", "msg": "first 1", "service": "gateway", "config_hash": hash} {
+		if entries[0][k] != v {
+			t.Errorf("unexpected %s: %v", k, entries[0][k])
+		}
+	}
+	for k, v := range map[string]interface{}{"level": "CRITICAL", "msg": "second", "config_hash": "reloaded", "request_id": "abc-123"} {
+		if entries[1][k] != v {
+			t.Errorf("unexpected %s: %v", k, entries[1][k])
+		}
+	}
+	if gelf.String() != string(b) {
+		t.Errorf("unexpected GELF entries: %s", gelf.String())
+	}
+}
+
+func TestNewLogger_console(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zaplog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "krakend.log")
+
+	gelf := new(bytes.Buffer)
+	l, err := NewLogger(config.ServiceConfig{ExtraConfig: config.ExtraConfig{Namespace: map[string]interface{}{
+		"encoder":      "console",
+		"level":        "DEBUG",
+		"output":       output,
+		"service_name": "custom",
+	}}}, gelf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("debug message")
+	l.Zap().Sync()
+
+	b, _ := ioutil.ReadFile(output)
+	if line := string(b); !strings.Contains(line, "DEBUG\tdebug message\t") || !strings.Contains(line, `"service": "custom"`) {
+		t.Errorf("unexpected entry: %s", line)
+	}
+	if gelf.Len() != 0 {
+		t.Errorf("the GELF writer was not enabled: %s", gelf.String())
+	}
+}
+
+func TestNewLogger_badConfig(t *testing.T) {
+	if _, err := NewLogger(config.ServiceConfig{}, nil); err != ErrNoConfig {
+		t.Errorf("unexpected error without config: %v", err)
+	}
+	for _, v := range []interface{}{
+		map[string]interface{}{"level": "TRACE"},
+		map[string]interface{}{"encoder": "logfmt"},
+		map[string]interface{}{"output": "unknown://sink"},
+		"invalid",
+	} {
+		if _, err := NewLogger(config.ServiceConfig{ExtraConfig: config.ExtraConfig{Namespace: v}}, nil); err == nil {
+			t.Errorf("expecting an error with the config %v", v)
+		}
+	}
+}
+
+func decode(t *testing.T, b []byte) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("unexpected entry %q: %v", line, err)
+		}
+		res = append(res, entry)
+	}
+	return res
+}